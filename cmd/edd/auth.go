@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"golang.org/x/term"
+)
+
+type loginRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// loginResponse is either the signed-in session or, for accounts with
+// two-factor authentication, a challenge to answer with a code.
+type loginResponse struct {
+	sessionInfo
+	TwoFactorRequired bool   `json:"two_factor_required"`
+	Challenge         string `json:"challenge"`
+}
+
+type loginTOTPRequest struct {
+	Challenge    string `json:"challenge"`
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recovery_code,omitempty"`
+}
+
+type sessionInfo struct {
+	UserID      int64    `json:"user_id"`
+	Username    string   `json:"username"`
+	DisplayName string   `json:"display_name"`
+	Roles       []string `json:"roles"`
+}
+
+// login signs in with a password, or checks and saves an existing session
+// token given with -token, and stores the session in the config file.
+func (a *app) login(ctx context.Context, args []string) error {
+	fs := a.flags("login", "")
+	username := fs.String("username", "", "account to sign in as (prompted if empty)")
+	passwordStdin := fs.Bool("password-stdin", false, "read the password from stdin")
+	code := fs.String("code", "", "two-factor code, for accounts that use 2FA (prompted if needed)")
+	rest, err := a.parse(fs, args)
+	if err != nil {
+		return err
+	}
+	if err := wantArgs(fs, rest, 0, 0); err != nil {
+		return err
+	}
+
+	c, err := a.client()
+	if err != nil {
+		return err
+	}
+
+	var session sessionInfo
+	if a.token != "" {
+		// Token login: keep the given session if it is valid.
+		if err := c.call(ctx, http.MethodGet, c.storageURL("/api/session", nil), nil, &session); err != nil {
+			return err
+		}
+	} else {
+		in := bufio.NewReader(a.stdin)
+		if *username == "" {
+			if *username, err = a.prompt(in, "Username: "); err != nil {
+				return err
+			}
+		}
+		var password string
+		if *passwordStdin {
+			password, err = readLine(in)
+		} else {
+			password, err = a.promptSecret(in, "Password: ")
+		}
+		if err != nil {
+			return err
+		}
+
+		c.session = ""
+		var resp loginResponse
+		token, err := c.startSession(ctx, "/api/login", loginRequest{Username: *username, Password: password}, &resp)
+		if err != nil {
+			return err
+		}
+		if resp.TwoFactorRequired {
+			if *code == "" {
+				if *code, err = a.prompt(in, "Two-factor code: "); err != nil {
+					return err
+				}
+			}
+			payload := loginTOTPRequest{Challenge: resp.Challenge, Code: *code}
+			// Recovery codes are longer than the six-digit TOTP codes.
+			if len(*code) > 8 {
+				payload = loginTOTPRequest{Challenge: resp.Challenge, RecoveryCode: *code}
+			}
+			resp = loginResponse{}
+			if token, err = c.startSession(ctx, "/api/login/2fa", payload, &resp); err != nil {
+				return err
+			}
+		}
+		if token == "" {
+			return errors.New("login succeeded but the server did not return a session")
+		}
+		a.token = token
+		session = resp.sessionInfo
+	}
+
+	a.cfg.URL = a.baseURL()
+	if a.computeURL != "" {
+		a.cfg.ComputeURL = a.computeBaseURL()
+	}
+	a.cfg.Session = a.token
+	a.cfg.Username = session.Username
+	if err := a.saveConfig(); err != nil {
+		return err
+	}
+	if a.jsonOut {
+		return a.printJSON(session)
+	}
+	fmt.Fprintf(a.stdout, "Logged in to %s as %s\n", a.cfg.URL, session.Username)
+	return nil
+}
+
+// startSession posts a login payload, decodes the response into out and
+// returns the session cookie the response sets, if any.
+func (c *client) startSession(ctx context.Context, path string, in, out any) (string, error) {
+	data, err := json.Marshal(in)
+	if err != nil {
+		return "", err
+	}
+	header := http.Header{"Content-Type": {"application/json"}}
+	resp, err := c.do(ctx, http.MethodPost, c.storageURL(path, nil), bytes.NewReader(data), header)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return "", fmt.Errorf("decode login response: %w", err)
+	}
+	for _, cookie := range resp.Cookies() {
+		if cookie.Name == sessionCookieName && cookie.Value != "" {
+			return cookie.Value, nil
+		}
+	}
+	return "", nil
+}
+
+func (a *app) logout(ctx context.Context, args []string) error {
+	fs := a.flags("logout", "")
+	rest, err := a.parse(fs, args)
+	if err != nil {
+		return err
+	}
+	if err := wantArgs(fs, rest, 0, 0); err != nil {
+		return err
+	}
+	c, err := a.client()
+	if err != nil {
+		return err
+	}
+	if c.session != "" {
+		if err := c.call(ctx, http.MethodPost, c.storageURL("/api/logout", nil), nil, nil); err != nil && !isStatus(err, http.StatusUnauthorized) {
+			return err
+		}
+	}
+	if a.token == "" || a.token == a.cfg.Session {
+		a.cfg.Session = ""
+		a.cfg.Username = ""
+		if err := a.saveConfig(); err != nil {
+			return err
+		}
+	}
+	if !a.jsonOut {
+		fmt.Fprintln(a.stdout, "Logged out")
+		return nil
+	}
+	return a.printJSON(map[string]string{"status": "ok"})
+}
+
+func (a *app) whoami(ctx context.Context, args []string) error {
+	fs := a.flags("whoami", "")
+	rest, err := a.parse(fs, args)
+	if err != nil {
+		return err
+	}
+	if err := wantArgs(fs, rest, 0, 0); err != nil {
+		return err
+	}
+	c, err := a.authClient()
+	if err != nil {
+		return err
+	}
+	var session sessionInfo
+	if err := c.call(ctx, http.MethodGet, c.storageURL("/api/session", nil), nil, &session); err != nil {
+		return err
+	}
+	if a.jsonOut {
+		return a.printJSON(session)
+	}
+	fmt.Fprintf(a.stdout, "%s (id %d) at %s\n", session.Username, session.UserID, c.baseURL)
+	if len(session.Roles) > 0 {
+		fmt.Fprintf(a.stdout, "roles: %s\n", strings.Join(session.Roles, ", "))
+	}
+	return nil
+}
+
+func (a *app) prompt(in *bufio.Reader, label string) (string, error) {
+	fmt.Fprint(a.stderr, label)
+	return readLine(in)
+}
+
+// promptSecret reads without echo when stdin is a terminal.
+func (a *app) promptSecret(in *bufio.Reader, label string) (string, error) {
+	if f, ok := a.stdin.(*os.File); ok && term.IsTerminal(int(f.Fd())) {
+		fmt.Fprint(a.stderr, label)
+		secret, err := term.ReadPassword(int(f.Fd()))
+		fmt.Fprintln(a.stderr)
+		return string(secret), err
+	}
+	return a.prompt(in, label)
+}
+
+func readLine(in *bufio.Reader) (string, error) {
+	line, err := in.ReadString('\n')
+	if err != nil && (err != io.EOF || line == "") {
+		if err == io.EOF {
+			return "", errors.New("unexpected end of input")
+		}
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
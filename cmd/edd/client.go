@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	sessionCookieName = "sfs_session"
+	csrfCookieName    = "sfs_csrf"
+	csrfHeaderName    = "X-CSRF-Token"
+)
+
+// client talks to SFS and compute with a session token. Both services check
+// a double-submit CSRF token on mutating requests that carry the session
+// cookie; a non-browser client can pick any value and send it as both the
+// cookie and the header.
+type client struct {
+	http       *http.Client
+	baseURL    string
+	computeURL string
+	session    string
+	csrf       string
+}
+
+func (a *app) client() (*client, error) {
+	var buf [16]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		return nil, err
+	}
+	return &client{
+		// No overall timeout: transfers and followed logs run as long as
+		// they need to; requests are bounded by their context instead.
+		http:       &http.Client{},
+		baseURL:    a.baseURL(),
+		computeURL: a.computeBaseURL(),
+		session:    a.sessionToken(),
+		csrf:       hex.EncodeToString(buf[:]),
+	}, nil
+}
+
+// authClient is client for commands that need a signed-in user.
+func (a *app) authClient() (*client, error) {
+	c, err := a.client()
+	if err != nil {
+		return nil, err
+	}
+	if c.session == "" {
+		return nil, errors.New("not logged in: run edd login, or set -token or EDD_TOKEN")
+	}
+	return c, nil
+}
+
+// apiError is a non-2xx response.
+type apiError struct {
+	Status  int
+	Message string
+}
+
+func (e *apiError) Error() string {
+	if e.Status == http.StatusUnauthorized {
+		return "session expired or invalid: run edd login"
+	}
+	return fmt.Sprintf("%s (HTTP %d)", e.Message, e.Status)
+}
+
+func isStatus(err error, status int) bool {
+	var apiErr *apiError
+	return errors.As(err, &apiErr) && apiErr.Status == status
+}
+
+func (c *client) storageURL(path string, query url.Values) string {
+	return buildURL(c.baseURL, path, query)
+}
+
+func (c *client) computeAPIURL(path string, query url.Values) string {
+	return buildURL(c.computeURL, path, query)
+}
+
+func buildURL(base, path string, query url.Values) string {
+	u := base + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	return u
+}
+
+// do sends a request and returns the response if it succeeded. The caller
+// closes the body.
+func (c *client) do(ctx context.Context, method, rawURL string, body io.Reader, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, rawURL, body)
+	if err != nil {
+		return nil, err
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	req.Header.Set("User-Agent", "edd-cli")
+	if c.session != "" {
+		req.AddCookie(&http.Cookie{Name: sessionCookieName, Value: c.session})
+		switch method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+		default:
+			req.AddCookie(&http.Cookie{Name: csrfCookieName, Value: c.csrf})
+			req.Header.Set(csrfHeaderName, c.csrf)
+		}
+	}
+	if seeker, ok := body.(io.Seeker); ok && req.ContentLength == 0 && req.GetBody == nil {
+		// Files: let net/http send a Content-Length instead of chunking.
+		if size, err := seeker.Seek(0, io.SeekEnd); err == nil {
+			if _, err := seeker.Seek(0, io.SeekStart); err == nil {
+				req.ContentLength = size
+			}
+		}
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	return nil, readAPIError(resp)
+}
+
+// readAPIError builds an apiError from an error response. The unversioned
+// routes answer in plain text, the v1 routes with a JSON envelope, and the
+// public file routes with an HTML page.
+func readAPIError(resp *http.Response) error {
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	message := strings.TrimSpace(string(data))
+	contentType := resp.Header.Get("Content-Type")
+	switch {
+	case strings.HasPrefix(contentType, "application/json"):
+		var envelope struct {
+			Error struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		if json.Unmarshal(data, &envelope) == nil && envelope.Error.Message != "" {
+			message = envelope.Error.Message
+		}
+	case strings.HasPrefix(contentType, "text/html"):
+		message = ""
+	}
+	if message == "" {
+		message = strings.ToLower(http.StatusText(resp.StatusCode))
+	}
+	if resp.StatusCode == http.StatusTooManyRequests {
+		if retry := resp.Header.Get("Retry-After"); retry != "" {
+			message += ", retry after " + retry + "s"
+		}
+	}
+	return &apiError{Status: resp.StatusCode, Message: message}
+}
+
+// call sends in as JSON (unless nil) and decodes the response into out
+// (unless nil).
+func (c *client) call(ctx context.Context, method, rawURL string, in, out any) error {
+	var body io.Reader
+	header := http.Header{}
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+		header.Set("Content-Type", "application/json")
+	}
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+	resp, err := c.do(ctx, method, rawURL, body, header)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if out == nil {
+		_, err = io.Copy(io.Discard, resp.Body)
+		return err
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("decode response from %s: %w", rawURL, err)
+	}
+	return nil
+}
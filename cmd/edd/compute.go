@@ -0,0 +1,372 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type container struct {
+	ID            string   `json:"id"`
+	Name          string   `json:"name"`
+	Status        string   `json:"status"`
+	Hostname      string   `json:"hostname"`
+	SSHCommand    *string  `json:"ssh_command,omitempty"`
+	MemoryMB      int      `json:"memory_mb"`
+	MemoryUsedMB  *int64   `json:"memory_used_mb,omitempty"`
+	StorageGB     int      `json:"storage_gb"`
+	StorageUsedGB *float64 `json:"storage_used_gb,omitempty"`
+	CreatedAt     string   `json:"created_at"`
+	SSHEnabled    bool     `json:"ssh_enabled"`
+	HTTPSEnabled  bool     `json:"https_enabled"`
+}
+
+type containerRequest struct {
+	Name       string  `json:"name"`
+	MemoryMB   int     `json:"memory_mb,omitempty"`
+	StorageGB  int     `json:"storage_gb,omitempty"`
+	SSHKeyIDs  []int64 `json:"ssh_key_ids"`
+	SSHEnabled bool    `json:"ssh_enabled"`
+}
+
+// listFlag collects a repeatable string flag.
+type listFlag []string
+
+func (l *listFlag) String() string { return strings.Join(*l, ",") }
+
+func (l *listFlag) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+func (c *client) containers(ctx context.Context) ([]container, error) {
+	var resp struct {
+		Containers []container `json:"containers"`
+	}
+	err := c.call(ctx, http.MethodGet, c.computeAPIURL("/compute/containers", nil), nil, &resp)
+	return resp.Containers, err
+}
+
+// findContainer resolves a container by ID or by name.
+func (c *client) findContainer(ctx context.Context, ref string) (container, error) {
+	containers, err := c.containers(ctx)
+	if err != nil {
+		return container{}, err
+	}
+	var matches []container
+	for _, ct := range containers {
+		if ct.ID == ref {
+			return ct, nil
+		}
+		if ct.Name == ref {
+			matches = append(matches, ct)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return container{}, fmt.Errorf("no container %q", ref)
+	case 1:
+		return matches[0], nil
+	default:
+		return container{}, fmt.Errorf("%d containers are named %q, use the ID", len(matches), ref)
+	}
+}
+
+func containerPath(id string, suffix string) string {
+	return "/compute/containers/" + url.PathEscape(id) + suffix
+}
+
+func (a *app) printContainers(containers []container) error {
+	if a.jsonOut {
+		if containers == nil {
+			containers = []container{}
+		}
+		return a.printJSON(containers)
+	}
+	rows := make([][]string, 0, len(containers))
+	for _, ct := range containers {
+		memory := fmt.Sprintf("%d MB", ct.MemoryMB)
+		if ct.MemoryUsedMB != nil {
+			memory = fmt.Sprintf("%d/%d MB", *ct.MemoryUsedMB, ct.MemoryMB)
+		}
+		storage := fmt.Sprintf("%d GB", ct.StorageGB)
+		if ct.StorageUsedGB != nil {
+			storage = fmt.Sprintf("%.1f/%d GB", *ct.StorageUsedGB, ct.StorageGB)
+		}
+		rows = append(rows, []string{ct.ID, ct.Name, ct.Status, memory, storage, ct.Hostname})
+	}
+	return a.table([]string{"ID", "NAME", "STATUS", "MEMORY", "STORAGE", "HOSTNAME"}, rows)
+}
+
+func (a *app) computeList(ctx context.Context, args []string) error {
+	fs := a.flags("compute ls", "")
+	rest, err := a.parse(fs, args)
+	if err != nil {
+		return err
+	}
+	if err := wantArgs(fs, rest, 0, 0); err != nil {
+		return err
+	}
+	c, err := a.authClient()
+	if err != nil {
+		return err
+	}
+	containers, err := c.containers(ctx)
+	if err != nil {
+		return err
+	}
+	return a.printContainers(containers)
+}
+
+func (a *app) computeCreate(ctx context.Context, args []string) error {
+	fs := a.flags("compute create", "NAME")
+	memory := fs.Int("memory", 0, "memory in MB (0 for the server default)")
+	storage := fs.Int("storage", 0, "disk size in GB (0 for the server default)")
+	ssh := fs.Bool("ssh", true, "allow SSH access")
+	wait := fs.Duration("wait", 0, "wait up to this long for the container to be running")
+	var keys listFlag
+	fs.Var(&keys, "key", "SSH key ID or name to install (repeatable; default all of your keys)")
+	rest, err := a.parse(fs, args)
+	if err != nil {
+		return err
+	}
+	if err := wantArgs(fs, rest, 1, 1); err != nil {
+		return err
+	}
+	c, err := a.authClient()
+	if err != nil {
+		return err
+	}
+
+	available, err := c.sshKeys(ctx)
+	if err != nil {
+		return err
+	}
+	var keyIDs []int64
+	if len(keys) == 0 {
+		for _, key := range available {
+			keyIDs = append(keyIDs, key.ID)
+		}
+		if len(keyIDs) == 0 {
+			return errors.New("you have no SSH keys; add one with edd sshkey add")
+		}
+	}
+	for _, ref := range keys {
+		key, err := findSSHKey(available, ref)
+		if err != nil {
+			return err
+		}
+		keyIDs = append(keyIDs, key.ID)
+	}
+
+	payload := containerRequest{Name: rest[0], MemoryMB: *memory, StorageGB: *storage, SSHKeyIDs: keyIDs, SSHEnabled: *ssh}
+	var created container
+	if err := c.call(ctx, http.MethodPost, c.computeAPIURL("/compute/containers", nil), payload, &created); err != nil {
+		return err
+	}
+	if *wait > 0 {
+		if created, err = c.waitRunning(ctx, created.ID, *wait); err != nil {
+			return err
+		}
+	}
+	if a.jsonOut {
+		return a.printJSON(created)
+	}
+	fmt.Fprintf(a.stdout, "Created container %s (%s), status %s\n", created.ID, created.Name, created.Status)
+	return nil
+}
+
+// containerPollInterval is how often -wait checks on a container.
+var containerPollInterval = 2 * time.Second
+
+// waitRunning polls a container until it is running, fails, or timeout
+// passes.
+func (c *client) waitRunning(ctx context.Context, id string, timeout time.Duration) (container, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	for {
+		var ct container
+		if err := c.call(ctx, http.MethodGet, c.computeAPIURL(containerPath(id, ""), nil), nil, &ct); err != nil {
+			return ct, err
+		}
+		switch ct.Status {
+		case "running":
+			return ct, nil
+		case "failed", "error":
+			return ct, fmt.Errorf("container %s failed to start", id)
+		}
+		select {
+		case <-ctx.Done():
+			return ct, fmt.Errorf("container %s is still %s after %s", id, ct.Status, timeout)
+		case <-time.After(containerPollInterval):
+		}
+	}
+}
+
+// containerAction runs start, stop or rm on each container named in args.
+func (a *app) containerAction(ctx context.Context, name string, args []string, run func(*client, container) (container, error)) error {
+	fs := a.flags("compute "+name, "CONTAINER...")
+	yes := new(bool)
+	if name == "rm" {
+		yes = fs.Bool("y", false, "don't ask for confirmation")
+	}
+	rest, err := a.parse(fs, args)
+	if err != nil {
+		return err
+	}
+	if err := wantArgs(fs, rest, 1, -1); err != nil {
+		return err
+	}
+	c, err := a.authClient()
+	if err != nil {
+		return err
+	}
+
+	var targets []container
+	for _, ref := range rest {
+		ct, err := c.findContainer(ctx, ref)
+		if err != nil {
+			return err
+		}
+		targets = append(targets, ct)
+	}
+	if name == "rm" && !*yes {
+		fmt.Fprintf(a.stderr, "Delete %d container(s) and their disks? [y/N] ", len(targets))
+		answer, err := readLine(bufio.NewReader(a.stdin))
+		if err != nil || !strings.EqualFold(strings.TrimSpace(answer), "y") {
+			return errors.New("aborted")
+		}
+	}
+
+	var results []container
+	for _, ct := range targets {
+		updated, err := run(c, ct)
+		if err != nil {
+			return fmt.Errorf("%s %s: %w", name, ct.ID, err)
+		}
+		results = append(results, updated)
+		if !a.jsonOut {
+			fmt.Fprintf(a.stdout, "%s %s (%s): %s\n", name, updated.ID, updated.Name, updated.Status)
+		}
+	}
+	if a.jsonOut {
+		return a.printJSON(results)
+	}
+	return nil
+}
+
+func (a *app) computeStart(ctx context.Context, args []string) error {
+	return a.containerAction(ctx, "start", args, func(c *client, ct container) (container, error) {
+		var updated container
+		err := c.call(ctx, http.MethodPost, c.computeAPIURL(containerPath(ct.ID, "/start"), nil), nil, &updated)
+		return updated, err
+	})
+}
+
+func (a *app) computeStop(ctx context.Context, args []string) error {
+	return a.containerAction(ctx, "stop", args, func(c *client, ct container) (container, error) {
+		var updated container
+		err := c.call(ctx, http.MethodPost, c.computeAPIURL(containerPath(ct.ID, "/stop"), nil), nil, &updated)
+		return updated, err
+	})
+}
+
+func (a *app) computeRemove(ctx context.Context, args []string) error {
+	return a.containerAction(ctx, "rm", args, func(c *client, ct container) (container, error) {
+		err := c.call(ctx, http.MethodDelete, c.computeAPIURL(containerPath(ct.ID, ""), nil), nil, nil)
+		ct.Status = "deleted"
+		return ct, err
+	})
+}
+
+// computeSSH opens an SSH session through the gateway, using the command
+// compute advertises for the container. Arguments after -- go to ssh.
+func (a *app) computeSSH(ctx context.Context, args []string) error {
+	fs := a.flags("compute ssh", "CONTAINER [-- SSH ARGS...]")
+	enable := fs.Bool("enable", false, "turn on SSH access first if it is off")
+	rest, err := a.parse(fs, args)
+	if err != nil {
+		return err
+	}
+	if err := wantArgs(fs, rest, 1, -1); err != nil {
+		return err
+	}
+	c, err := a.authClient()
+	if err != nil {
+		return err
+	}
+	ct, err := c.findContainer(ctx, rest[0])
+	if err != nil {
+		return err
+	}
+	if !ct.SSHEnabled {
+		if !*enable {
+			return fmt.Errorf("SSH access is off for %s; run edd compute ssh -enable %s to turn it on", ct.ID, rest[0])
+		}
+		payload := map[string]bool{"ssh_enabled": true}
+		if err := c.call(ctx, http.MethodPut, c.computeAPIURL(containerPath(ct.ID, "/ssh"), nil), payload, nil); err != nil {
+			return err
+		}
+		ct.SSHEnabled = true
+	}
+
+	command := []string{"ssh", "root@" + ct.Hostname}
+	if ct.SSHCommand != nil && *ct.SSHCommand != "" {
+		command = strings.Fields(*ct.SSHCommand)
+	}
+	command = append(command, rest[1:]...)
+	return a.exec(ctx, command)
+}
+
+// exec runs a command attached to the terminal. Tests replace it.
+func (a *app) exec(ctx context.Context, command []string) error {
+	if a.execFunc != nil {
+		return a.execFunc(ctx, command)
+	}
+	cmd := exec.CommandContext(ctx, command[0], command[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	return cmd.Run()
+}
+
+func (a *app) computeLogs(ctx context.Context, args []string) error {
+	fs := a.flags("compute logs", "CONTAINER")
+	follow := fs.Bool("f", false, "keep printing new output")
+	tail := fs.Int("tail", 100, "number of lines from the end to show (-1 for all)")
+	rest, err := a.parse(fs, args)
+	if err != nil {
+		return err
+	}
+	if err := wantArgs(fs, rest, 1, 1); err != nil {
+		return err
+	}
+	c, err := a.authClient()
+	if err != nil {
+		return err
+	}
+	ct, err := c.findContainer(ctx, rest[0])
+	if err != nil {
+		return err
+	}
+	query := url.Values{"tail": {strconv.Itoa(*tail)}}
+	if *follow {
+		query.Set("follow", "true")
+	}
+	resp, err := c.do(ctx, http.MethodGet, c.computeAPIURL(containerPath(ct.ID, "/logs"), query), nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if _, err := io.Copy(a.stdout, resp.Body); err != nil && ctx.Err() == nil {
+		return err
+	}
+	return nil
+}
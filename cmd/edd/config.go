@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// config is what edd login saves between runs.
+type config struct {
+	URL        string `json:"url,omitempty"`
+	ComputeURL string `json:"compute_url,omitempty"`
+	Session    string `json:"session,omitempty"`
+	Username   string `json:"username,omitempty"`
+}
+
+func (a *app) loadConfig() error {
+	if a.configPath == "" {
+		dir, err := os.UserConfigDir()
+		if err != nil {
+			return fmt.Errorf("locate config directory: %w (set -config or EDD_CONFIG)", err)
+		}
+		a.configPath = filepath.Join(dir, "edd", "config.json")
+	}
+	data, err := os.ReadFile(a.configPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("read config: %w", err)
+	}
+	if err := json.Unmarshal(data, &a.cfg); err != nil {
+		return fmt.Errorf("parse config %s: %w", a.configPath, err)
+	}
+	return nil
+}
+
+// saveConfig writes the config readable by the user only, since it holds the
+// session token.
+func (a *app) saveConfig() error {
+	if err := os.MkdirAll(filepath.Dir(a.configPath), 0o700); err != nil {
+		return fmt.Errorf("create config directory: %w", err)
+	}
+	data, err := json.MarshalIndent(a.cfg, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := a.configPath + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0o600); err != nil {
+		return fmt.Errorf("write config: %w", err)
+	}
+	if err := os.Rename(tmp, a.configPath); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("write config: %w", err)
+	}
+	return nil
+}
+
+// baseURL resolves the API URL from the flag, the environment, the saved
+// config and finally the default, in that order.
+func (a *app) baseURL() string {
+	for _, candidate := range []string{a.url, a.cfg.URL, defaultURL} {
+		if candidate != "" {
+			return strings.TrimRight(candidate, "/")
+		}
+	}
+	return defaultURL
+}
+
+func (a *app) computeBaseURL() string {
+	for _, candidate := range []string{a.computeURL, a.cfg.ComputeURL} {
+		if candidate != "" {
+			return strings.TrimRight(candidate, "/")
+		}
+	}
+	return a.baseURL()
+}
+
+// sessionToken is the token requests authenticate with; -token and EDD_TOKEN
+// take precedence over a saved login. A saved session is only sent to the
+// server it came from.
+func (a *app) sessionToken() string {
+	if a.token != "" {
+		return a.token
+	}
+	if a.url != "" && strings.TrimRight(a.url, "/") != strings.TrimRight(a.cfg.URL, "/") {
+		return ""
+	}
+	return a.cfg.Session
+}
@@ -0,0 +1,231 @@
+// Command edd is the command-line client for edd-cloud storage and compute.
+//
+//	edd login -username alice
+//	edd storage cp -r ./site docs:
+//	edd storage sync docs:reports ./reports
+//	edd compute create -memory 1024 devbox
+//	edd -json compute ls
+//
+// Paths of the form namespace:path refer to stored files; anything else is a
+// local path. Credentials come from -token or EDD_TOKEN (a session token),
+// otherwise from the session saved by edd login.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+)
+
+const defaultURL = "https://cloud-api.eddisonso.com"
+
+const usage = `usage: edd [global flags] <command> [arguments]
+
+Commands:
+  login       sign in and save the session
+  logout      end the saved session
+  whoami      show the signed-in user
+  storage     ls, cp, mv, rm, sync, share
+  namespace   create, ls, rm
+  compute     create, ls, start, stop, rm, ssh, logs
+  sshkey      add, ls, rm
+
+Global flags:
+  -url URL          API base URL (EDD_URL, default ` + defaultURL + `)
+  -compute-url URL  compute API base URL if it differs (EDD_COMPUTE_URL)
+  -token TOKEN      session token to use instead of the saved one (EDD_TOKEN)
+  -config FILE      config file (EDD_CONFIG, default <user config dir>/edd/config.json)
+  -json             print JSON instead of tables
+
+Run "edd <command> -h" for the flags of a command.
+`
+
+var (
+	// errUsage reports bad arguments whose explanation was already printed.
+	errUsage = errors.New("usage")
+	// errHelp ends a run after -h printed the usage.
+	errHelp = errors.New("help")
+)
+
+type app struct {
+	stdin  io.Reader
+	stdout io.Writer
+	stderr io.Writer
+	getenv func(string) string
+	// execFunc runs external commands (ssh); nil runs them for real.
+	execFunc func(ctx context.Context, command []string) error
+
+	configPath string
+	cfg        config
+	jsonOut    bool
+
+	url        string
+	computeURL string
+	token      string
+}
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	a := &app{stdin: os.Stdin, stdout: os.Stdout, stderr: os.Stderr, getenv: os.Getenv}
+	if err := a.run(ctx, os.Args[1:]); err != nil {
+		if errors.Is(err, errHelp) {
+			return
+		}
+		if errors.Is(err, errUsage) {
+			os.Exit(2)
+		}
+		fmt.Fprintf(os.Stderr, "edd: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func (a *app) run(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("edd", flag.ContinueOnError)
+	fs.SetOutput(a.stderr)
+	fs.Usage = func() { fmt.Fprint(a.stderr, usage) }
+	fs.StringVar(&a.url, "url", a.getenv("EDD_URL"), "")
+	fs.StringVar(&a.computeURL, "compute-url", a.getenv("EDD_COMPUTE_URL"), "")
+	fs.StringVar(&a.token, "token", a.getenv("EDD_TOKEN"), "")
+	fs.StringVar(&a.configPath, "config", a.getenv("EDD_CONFIG"), "")
+	fs.BoolVar(&a.jsonOut, "json", false, "")
+	if err := fs.Parse(args); err != nil {
+		return a.flagError(err)
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return errUsage
+	}
+
+	if err := a.loadConfig(); err != nil {
+		return err
+	}
+
+	cmd, rest := fs.Arg(0), fs.Args()[1:]
+	switch cmd {
+	case "login":
+		return a.login(ctx, rest)
+	case "logout":
+		return a.logout(ctx, rest)
+	case "whoami":
+		return a.whoami(ctx, rest)
+	case "storage":
+		return a.dispatch(ctx, "storage", rest, map[string]command{
+			"ls":    a.storageList,
+			"cp":    a.storageCopy,
+			"mv":    a.storageMove,
+			"rm":    a.storageRemove,
+			"sync":  a.storageSync,
+			"share": a.storageShare,
+		})
+	case "namespace", "ns":
+		return a.dispatch(ctx, "namespace", rest, map[string]command{
+			"create": a.namespaceCreate,
+			"ls":     a.namespaceList,
+			"rm":     a.namespaceRemove,
+		})
+	case "compute":
+		return a.dispatch(ctx, "compute", rest, map[string]command{
+			"create": a.computeCreate,
+			"ls":     a.computeList,
+			"start":  a.computeStart,
+			"stop":   a.computeStop,
+			"rm":     a.computeRemove,
+			"ssh":    a.computeSSH,
+			"logs":   a.computeLogs,
+		})
+	case "sshkey":
+		return a.dispatch(ctx, "sshkey", rest, map[string]command{
+			"add": a.sshKeyAdd,
+			"ls":  a.sshKeyList,
+			"rm":  a.sshKeyRemove,
+		})
+	case "help":
+		fmt.Fprint(a.stdout, usage)
+		return nil
+	default:
+		fmt.Fprintf(a.stderr, "edd: unknown command %q\n\n", cmd)
+		fs.Usage()
+		return errUsage
+	}
+}
+
+type command func(ctx context.Context, args []string) error
+
+func (a *app) dispatch(ctx context.Context, group string, args []string, commands map[string]command) error {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if len(args) == 0 || args[0] == "-h" || args[0] == "-help" || args[0] == "help" {
+		fmt.Fprintf(a.stderr, "usage: edd %s <%s> [arguments]\n", group, strings.Join(names, "|"))
+		return errUsage
+	}
+	run, ok := commands[args[0]]
+	if !ok {
+		fmt.Fprintf(a.stderr, "edd: unknown %s command %q (want one of %s)\n", group, args[0], strings.Join(names, ", "))
+		return errUsage
+	}
+	return run(ctx, args[1:])
+}
+
+// flags returns the flag set for a subcommand. Every subcommand accepts
+// -json as well, so it may come after the command name.
+func (a *app) flags(name, args string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(a.stderr)
+	fs.BoolVar(&a.jsonOut, "json", a.jsonOut, "print JSON")
+	fs.Usage = func() {
+		fmt.Fprintf(a.stderr, "usage: edd %s [flags] %s\n", name, args)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// parse parses flags that may be mixed with positional arguments, so
+// "edd storage rm docs:a -json" works. Arguments after "--" are passed
+// through untouched.
+func (a *app) parse(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, a.flagError(err)
+		}
+		rest := fs.Args()
+		if n := len(args) - len(rest); n > 0 && args[n-1] == "--" {
+			return append(positional, rest...), nil
+		}
+		if len(rest) == 0 {
+			return positional, nil
+		}
+		positional = append(positional, rest[0])
+		args = rest[1:]
+	}
+}
+
+// flagError maps flag parsing errors, which the flag package has already
+// printed, to errHelp or errUsage.
+func (a *app) flagError(err error) error {
+	if errors.Is(err, flag.ErrHelp) {
+		return errHelp
+	}
+	return errUsage
+}
+
+// wantArgs checks the number of positional arguments, printing usage if it
+// is off. max < 0 means no upper bound.
+func wantArgs(fs *flag.FlagSet, args []string, min, max int) error {
+	if len(args) < min || (max >= 0 && len(args) > max) {
+		fs.Usage()
+		return errUsage
+	}
+	return nil
+}
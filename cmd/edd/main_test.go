@@ -0,0 +1,430 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testSession = "session-token"
+
+// fakeSFS is an in-memory stand-in for the SFS endpoints the CLI uses. It
+// checks the session cookie, and the CSRF double-submit on mutating
+// requests, the way SFS does.
+type fakeSFS struct {
+	t *testing.T
+
+	mu         sync.Mutex
+	namespaces map[string]*namespaceInfo
+	files      map[string]map[string]*fakeFile
+	drops      int
+	uploads    int
+	inFlight   int
+	maxFlight  int
+	// uploadDelay holds uploads open to observe parallelism.
+	uploadDelay time.Duration
+	totpCode    string
+}
+
+type fakeFile struct {
+	data     []byte
+	modified int64
+}
+
+func newFakeSFS(t *testing.T) (*fakeSFS, *httptest.Server) {
+	f := &fakeSFS{
+		t:          t,
+		namespaces: map[string]*namespaceInfo{"default": {Name: "default"}},
+		files:      map[string]map[string]*fakeFile{"default": {}},
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /api/login", f.login)
+	mux.HandleFunc("POST /api/login/2fa", f.loginTOTP)
+	mux.HandleFunc("GET /api/session", f.auth(f.session))
+	mux.HandleFunc("POST /api/logout", f.auth(func(w http.ResponseWriter, r *http.Request) {}))
+	mux.HandleFunc("GET /storage/namespaces", f.namespaceList)
+	mux.HandleFunc("POST /storage/namespaces", f.auth(f.namespaceCreate))
+	mux.HandleFunc("DELETE /storage/namespaces/{name}", f.auth(f.namespaceDelete))
+	mux.HandleFunc("POST /storage/namespaces/{name}/drops", f.auth(f.dropCreate))
+	mux.HandleFunc("GET /storage/files", f.list)
+	mux.HandleFunc("PUT /storage/{namespace}/{file...}", f.auth(f.put))
+	mux.HandleFunc("GET /storage/download/{namespace}/{file...}", f.get)
+	mux.HandleFunc("POST /storage/batch", f.auth(f.batch))
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return f, srv
+}
+
+// checkAuth answers 401 or 403 like SFS and reports whether to go on.
+func checkAuth(w http.ResponseWriter, r *http.Request) bool {
+	cookie, err := r.Cookie(sessionCookieName)
+	if err != nil || cookie.Value != testSession {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	if r.Method != http.MethodGet {
+		csrf, err := r.Cookie(csrfCookieName)
+		if err != nil || csrf.Value == "" || csrf.Value != r.Header.Get(csrfHeaderName) {
+			http.Error(w, "invalid csrf token", http.StatusForbidden)
+			return false
+		}
+	}
+	return true
+}
+
+func (f *fakeSFS) auth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if checkAuth(w, r) {
+			next(w, r)
+		}
+	}
+}
+
+func writeTestJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func (f *fakeSFS) login(w http.ResponseWriter, r *http.Request) {
+	var payload loginRequest
+	_ = json.NewDecoder(r.Body).Decode(&payload)
+	if payload.Username != "alice" || payload.Password != "hunter2" {
+		http.Error(w, "invalid credentials", http.StatusUnauthorized)
+		return
+	}
+	if f.totpCode != "" {
+		writeTestJSON(w, map[string]any{"two_factor_required": true, "challenge": "challenge-1"})
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: sessionCookieName, Value: testSession, HttpOnly: true})
+	writeTestJSON(w, sessionInfo{UserID: 7, Username: "alice"})
+}
+
+func (f *fakeSFS) loginTOTP(w http.ResponseWriter, r *http.Request) {
+	var payload loginTOTPRequest
+	_ = json.NewDecoder(r.Body).Decode(&payload)
+	if payload.Challenge != "challenge-1" || payload.Code != f.totpCode {
+		http.Error(w, "invalid code", http.StatusUnauthorized)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: sessionCookieName, Value: testSession, HttpOnly: true})
+	writeTestJSON(w, sessionInfo{UserID: 7, Username: "alice"})
+}
+
+func (f *fakeSFS) session(w http.ResponseWriter, r *http.Request) {
+	writeTestJSON(w, sessionInfo{UserID: 7, Username: "alice", Roles: []string{"storage-admin"}})
+}
+
+func (f *fakeSFS) namespaceList(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	out := make([]namespaceInfo, 0, len(f.namespaces))
+	for name, ns := range f.namespaces {
+		info := *ns
+		info.Count = len(f.files[name])
+		out = append(out, info)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	writeTestJSON(w, out)
+}
+
+func (f *fakeSFS) namespaceCreate(w http.ResponseWriter, r *http.Request) {
+	var payload namespaceCreateRequest
+	_ = json.NewDecoder(r.Body).Decode(&payload)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.namespaces[payload.Name]; ok {
+		http.Error(w, "namespace already exists", http.StatusConflict)
+		return
+	}
+	ns := &namespaceInfo{Name: payload.Name, Hidden: payload.Hidden, Compression: payload.Compression}
+	f.namespaces[payload.Name] = ns
+	f.files[payload.Name] = map[string]*fakeFile{}
+	writeTestJSON(w, ns)
+}
+
+func (f *fakeSFS) namespaceDelete(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	name := r.PathValue("name")
+	if _, ok := f.namespaces[name]; !ok {
+		http.Error(w, "namespace not found", http.StatusNotFound)
+		return
+	}
+	delete(f.namespaces, name)
+	delete(f.files, name)
+	writeTestJSON(w, map[string]string{"status": "ok"})
+}
+
+func (f *fakeSFS) dropCreate(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.drops++
+	writeTestJSON(w, dropLink{ID: f.drops, Token: fmt.Sprintf("drop-%d", f.drops), Namespace: r.PathValue("name"), ExpiresAt: 2000000000})
+}
+
+func (f *fakeSFS) list(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	ns := r.URL.Query().Get("namespace")
+	out := make([]fileInfo, 0)
+	for name, file := range f.files[ns] {
+		out = append(out, fileInfo{Name: name, Path: name, Namespace: ns, Size: int64(len(file.data)), ModifiedAt: file.modified})
+	}
+	writeTestJSON(w, out)
+}
+
+func (f *fakeSFS) put(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	f.inFlight++
+	f.maxFlight = max(f.maxFlight, f.inFlight)
+	f.mu.Unlock()
+	defer func() {
+		f.mu.Lock()
+		f.inFlight--
+		f.mu.Unlock()
+	}()
+	time.Sleep(f.uploadDelay)
+
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "read failed", http.StatusBadRequest)
+		return
+	}
+	if r.ContentLength != int64(len(data)) {
+		f.t.Errorf("upload of %s sent Content-Length %d for %d bytes", r.URL.Path, r.ContentLength, len(data))
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	files, ok := f.files[r.PathValue("namespace")]
+	if !ok {
+		http.Error(w, "namespace does not exist", http.StatusNotFound)
+		return
+	}
+	name := r.PathValue("file")
+	if _, exists := files[name]; exists {
+		if r.Header.Get("If-None-Match") == "*" {
+			http.Error(w, "file already exists", http.StatusPreconditionFailed)
+			return
+		}
+		if r.URL.Query().Get("overwrite") != "true" {
+			http.Error(w, "file already exists", http.StatusConflict)
+			return
+		}
+	}
+	files[name] = &fakeFile{data: data, modified: time.Now().Unix()}
+	f.uploads++
+	writeTestJSON(w, fileInfo{Name: name, Size: int64(len(data))})
+}
+
+func (f *fakeSFS) get(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	file, ok := f.files[r.PathValue("namespace")][r.PathValue("file")]
+	f.mu.Unlock()
+	if !ok {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(http.StatusNotFound)
+		io.WriteString(w, "<html>not found</html>")
+		return
+	}
+	w.Write(file.data)
+}
+
+func (f *fakeSFS) batch(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		Operations []batchOperation `json:"operations"`
+	}
+	_ = json.NewDecoder(r.Body).Decode(&payload)
+	if len(payload.Operations) > maxBatch {
+		http.Error(w, "batch too large for a synchronous run", http.StatusBadRequest)
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	job := batchJob{Status: "done"}
+	for i, op := range payload.Operations {
+		result := batchResult{Index: i, Op: op.Op, Status: http.StatusOK}
+		file, ok := f.files[op.Namespace][op.Name]
+		switch {
+		case !ok:
+			result.Status, result.Error = http.StatusNotFound, "file not found"
+		case op.Op == "delete":
+			delete(f.files[op.Namespace], op.Name)
+		case op.Op == "copy" || op.Op == "move":
+			dst, ok := f.files[op.ToNamespace]
+			if !ok {
+				result.Status, result.Error = http.StatusNotFound, "destination namespace does not exist"
+				break
+			}
+			dst[op.ToName] = &fakeFile{data: file.data, modified: time.Now().Unix()}
+			if op.Op == "move" {
+				delete(f.files[op.Namespace], op.Name)
+			}
+		}
+		job.Results = append(job.Results, result)
+	}
+	writeTestJSON(w, job)
+}
+
+func (f *fakeSFS) put1(ns, name, data string, modified int64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.files[ns] == nil {
+		f.namespaces[ns] = &namespaceInfo{Name: ns}
+		f.files[ns] = map[string]*fakeFile{}
+	}
+	f.files[ns][name] = &fakeFile{data: []byte(data), modified: modified}
+}
+
+func (f *fakeSFS) contents(ns string) map[string]string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	out := make(map[string]string)
+	for name, file := range f.files[ns] {
+		out[name] = string(file.data)
+	}
+	return out
+}
+
+type testRun struct {
+	app    *app
+	stdout *bytes.Buffer
+	stderr *bytes.Buffer
+}
+
+// newTestApp returns an app pointed at the stand-ins and signed in with the
+// test session unless token is empty.
+func newTestApp(t *testing.T, sfsURL, computeURL, token string) *testRun {
+	t.Helper()
+	run := &testRun{stdout: &bytes.Buffer{}, stderr: &bytes.Buffer{}}
+	env := map[string]string{
+		"EDD_URL":         sfsURL,
+		"EDD_COMPUTE_URL": computeURL,
+		"EDD_TOKEN":       token,
+		"EDD_CONFIG":      filepath.Join(t.TempDir(), "config.json"),
+	}
+	run.app = &app{
+		stdin:  strings.NewReader(""),
+		stdout: run.stdout,
+		stderr: run.stderr,
+		getenv: func(key string) string { return env[key] },
+	}
+	return run
+}
+
+func (r *testRun) run(t *testing.T, args ...string) error {
+	t.Helper()
+	r.stdout.Reset()
+	r.stderr.Reset()
+	// Each invocation starts from a fresh set of flag values, like a new
+	// process would.
+	r.app.jsonOut, r.app.url, r.app.computeURL, r.app.token = false, "", "", ""
+	r.app.cfg = config{}
+	return r.app.run(context.Background(), args)
+}
+
+func (r *testRun) mustRun(t *testing.T, args ...string) string {
+	t.Helper()
+	if err := r.run(t, args...); err != nil {
+		t.Fatalf("edd %s: %v\nstderr: %s", strings.Join(args, " "), err, r.stderr)
+	}
+	return r.stdout.String()
+}
+
+func TestLoginSavesSession(t *testing.T) {
+	sfs, srv := newFakeSFS(t)
+	sfs.totpCode = "123456"
+	run := newTestApp(t, srv.URL, "", "")
+	run.app.stdin = strings.NewReader("hunter2\n123456\n")
+
+	out := run.mustRun(t, "login", "-username", "alice", "-password-stdin")
+	if !strings.Contains(out, "as alice") {
+		t.Fatalf("login output = %q", out)
+	}
+	if run.app.cfg.Session != testSession {
+		t.Fatalf("saved session = %q, want %q", run.app.cfg.Session, testSession)
+	}
+
+	// The next run picks the session up from the config file.
+	out = run.mustRun(t, "whoami")
+	if !strings.Contains(out, "alice (id 7)") {
+		t.Fatalf("whoami output = %q", out)
+	}
+
+	run.mustRun(t, "logout")
+	if err := run.run(t, "whoami"); err == nil || !strings.Contains(err.Error(), "not logged in") {
+		t.Fatalf("whoami after logout: err = %v", err)
+	}
+}
+
+func TestLoginRejectsBadPassword(t *testing.T) {
+	_, srv := newFakeSFS(t)
+	run := newTestApp(t, srv.URL, "", "")
+	run.app.stdin = strings.NewReader("wrong\n")
+	err := run.run(t, "login", "-username", "alice", "-password-stdin")
+	if !isStatus(err, http.StatusUnauthorized) {
+		t.Fatalf("err = %v, want 401", err)
+	}
+}
+
+func TestTokenFromEnvironment(t *testing.T) {
+	_, srv := newFakeSFS(t)
+	run := newTestApp(t, srv.URL, "", testSession)
+	out := run.mustRun(t, "-json", "whoami")
+	var session sessionInfo
+	if err := json.Unmarshal([]byte(out), &session); err != nil {
+		t.Fatalf("whoami -json output %q: %v", out, err)
+	}
+	if session.Username != "alice" || session.UserID != 7 {
+		t.Fatalf("session = %+v", session)
+	}
+}
+
+func TestUnknownCommandIsUsageError(t *testing.T) {
+	run := newTestApp(t, "http://127.0.0.1:1", "", testSession)
+	if err := run.run(t, "storage", "frobnicate"); err != errUsage {
+		t.Fatalf("err = %v, want errUsage", err)
+	}
+	if err := run.run(t, "storage", "cp", "-h"); err != errHelp {
+		t.Fatalf("err = %v, want errHelp", err)
+	}
+}
+
+func TestParseRemote(t *testing.T) {
+	cases := []struct {
+		arg    string
+		remote bool
+		want   remotePath
+	}{
+		{"docs:reports/q1.pdf", true, remotePath{"docs", "reports/q1.pdf"}},
+		{"docs:", true, remotePath{"docs", ""}},
+		{"docs:/a", true, remotePath{"docs", "a"}},
+		{"./a:b", false, remotePath{}},
+		{"report.pdf", false, remotePath{}},
+		{":x", false, remotePath{}},
+	}
+	for _, tc := range cases {
+		got, ok := parseRemote(tc.arg)
+		if ok != tc.remote || got != tc.want {
+			t.Errorf("parseRemote(%q) = %+v, %v; want %+v, %v", tc.arg, got, ok, tc.want, tc.remote)
+		}
+	}
+}
+
+func TestFormatSize(t *testing.T) {
+	for n, want := range map[int64]string{0: "0 B", 1023: "1023 B", 1536: "1.5 KiB", 5 << 30: "5.0 GiB"} {
+		if got := formatSize(n); got != want {
+			t.Errorf("formatSize(%d) = %q, want %q", n, got, want)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+type namespaceInfo struct {
+	Name         string `json:"name"`
+	Count        int    `json:"count"`
+	Bytes        int64  `json:"bytes"`
+	LogicalBytes int64  `json:"logical_bytes"`
+	LastModified int64  `json:"last_modified,omitempty"`
+	Hidden       bool   `json:"hidden"`
+	Encrypted    bool   `json:"encrypted"`
+	Compression  string `json:"compression,omitempty"`
+	OwnerID      *int   `json:"owner_id,omitempty"`
+}
+
+type namespaceCreateRequest struct {
+	Name        string `json:"name"`
+	Hidden      bool   `json:"hidden"`
+	Encrypted   bool   `json:"encrypted"`
+	Compression string `json:"compression,omitempty"`
+}
+
+func (c *client) namespaces(ctx context.Context) ([]namespaceInfo, error) {
+	var namespaces []namespaceInfo
+	err := c.call(ctx, http.MethodGet, c.storageURL("/storage/namespaces", nil), nil, &namespaces)
+	return namespaces, err
+}
+
+func (a *app) namespaceList(ctx context.Context, args []string) error {
+	fs := a.flags("namespace ls", "")
+	rest, err := a.parse(fs, args)
+	if err != nil {
+		return err
+	}
+	if err := wantArgs(fs, rest, 0, 0); err != nil {
+		return err
+	}
+	c, err := a.client()
+	if err != nil {
+		return err
+	}
+	namespaces, err := c.namespaces(ctx)
+	if err != nil {
+		return err
+	}
+	if a.jsonOut {
+		return a.printJSON(namespaces)
+	}
+	rows := make([][]string, 0, len(namespaces))
+	for _, ns := range namespaces {
+		var flags []string
+		if ns.Hidden {
+			flags = append(flags, "private")
+		}
+		if ns.Encrypted {
+			flags = append(flags, "encrypted")
+		}
+		if ns.Compression != "" {
+			flags = append(flags, ns.Compression)
+		}
+		rows = append(rows, []string{
+			ns.Name,
+			strconv.Itoa(ns.Count),
+			formatSize(ns.LogicalBytes),
+			formatUnix(ns.LastModified),
+			strings.Join(flags, ","),
+		})
+	}
+	return a.table([]string{"NAME", "FILES", "SIZE", "MODIFIED", "FLAGS"}, rows)
+}
+
+func (a *app) namespaceCreate(ctx context.Context, args []string) error {
+	fs := a.flags("namespace create", "NAME")
+	private := fs.Bool("private", false, "hide the namespace from other users")
+	encrypted := fs.Bool("encrypted", false, "encrypt files at rest")
+	compression := fs.String("compression", "", "compress new files with this codec (gzip or zstd)")
+	rest, err := a.parse(fs, args)
+	if err != nil {
+		return err
+	}
+	if err := wantArgs(fs, rest, 1, 1); err != nil {
+		return err
+	}
+	c, err := a.authClient()
+	if err != nil {
+		return err
+	}
+	payload := namespaceCreateRequest{Name: rest[0], Hidden: *private, Encrypted: *encrypted, Compression: *compression}
+	var created namespaceInfo
+	if err := c.call(ctx, http.MethodPost, c.storageURL("/storage/namespaces", nil), payload, &created); err != nil {
+		return err
+	}
+	if a.jsonOut {
+		return a.printJSON(created)
+	}
+	fmt.Fprintf(a.stdout, "Created namespace %s\n", created.Name)
+	return nil
+}
+
+func (a *app) namespaceRemove(ctx context.Context, args []string) error {
+	fs := a.flags("namespace rm", "NAME")
+	yes := fs.Bool("y", false, "don't ask for confirmation")
+	rest, err := a.parse(fs, args)
+	if err != nil {
+		return err
+	}
+	if err := wantArgs(fs, rest, 1, 1); err != nil {
+		return err
+	}
+	name := rest[0]
+	c, err := a.authClient()
+	if err != nil {
+		return err
+	}
+	if !*yes {
+		fmt.Fprintf(a.stderr, "Delete namespace %s and every file in it? [y/N] ", name)
+		answer, err := readLine(bufio.NewReader(a.stdin))
+		if err != nil || !strings.EqualFold(strings.TrimSpace(answer), "y") {
+			return errors.New("aborted")
+		}
+	}
+	if err := c.call(ctx, http.MethodDelete, c.storageURL("/storage/namespaces/"+url.PathEscape(name), nil), nil, nil); err != nil {
+		return err
+	}
+	if a.jsonOut {
+		return a.printJSON(map[string]string{"status": "ok", "namespace": name})
+	}
+	fmt.Fprintf(a.stdout, "Deleted namespace %s\n", name)
+	return nil
+}
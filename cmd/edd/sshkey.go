@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+type sshKey struct {
+	ID        int64  `json:"id"`
+	Name      string `json:"name"`
+	PublicKey string `json:"public_key"`
+	CreatedAt string `json:"created_at"`
+}
+
+type sshKeyRequest struct {
+	Name      string `json:"name"`
+	PublicKey string `json:"public_key"`
+}
+
+func (c *client) sshKeys(ctx context.Context) ([]sshKey, error) {
+	var resp struct {
+		SSHKeys []sshKey `json:"ssh_keys"`
+	}
+	err := c.call(ctx, http.MethodGet, c.computeAPIURL("/compute/ssh-keys", nil), nil, &resp)
+	return resp.SSHKeys, err
+}
+
+// findSSHKey resolves a key by ID or by name.
+func findSSHKey(keys []sshKey, ref string) (sshKey, error) {
+	if id, err := strconv.ParseInt(ref, 10, 64); err == nil {
+		for _, key := range keys {
+			if key.ID == id {
+				return key, nil
+			}
+		}
+	}
+	for _, key := range keys {
+		if key.Name == ref {
+			return key, nil
+		}
+	}
+	return sshKey{}, fmt.Errorf("no SSH key %q", ref)
+}
+
+// defaultPublicKey finds the user's public key the way ssh-keygen names it.
+func defaultPublicKey() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	for _, name := range []string{"id_ed25519.pub", "id_ecdsa.pub", "id_rsa.pub"} {
+		candidate := filepath.Join(home, ".ssh", name)
+		if _, err := os.Stat(candidate); err == nil {
+			return candidate, nil
+		}
+	}
+	return "", errors.New("no public key found in ~/.ssh; pass the key file")
+}
+
+func (a *app) sshKeyAdd(ctx context.Context, args []string) error {
+	fs := a.flags("sshkey add", "[PUBLIC-KEY-FILE | -]")
+	name := fs.String("name", "", "key name (default: the key's comment)")
+	rest, err := a.parse(fs, args)
+	if err != nil {
+		return err
+	}
+	if err := wantArgs(fs, rest, 0, 1); err != nil {
+		return err
+	}
+
+	var data []byte
+	switch {
+	case len(rest) == 1 && rest[0] == "-":
+		data, err = io.ReadAll(a.stdin)
+	case len(rest) == 1:
+		data, err = os.ReadFile(rest[0])
+	default:
+		var file string
+		if file, err = defaultPublicKey(); err == nil {
+			data, err = os.ReadFile(file)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	publicKey := strings.TrimSpace(string(data))
+	if strings.Contains(publicKey, "PRIVATE KEY") {
+		return errors.New("that is a private key; pass the .pub file")
+	}
+	if *name == "" {
+		// "type base64 comment": the comment is usually user@host.
+		if fields := strings.Fields(publicKey); len(fields) >= 3 {
+			*name = strings.Join(fields[2:], " ")
+		} else {
+			return errors.New("the key has no comment to name it by; pass -name")
+		}
+	}
+
+	c, err := a.authClient()
+	if err != nil {
+		return err
+	}
+	var key sshKey
+	payload := sshKeyRequest{Name: *name, PublicKey: publicKey}
+	if err := c.call(ctx, http.MethodPost, c.computeAPIURL("/compute/ssh-keys", nil), payload, &key); err != nil {
+		return err
+	}
+	if a.jsonOut {
+		return a.printJSON(key)
+	}
+	fmt.Fprintf(a.stdout, "Added SSH key %d (%s)\n", key.ID, key.Name)
+	return nil
+}
+
+func (a *app) sshKeyList(ctx context.Context, args []string) error {
+	fs := a.flags("sshkey ls", "")
+	rest, err := a.parse(fs, args)
+	if err != nil {
+		return err
+	}
+	if err := wantArgs(fs, rest, 0, 0); err != nil {
+		return err
+	}
+	c, err := a.authClient()
+	if err != nil {
+		return err
+	}
+	keys, err := c.sshKeys(ctx)
+	if err != nil {
+		return err
+	}
+	if a.jsonOut {
+		if keys == nil {
+			keys = []sshKey{}
+		}
+		return a.printJSON(keys)
+	}
+	rows := make([][]string, 0, len(keys))
+	for _, key := range keys {
+		keyType := ""
+		if fields := strings.Fields(key.PublicKey); len(fields) > 0 {
+			keyType = fields[0]
+		}
+		rows = append(rows, []string{strconv.FormatInt(key.ID, 10), key.Name, keyType, key.CreatedAt})
+	}
+	return a.table([]string{"ID", "NAME", "TYPE", "CREATED"}, rows)
+}
+
+func (a *app) sshKeyRemove(ctx context.Context, args []string) error {
+	fs := a.flags("sshkey rm", "KEY...")
+	rest, err := a.parse(fs, args)
+	if err != nil {
+		return err
+	}
+	if err := wantArgs(fs, rest, 1, -1); err != nil {
+		return err
+	}
+	c, err := a.authClient()
+	if err != nil {
+		return err
+	}
+	keys, err := c.sshKeys(ctx)
+	if err != nil {
+		return err
+	}
+	var removed []sshKey
+	for _, ref := range rest {
+		key, err := findSSHKey(keys, ref)
+		if err != nil {
+			return err
+		}
+		rawURL := c.computeAPIURL("/compute/ssh-keys/"+strconv.FormatInt(key.ID, 10), nil)
+		if err := c.call(ctx, http.MethodDelete, rawURL, nil, nil); err != nil {
+			return fmt.Errorf("remove %s: %w", ref, err)
+		}
+		removed = append(removed, key)
+		if !a.jsonOut {
+			fmt.Fprintf(a.stdout, "Removed SSH key %d (%s)\n", key.ID, key.Name)
+		}
+	}
+	if a.jsonOut {
+		return a.printJSON(removed)
+	}
+	return nil
+}
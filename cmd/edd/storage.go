@@ -0,0 +1,721 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultNamespace = "default"
+	defaultParallel  = 4
+	// maxBatch is the largest batch SFS runs inside the request; bigger
+	// ones are split so the CLI never has to poll a job.
+	maxBatch = 100
+)
+
+type fileInfo struct {
+	Name       string            `json:"name"`
+	Path       string            `json:"path"`
+	Namespace  string            `json:"namespace"`
+	Size       int64             `json:"size"`
+	CreatedAt  int64             `json:"created_at"`
+	ModifiedAt int64             `json:"modified_at"`
+	Tags       map[string]string `json:"tags,omitempty"`
+	StoredSize int64             `json:"stored_size"`
+	Encoding   string            `json:"encoding,omitempty"`
+}
+
+// remotePath is a stored file or folder, written namespace:path. An empty
+// path or one ending in "/" is a folder.
+type remotePath struct {
+	Namespace string
+	Path      string
+}
+
+func (p remotePath) String() string {
+	return p.Namespace + ":" + p.Path
+}
+
+func (p remotePath) isFolder() bool {
+	return p.Path == "" || strings.HasSuffix(p.Path, "/")
+}
+
+// prefix is the listing prefix for everything under the path.
+func (p remotePath) prefix() string {
+	trimmed := strings.Trim(p.Path, "/")
+	if trimmed == "" {
+		return ""
+	}
+	return trimmed + "/"
+}
+
+// parseRemote recognizes namespace:path arguments. The part before the colon
+// has to look like a namespace name, so local paths such as ./a:b are left
+// alone.
+func parseRemote(arg string) (remotePath, bool) {
+	ns, p, ok := strings.Cut(arg, ":")
+	if !ok || ns == "" {
+		return remotePath{}, false
+	}
+	for _, r := range ns {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' || r == '.') {
+			return remotePath{}, false
+		}
+	}
+	return remotePath{Namespace: ns, Path: strings.TrimLeft(p, "/")}, true
+}
+
+// escapePath escapes each segment of a file path for use in a URL.
+func escapePath(p string) string {
+	segments := strings.Split(p, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+// listFiles lists a namespace's files under prefix, sorted by name.
+func (c *client) listFiles(ctx context.Context, namespace, prefix string) ([]fileInfo, error) {
+	var files []fileInfo
+	query := url.Values{"namespace": {namespace}}
+	if err := c.call(ctx, http.MethodGet, c.storageURL("/storage/files", query), nil, &files); err != nil {
+		return nil, err
+	}
+	matched := files[:0]
+	for _, f := range files {
+		if strings.HasPrefix(f.Name, prefix) {
+			matched = append(matched, f)
+		}
+	}
+	sort.Slice(matched, func(i, j int) bool { return matched[i].Name < matched[j].Name })
+	return matched, nil
+}
+
+// upload stores a local file. Without overwrite an existing file is left
+// alone and errFileExists returned.
+func (c *client) upload(ctx context.Context, local string, dst remotePath, overwrite bool) (int64, error) {
+	f, err := os.Open(local)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	query := url.Values{}
+	header := http.Header{"Content-Type": {"application/octet-stream"}}
+	if overwrite {
+		query.Set("overwrite", "true")
+	} else {
+		header.Set("If-None-Match", "*")
+	}
+	rawURL := c.storageURL("/storage/"+url.PathEscape(dst.Namespace)+"/"+escapePath(dst.Path), query)
+	resp, err := c.do(ctx, http.MethodPut, rawURL, f, header)
+	if isStatus(err, http.StatusPreconditionFailed) {
+		return 0, errFileExists
+	}
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	return info.Size(), nil
+}
+
+var errFileExists = errors.New("file already exists")
+
+// download fetches a stored file into local, replacing it only once the
+// whole file has arrived. modified, when known, becomes the file's mtime so
+// a later sync sees it as current.
+func (c *client) download(ctx context.Context, src remotePath, local string, modified int64) (int64, error) {
+	rawURL := c.storageURL("/storage/download/"+url.PathEscape(src.Namespace)+"/"+escapePath(src.Path), nil)
+	resp, err := c.do(ctx, http.MethodGet, rawURL, nil, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	dir := filepath.Dir(local)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return 0, err
+	}
+	tmp, err := os.CreateTemp(dir, ".edd-download-*")
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(tmp, resp.Body)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), local)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return n, err
+	}
+	if modified > 0 {
+		mtime := time.Unix(modified, 0)
+		_ = os.Chtimes(local, mtime, mtime)
+	}
+	return n, nil
+}
+
+type batchOperation struct {
+	Op          string `json:"op"`
+	Namespace   string `json:"namespace"`
+	Name        string `json:"name"`
+	ToNamespace string `json:"to_namespace,omitempty"`
+	ToName      string `json:"to_name,omitempty"`
+	Overwrite   bool   `json:"overwrite,omitempty"`
+}
+
+type batchResult struct {
+	Index  int    `json:"index"`
+	Op     string `json:"op"`
+	Status int    `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type batchJob struct {
+	ID      string        `json:"id,omitempty"`
+	Status  string        `json:"status"`
+	Results []batchResult `json:"results,omitempty"`
+}
+
+// batch runs operations through the batch API and returns one result per
+// operation, in order.
+func (c *client) batch(ctx context.Context, ops []batchOperation) ([]batchResult, error) {
+	results := make([]batchResult, 0, len(ops))
+	for start := 0; start < len(ops); start += maxBatch {
+		chunk := ops[start:min(start+maxBatch, len(ops))]
+		var job batchJob
+		payload := map[string]any{"operations": chunk}
+		if err := c.call(ctx, http.MethodPost, c.storageURL("/storage/batch", nil), payload, &job); err != nil {
+			return nil, err
+		}
+		// The server may still decide to run the batch as a job.
+		for job.Status == "running" && job.ID != "" {
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(time.Second):
+			}
+			if err := c.call(ctx, http.MethodGet, c.storageURL("/storage/batch/"+url.PathEscape(job.ID), nil), nil, &job); err != nil {
+				return nil, err
+			}
+		}
+		if len(job.Results) != len(chunk) {
+			return nil, fmt.Errorf("batch %s: expected %d results, got %d", job.Status, len(chunk), len(job.Results))
+		}
+		for _, result := range job.Results {
+			result.Index += start
+			results = append(results, result)
+		}
+	}
+	return results, nil
+}
+
+func (r batchResult) failed() bool {
+	return r.Error != "" || r.Status >= 300
+}
+
+func (a *app) storageList(ctx context.Context, args []string) error {
+	fs := a.flags("storage ls", "[NAMESPACE[:PREFIX]]")
+	rest, err := a.parse(fs, args)
+	if err != nil {
+		return err
+	}
+	if err := wantArgs(fs, rest, 0, 1); err != nil {
+		return err
+	}
+	target := remotePath{Namespace: defaultNamespace}
+	if len(rest) == 1 {
+		var ok bool
+		if target, ok = parseRemote(rest[0]); !ok {
+			// A bare name is a namespace.
+			target = remotePath{Namespace: rest[0]}
+		}
+	}
+
+	c, err := a.client()
+	if err != nil {
+		return err
+	}
+	prefix := target.Path
+	files, err := c.listFiles(ctx, target.Namespace, prefix)
+	if err != nil {
+		return err
+	}
+	if a.jsonOut {
+		return a.printJSON(files)
+	}
+	rows := make([][]string, 0, len(files))
+	for _, f := range files {
+		rows = append(rows, []string{formatSize(f.Size), formatUnix(f.ModifiedAt), f.Name})
+	}
+	return a.table([]string{"SIZE", "MODIFIED", "NAME"}, rows)
+}
+
+// transfer is one file copied or moved by cp, mv or sync.
+type transfer struct {
+	Op          string `json:"op"`
+	Source      string `json:"source"`
+	Destination string `json:"destination"`
+	Size        int64  `json:"size"`
+	Skipped     bool   `json:"skipped,omitempty"`
+	Error       string `json:"error,omitempty"`
+
+	local    string
+	src      remotePath
+	dst      remotePath
+	modified int64
+}
+
+const (
+	opUpload   = "upload"
+	opDownload = "download"
+	opCopy     = "copy"
+	opMove     = "move"
+	opDelete   = "delete"
+)
+
+// sourceFile is one file found under a cp or mv source argument, with its
+// path relative to the destination.
+type sourceFile struct {
+	rel      string
+	local    string
+	remote   remotePath
+	size     int64
+	modified int64
+}
+
+// expandRemote lists the files a remote source stands for. A folder copies
+// its contents; with recursive a path without a trailing slash copies the
+// folder itself, like rsync.
+func (c *client) expandRemote(ctx context.Context, src remotePath, recursive bool) ([]sourceFile, error) {
+	if !recursive {
+		if src.isFolder() {
+			return nil, fmt.Errorf("%s is a folder (use -r)", src)
+		}
+		return []sourceFile{{rel: path.Base(src.Path), remote: src}}, nil
+	}
+	files, err := c.listFiles(ctx, src.Namespace, src.prefix())
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("%s: no such files", src)
+	}
+	base := ""
+	if !src.isFolder() {
+		base = path.Base(src.Path) + "/"
+	}
+	out := make([]sourceFile, 0, len(files))
+	for _, f := range files {
+		out = append(out, sourceFile{
+			rel:      base + strings.TrimPrefix(f.Name, src.prefix()),
+			remote:   remotePath{Namespace: src.Namespace, Path: f.Name},
+			size:     f.Size,
+			modified: f.ModifiedAt,
+		})
+	}
+	return out, nil
+}
+
+// expandLocal lists the files under a local source, following the same
+// trailing-slash rule as expandRemote.
+func expandLocal(src string, recursive bool) ([]sourceFile, error) {
+	info, err := os.Stat(src)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return []sourceFile{{rel: filepath.Base(src), local: src, size: info.Size()}}, nil
+	}
+	if !recursive {
+		return nil, fmt.Errorf("%s is a directory (use -r)", src)
+	}
+	base := ""
+	if !strings.HasSuffix(src, string(filepath.Separator)) && !strings.HasSuffix(src, "/") {
+		base = filepath.Base(filepath.Clean(src)) + "/"
+	}
+	var out []sourceFile
+	err = filepath.WalkDir(src, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || !d.Type().IsRegular() {
+			return err
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		out = append(out, sourceFile{rel: base + filepath.ToSlash(rel), local: p, size: info.Size(), modified: info.ModTime().Unix()})
+		return nil
+	})
+	return out, err
+}
+
+// planCopy turns cp or mv arguments into transfers. With several sources, -r
+// or a folder destination, files keep their names under the destination;
+// otherwise the single source is copied to exactly the destination.
+func (a *app) planCopy(ctx context.Context, c *client, op string, srcs []string, dst string, recursive bool) ([]*transfer, error) {
+	dstRemote, dstIsRemote := parseRemote(dst)
+	into := len(srcs) > 1 || recursive
+	if dstIsRemote {
+		into = into || dstRemote.isFolder()
+	} else if info, err := os.Stat(dst); (err == nil && info.IsDir()) || strings.HasSuffix(dst, string(filepath.Separator)) {
+		into = true
+	}
+
+	var transfers []*transfer
+	for _, src := range srcs {
+		srcRemote, srcIsRemote := parseRemote(src)
+		var files []sourceFile
+		var err error
+		switch {
+		case !srcIsRemote && !dstIsRemote:
+			return nil, fmt.Errorf("%s and %s are both local paths; remote paths are written namespace:path", src, dst)
+		case !srcIsRemote && op == opMove:
+			return nil, fmt.Errorf("mv only moves stored files; use cp to upload %s", src)
+		case srcIsRemote:
+			files, err = c.expandRemote(ctx, srcRemote, recursive)
+		default:
+			files, err = expandLocal(src, recursive)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		for _, f := range files {
+			t := &transfer{Size: f.size, modified: f.modified, local: f.local, src: f.remote}
+			switch {
+			case dstIsRemote:
+				t.dst = dstRemote
+				if into {
+					t.dst.Path = path.Join(dstRemote.Path, f.rel)
+				}
+				t.Destination = t.dst.String()
+			default:
+				t.local = dst
+				if into {
+					t.local = filepath.Join(dst, filepath.FromSlash(f.rel))
+				}
+				t.Destination = t.local
+			}
+			switch {
+			case srcIsRemote && dstIsRemote:
+				t.Op = op
+				t.Source = f.remote.String()
+			case srcIsRemote:
+				t.Op = opDownload
+				t.Source = f.remote.String()
+			default:
+				t.Op = opUpload
+				t.Source = f.local
+			}
+			transfers = append(transfers, t)
+		}
+	}
+	return transfers, nil
+}
+
+// runTransfers carries out transfers and reports on them.
+func (a *app) runTransfers(ctx context.Context, c *client, transfers []*transfer, parallel int, overwrite bool) error {
+	if err := c.executeTransfers(ctx, transfers, parallel, overwrite); err != nil {
+		return err
+	}
+	return a.reportTransfers(transfers)
+}
+
+// executeTransfers runs uploads and downloads in parallel, and copies, moves
+// and deletes of stored files as batches on the server. Per-file failures
+// are recorded on the transfers; the error is for the batch as a whole.
+func (c *client) executeTransfers(ctx context.Context, transfers []*transfer, parallel int, overwrite bool) error {
+	var batched []*transfer
+	var ops []batchOperation
+	jobs := make(chan *transfer)
+	var wg sync.WaitGroup
+	for range max(parallel, 1) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for t := range jobs {
+				var err error
+				switch t.Op {
+				case opUpload:
+					t.Size, err = c.upload(ctx, t.local, t.dst, overwrite)
+				case opDownload:
+					if !overwrite {
+						if _, statErr := os.Stat(t.local); statErr == nil {
+							err = errFileExists
+							break
+						}
+					}
+					t.Size, err = c.download(ctx, t.src, t.local, t.modified)
+				case opDelete:
+					err = os.Remove(t.local)
+				}
+				if errors.Is(err, errFileExists) {
+					t.Skipped = true
+				} else if err != nil {
+					t.Error = err.Error()
+				}
+			}
+		}()
+	}
+	for _, t := range transfers {
+		if t.Op == opUpload || t.Op == opDownload || (t.Op == opDelete && t.local != "") {
+			jobs <- t
+			continue
+		}
+		batched = append(batched, t)
+		ops = append(ops, batchOperation{
+			Op:          t.Op,
+			Namespace:   t.src.Namespace,
+			Name:        t.src.Path,
+			ToNamespace: t.dst.Namespace,
+			ToName:      t.dst.Path,
+			Overwrite:   overwrite,
+		})
+	}
+	close(jobs)
+	wg.Wait()
+
+	if len(ops) == 0 {
+		return nil
+	}
+	results, err := c.batch(ctx, ops)
+	if err != nil {
+		return err
+	}
+	for i, result := range results {
+		if result.failed() {
+			batched[i].Error = result.Error
+			if batched[i].Error == "" {
+				batched[i].Error = strings.ToLower(http.StatusText(result.Status))
+			}
+		}
+	}
+	return nil
+}
+
+// reportTransfers prints what happened to each transfer and fails if any of
+// them did.
+func (a *app) reportTransfers(transfers []*transfer) error {
+	failed := 0
+	for _, t := range transfers {
+		if t.Error != "" {
+			failed++
+		}
+	}
+	if a.jsonOut {
+		if transfers == nil {
+			transfers = []*transfer{}
+		}
+		if err := a.printJSON(transfers); err != nil {
+			return err
+		}
+	} else {
+		for _, t := range transfers {
+			switch {
+			case t.Error != "":
+				fmt.Fprintf(a.stderr, "%s %s: %s\n", t.Op, t.Source, t.Error)
+			case t.Skipped:
+				fmt.Fprintf(a.stdout, "skip %s (%s exists)\n", t.Source, t.Destination)
+			case t.Op == opDelete:
+				fmt.Fprintf(a.stdout, "delete %s\n", t.Source)
+			default:
+				fmt.Fprintf(a.stdout, "%s %s -> %s (%s)\n", t.Op, t.Source, t.Destination, formatSize(t.Size))
+			}
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d operations failed", failed, len(transfers))
+	}
+	return nil
+}
+
+func (a *app) storageCopy(ctx context.Context, args []string) error {
+	fs := a.flags("storage cp", "SOURCE... DESTINATION")
+	recursive := fs.Bool("r", false, "copy folders recursively")
+	noClobber := fs.Bool("n", false, "don't overwrite existing files")
+	parallel := fs.Int("parallel", defaultParallel, "number of files to transfer at once")
+	rest, err := a.parse(fs, args)
+	if err != nil {
+		return err
+	}
+	if err := wantArgs(fs, rest, 2, -1); err != nil {
+		return err
+	}
+	c, err := a.authClient()
+	if err != nil {
+		return err
+	}
+	transfers, err := a.planCopy(ctx, c, opCopy, rest[:len(rest)-1], rest[len(rest)-1], *recursive)
+	if err != nil {
+		return err
+	}
+	return a.runTransfers(ctx, c, transfers, *parallel, !*noClobber)
+}
+
+func (a *app) storageMove(ctx context.Context, args []string) error {
+	fs := a.flags("storage mv", "SOURCE... DESTINATION")
+	recursive := fs.Bool("r", false, "move folders recursively")
+	noClobber := fs.Bool("n", false, "don't overwrite existing files")
+	rest, err := a.parse(fs, args)
+	if err != nil {
+		return err
+	}
+	if err := wantArgs(fs, rest, 2, -1); err != nil {
+		return err
+	}
+	if _, ok := parseRemote(rest[len(rest)-1]); !ok {
+		return fmt.Errorf("mv only moves stored files; use cp to download to %s", rest[len(rest)-1])
+	}
+	c, err := a.authClient()
+	if err != nil {
+		return err
+	}
+	transfers, err := a.planCopy(ctx, c, opMove, rest[:len(rest)-1], rest[len(rest)-1], *recursive)
+	if err != nil {
+		return err
+	}
+	return a.runTransfers(ctx, c, transfers, 1, !*noClobber)
+}
+
+func (a *app) storageRemove(ctx context.Context, args []string) error {
+	fs := a.flags("storage rm", "NAMESPACE:PATH...")
+	recursive := fs.Bool("r", false, "remove everything under folders")
+	rest, err := a.parse(fs, args)
+	if err != nil {
+		return err
+	}
+	if err := wantArgs(fs, rest, 1, -1); err != nil {
+		return err
+	}
+	c, err := a.authClient()
+	if err != nil {
+		return err
+	}
+
+	var transfers []*transfer
+	for _, arg := range rest {
+		target, ok := parseRemote(arg)
+		if !ok {
+			return fmt.Errorf("%s is not a stored file; remote paths are written namespace:path", arg)
+		}
+		files, err := c.expandRemote(ctx, target, *recursive)
+		if err != nil {
+			return err
+		}
+		for _, f := range files {
+			transfers = append(transfers, &transfer{Op: opDelete, Source: f.remote.String(), src: f.remote, Size: f.size})
+		}
+	}
+	return a.runTransfers(ctx, c, transfers, 1, false)
+}
+
+type dropLinkRequest struct {
+	Label          string `json:"label"`
+	ExpiresInHours int    `json:"expires_in_hours"`
+	MaxFileSizeMB  int64  `json:"max_file_size_mb,omitempty"`
+	MaxFiles       int    `json:"max_files,omitempty"`
+}
+
+type dropLink struct {
+	ID        int    `json:"id"`
+	Token     string `json:"token"`
+	Namespace string `json:"namespace"`
+	ExpiresAt int64  `json:"expires_at"`
+}
+
+type shareLink struct {
+	URL       string `json:"url"`
+	Namespace string `json:"namespace"`
+	Path      string `json:"path,omitempty"`
+	Private   bool   `json:"private,omitempty"`
+	ExpiresAt int64  `json:"expires_at,omitempty"`
+}
+
+// storageShare prints the public link to a stored file, or with -drop
+// creates an upload link others can send files to a namespace with.
+func (a *app) storageShare(ctx context.Context, args []string) error {
+	fs := a.flags("storage share", "NAMESPACE:PATH | -drop NAMESPACE")
+	drop := fs.Bool("drop", false, "create an upload link for the namespace instead")
+	label := fs.String("label", "", "drop link label")
+	expires := fs.Int("expires", 24, "drop link lifetime in hours")
+	maxFiles := fs.Int("max-files", 0, "drop link file limit (0 for the server default)")
+	maxSize := fs.Int64("max-size", 0, "drop link per-file limit in MB (0 for the server default)")
+	rest, err := a.parse(fs, args)
+	if err != nil {
+		return err
+	}
+	if err := wantArgs(fs, rest, 1, 1); err != nil {
+		return err
+	}
+	c, err := a.authClient()
+	if err != nil {
+		return err
+	}
+
+	if *drop {
+		namespace := strings.TrimSuffix(rest[0], ":")
+		payload := dropLinkRequest{Label: *label, ExpiresInHours: *expires, MaxFiles: *maxFiles, MaxFileSizeMB: *maxSize}
+		var link dropLink
+		rawURL := c.storageURL("/storage/namespaces/"+url.PathEscape(namespace)+"/drops", nil)
+		if err := c.call(ctx, http.MethodPost, rawURL, payload, &link); err != nil {
+			return err
+		}
+		share := shareLink{URL: c.storageURL("/drop/"+url.PathEscape(link.Token), nil), Namespace: link.Namespace, ExpiresAt: link.ExpiresAt}
+		if a.jsonOut {
+			return a.printJSON(share)
+		}
+		fmt.Fprintln(a.stdout, share.URL)
+		fmt.Fprintf(a.stderr, "Upload link for %s, valid until %s. Send files with:\n  curl -F file=@FILE %s\n", link.Namespace, formatUnix(link.ExpiresAt), share.URL)
+		return nil
+	}
+
+	target, ok := parseRemote(rest[0])
+	if !ok || target.isFolder() {
+		return fmt.Errorf("%s is not a stored file; remote paths are written namespace:path", rest[0])
+	}
+	namespaces, err := c.namespaces(ctx)
+	if err != nil {
+		return err
+	}
+	share := shareLink{
+		URL:       c.storageURL("/storage/"+url.PathEscape(target.Namespace)+"/"+escapePath(target.Path), nil),
+		Namespace: target.Namespace,
+		Path:      target.Path,
+	}
+	for _, ns := range namespaces {
+		if ns.Name == target.Namespace {
+			share.Private = ns.Hidden
+		}
+	}
+	if a.jsonOut {
+		return a.printJSON(share)
+	}
+	fmt.Fprintln(a.stdout, share.URL)
+	if share.Private {
+		fmt.Fprintf(a.stderr, "%s is private: the link only works for you while signed in\n", target.Namespace)
+	}
+	return nil
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, data := range files {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func readFiles(t *testing.T, dir string) map[string]string {
+	t.Helper()
+	out := make(map[string]string)
+	err := filepath.WalkDir(dir, func(p string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		data, err := os.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(dir, p)
+		out[filepath.ToSlash(rel)] = string(data)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func TestCopyUploadAndDownload(t *testing.T) {
+	sfs, srv := newFakeSFS(t)
+	sfs.uploadDelay = 50 * time.Millisecond
+	run := newTestApp(t, srv.URL, "", testSession)
+
+	src := t.TempDir()
+	files := map[string]string{
+		"a.txt":       "alpha",
+		"b.txt":       "bravo",
+		"sub/c.txt":   "charlie",
+		"sub/d/e.txt": "echo",
+	}
+	writeFiles(t, src, files)
+
+	out := run.mustRun(t, "storage", "cp", "-r", "-parallel", "4", src+"/", "default:backup/")
+	if got := strings.Count(out, "upload "); got != len(files) {
+		t.Fatalf("cp printed %d uploads, want %d:\n%s", got, len(files), out)
+	}
+	want := map[string]string{}
+	for name, data := range files {
+		want["backup/"+name] = data
+	}
+	if got := sfs.contents("default"); !reflect.DeepEqual(got, want) {
+		t.Fatalf("stored files = %v, want %v", got, want)
+	}
+	if sfs.maxFlight < 2 {
+		t.Fatalf("uploads ran one at a time with -parallel 4")
+	}
+
+	// -n leaves existing files alone.
+	writeFiles(t, src, map[string]string{"a.txt": "changed"})
+	out = run.mustRun(t, "storage", "cp", "-n", filepath.Join(src, "a.txt"), "default:backup/a.txt")
+	if !strings.Contains(out, "skip ") || sfs.contents("default")["backup/a.txt"] != "alpha" {
+		t.Fatalf("cp -n overwrote the file: %s", out)
+	}
+
+	dst := t.TempDir()
+	run.mustRun(t, "storage", "cp", "-r", "default:backup/", dst)
+	if got := readFiles(t, dst); !reflect.DeepEqual(got, files) {
+		t.Fatalf("downloaded files = %v, want %v", got, files)
+	}
+
+	// Without a trailing slash the folder itself is copied.
+	dst = t.TempDir()
+	run.mustRun(t, "storage", "cp", "-r", "default:backup/sub", dst)
+	if got := readFiles(t, dst); !reflect.DeepEqual(got, map[string]string{"sub/c.txt": "charlie", "sub/d/e.txt": "echo"}) {
+		t.Fatalf("downloaded files = %v", got)
+	}
+}
+
+func TestCopyMissingFile(t *testing.T) {
+	_, srv := newFakeSFS(t)
+	run := newTestApp(t, srv.URL, "", testSession)
+	err := run.run(t, "storage", "cp", "default:nope.txt", t.TempDir())
+	if err == nil || !strings.Contains(err.Error(), "1 of 1 operations failed") {
+		t.Fatalf("err = %v", err)
+	}
+	if !strings.Contains(run.stderr.String()+run.stdout.String(), "not found") {
+		t.Fatalf("output does not explain the failure: %q %q", run.stdout, run.stderr)
+	}
+}
+
+func TestSyncRoundTrip(t *testing.T) {
+	sfs, srv := newFakeSFS(t)
+	run := newTestApp(t, srv.URL, "", testSession)
+
+	src := t.TempDir()
+	writeFiles(t, src, map[string]string{"index.html": "<h1>hi</h1>", "css/site.css": "body{}"})
+	old := time.Now().Add(-time.Hour)
+	for _, name := range []string{"index.html", "css/site.css"} {
+		if err := os.Chtimes(filepath.Join(src, name), old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	run.mustRun(t, "storage", "sync", src, "default:site")
+	if got := sfs.contents("default"); len(got) != 2 || got["site/css/site.css"] != "body{}" {
+		t.Fatalf("stored files = %v", got)
+	}
+	if out := run.mustRun(t, "storage", "sync", src, "default:site"); !strings.Contains(out, "Already in sync") {
+		t.Fatalf("second sync output = %q", out)
+	}
+
+	// Change one file, remove another and check -dry-run changes nothing.
+	writeFiles(t, src, map[string]string{"index.html": "<h1>hello</h1>"})
+	if err := os.Remove(filepath.Join(src, "css", "site.css")); err != nil {
+		t.Fatal(err)
+	}
+	out := run.mustRun(t, "storage", "sync", "-delete", "-dry-run", src, "default:site")
+	if !strings.Contains(out, "would upload") || !strings.Contains(out, "would delete default:site/css/site.css") {
+		t.Fatalf("dry run output = %q", out)
+	}
+	if len(sfs.contents("default")) != 2 {
+		t.Fatalf("dry run changed the namespace")
+	}
+	run.mustRun(t, "storage", "sync", "-delete", src, "default:site")
+	if got := sfs.contents("default"); !reflect.DeepEqual(got, map[string]string{"site/index.html": "<h1>hello</h1>"}) {
+		t.Fatalf("stored files = %v", got)
+	}
+
+	// Download back into an empty directory, then again with nothing to do.
+	dst := filepath.Join(t.TempDir(), "mirror")
+	run.mustRun(t, "storage", "sync", "default:site", dst)
+	if got := readFiles(t, dst); !reflect.DeepEqual(got, map[string]string{"index.html": "<h1>hello</h1>"}) {
+		t.Fatalf("downloaded files = %v", got)
+	}
+	if out := run.mustRun(t, "storage", "sync", "default:site", dst); !strings.Contains(out, "Already in sync") {
+		t.Fatalf("second download sync output = %q", out)
+	}
+}
+
+func TestMoveAndRemove(t *testing.T) {
+	sfs, srv := newFakeSFS(t)
+	run := newTestApp(t, srv.URL, "", testSession)
+	sfs.put1("default", "logs/1.txt", "one", 1)
+	sfs.put1("default", "logs/2.txt", "two", 1)
+	sfs.put1("archive", "keep.txt", "keep", 1)
+
+	run.mustRun(t, "storage", "mv", "-r", "default:logs/", "archive:old/")
+	if got := sfs.contents("archive"); !reflect.DeepEqual(got, map[string]string{"keep.txt": "keep", "old/1.txt": "one", "old/2.txt": "two"}) {
+		t.Fatalf("archive = %v", got)
+	}
+	if got := sfs.contents("default"); len(got) != 0 {
+		t.Fatalf("default still has %v after mv", got)
+	}
+
+	if err := run.run(t, "storage", "rm", "archive:old/"); err == nil {
+		t.Fatalf("rm of a folder without -r succeeded")
+	}
+	run.mustRun(t, "storage", "rm", "-r", "archive:old/")
+	if got := sfs.contents("archive"); !reflect.DeepEqual(got, map[string]string{"keep.txt": "keep"}) {
+		t.Fatalf("archive = %v", got)
+	}
+}
+
+func TestMoveRejectsUpload(t *testing.T) {
+	_, srv := newFakeSFS(t)
+	run := newTestApp(t, srv.URL, "", testSession)
+	if err := run.run(t, "storage", "mv", t.TempDir(), "default:x"); err == nil {
+		t.Fatalf("mv from a local path succeeded")
+	}
+}
+
+func TestStorageListJSON(t *testing.T) {
+	sfs, srv := newFakeSFS(t)
+	run := newTestApp(t, srv.URL, "", testSession)
+	sfs.put1("default", "docs/a.pdf", "pdf", 1700000000)
+	sfs.put1("default", "notes.txt", "txt", 1700000000)
+
+	out := run.mustRun(t, "-json", "storage", "ls", "default:docs/")
+	var files []fileInfo
+	if err := json.Unmarshal([]byte(out), &files); err != nil {
+		t.Fatalf("ls -json output %q: %v", out, err)
+	}
+	if len(files) != 1 || files[0].Name != "docs/a.pdf" || files[0].Size != 3 {
+		t.Fatalf("files = %+v", files)
+	}
+
+	out = run.mustRun(t, "storage", "ls", "default")
+	if !strings.Contains(out, "notes.txt") || !strings.Contains(out, "docs/a.pdf") {
+		t.Fatalf("ls output = %q", out)
+	}
+}
+
+func TestNamespaces(t *testing.T) {
+	sfs, srv := newFakeSFS(t)
+	run := newTestApp(t, srv.URL, "", testSession)
+
+	run.mustRun(t, "namespace", "create", "-private", "-compression", "gzip", "photos")
+	if ns := sfs.namespaces["photos"]; ns == nil || !ns.Hidden || ns.Compression != "gzip" {
+		t.Fatalf("created namespace = %+v", ns)
+	}
+	if err := run.run(t, "ns", "create", "photos"); !isStatus(err, 409) {
+		t.Fatalf("duplicate create: err = %v", err)
+	}
+
+	out := run.mustRun(t, "ns", "ls")
+	if !strings.Contains(out, "photos") || !strings.Contains(out, "private") {
+		t.Fatalf("ls output = %q", out)
+	}
+
+	// rm asks first; answering no keeps the namespace.
+	run.app.stdin = strings.NewReader("n\n")
+	if err := run.run(t, "ns", "rm", "photos"); err == nil {
+		t.Fatalf("rm without confirmation succeeded")
+	}
+	run.mustRun(t, "ns", "rm", "-y", "photos")
+	if _, ok := sfs.namespaces["photos"]; ok {
+		t.Fatalf("namespace still exists")
+	}
+}
+
+func TestShare(t *testing.T) {
+	sfs, srv := newFakeSFS(t)
+	run := newTestApp(t, srv.URL, "", testSession)
+	sfs.put1("default", "report.pdf", "pdf", 1)
+
+	out := run.mustRun(t, "storage", "share", "default:report.pdf")
+	if !strings.Contains(out, srv.URL+"/storage/default/report.pdf") {
+		t.Fatalf("share output = %q", out)
+	}
+	out = run.mustRun(t, "storage", "share", "-drop", "-label", "uploads", "default:")
+	if !strings.Contains(out, srv.URL+"/drop/drop-1") {
+		t.Fatalf("share -drop output = %q", out)
+	}
+}
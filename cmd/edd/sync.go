@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+)
+
+// storageSync makes one side match the other, transferring only files that
+// are missing or differ in size, or whose source is newer. Downloads take the
+// stored file's modification time, so a repeated sync finds nothing to do.
+func (a *app) storageSync(ctx context.Context, args []string) error {
+	fs := a.flags("storage sync", "SOURCE DESTINATION")
+	del := fs.Bool("delete", false, "delete destination files that are not in the source")
+	dryRun := fs.Bool("dry-run", false, "print what would change without changing anything")
+	parallel := fs.Int("parallel", defaultParallel, "number of files to transfer at once")
+	rest, err := a.parse(fs, args)
+	if err != nil {
+		return err
+	}
+	if err := wantArgs(fs, rest, 2, 2); err != nil {
+		return err
+	}
+	src, dst := rest[0], rest[1]
+	srcRemote, srcIsRemote := parseRemote(src)
+	dstRemote, dstIsRemote := parseRemote(dst)
+	if srcIsRemote == dstIsRemote {
+		return fmt.Errorf("sync needs one local directory and one namespace:path")
+	}
+
+	c, err := a.authClient()
+	if err != nil {
+		return err
+	}
+
+	var transfers []*transfer
+	if srcIsRemote {
+		transfers, err = a.planDownloadSync(ctx, c, srcRemote, dst, *del)
+	} else {
+		transfers, err = a.planUploadSync(ctx, c, src, dstRemote, *del)
+	}
+	if err != nil {
+		return err
+	}
+
+	if *dryRun {
+		if a.jsonOut {
+			return a.printJSON(transfers)
+		}
+		for _, t := range transfers {
+			if t.Op == opDelete {
+				fmt.Fprintf(a.stdout, "would delete %s\n", t.Source)
+				continue
+			}
+			fmt.Fprintf(a.stdout, "would %s %s -> %s (%s)\n", t.Op, t.Source, t.Destination, formatSize(t.Size))
+		}
+		return nil
+	}
+	if len(transfers) == 0 && !a.jsonOut {
+		fmt.Fprintln(a.stdout, "Already in sync")
+		return nil
+	}
+	return a.runSync(ctx, c, transfers, *parallel)
+}
+
+// runSync transfers files before deleting anything, and deletes nothing if a
+// transfer failed, so the destination never loses files the source still
+// has.
+func (a *app) runSync(ctx context.Context, c *client, transfers []*transfer, parallel int) error {
+	var copies, deletes []*transfer
+	for _, t := range transfers {
+		if t.Op == opDelete {
+			deletes = append(deletes, t)
+		} else {
+			copies = append(copies, t)
+		}
+	}
+	if err := c.executeTransfers(ctx, copies, parallel, true); err != nil {
+		return err
+	}
+	done := copies
+	for _, t := range copies {
+		if t.Error != "" {
+			return a.reportTransfers(done)
+		}
+	}
+	if err := c.executeTransfers(ctx, deletes, parallel, false); err != nil {
+		return err
+	}
+	return a.reportTransfers(append(done, deletes...))
+}
+
+type syncEntry struct {
+	size     int64
+	modified int64
+}
+
+func (a *app) planUploadSync(ctx context.Context, c *client, dir string, dst remotePath, del bool) ([]*transfer, error) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", dir)
+	}
+	// Sync copies the directory's contents, not the directory itself.
+	files, err := expandLocal(dir+string(filepath.Separator), true)
+	if err != nil {
+		return nil, err
+	}
+	remoteFiles, err := c.listFiles(ctx, dst.Namespace, dst.prefix())
+	if err != nil {
+		return nil, err
+	}
+	remote := make(map[string]syncEntry, len(remoteFiles))
+	for _, f := range remoteFiles {
+		remote[f.Name[len(dst.prefix()):]] = syncEntry{size: f.Size, modified: f.ModifiedAt}
+	}
+
+	var transfers []*transfer
+	seen := make(map[string]bool, len(files))
+	for _, f := range files {
+		seen[f.rel] = true
+		existing, ok := remote[f.rel]
+		if ok && existing.size == f.size && f.modified <= existing.modified {
+			continue
+		}
+		target := remotePath{Namespace: dst.Namespace, Path: path.Join(dst.prefix(), f.rel)}
+		transfers = append(transfers, &transfer{
+			Op:          opUpload,
+			Source:      f.local,
+			Destination: target.String(),
+			Size:        f.size,
+			local:       f.local,
+			dst:         target,
+		})
+	}
+	if del {
+		for _, rel := range sortedKeys(remote) {
+			if seen[rel] {
+				continue
+			}
+			target := remotePath{Namespace: dst.Namespace, Path: dst.prefix() + rel}
+			transfers = append(transfers, &transfer{Op: opDelete, Source: target.String(), src: target, Size: remote[rel].size})
+		}
+	}
+	return transfers, nil
+}
+
+func (a *app) planDownloadSync(ctx context.Context, c *client, src remotePath, dir string, del bool) ([]*transfer, error) {
+	remoteFiles, err := c.listFiles(ctx, src.Namespace, src.prefix())
+	if err != nil {
+		return nil, err
+	}
+	local := make(map[string]syncEntry)
+	if info, err := os.Stat(dir); err == nil {
+		if !info.IsDir() {
+			return nil, fmt.Errorf("%s is not a directory", dir)
+		}
+		files, err := expandLocal(dir+string(filepath.Separator), true)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range files {
+			local[f.rel] = syncEntry{size: f.size, modified: f.modified}
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	var transfers []*transfer
+	seen := make(map[string]bool, len(remoteFiles))
+	for _, f := range remoteFiles {
+		rel := f.Name[len(src.prefix()):]
+		seen[rel] = true
+		existing, ok := local[rel]
+		if ok && existing.size == f.Size && f.ModifiedAt <= existing.modified {
+			continue
+		}
+		target := filepath.Join(dir, filepath.FromSlash(rel))
+		from := remotePath{Namespace: src.Namespace, Path: f.Name}
+		transfers = append(transfers, &transfer{
+			Op:          opDownload,
+			Source:      from.String(),
+			Destination: target,
+			Size:        f.Size,
+			local:       target,
+			src:         from,
+			modified:    f.ModifiedAt,
+		})
+	}
+	if del {
+		for _, rel := range sortedKeys(local) {
+			if seen[rel] {
+				continue
+			}
+			target := filepath.Join(dir, filepath.FromSlash(rel))
+			transfers = append(transfers, &transfer{Op: opDelete, Source: target, local: target, Size: local[rel].size})
+		}
+	}
+	return transfers, nil
+}
+
+func sortedKeys(m map[string]syncEntry) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
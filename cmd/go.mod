@@ -0,0 +1,7 @@
+module eddisonso.com/edd-cloud/cmd
+
+go 1.24.0
+
+require golang.org/x/term v0.39.0
+
+require golang.org/x/sys v0.40.0 // indirect
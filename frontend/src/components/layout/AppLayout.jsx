@@ -1,27 +1,47 @@
-import { useState } from "react";
+import { useEffect, useState } from "react";
 import { Outlet } from "react-router-dom";
 import { Sidebar } from "./Sidebar";
 import { ThemeToggle } from "./ThemeToggle";
 import { useHealth } from "@/hooks";
 import { useAuth } from "@/contexts/AuthContext";
+import { buildApiBase } from "@/lib/api";
 import { Button } from "@/components/ui/button";
 import { Input } from "@/components/ui/input";
 import { Label } from "@/components/ui/label";
 import { Card, CardContent, CardHeader, CardTitle } from "@/components/ui/card";
 
 export function AppLayout() {
-  const { user, loading: authLoading, login } = useAuth();
+  const { user, loading: authLoading, login, verifyTwoFactor } = useAuth();
   const { health } = useHealth(user, true);
   const [loginForm, setLoginForm] = useState({ username: "", password: "" });
   const [loginError, setLoginError] = useState("");
   const [loggingIn, setLoggingIn] = useState(false);
+  const [challenge, setChallenge] = useState(null);
+  const [code, setCode] = useState("");
+  const [sso, setSso] = useState(null);
+
+  useEffect(() => {
+    if (authLoading || user) return;
+    fetch(`${buildApiBase()}/api/oidc`, { credentials: "include" })
+      .then((res) => (res.ok ? res.json() : null))
+      .then((config) => setSso(config?.enabled ? config : null))
+      .catch(() => setSso(null));
+  }, [authLoading, user]);
+
+  const handleSso = () => {
+    const redirect = encodeURIComponent(window.location.href);
+    window.location.href = `${buildApiBase()}/api/oidc/login?redirect=${redirect}`;
+  };
 
   const handleLogin = async (e) => {
     e.preventDefault();
     setLoginError("");
     setLoggingIn(true);
     try {
-      await login(loginForm.username, loginForm.password);
+      const result = await login(loginForm.username, loginForm.password);
+      if (result?.twoFactorRequired) {
+        setChallenge(result.challenge);
+      }
       setLoginForm({ username: "", password: "" });
     } catch (err) {
       setLoginError(err.message);
@@ -30,6 +50,25 @@ export function AppLayout() {
     }
   };
 
+  const handleVerify = async (e) => {
+    e.preventDefault();
+    setLoginError("");
+    setLoggingIn(true);
+    try {
+      await verifyTwoFactor(challenge, code.trim());
+      setChallenge(null);
+      setCode("");
+    } catch (err) {
+      setLoginError(err.message);
+      // An expired challenge means starting over from the password step
+      if (err.message.includes("sign in again")) {
+        setChallenge(null);
+      }
+    } finally {
+      setLoggingIn(false);
+    }
+  };
+
   // Show login only after auth check confirms user is not logged in
   if (!authLoading && !user) {
     return (
@@ -42,35 +81,76 @@ export function AppLayout() {
             <CardTitle>Sign in to Edd Cloud</CardTitle>
           </CardHeader>
           <CardContent>
-            <form onSubmit={handleLogin} className="space-y-4">
-              <div className="space-y-2">
-                <Label htmlFor="login-username">Username</Label>
-                <Input
-                  id="login-username"
-                  type="text"
-                  value={loginForm.username}
-                  onChange={(e) => setLoginForm((p) => ({ ...p, username: e.target.value }))}
-                  autoComplete="username"
-                  autoFocus
-                />
-              </div>
-              <div className="space-y-2">
-                <Label htmlFor="login-password">Password</Label>
-                <Input
-                  id="login-password"
-                  type="password"
-                  value={loginForm.password}
-                  onChange={(e) => setLoginForm((p) => ({ ...p, password: e.target.value }))}
-                  autoComplete="current-password"
-                />
-              </div>
-              <Button type="submit" className="w-full" disabled={loggingIn}>
-                {loggingIn ? "Signing in..." : "Sign in"}
-              </Button>
-              {loginError && (
-                <p className="text-sm text-destructive text-center">{loginError}</p>
-              )}
-            </form>
+            {challenge ? (
+              <form onSubmit={handleVerify} className="space-y-4">
+                <div className="space-y-2">
+                  <Label htmlFor="login-code">Authentication code</Label>
+                  <Input
+                    id="login-code"
+                    type="text"
+                    inputMode="numeric"
+                    value={code}
+                    onChange={(e) => setCode(e.target.value)}
+                    autoComplete="one-time-code"
+                    placeholder="123456 or recovery code"
+                    autoFocus
+                  />
+                </div>
+                <Button type="submit" className="w-full" disabled={loggingIn || !code.trim()}>
+                  {loggingIn ? "Verifying..." : "Verify"}
+                </Button>
+                <Button
+                  type="button"
+                  variant="ghost"
+                  className="w-full"
+                  onClick={() => {
+                    setChallenge(null);
+                    setCode("");
+                    setLoginError("");
+                  }}
+                >
+                  Back
+                </Button>
+                {loginError && (
+                  <p className="text-sm text-destructive text-center">{loginError}</p>
+                )}
+              </form>
+            ) : (
+              <form onSubmit={handleLogin} className="space-y-4">
+                <div className="space-y-2">
+                  <Label htmlFor="login-username">Username</Label>
+                  <Input
+                    id="login-username"
+                    type="text"
+                    value={loginForm.username}
+                    onChange={(e) => setLoginForm((p) => ({ ...p, username: e.target.value }))}
+                    autoComplete="username"
+                    autoFocus
+                  />
+                </div>
+                <div className="space-y-2">
+                  <Label htmlFor="login-password">Password</Label>
+                  <Input
+                    id="login-password"
+                    type="password"
+                    value={loginForm.password}
+                    onChange={(e) => setLoginForm((p) => ({ ...p, password: e.target.value }))}
+                    autoComplete="current-password"
+                  />
+                </div>
+                <Button type="submit" className="w-full" disabled={loggingIn}>
+                  {loggingIn ? "Signing in..." : "Sign in"}
+                </Button>
+                {sso && (
+                  <Button type="button" variant="outline" className="w-full" onClick={handleSso}>
+                    Sign in with {sso.name}
+                  </Button>
+                )}
+                {loginError && (
+                  <p className="text-sm text-destructive text-center">{loginError}</p>
+                )}
+              </form>
+            )}
           </CardContent>
         </Card>
       </div>
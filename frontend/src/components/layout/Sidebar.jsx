@@ -11,12 +11,12 @@ import { StatusDot } from "@/components/common";
 
 export function Sidebar({ healthOk = true }) {
   const location = useLocation();
-  const { user, displayName, isAdmin, login, logout } = useAuth();
+  const { user, displayName, roles, login, logout } = useAuth();
   const [loginForm, setLoginForm] = useState({ username: "", password: "" });
   const [loginError, setLoginError] = useState("");
   const [loggingIn, setLoggingIn] = useState(false);
 
-  const navItems = isAdmin ? [...NAV_ITEMS, ADMIN_NAV_ITEM] : NAV_ITEMS;
+  const navItems = roles.length > 0 ? [...NAV_ITEMS, ADMIN_NAV_ITEM] : NAV_ITEMS;
 
   const handleLogin = async (e) => {
     e.preventDefault();
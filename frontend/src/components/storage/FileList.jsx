@@ -43,6 +43,7 @@ export function FileList({
         const fileKey = `${file.namespace || "default"}:${file.name}`;
         const isDeleting = deleting[fileKey];
         const fileUrl = buildFileUrl(file.name);
+        const scanBlocked = file.scan_status === "pending" || file.scan_status === "infected";
 
         return (
           <div
@@ -51,17 +52,28 @@ export function FileList({
           >
             <div className="min-w-0 text-center">
               <span className="font-medium truncate block">{file.name}</span>
+              {scanBlocked && (
+                <span className="text-xs text-muted-foreground">
+                  {file.scan_status === "pending" ? "Scanning for malware" : "Quarantined"}
+                </span>
+              )}
             </div>
             <div className="flex justify-center min-w-0">
               <CopyableText text={fileUrl} mono className="text-xs truncate" />
             </div>
-            <div className="text-sm text-muted-foreground text-center">{formatBytes(file.size)}</div>
+            <div
+              className="text-sm text-muted-foreground text-center"
+              title={file.encoding ? `${formatBytes(file.stored_size)} stored (${file.encoding})` : undefined}
+            >
+              {formatBytes(file.size)}
+            </div>
             <div className="text-sm text-muted-foreground text-center">{formatTimestamp(file.modified)}</div>
             <div className="flex gap-2 justify-center">
               <Button
                 variant="ghost"
                 size="sm"
                 onClick={() => onDownload?.(file)}
+                disabled={scanBlocked}
                 className="text-primary hover:text-primary hover:bg-primary/10"
               >
                 <Download className="w-4 h-4" />
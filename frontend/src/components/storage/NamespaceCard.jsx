@@ -1,4 +1,5 @@
 import { cn } from "@/lib/utils";
+import { formatBytes } from "@/lib/formatters";
 import { FolderOpen } from "lucide-react";
 
 export function NamespaceCard({
@@ -29,6 +30,8 @@ export function NamespaceCard({
       </div>
       <p className="text-xs text-muted-foreground">
         {namespace.count} {namespace.count === 1 ? "file" : "files"}
+        {namespace.bytes > 0 && ` · ${formatBytes(namespace.logical_bytes || namespace.bytes)}`}
+        {namespace.logical_bytes > namespace.bytes && ` (${formatBytes(namespace.bytes)} stored)`}
       </p>
     </div>
   );
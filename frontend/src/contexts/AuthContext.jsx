@@ -1,5 +1,5 @@
-import { createContext, useContext, useEffect, useState } from "react";
-import { buildApiBase } from "@/lib/api";
+import { createContext, useContext, useEffect, useRef, useState } from "react";
+import { buildApiBase, setCsrfToken } from "@/lib/api";
 import { clearAllCaches } from "@/lib/cache";
 
 const AuthContext = createContext();
@@ -8,7 +8,27 @@ export function AuthProvider({ children }) {
   const [user, setUser] = useState(null);
   const [displayName, setDisplayName] = useState(null);
   const [isAdmin, setIsAdmin] = useState(false);
+  const [roles, setRoles] = useState([]);
   const [loading, setLoading] = useState(true);
+  const refreshTimer = useRef(null);
+
+  // Compute verifies short-lived access tokens (set as a cookie by
+  // /api/token); renew one a minute before it expires while signed in.
+  const refreshAccessToken = async () => {
+    clearTimeout(refreshTimer.current);
+    try {
+      const response = await fetch(`${buildApiBase()}/api/token`, {
+        method: "POST",
+        credentials: "include",
+      });
+      if (!response.ok) return;
+      const payload = await response.json();
+      const delay = Math.max(payload.expires_at * 1000 - Date.now() - 60000, 10000);
+      refreshTimer.current = setTimeout(refreshAccessToken, delay);
+    } catch (err) {
+      refreshTimer.current = setTimeout(refreshAccessToken, 30000);
+    }
+  };
 
   const checkSession = async () => {
     try {
@@ -19,16 +39,21 @@ export function AuthProvider({ children }) {
         setUser(null);
         setDisplayName(null);
         setIsAdmin(false);
+        setRoles([]);
         return;
       }
       const payload = await response.json();
       setUser(payload.username);
       setDisplayName(payload.display_name || payload.username);
       setIsAdmin(payload.is_admin || false);
+      setRoles(payload.roles || []);
+      setCsrfToken(payload.csrf_token);
+      refreshAccessToken();
     } catch (err) {
       setUser(null);
       setDisplayName(null);
       setIsAdmin(false);
+      setRoles([]);
     } finally {
       setLoading(false);
     }
@@ -36,6 +61,7 @@ export function AuthProvider({ children }) {
 
   useEffect(() => {
     checkSession();
+    return () => clearTimeout(refreshTimer.current);
   }, []);
 
   const login = async (username, password) => {
@@ -49,6 +75,29 @@ export function AuthProvider({ children }) {
       const error = await response.text();
       throw new Error(error || "Login failed");
     }
+    const payload = await response.json();
+    if (payload.two_factor_required) {
+      return { twoFactorRequired: true, challenge: payload.challenge };
+    }
+    await checkSession();
+    return true;
+  };
+
+  const verifyTwoFactor = async (challenge, code) => {
+    // Recovery codes contain a dash; authenticator codes are digits only
+    const isRecovery = code.includes("-");
+    const response = await fetch(`${buildApiBase()}/api/login/2fa`, {
+      method: "POST",
+      headers: { "Content-Type": "application/json" },
+      credentials: "include",
+      body: JSON.stringify(
+        isRecovery ? { challenge, recovery_code: code } : { challenge, code }
+      ),
+    });
+    if (!response.ok) {
+      const error = await response.text();
+      throw new Error(error || "Verification failed");
+    }
     await checkSession();
     return true;
   };
@@ -65,15 +114,25 @@ export function AuthProvider({ children }) {
     setUser(null);
     setDisplayName(null);
     setIsAdmin(false);
+    setRoles([]);
+    setCsrfToken(null);
+    clearTimeout(refreshTimer.current);
     clearAllCaches();
   };
 
+  // admin implies every other role
+  const hasRole = (...wanted) =>
+    roles.includes("admin") || wanted.some((role) => roles.includes(role));
+
   const value = {
     user,
     displayName,
     isAdmin,
+    roles,
+    hasRole,
     loading,
     login,
+    verifyTwoFactor,
     logout,
     checkSession,
   };
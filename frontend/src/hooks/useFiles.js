@@ -1,5 +1,5 @@
 import { useState, useCallback, useRef } from "react";
-import { buildApiBase, buildWsUrl, createTransferId, waitForSocket } from "@/lib/api";
+import { buildApiBase, createTransferId, openProgressSocket } from "@/lib/api";
 import { DEFAULT_NAMESPACE } from "@/lib/constants";
 import { registerCacheClear } from "@/lib/cache";
 
@@ -74,31 +74,24 @@ export function useFiles() {
     const formData = new FormData();
     formData.append("file", file);
     const transferId = createTransferId();
-    const socket = new WebSocket(buildWsUrl(transferId));
+    const progress = openProgressSocket(transferId, (payload) => {
+      if (payload.direction !== "upload") return;
+      setUploadProgress((prev) => ({
+        ...prev,
+        bytes: payload.bytes ?? prev.bytes,
+        total: payload.total ?? prev.total,
+      }));
+      if (payload.done) {
+        setUploadProgress((prev) => ({ ...prev, active: false }));
+        progress.close();
+      }
+    });
 
     try {
       setUploading(true);
       setUploadProgress({ bytes: 0, total: file.size, active: true });
       setStatus("Uploading...");
 
-      socket.onmessage = (event) => {
-        try {
-          const payload = JSON.parse(event.data);
-          if (payload.direction !== "upload") return;
-          setUploadProgress((prev) => ({
-            ...prev,
-            bytes: payload.bytes ?? prev.bytes,
-            total: payload.total ?? prev.total,
-          }));
-          if (payload.done) {
-            setUploadProgress((prev) => ({ ...prev, active: false }));
-            socket.close();
-          }
-        } catch (err) {
-          console.warn("Failed to parse upload progress", err);
-        }
-      };
-
       // Start fetch immediately (don't wait for WebSocket) - browser can prepare upload while WS connects
       const url = `${buildApiBase()}/storage/upload?id=${encodeURIComponent(transferId)}&namespace=${encodeURIComponent(namespace)}${overwrite ? "&overwrite=true" : ""}`;
       const response = await fetch(url, {
@@ -113,9 +106,12 @@ export function useFiles() {
         if (response.status === 409) {
           setStatus("");
           setUploading(false);
-          socket.close();
+          progress.close();
           return { success: false, fileExists: true, fileName: file.name };
         }
+        if (response.status === 503) {
+          throw new Error("The server is restarting. Try the upload again in a moment.");
+        }
         throw new Error(message || "Upload failed");
       }
       await response.json();
@@ -130,41 +126,35 @@ export function useFiles() {
       return { success: false };
     } finally {
       setUploading(false);
-      socket.close();
+      progress.close();
     }
   }, [loadFiles]);
 
   const downloadFile = useCallback(async (file, user) => {
     const transferId = createTransferId();
-    let socket;
+    let progress;
     const fileKey = `${file.namespace || DEFAULT_NAMESPACE}:${file.name}`;
 
     if (user) {
-      socket = new WebSocket(buildWsUrl(transferId));
       setDownloadProgress((prev) => ({
         ...prev,
         [fileKey]: { bytes: 0, total: file.size, active: true },
       }));
 
-      socket.onmessage = (event) => {
-        try {
-          const payload = JSON.parse(event.data);
-          if (payload.direction !== "download") return;
-          setDownloadProgress((prev) => ({
-            ...prev,
-            [fileKey]: {
-              bytes: payload.bytes ?? prev[fileKey]?.bytes ?? 0,
-              total: payload.total ?? prev[fileKey]?.total ?? file.size,
-              active: !payload.done,
-            },
-          }));
-          if (payload.done) socket.close();
-        } catch (err) {
-          console.warn("Failed to parse download progress", err);
-        }
-      };
+      progress = openProgressSocket(transferId, (payload) => {
+        if (payload.direction !== "download") return;
+        setDownloadProgress((prev) => ({
+          ...prev,
+          [fileKey]: {
+            bytes: payload.bytes ?? prev[fileKey]?.bytes ?? 0,
+            total: payload.total ?? prev[fileKey]?.total ?? file.size,
+            active: !payload.done,
+          },
+        }));
+        if (payload.done) progress.close();
+      });
 
-      await waitForSocket(socket, 2000).catch(() => {});
+      await progress.ready(2000).catch(() => {});
     }
 
     const link = document.createElement("a");
@@ -174,7 +164,7 @@ export function useFiles() {
     document.body.appendChild(link);
     link.click();
     document.body.removeChild(link);
-    if (socket) socket.close();
+    if (progress) progress.close();
   }, []);
 
   const deleteFile = useCallback(async (file, namespace, onComplete) => {
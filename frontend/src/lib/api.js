@@ -11,6 +11,37 @@ export function buildApiBase() {
   return `${window.location.protocol}//${resolveApiHost()}`;
 }
 
+let csrfToken = null;
+
+// setCsrfToken stores the token returned by /api/session
+export function setCsrfToken(token) {
+  csrfToken = token || null;
+}
+
+function readCsrfCookie() {
+  const match = document.cookie.match(/(?:^|;\s*)sfs_csrf=([^;]*)/);
+  return match ? decodeURIComponent(match[1]) : null;
+}
+
+// installCsrfFetch makes every mutating request to the API carry the
+// X-CSRF-Token header the backends require alongside the session cookie.
+export function installCsrfFetch() {
+  const nativeFetch = window.fetch.bind(window);
+  window.fetch = (input, init = {}) => {
+    const url = typeof input === "string" ? input : input.url;
+    const method = (init.method || input.method || "GET").toUpperCase();
+    if (!["GET", "HEAD", "OPTIONS"].includes(method) && url.startsWith(buildApiBase())) {
+      const token = readCsrfCookie() || csrfToken;
+      if (token) {
+        const headers = new Headers(init.headers || (typeof input === "string" ? undefined : input.headers));
+        headers.set("X-CSRF-Token", token);
+        init = { ...init, headers };
+      }
+    }
+    return nativeFetch(input, init);
+  };
+}
+
 export function buildWsBase() {
   const protocol = window.location.protocol === "https:" ? "wss" : "ws";
   return `${protocol}://${resolveApiHost()}`;
@@ -52,6 +83,39 @@ export function waitForSocket(socket, timeoutMs = 1000) {
   });
 }
 
+// openProgressSocket follows a transfer's progress over /ws. When the server
+// asks clients to reconnect (it is restarting), the socket is reopened.
+export function openProgressSocket(id, onProgress) {
+  let socket;
+  let closed = false;
+  const connect = () => {
+    socket = new WebSocket(buildWsUrl(id));
+    socket.onmessage = (event) => {
+      let payload;
+      try {
+        payload = JSON.parse(event.data);
+      } catch (err) {
+        console.warn("Failed to parse transfer progress", err);
+        return;
+      }
+      if (payload.reconnect) {
+        socket.close();
+        if (!closed) setTimeout(connect, 1000);
+        return;
+      }
+      onProgress(payload);
+    };
+  };
+  connect();
+  return {
+    ready: (timeoutMs) => waitForSocket(socket, timeoutMs),
+    close: () => {
+      closed = true;
+      socket.close();
+    },
+  };
+}
+
 export function copyToClipboard(text, showToast = true) {
   navigator.clipboard.writeText(text).then(() => {
     if (showToast) {
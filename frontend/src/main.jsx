@@ -1,8 +1,10 @@
 import React from "react";
 import ReactDOM from "react-dom/client";
 import App from "./App.jsx";
+import { installCsrfFetch } from "./lib/api";
 import "./styles/globals.css";
 
 window.BUILD_INFO = window.BUILD_INFO || { commit: "dev", time: "" };
+installCsrfFetch();
 
 ReactDOM.createRoot(document.getElementById("root")).render(<App />);
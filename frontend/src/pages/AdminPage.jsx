@@ -8,12 +8,16 @@ import { TextSkeleton } from "@/components/ui/skeleton";
 import { StatusBadge, CopyableText, Modal } from "@/components/common";
 import { TAB_COPY } from "@/lib/constants";
 import { buildApiBase } from "@/lib/api";
+import { formatBytes } from "@/lib/formatters";
 import { useAuth } from "@/contexts/AuthContext";
 import { Trash2, UserPlus, Eye, EyeOff } from "lucide-react";
 
 export function AdminPage() {
   const copy = TAB_COPY.admin;
-  const { user, isAdmin } = useAuth();
+  const { user, roles, hasRole } = useAuth();
+  // Any role opens the page; each section is shown to the roles that can read it
+  const canView = roles.length > 0;
+  const isAdmin = hasRole();
   const [containers, setContainers] = useState([]);
   const [users, setUsers] = useState([]);
   const [namespaces, setNamespaces] = useState([]);
@@ -34,7 +38,7 @@ export function AdminPage() {
   };
 
   const loadData = async () => {
-    if (!isAdmin) return;
+    if (!canView) return;
     setLoading(true);
     setError("");
     try {
@@ -67,7 +71,7 @@ export function AdminPage() {
 
   useEffect(() => {
     loadData();
-  }, [isAdmin]);
+  }, [canView]);
 
   const handleCreateUser = async (e) => {
     e.preventDefault();
@@ -116,7 +120,7 @@ export function AdminPage() {
     }
   };
 
-  if (!isAdmin) {
+  if (!canView) {
     return (
       <div>
         <Header eyebrow={copy.eyebrow} title={copy.title} description={copy.lead} />
@@ -171,10 +175,12 @@ export function AdminPage() {
       <Card className="mb-6">
         <CardHeader className="flex flex-row items-center justify-between space-y-0">
           <CardTitle>Users</CardTitle>
-          <Button variant="outline" onClick={() => setShowCreateUserModal(true)}>
-            <UserPlus className="w-4 h-4 mr-2" />
-            Add User
-          </Button>
+          {isAdmin && (
+            <Button variant="outline" onClick={() => setShowCreateUserModal(true)}>
+              <UserPlus className="w-4 h-4 mr-2" />
+              Add User
+            </Button>
+          )}
         </CardHeader>
         <CardContent>
           {error && <p className="text-destructive text-sm mb-4">{error}</p>}
@@ -187,16 +193,17 @@ export function AdminPage() {
           ) : (
             <div className="space-y-2">
               {/* Header - hidden on mobile */}
-              <div className="hidden sm:grid sm:grid-cols-[1fr_2fr_2fr_80px] gap-4 px-4 py-2 text-xs font-semibold uppercase tracking-wider text-muted-foreground">
+              <div className="hidden sm:grid sm:grid-cols-[1fr_2fr_2fr_2fr_80px] gap-4 px-4 py-2 text-xs font-semibold uppercase tracking-wider text-muted-foreground">
                 <div className="text-center">ID</div>
                 <div className="text-center">Display Name</div>
                 <div className="text-center">Username</div>
+                <div className="text-center">Roles</div>
                 <div className="text-center">Actions</div>
               </div>
               {users.map((u) => (
                 <div
                   key={u.id}
-                  className="flex flex-col sm:grid sm:grid-cols-[1fr_2fr_2fr_80px] gap-2 sm:gap-4 px-4 py-3 bg-secondary rounded-md sm:items-center"
+                  className="flex flex-col sm:grid sm:grid-cols-[1fr_2fr_2fr_2fr_80px] gap-2 sm:gap-4 px-4 py-3 bg-secondary rounded-md sm:items-center"
                 >
                   <div className="flex justify-between sm:justify-center">
                     <span className="text-xs text-muted-foreground sm:hidden">ID:</span>
@@ -210,15 +217,23 @@ export function AdminPage() {
                     <span className="text-xs text-muted-foreground sm:hidden">Username:</span>
                     <span className="text-muted-foreground truncate">{u.username}</span>
                   </div>
+                  <div className="flex justify-between sm:block sm:text-center">
+                    <span className="text-xs text-muted-foreground sm:hidden">Roles:</span>
+                    <span className="text-sm text-muted-foreground truncate">
+                      {u.roles?.length ? u.roles.join(", ") : "—"}
+                    </span>
+                  </div>
                   <div className="flex justify-center">
-                    <Button
-                      variant="ghost"
-                      size="sm"
-                      className="text-destructive hover:text-destructive hover:bg-destructive/10"
-                      onClick={() => handleDeleteUser(u.id)}
-                    >
-                      <Trash2 className="w-4 h-4" />
-                    </Button>
+                    {isAdmin && (
+                      <Button
+                        variant="ghost"
+                        size="sm"
+                        className="text-destructive hover:text-destructive hover:bg-destructive/10"
+                        onClick={() => handleDeleteUser(u.id)}
+                      >
+                        <Trash2 className="w-4 h-4" />
+                      </Button>
+                    )}
                   </div>
                 </div>
               ))}
@@ -311,7 +326,12 @@ export function AdminPage() {
                   </div>
                   <div className="flex justify-between sm:block sm:text-center">
                     <span className="text-xs text-muted-foreground sm:hidden">Files:</span>
-                    <span className="text-muted-foreground">{ns.count}</span>
+                    <span className="text-muted-foreground">
+                      {ns.count}
+                      {ns.bytes > 0 && ` (${formatBytes(ns.logical_bytes || ns.bytes)}`}
+                      {ns.logical_bytes > ns.bytes && `, ${formatBytes(ns.bytes)} stored`}
+                      {ns.bytes > 0 && ")"}
+                    </span>
                   </div>
                   <div className="flex justify-between sm:justify-center items-center">
                     <span className="text-xs text-muted-foreground sm:hidden">Visibility:</span>
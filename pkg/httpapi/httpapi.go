@@ -0,0 +1,168 @@
+// Package httpapi holds the pieces the versioned service APIs share: request
+// IDs and the JSON error envelope
+//
+//	{"error": {"code": "not_found", "message": "...", "request_id": "...", "details": ...}}
+//
+// Handlers keep calling http.Error; ErrorWriter rewrites those plain-text
+// error responses, and any other error that isn't JSON already, into the
+// envelope, so legacy and versioned routes can share handlers.
+package httpapi
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// RequestIDHeader carries the request ID in both directions.
+const RequestIDHeader = "X-Request-ID"
+
+type requestIDKey struct{}
+
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// TagRequest gives the request an ID, reusing a sane X-Request-ID set by the
+// proxy or client, and echoes it in the response.
+func TagRequest(w http.ResponseWriter, r *http.Request) *http.Request {
+	id := r.Header.Get(RequestIDHeader)
+	if !validRequestID.MatchString(id) {
+		buf := make([]byte, 12)
+		_, _ = rand.Read(buf)
+		id = hex.EncodeToString(buf)
+	}
+	w.Header().Set(RequestIDHeader, id)
+	return r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id))
+}
+
+// WithRequestID runs TagRequest ahead of next.
+func WithRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, TagRequest(w, r))
+	})
+}
+
+// RequestID returns the ID TagRequest assigned, or "".
+func RequestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDKey{}).(string)
+	return id
+}
+
+// Error is the body of the envelope.
+type Error struct {
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	RequestID string `json:"request_id,omitempty"`
+	Details   any    `json:"details,omitempty"`
+}
+
+// ErrorCode derives the envelope code from the status: 404 -> "not_found".
+func ErrorCode(status int) string {
+	text := http.StatusText(status)
+	if text == "" {
+		return "error"
+	}
+	return strings.NewReplacer(" ", "_", "-", "_", "'", "").Replace(strings.ToLower(text))
+}
+
+// WriteError writes an error envelope.
+func WriteError(w http.ResponseWriter, r *http.Request, status int, message string, details any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(map[string]Error{"error": {
+		Code:      ErrorCode(status),
+		Message:   message,
+		RequestID: RequestID(r),
+		Details:   details,
+	}}); err != nil {
+		slog.Error("failed to encode error response", "error", err)
+	}
+}
+
+// ErrorWriter buffers error bodies that aren't JSON and re-emits them as an
+// envelope when Finish is called once the handler returns. Plain-text bodies,
+// like those http.Error writes, become the message; anything else, such as an
+// HTML error page, is replaced by the status text. Everything else passes
+// straight through.
+type ErrorWriter struct {
+	http.ResponseWriter
+	r           *http.Request
+	wroteHeader bool
+	status      int // set while capturing an error body
+	plain       bool
+	body        bytes.Buffer
+}
+
+// NewErrorWriter wraps w for a request to r.
+func NewErrorWriter(w http.ResponseWriter, r *http.Request) *ErrorWriter {
+	return &ErrorWriter{ResponseWriter: w, r: r}
+}
+
+func (w *ErrorWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	contentType := w.Header().Get("Content-Type")
+	if status >= 400 && !strings.HasPrefix(contentType, "application/json") {
+		w.status = status
+		w.plain = strings.HasPrefix(contentType, "text/plain")
+		return
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *ErrorWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.status != 0 {
+		return w.body.Write(p)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// Finish writes the envelope for a captured error.
+func (w *ErrorWriter) Finish() {
+	if w.status == 0 {
+		return
+	}
+	w.Header().Del("Content-Length")
+	w.Header().Del("Content-Disposition")
+	message := strings.TrimSpace(w.body.String())
+	if !w.plain || message == "" {
+		message = strings.ToLower(http.StatusText(w.status))
+	}
+	WriteError(w.ResponseWriter, w.r, w.status, message, nil)
+}
+
+func (w *ErrorWriter) Flush() {
+	if w.status != 0 {
+		return
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack lets WebSocket upgrades through the wrapper.
+func (w *ErrorWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("hijacking not supported")
+	}
+	return hj.Hijack()
+}
+
+func (w *ErrorWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,89 @@
+package httpapi
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func serve(r *http.Request, h http.HandlerFunc) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	WithRequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ew := NewErrorWriter(w, r)
+		defer ew.Finish()
+		h(ew, r)
+	})).ServeHTTP(rec, r)
+	return rec
+}
+
+func TestErrorWriterEnvelope(t *testing.T) {
+	r := httptest.NewRequest("GET", "/x", nil)
+	r.Header.Set(RequestIDHeader, "req-1")
+	rec := serve(r, func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "file not found", http.StatusNotFound)
+	})
+
+	if rec.Code != http.StatusNotFound || rec.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("status %d, content type %q", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	var body map[string]Error
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("body %q: %v", rec.Body, err)
+	}
+	want := Error{Code: "not_found", Message: "file not found", RequestID: "req-1"}
+	if body["error"] != want {
+		t.Fatalf("error = %+v, want %+v", body["error"], want)
+	}
+}
+
+func TestErrorWriterReplacesHTML(t *testing.T) {
+	rec := serve(httptest.NewRequest("GET", "/x", nil), func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("<html>nope</html>"))
+	})
+	var body map[string]Error
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("body %q: %v", rec.Body, err)
+	}
+	if rec.Code != http.StatusForbidden || body["error"].Code != "forbidden" || body["error"].Message != "forbidden" {
+		t.Fatalf("status %d, body %q", rec.Code, rec.Body)
+	}
+}
+
+func TestErrorWriterPassthrough(t *testing.T) {
+	rec := serve(httptest.NewRequest("GET", "/x", nil), func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte(`{"custom":true}`))
+	})
+	if rec.Code != http.StatusConflict || rec.Body.String() != `{"custom":true}` {
+		t.Fatalf("status %d, body %q", rec.Code, rec.Body)
+	}
+	if id := rec.Header().Get(RequestIDHeader); len(id) != 24 {
+		t.Fatalf("generated request id %q", id)
+	}
+}
+
+func TestRequestIDRejectsJunk(t *testing.T) {
+	r := httptest.NewRequest("GET", "/x", nil)
+	r.Header.Set(RequestIDHeader, "bad id\n")
+	rec := serve(r, func(w http.ResponseWriter, r *http.Request) {})
+	if id := rec.Header().Get(RequestIDHeader); id == "bad id\n" || id == "" {
+		t.Fatalf("request id %q", id)
+	}
+}
+
+func TestErrorCode(t *testing.T) {
+	for status, want := range map[int]string{
+		http.StatusNotFound:              "not_found",
+		http.StatusRequestEntityTooLarge: "request_entity_too_large",
+		http.StatusTeapot:                "im_a_teapot",
+		599:                              "error",
+	} {
+		if got := ErrorCode(status); got != want {
+			t.Errorf("ErrorCode(%d) = %q, want %q", status, got, want)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+// Package metrics holds the Prometheus plumbing the services share: the
+// /metrics handler and per-route HTTP request metrics. Services register
+// their own metrics with promauto against the default registry.
+package metrics
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// DefaultBuckets covers request latencies from 5ms to a minute.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60}
+
+// Handler serves the default registry.
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// Since observes the seconds elapsed since start.
+func Since(o prometheus.Observer, start time.Time) {
+	o.Observe(time.Since(start).Seconds())
+}
+
+// HTTPMetrics counts requests and their latency by route, method and status.
+// Routes are mux patterns, so the label stays bounded.
+type HTTPMetrics struct {
+	requests *prometheus.CounterVec
+	duration *prometheus.HistogramVec
+}
+
+// NewHTTPMetrics registers <prefix>_http_requests_total and
+// <prefix>_http_request_duration_seconds.
+func NewHTTPMetrics(prefix string) *HTTPMetrics {
+	return &HTTPMetrics{
+		requests: promauto.NewCounterVec(prometheus.CounterOpts{
+			Name: prefix + "_http_requests_total",
+			Help: "HTTP requests by route, method and status.",
+		}, []string{"route", "method", "status"}),
+		duration: promauto.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    prefix + "_http_request_duration_seconds",
+			Help:    "HTTP request latency by route and method, excluding WebSocket sessions.",
+			Buckets: DefaultBuckets,
+		}, []string{"route", "method"}),
+	}
+}
+
+// Observe records a request served through rec.
+func (m *HTTPMetrics) Observe(rec *StatusRecorder, r *http.Request, route string, start time.Time) {
+	if route == "" {
+		route = "other"
+	}
+	status := rec.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	method := methodLabel(r.Method)
+	m.requests.WithLabelValues(route, method, strconv.Itoa(status)).Inc()
+	if status != http.StatusSwitchingProtocols {
+		Since(m.duration.WithLabelValues(route, method), start)
+	}
+}
+
+// Instrument wraps mux, labelling each request with the pattern it matched.
+func (m *HTTPMetrics) Instrument(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &StatusRecorder{ResponseWriter: w}
+		// ServeMux sets Pattern on the request it dispatches.
+		mux.ServeHTTP(rec, r)
+		m.Observe(rec, r, r.Pattern, start)
+	})
+}
+
+// methodLabel keeps arbitrary client-chosen methods out of the label set.
+func methodLabel(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut,
+		http.MethodPatch, http.MethodDelete, http.MethodOptions:
+		return method
+	}
+	return "other"
+}
+
+// StatusRecorder captures the response status. A hijacked connection counts
+// as 101 Switching Protocols.
+type StatusRecorder struct {
+	http.ResponseWriter
+	Status int
+}
+
+func (w *StatusRecorder) WriteHeader(status int) {
+	if w.Status == 0 {
+		w.Status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *StatusRecorder) Write(p []byte) (int, error) {
+	if w.Status == 0 {
+		w.Status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *StatusRecorder) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *StatusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("hijacking not supported")
+	}
+	w.Status = http.StatusSwitchingProtocols
+	return hj.Hijack()
+}
+
+func (w *StatusRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,33 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestInstrument(t *testing.T) {
+	m := NewHTTPMetrics("test")
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /files/{name}", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "missing", http.StatusNotFound)
+	})
+	h := m.Instrument(mux)
+
+	for _, target := range []string{"/files/a", "/files/b", "/nowhere"} {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", target, nil))
+	}
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("PROPFIND", "/files/a", nil))
+
+	if got := testutil.ToFloat64(m.requests.WithLabelValues("GET /files/{name}", "GET", "404")); got != 2 {
+		t.Errorf("routed requests = %v, want 2", got)
+	}
+	if got := testutil.ToFloat64(m.requests.WithLabelValues("other", "GET", "404")); got != 1 {
+		t.Errorf("unrouted requests = %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(m.requests.WithLabelValues("other", "other", "405")); got != 1 {
+		t.Errorf("unknown method requests = %v, want 1", got)
+	}
+}
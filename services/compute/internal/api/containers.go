@@ -9,6 +9,7 @@ import (
 	"strings"
 	"time"
 
+	"eddisonso.com/edd-cloud/pkg/metrics"
 	"eddisonso.com/edd-cloud/services/compute/internal/db"
 	"github.com/google/uuid"
 )
@@ -105,7 +106,7 @@ func (h *Handler) CreateContainer(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	if count >= maxContainersPerUser {
-		writeError(w, fmt.Sprintf("container limit reached (%d)", maxContainersPerUser), http.StatusBadRequest)
+		writeError(w, fmt.Sprintf("container limit reached (%d)", maxContainersPerUser), http.StatusConflict)
 		return
 	}
 
@@ -186,7 +187,9 @@ func (h *Handler) provisionContainer(container *db.Container, sshKeys []*db.SSHK
 	}
 
 	// Create namespace
-	if err := h.k8s.CreateNamespace(ctx, container.Namespace, container.UserID, container.ID); err != nil {
+	if err := provisionStep("namespace", func() error {
+		return h.k8s.CreateNamespace(ctx, container.Namespace, container.UserID, container.ID)
+	}); err != nil {
 		slog.Error("failed to create namespace", "container", container.ID, "error", err)
 		h.db.UpdateContainerStatus(container.ID, "failed")
 		GetHub().SendContainerStatus(container.UserID, container.ID, "failed", nil)
@@ -194,7 +197,9 @@ func (h *Handler) provisionContainer(container *db.Container, sshKeys []*db.SSHK
 	}
 
 	// Create SSH secret
-	if err := h.k8s.CreateSSHSecret(ctx, container.Namespace, authorizedKeys.String()); err != nil {
+	if err := provisionStep("ssh_secret", func() error {
+		return h.k8s.CreateSSHSecret(ctx, container.Namespace, authorizedKeys.String())
+	}); err != nil {
 		slog.Error("failed to create ssh secret", "container", container.ID, "error", err)
 		h.db.UpdateContainerStatus(container.ID, "failed")
 		GetHub().SendContainerStatus(container.UserID, container.ID, "failed", nil)
@@ -202,7 +207,9 @@ func (h *Handler) provisionContainer(container *db.Container, sshKeys []*db.SSHK
 	}
 
 	// Create PVC
-	if err := h.k8s.CreatePVC(ctx, container.Namespace, container.StorageGB); err != nil {
+	if err := provisionStep("pvc", func() error {
+		return h.k8s.CreatePVC(ctx, container.Namespace, container.StorageGB)
+	}); err != nil {
 		slog.Error("failed to create pvc", "container", container.ID, "error", err)
 		h.db.UpdateContainerStatus(container.ID, "failed")
 		GetHub().SendContainerStatus(container.UserID, container.ID, "failed", nil)
@@ -210,7 +217,9 @@ func (h *Handler) provisionContainer(container *db.Container, sshKeys []*db.SSHK
 	}
 
 	// Create NetworkPolicy
-	if err := h.k8s.CreateNetworkPolicy(ctx, container.Namespace); err != nil {
+	if err := provisionStep("network_policy", func() error {
+		return h.k8s.CreateNetworkPolicy(ctx, container.Namespace)
+	}); err != nil {
 		slog.Error("failed to create network policy", "container", container.ID, "error", err)
 		h.db.UpdateContainerStatus(container.ID, "failed")
 		GetHub().SendContainerStatus(container.UserID, container.ID, "failed", nil)
@@ -218,7 +227,9 @@ func (h *Handler) provisionContainer(container *db.Container, sshKeys []*db.SSHK
 	}
 
 	// Create Pod
-	if err := h.k8s.CreatePod(ctx, container.Namespace, container.Image, container.MemoryMB); err != nil {
+	if err := provisionStep("pod", func() error {
+		return h.k8s.CreatePod(ctx, container.Namespace, container.Image, container.MemoryMB)
+	}); err != nil {
 		slog.Error("failed to create pod", "container", container.ID, "error", err)
 		h.db.UpdateContainerStatus(container.ID, "failed")
 		GetHub().SendContainerStatus(container.UserID, container.ID, "failed", nil)
@@ -226,7 +237,9 @@ func (h *Handler) provisionContainer(container *db.Container, sshKeys []*db.SSHK
 	}
 
 	// Create LoadBalancer service
-	if err := h.k8s.CreateLoadBalancer(ctx, container.Namespace); err != nil {
+	if err := provisionStep("load_balancer", func() error {
+		return h.k8s.CreateLoadBalancer(ctx, container.Namespace)
+	}); err != nil {
 		slog.Error("failed to create load balancer", "container", container.ID, "error", err)
 		h.db.UpdateContainerStatus(container.ID, "failed")
 		GetHub().SendContainerStatus(container.UserID, container.ID, "failed", nil)
@@ -249,6 +262,7 @@ func (h *Handler) pollContainerReady(container *db.Container) {
 	ticker := time.NewTicker(3 * time.Second)
 	defer ticker.Stop()
 
+	start := time.Now()
 	podReady := false
 	ipAssigned := false
 	var externalIP string
@@ -257,6 +271,12 @@ func (h *Handler) pollContainerReady(container *db.Container) {
 		select {
 		case <-ctx.Done():
 			slog.Warn("timeout waiting for container ready", "container", container.ID)
+			if !podReady {
+				metrics.Since(provisionStepDuration.WithLabelValues("pod_ready", "timeout"), start)
+			}
+			if !ipAssigned {
+				metrics.Since(provisionStepDuration.WithLabelValues("external_ip", "timeout"), start)
+			}
 			return
 		case <-ticker.C:
 			// Check pod status
@@ -269,10 +289,12 @@ func (h *Handler) pollContainerReady(container *db.Container) {
 
 				if status == "running" {
 					podReady = true
+					metrics.Since(provisionStepDuration.WithLabelValues("pod_ready", "ok"), start)
 					h.db.UpdateContainerStatus(container.ID, "running")
 					slog.Info("container running", "container", container.ID)
 					GetHub().SendContainerStatus(container.UserID, container.ID, "running", nil)
 				} else if status == "failed" {
+					metrics.Since(provisionStepDuration.WithLabelValues("pod_ready", "error"), start)
 					h.db.UpdateContainerStatus(container.ID, "failed")
 					GetHub().SendContainerStatus(container.UserID, container.ID, "failed", nil)
 					return
@@ -289,6 +311,7 @@ func (h *Handler) pollContainerReady(container *db.Container) {
 				if ip != "" {
 					ipAssigned = true
 					externalIP = ip
+					metrics.Since(provisionStepDuration.WithLabelValues("external_ip", "ok"), start)
 					if err := h.db.UpdateContainerIP(container.ID, ip); err != nil {
 						slog.Error("failed to update container ip", "container", container.ID, "error", err)
 					}
@@ -460,7 +483,9 @@ func (h *Handler) StartContainer(w http.ResponseWriter, r *http.Request) {
 	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
 	defer cancel()
 
-	if err := h.k8s.CreatePod(ctx, container.Namespace, container.Image, container.MemoryMB); err != nil {
+	if err := provisionStep("pod", func() error {
+		return h.k8s.CreatePod(ctx, container.Namespace, container.Image, container.MemoryMB)
+	}); err != nil {
 		slog.Error("failed to create pod", "error", err)
 		writeError(w, "failed to start container", http.StatusInternalServerError)
 		return
@@ -2,6 +2,8 @@ package api
 
 import (
 	"context"
+
+	"eddisonso.com/edd-cloud/services/compute/internal/auth"
 )
 
 type contextKey string
@@ -11,12 +13,14 @@ const userContextKey contextKey = "user"
 type userInfo struct {
 	UserID   int64
 	Username string
+	Roles    []string
 }
 
-func setUserContext(ctx context.Context, userID int64, username string) context.Context {
+func setUserContext(ctx context.Context, session *auth.Session) context.Context {
 	return context.WithValue(ctx, userContextKey, &userInfo{
-		UserID:   userID,
-		Username: username,
+		UserID:   session.UserID,
+		Username: session.Username,
+		Roles:    session.Roles,
 	})
 }
 
@@ -5,32 +5,40 @@ import (
 	"encoding/json"
 	"log/slog"
 	"net/http"
-	"os"
+	"strings"
 	"time"
 
+	"eddisonso.com/edd-cloud/pkg/httpapi"
+	"eddisonso.com/edd-cloud/pkg/metrics"
 	"eddisonso.com/edd-cloud/services/compute/internal/auth"
 	"eddisonso.com/edd-cloud/services/compute/internal/db"
 	"eddisonso.com/edd-cloud/services/compute/internal/k8s"
+	"github.com/gorilla/websocket"
 )
 
 type Handler struct {
 	db        *db.DB
 	k8s       *k8s.Client
+	tokens    *auth.TokenVerifier
 	validator *auth.SessionValidator
+	upgrader  *websocket.Upgrader
 	mux       *http.ServeMux
 }
 
-func NewHandler(database *db.DB, k8sClient *k8s.Client) http.Handler {
+func NewHandler(database *db.DB, k8sClient *k8s.Client, origins *auth.OriginPolicy) http.Handler {
 	h := &Handler{
 		db:        database,
 		k8s:       k8sClient,
+		tokens:    auth.NewTokenVerifier("http://simple-file-share-backend"),
 		validator: auth.NewSessionValidator("http://simple-file-share-backend"),
+		upgrader:  newUpgrader(origins),
 		mux:       http.NewServeMux(),
 	}
 
 	// Health check (both paths for internal probes and external ingress access)
 	h.mux.HandleFunc("GET /healthz", h.Healthz)
 	h.mux.HandleFunc("GET /compute/healthz", h.Healthz)
+	h.mux.Handle("GET /metrics", metrics.Handler())
 
 	// Container endpoints
 	h.mux.HandleFunc("GET /compute/containers", h.authMiddleware(h.ListContainers))
@@ -39,6 +47,7 @@ func NewHandler(database *db.DB, k8sClient *k8s.Client) http.Handler {
 	h.mux.HandleFunc("DELETE /compute/containers/{id}", h.authMiddleware(h.DeleteContainer))
 	h.mux.HandleFunc("POST /compute/containers/{id}/stop", h.authMiddleware(h.StopContainer))
 	h.mux.HandleFunc("POST /compute/containers/{id}/start", h.authMiddleware(h.StartContainer))
+	h.mux.HandleFunc("GET /compute/containers/{id}/logs", h.authMiddleware(h.GetContainerLogs))
 
 	// SSH key endpoints
 	h.mux.HandleFunc("GET /compute/ssh-keys", h.authMiddleware(h.ListSSHKeys))
@@ -61,30 +70,25 @@ func NewHandler(database *db.DB, k8sClient *k8s.Client) http.Handler {
 	h.mux.HandleFunc("DELETE /compute/containers/{id}/ingress/{port}", h.authMiddleware(h.RemoveIngressRule))
 
 	// Admin endpoints
-	h.mux.HandleFunc("GET /compute/admin/containers", h.adminMiddleware(h.AdminListContainers))
+	h.mux.HandleFunc("GET /compute/admin/containers", h.roleMiddleware(h.AdminListContainers, auth.RoleComputeAdmin, auth.RoleAuditor))
 
 	return h
 }
 
-var adminUsername = os.Getenv("ADMIN_USERNAME")
-
-// adminMiddleware validates session and checks admin status
-func (h *Handler) adminMiddleware(next http.HandlerFunc) http.HandlerFunc {
+// roleMiddleware validates session and requires admin or one of the roles
+func (h *Handler) roleMiddleware(next http.HandlerFunc, roles ...string) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		// Try all session tokens until one is valid
-		for _, token := range auth.GetSessionTokens(r) {
-			username, err := h.validator.ValidateSession(token)
-			if err != nil {
-				slog.Error("session validation failed", "error", err)
-				continue
-			}
-			if adminUsername != "" && username == adminUsername {
-				r = r.WithContext(setUserContext(r.Context(), 1, username))
-				next(w, r)
-				return
-			}
+		session := h.session(r)
+		if session == nil {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if !session.HasRole(roles...) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
 		}
-		http.Error(w, "forbidden", http.StatusForbidden)
+		r = r.WithContext(setUserContext(r.Context(), session))
+		next(w, r)
 	}
 }
 
@@ -148,7 +152,16 @@ func (h *Handler) AdminListContainers(w http.ResponseWriter, r *http.Request) {
 }
 
 func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	h.mux.ServeHTTP(w, r)
+	start := time.Now()
+	rec := &metrics.StatusRecorder{ResponseWriter: w}
+	r = httpapi.TagRequest(rec, r)
+	if r.URL.Path == v1Prefix || strings.HasPrefix(r.URL.Path, v1Prefix+"/") {
+		httpMetrics.Observe(rec, r, h.serveV1(rec, r), start)
+		return
+	}
+	// ServeMux sets Pattern on the request it dispatches
+	h.mux.ServeHTTP(rec, r)
+	httpMetrics.Observe(rec, r, r.Pattern, start)
 }
 
 func (h *Handler) Healthz(w http.ResponseWriter, r *http.Request) {
@@ -159,24 +172,38 @@ func (h *Handler) Healthz(w http.ResponseWriter, r *http.Request) {
 // authMiddleware validates session and injects user info into context
 func (h *Handler) authMiddleware(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		// Try all session tokens until one is valid
-		for _, token := range auth.GetSessionTokens(r) {
-			username, err := h.validator.ValidateSession(token)
-			if err != nil {
-				slog.Error("session validation failed", "error", err)
-				continue
-			}
-			if username != "" {
-				// For now, use username as user ID (simplified)
-				// In production, would lookup user ID from username
-				r = r.WithContext(setUserContext(r.Context(), 1, username))
-				next(w, r)
-				return
-			}
+		session := h.session(r)
+		if session == nil {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
 		}
+		r = r.WithContext(setUserContext(r.Context(), session))
+		next(w, r)
+	}
+}
 
-		http.Error(w, "unauthorized", http.StatusUnauthorized)
+// session verifies the request's access token locally. Clients without a
+// valid access token (e.g. sessions from before tokens existed) fall back to
+// asking SFS about their session cookie.
+func (h *Handler) session(r *http.Request) *auth.Session {
+	if token := auth.GetAccessToken(r); token != "" {
+		session, err := h.tokens.Verify(token)
+		if err == nil {
+			return session
+		}
+		slog.Debug("access token rejected", "error", err)
+	}
+	for _, token := range auth.GetSessionTokens(r) {
+		session, err := h.validator.ValidateSession(token)
+		if err != nil {
+			slog.Error("session validation failed", "error", err)
+			continue
+		}
+		if session != nil {
+			return session
+		}
 	}
+	return nil
 }
 
 func writeJSON(w http.ResponseWriter, data any) {
@@ -0,0 +1,86 @@
+package api
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const defaultLogTail = 100
+
+// GetContainerLogs streams a container's output as plain text. tail limits
+// the lines returned (-1 for the whole log) and follow keeps the response
+// open for new output
+func (h *Handler) GetContainerLogs(w http.ResponseWriter, r *http.Request) {
+	userID, _, ok := getUserFromContext(r.Context())
+	if !ok {
+		writeError(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	tail := int64(defaultLogTail)
+	if raw := r.URL.Query().Get("tail"); raw != "" {
+		parsed, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil || parsed < -1 {
+			writeError(w, "invalid tail", http.StatusBadRequest)
+			return
+		}
+		tail = parsed
+	}
+	follow := r.URL.Query().Get("follow") == "true"
+
+	containerID := r.PathValue("id")
+	container, err := h.db.GetContainer(containerID)
+	if err != nil {
+		slog.Error("failed to get container", "error", err)
+		writeError(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if container == nil || container.UserID != userID {
+		writeError(w, "container not found", http.StatusNotFound)
+		return
+	}
+	if container.Status == "stopped" {
+		writeError(w, "container not running", http.StatusBadRequest)
+		return
+	}
+
+	ctx := r.Context()
+	if !follow {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, 30*time.Second)
+		defer cancel()
+	}
+	stream, err := h.k8s.StreamPodLogs(ctx, container.Namespace, tail, follow)
+	if err != nil {
+		slog.Error("failed to stream logs", "error", err, "container", containerID)
+		writeError(w, "failed to get logs", http.StatusBadGateway)
+		return
+	}
+	defer stream.Close()
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	flusher, _ := w.(http.Flusher)
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := stream.Read(buf)
+		if n > 0 {
+			if _, werr := w.Write(buf[:n]); werr != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		if err != nil {
+			if err != io.EOF && ctx.Err() == nil {
+				slog.Warn("log stream ended", "error", err, "container", containerID)
+			}
+			return
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package api
+
+import (
+	"time"
+
+	"eddisonso.com/edd-cloud/pkg/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	httpMetrics           = metrics.NewHTTPMetrics("compute")
+	provisionStepDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "compute_provision_step_duration_seconds",
+		Help:    "Container provisioning step latency by outcome.",
+		Buckets: metrics.DefaultBuckets,
+	}, []string{"step", "result"})
+	terminalSessions = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "compute_terminal_sessions",
+		Help: "Open container terminal sessions.",
+	})
+	_ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "compute_websocket_connections",
+		Help: "Open container status WebSocket connections.",
+	}, func() float64 { return float64(GetHub().Count()) })
+)
+
+// provisionStep runs one provisioning call and records how long it took
+func provisionStep(step string, fn func() error) error {
+	start := time.Now()
+	err := fn()
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+	metrics.Since(provisionStepDuration.WithLabelValues(step, result), start)
+	return err
+}
@@ -89,7 +89,7 @@ func (h *Handler) AddSSHKey(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	if count >= maxSSHKeysPerUser {
-		writeError(w, fmt.Sprintf("SSH key limit reached (%d)", maxSSHKeysPerUser), http.StatusBadRequest)
+		writeError(w, fmt.Sprintf("SSH key limit reached (%d)", maxSSHKeysPerUser), http.StatusConflict)
 		return
 	}
 
@@ -16,14 +16,6 @@ import (
 	"golang.org/x/crypto/ssh"
 )
 
-var terminalUpgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool {
-		return true
-	},
-	ReadBufferSize:  1024,
-	WriteBufferSize: 1024,
-}
-
 // HandleTerminal handles WebSocket connections for cloud terminal
 func (h *Handler) HandleTerminal(w http.ResponseWriter, r *http.Request) {
 	containerID := r.PathValue("id")
@@ -58,12 +50,14 @@ func (h *Handler) HandleTerminal(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Upgrade to WebSocket
-	ws, err := terminalUpgrader.Upgrade(w, r, nil)
+	ws, err := h.upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		slog.Error("websocket upgrade failed", "error", err)
 		return
 	}
 	defer ws.Close()
+	terminalSessions.Inc()
+	defer terminalSessions.Dec()
 
 	slog.Info("terminal session started", "container", containerID, "user", userID)
 
@@ -77,7 +71,7 @@ func (h *Handler) HandleTerminal(w http.ResponseWriter, r *http.Request) {
 
 	// Inject public key into container
 	keyID := fmt.Sprintf("terminal-%d", time.Now().UnixNano())
-	namespace := fmt.Sprintf("compute-%d-%s", container.UserID, container.ID)
+	namespace := container.Namespace
 
 	if err := h.k8s.InjectTempKey(r.Context(), namespace, pubKey, keyID); err != nil {
 		slog.Error("failed to inject temp key", "error", err, "container", containerID)
@@ -0,0 +1,47 @@
+package api
+
+import (
+	_ "embed"
+	"net/http"
+	"strings"
+
+	"eddisonso.com/edd-cloud/pkg/httpapi"
+)
+
+// /compute/v1/... serves the same handlers as /compute/..., but every error
+// is a JSON envelope:
+//
+//	{"error": {"code": "not_found", "message": "...", "request_id": "...", "details": ...}}
+//
+// Handlers keep using writeError; httpapi.ErrorWriter rewrites plain-text
+// error responses on the v1 surface.
+
+const v1Prefix = "/compute/v1"
+
+//go:embed openapi.json
+var openAPISpec []byte
+
+// serveV1 answers the OpenAPI document and dispatches the rest of /compute/v1
+// to the unversioned routes with JSON errors. It returns the matched route.
+func (h *Handler) serveV1(w http.ResponseWriter, r *http.Request) string {
+	if r.URL.Path == v1Prefix+"/openapi.json" {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			httpapi.WriteError(w, r, http.StatusMethodNotAllowed, "method not allowed", nil)
+			return "openapi"
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "public, max-age=300")
+		_, _ = w.Write(openAPISpec)
+		return "openapi"
+	}
+
+	legacy := r.Clone(r.Context())
+	legacy.URL.Path = "/compute" + strings.TrimPrefix(r.URL.Path, v1Prefix)
+	legacy.URL.RawPath = ""
+
+	ew := httpapi.NewErrorWriter(w, r)
+	defer ew.Finish()
+	h.mux.ServeHTTP(ew, legacy)
+	return legacy.Pattern
+}
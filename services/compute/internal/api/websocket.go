@@ -7,15 +7,16 @@ import (
 	"sync"
 	"time"
 
+	"eddisonso.com/edd-cloud/services/compute/internal/auth"
 	"github.com/gorilla/websocket"
 )
 
-var upgrader = websocket.Upgrader{
-	ReadBufferSize:  1024,
-	WriteBufferSize: 1024,
-	CheckOrigin: func(r *http.Request) bool {
-		return true // Allow all origins for now
-	},
+func newUpgrader(origins *auth.OriginPolicy) *websocket.Upgrader {
+	return &websocket.Upgrader{
+		ReadBufferSize:  1024,
+		WriteBufferSize: 1024,
+		CheckOrigin:     origins.CheckOrigin,
+	}
 }
 
 // WSMessage represents a WebSocket message
@@ -73,6 +74,18 @@ func (h *WSHub) Unregister(userID int64, conn *websocket.Conn) {
 	slog.Debug("WebSocket unregistered", "user", userID)
 }
 
+// Count returns the number of open connections
+func (h *WSHub) Count() int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	n := 0
+	for _, conns := range h.conns {
+		n += len(conns)
+	}
+	return n
+}
+
 // BroadcastToUser sends a message to all connections for a user
 func (h *WSHub) BroadcastToUser(userID int64, msg WSMessage) {
 	h.mu.RLock()
@@ -118,7 +131,7 @@ func (h *Handler) HandleWebSocket(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	conn, err := upgrader.Upgrade(w, r, nil)
+	conn, err := h.upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		slog.Error("websocket upgrade failed", "error", err)
 		return
@@ -0,0 +1,117 @@
+package auth
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+const (
+	// CSRFCookieName is the double-submit cookie SFS sets alongside the session
+	CSRFCookieName = "sfs_csrf"
+	// CSRFHeaderName must echo the CSRF cookie on mutating requests
+	CSRFHeaderName = "X-CSRF-Token"
+
+	defaultAllowedOrigins = "https://cloud.eddisonso.com,http://localhost:5173"
+)
+
+// OriginPolicy decides which browser origins may make credentialed calls.
+// Requests from the API's own origin are always allowed.
+type OriginPolicy struct {
+	allowed map[string]bool
+}
+
+// LoadOriginPolicy reads the comma-separated ALLOWED_ORIGINS allowlist
+func LoadOriginPolicy() *OriginPolicy {
+	raw := os.Getenv("ALLOWED_ORIGINS")
+	if strings.TrimSpace(raw) == "" {
+		raw = defaultAllowedOrigins
+	}
+	p := &OriginPolicy{allowed: make(map[string]bool)}
+	for _, origin := range strings.Split(raw, ",") {
+		if origin = strings.TrimSuffix(strings.TrimSpace(origin), "/"); origin != "" {
+			p.allowed[strings.ToLower(origin)] = true
+		}
+	}
+	return p
+}
+
+// Allows reports whether origin may make credentialed requests
+func (p *OriginPolicy) Allows(r *http.Request, origin string) bool {
+	origin = strings.ToLower(origin)
+	if p.allowed[origin] {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && u.Host != "" && strings.EqualFold(u.Host, r.Host)
+}
+
+// CheckOrigin is a websocket.Upgrader CheckOrigin: browsers always send
+// Origin on upgrades, so a missing or unknown one is refused
+func (p *OriginPolicy) CheckOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	return origin != "" && p.Allows(r, origin)
+}
+
+// CORS sets CORS headers for allowlisted origins only and answers preflights
+func (p *OriginPolicy) CORS(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		allowed := origin != "" && p.Allows(r, origin)
+		if allowed {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, "+CSRFHeaderName)
+			w.Header().Set("Access-Control-Expose-Headers", "X-Request-ID")
+			w.Header().Add("Vary", "Origin")
+		}
+		if r.Method == http.MethodOptions {
+			if origin != "" && !allowed {
+				http.Error(w, "origin not allowed", http.StatusForbidden)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// CSRF rejects mutating requests from foreign origins, and cookie-authenticated
+// ones whose X-CSRF-Token header doesn't match the CSRF cookie
+func (p *OriginPolicy) CSRF(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			next.ServeHTTP(w, r)
+			return
+		}
+		if origin := r.Header.Get("Origin"); origin != "" && !p.Allows(r, origin) {
+			http.Error(w, "origin not allowed", http.StatusForbidden)
+			return
+		}
+		if !hasAuthCookie(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		cookie, err := r.Cookie(CSRFCookieName)
+		header := r.Header.Get(CSRFHeaderName)
+		if err != nil || cookie.Value == "" || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(header)) != 1 {
+			http.Error(w, "invalid csrf token", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func hasAuthCookie(r *http.Request) bool {
+	for _, cookie := range r.Cookies() {
+		if (cookie.Name == sessionCookieName || cookie.Name == AccessCookieName) && cookie.Value != "" {
+			return true
+		}
+	}
+	return false
+}
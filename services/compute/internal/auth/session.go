@@ -4,16 +4,60 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"sync"
 	"time"
 )
 
+const (
+	sessionCookieName = "sfs_session"
+	// Validated sessions are reused for this long instead of calling SFS on
+	// every request, so a logout takes up to this long to reach compute
+	sessionCacheTTL = 30 * time.Second
+	// sessionCacheSize bounds the number of cached tokens
+	sessionCacheSize = 10000
+)
+
 type SessionValidator struct {
 	sfsURL     string
 	httpClient *http.Client
+
+	mu    sync.Mutex
+	cache map[string]cachedSession
+}
+
+type cachedSession struct {
+	session *Session
+	expires time.Time
+}
+
+// Roles assigned by SFS. RoleAdmin implies every other role.
+const (
+	RoleAdmin        = "admin"
+	RoleStorageAdmin = "storage-admin"
+	RoleComputeAdmin = "compute-admin"
+	RoleAuditor      = "auditor"
+)
+
+// Session is the signed-in user behind a session cookie.
+type Session struct {
+	UserID   int64    `json:"user_id"`
+	Username string   `json:"username"`
+	Roles    []string `json:"roles"`
 }
 
-type sessionResponse struct {
-	Username string `json:"username"`
+// HasRole reports whether the session holds admin or any of the given roles.
+func (s *Session) HasRole(roles ...string) bool {
+	for _, held := range s.Roles {
+		if held == RoleAdmin {
+			return true
+		}
+		for _, role := range roles {
+			if held == role {
+				return true
+			}
+		}
+	}
+	return false
 }
 
 func NewSessionValidator(sfsURL string) *SessionValidator {
@@ -22,48 +66,100 @@ func NewSessionValidator(sfsURL string) *SessionValidator {
 		httpClient: &http.Client{
 			Timeout: 5 * time.Second,
 		},
+		cache: make(map[string]cachedSession),
 	}
 }
 
-// ValidateSession validates a session cookie by calling SFS /api/session
-// Returns the username if valid, empty string if invalid
-func (v *SessionValidator) ValidateSession(sessionToken string) (string, error) {
+// ValidateSession validates a session cookie by calling SFS /api/session,
+// reusing recent results from the cache
+// Returns the session if valid, nil if invalid
+func (v *SessionValidator) ValidateSession(sessionToken string) (*Session, error) {
+	if session := v.cached(sessionToken); session != nil {
+		return session, nil
+	}
+	session, err := v.fetchSession(sessionToken)
+	if err != nil || session == nil {
+		return session, err
+	}
+	v.store(sessionToken, session)
+	return session, nil
+}
+
+func (v *SessionValidator) cached(token string) *Session {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	entry, ok := v.cache[token]
+	if !ok {
+		return nil
+	}
+	if time.Now().After(entry.expires) {
+		delete(v.cache, token)
+		return nil
+	}
+	return entry.session
+}
+
+func (v *SessionValidator) store(token string, session *Session) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	now := time.Now()
+	if len(v.cache) >= sessionCacheSize {
+		for t, entry := range v.cache {
+			if now.After(entry.expires) {
+				delete(v.cache, t)
+			}
+		}
+	}
+	// Still full: evict arbitrary entries, they are cheap to refetch
+	for t := range v.cache {
+		if len(v.cache) < sessionCacheSize {
+			break
+		}
+		delete(v.cache, t)
+	}
+	v.cache[token] = cachedSession{session: session, expires: now.Add(sessionCacheTTL)}
+}
+
+func (v *SessionValidator) fetchSession(sessionToken string) (*Session, error) {
 	req, err := http.NewRequest("GET", v.sfsURL+"/api/session", nil)
 	if err != nil {
-		return "", fmt.Errorf("create request: %w", err)
+		return nil, fmt.Errorf("create request: %w", err)
 	}
 
 	req.AddCookie(&http.Cookie{
-		Name:  "sfs_session",
+		Name:  sessionCookieName,
 		Value: sessionToken,
 	})
 
 	resp, err := v.httpClient.Do(req)
 	if err != nil {
-		return "", fmt.Errorf("call sfs: %w", err)
+		return nil, fmt.Errorf("call sfs: %w", err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode == http.StatusUnauthorized {
-		return "", nil
+		return nil, nil
 	}
 	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("sfs returned status %d", resp.StatusCode)
+		return nil, fmt.Errorf("sfs returned status %d", resp.StatusCode)
 	}
 
-	var session sessionResponse
+	var session Session
 	if err := json.NewDecoder(resp.Body).Decode(&session); err != nil {
-		return "", fmt.Errorf("decode response: %w", err)
+		return nil, fmt.Errorf("decode response: %w", err)
+	}
+	if session.Username == "" || session.UserID == 0 {
+		return nil, nil
 	}
 
-	return session.Username, nil
+	return &session, nil
 }
 
 // GetSessionTokens extracts all session tokens from request cookies
 func GetSessionTokens(r *http.Request) []string {
 	var tokens []string
 	for _, cookie := range r.Cookies() {
-		if cookie.Name == "sfs_session" && cookie.Value != "" {
+		if cookie.Name == sessionCookieName && cookie.Value != "" {
 			tokens = append(tokens, cookie.Value)
 		}
 	}
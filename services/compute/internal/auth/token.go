@@ -0,0 +1,205 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	tokenIssuer   = "edd-cloud-sfs"
+	tokenAudience = "edd-cloud"
+	// AccessCookieName is the cookie SFS sets alongside the session cookie
+	AccessCookieName = "sfs_access"
+	// jwksRefreshInterval is how often known keys are refreshed in the background
+	jwksRefreshInterval = 10 * time.Minute
+	// jwksMinRefresh rate-limits refetches triggered by an unknown key ID
+	jwksMinRefresh = 30 * time.Second
+	// clockSkew is tolerated on exp and iat
+	clockSkew = 30 * time.Second
+)
+
+var ErrInvalidToken = errors.New("invalid access token")
+
+// TokenVerifier checks SFS access tokens locally against the keys published
+// at the SFS JWKS endpoint. Keys are cached, so verification keeps working
+// while SFS is unreachable; an unknown key ID (after a rotation) triggers a
+// refetch.
+type TokenVerifier struct {
+	jwksURL    string
+	httpClient *http.Client
+
+	mu          sync.Mutex
+	keys        map[string]ed25519.PublicKey
+	fetchedAt   time.Time
+	lastAttempt time.Time
+}
+
+type accessClaims struct {
+	Issuer    string   `json:"iss"`
+	Audience  string   `json:"aud"`
+	Subject   string   `json:"sub"`
+	Username  string   `json:"preferred_username"`
+	Roles     []string `json:"roles"`
+	IssuedAt  int64    `json:"iat"`
+	ExpiresAt int64    `json:"exp"`
+}
+
+func NewTokenVerifier(sfsURL string) *TokenVerifier {
+	return &TokenVerifier{
+		jwksURL: sfsURL + "/.well-known/jwks.json",
+		httpClient: &http.Client{
+			Timeout: 5 * time.Second,
+		},
+		keys: make(map[string]ed25519.PublicKey),
+	}
+}
+
+// Verify checks the signature and claims of an access token and returns the
+// session it stands for
+func (v *TokenVerifier) Verify(token string) (*Session, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidToken
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil || header.Alg != "EdDSA" {
+		return nil, ErrInvalidToken
+	}
+	key, err := v.key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || !ed25519.Verify(key, []byte(parts[0]+"."+parts[1]), signature) {
+		return nil, ErrInvalidToken
+	}
+
+	var claims accessClaims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, ErrInvalidToken
+	}
+	now := time.Now()
+	switch {
+	case claims.Issuer != tokenIssuer || claims.Audience != tokenAudience:
+		return nil, ErrInvalidToken
+	case now.After(time.Unix(claims.ExpiresAt, 0).Add(clockSkew)):
+		return nil, fmt.Errorf("%w: expired", ErrInvalidToken)
+	case time.Unix(claims.IssuedAt, 0).After(now.Add(clockSkew)):
+		return nil, fmt.Errorf("%w: issued in the future", ErrInvalidToken)
+	}
+	userID, err := strconv.ParseInt(claims.Subject, 10, 64)
+	if err != nil || userID == 0 || claims.Username == "" {
+		return nil, ErrInvalidToken
+	}
+	return &Session{UserID: userID, Username: claims.Username, Roles: claims.Roles}, nil
+}
+
+func (v *TokenVerifier) key(kid string) (ed25519.PublicKey, error) {
+	v.mu.Lock()
+	key, known := v.keys[kid]
+	now := time.Now()
+	refresh := now.Sub(v.lastAttempt) > jwksMinRefresh &&
+		(!known || now.Sub(v.fetchedAt) > jwksRefreshInterval)
+	if refresh {
+		v.lastAttempt = now
+	}
+	v.mu.Unlock()
+
+	switch {
+	case refresh && known:
+		// Routine refresh: keep serving the cached key meanwhile
+		go v.refresh()
+		return key, nil
+	case refresh:
+		if err := v.refresh(); err != nil {
+			return nil, fmt.Errorf("fetch jwks: %w", err)
+		}
+		v.mu.Lock()
+		key, known = v.keys[kid]
+		v.mu.Unlock()
+	}
+	if !known {
+		return nil, fmt.Errorf("%w: unknown key %q", ErrInvalidToken, kid)
+	}
+	return key, nil
+}
+
+func (v *TokenVerifier) refresh() error {
+	keys, err := v.fetchKeys()
+	if err != nil {
+		slog.Warn("jwks refresh failed", "error", err)
+		return err
+	}
+	v.mu.Lock()
+	v.keys = keys
+	v.fetchedAt = time.Now()
+	v.mu.Unlock()
+	return nil
+}
+
+func (v *TokenVerifier) fetchKeys() (map[string]ed25519.PublicKey, error) {
+	resp, err := v.httpClient.Get(v.jwksURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("jwks returned status %d", resp.StatusCode)
+	}
+
+	var set struct {
+		Keys []struct {
+			Kid string `json:"kid"`
+			Kty string `json:"kty"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+		} `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return nil, fmt.Errorf("decode jwks: %w", err)
+	}
+	keys := make(map[string]ed25519.PublicKey, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Kty != "OKP" || k.Crv != "Ed25519" {
+			continue
+		}
+		raw, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil || len(raw) != ed25519.PublicKeySize {
+			continue
+		}
+		keys[k.Kid] = ed25519.PublicKey(raw)
+	}
+	return keys, nil
+}
+
+func decodeSegment(segment string, out any) error {
+	raw, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(raw, out)
+}
+
+// GetAccessToken returns the bearer token from the Authorization header, or
+// the access cookie (browsers can't set headers on WebSocket upgrades)
+func GetAccessToken(r *http.Request) string {
+	if header := r.Header.Get("Authorization"); strings.HasPrefix(header, "Bearer ") {
+		return strings.TrimSpace(strings.TrimPrefix(header, "Bearer "))
+	}
+	if cookie, err := r.Cookie(AccessCookieName); err == nil {
+		return cookie.Value
+	}
+	return ""
+}
@@ -0,0 +1,281 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// migration is one versioned schema change. Up and Down run in a single
+// transaction together with the schema_migrations bookkeeping.
+//
+// Versions 1-3 are idempotent because they replay the statements that used to
+// run on every boot, so databases created before versioning adopt them as-is.
+type migration struct {
+	Version int
+	Name    string
+	Up      []string
+	Down    []string
+}
+
+const (
+	// schema_migrations may be shared with other services on the same
+	// database, so rows are keyed by service
+	migrationService = "compute"
+	// migrationLockKey serializes migrations across replicas ("compute" in ASCII)
+	migrationLockKey int64 = 0x636f6d70757465
+)
+
+var migrations = []migration{
+	{
+		Version: 1,
+		Name:    "initial schema",
+		Up: []string{
+			`CREATE TABLE IF NOT EXISTS containers (
+				id TEXT PRIMARY KEY,
+				user_id BIGINT NOT NULL,
+				name TEXT NOT NULL,
+				namespace TEXT NOT NULL,
+				status TEXT DEFAULT 'pending',
+				external_ip TEXT,
+				memory_mb INTEGER DEFAULT 512,
+				storage_gb INTEGER DEFAULT 5,
+				image TEXT DEFAULT 'eddisonso/ecloud-compute-base:latest',
+				created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+				stopped_at TIMESTAMP
+			)`,
+			`CREATE TABLE IF NOT EXISTS ssh_keys (
+				id SERIAL PRIMARY KEY,
+				user_id BIGINT NOT NULL,
+				name TEXT NOT NULL,
+				public_key TEXT NOT NULL,
+				fingerprint TEXT NOT NULL,
+				created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+			)`,
+			`CREATE INDEX IF NOT EXISTS idx_containers_user_id ON containers(user_id)`,
+			`CREATE INDEX IF NOT EXISTS idx_ssh_keys_user_id ON ssh_keys(user_id)`,
+		},
+		Down: []string{
+			`DROP TABLE IF EXISTS ssh_keys`,
+			`DROP TABLE IF EXISTS containers`,
+		},
+	},
+	{
+		Version: 2,
+		Name:    "ingress rules",
+		Up: []string{
+			`CREATE TABLE IF NOT EXISTS ingress_rules (
+				id SERIAL PRIMARY KEY,
+				container_id TEXT NOT NULL REFERENCES containers(id) ON DELETE CASCADE,
+				port INTEGER NOT NULL,
+				target_port INTEGER NOT NULL DEFAULT 80,
+				created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+				UNIQUE(container_id, port)
+			)`,
+			`ALTER TABLE ingress_rules ADD COLUMN IF NOT EXISTS target_port INTEGER DEFAULT 80`,
+			`CREATE INDEX IF NOT EXISTS idx_ingress_rules_container_id ON ingress_rules(container_id)`,
+		},
+		Down: []string{
+			`DROP TABLE IF EXISTS ingress_rules`,
+		},
+	},
+	{
+		// Protocol access through gateway (SSH and HTTPS only, no HTTP)
+		Version: 3,
+		Name:    "protocol access",
+		Up: []string{
+			`ALTER TABLE containers ADD COLUMN IF NOT EXISTS ssh_enabled BOOLEAN DEFAULT false`,
+			`ALTER TABLE containers ADD COLUMN IF NOT EXISTS https_enabled BOOLEAN DEFAULT false`,
+		},
+		Down: []string{
+			`ALTER TABLE containers DROP COLUMN IF EXISTS https_enabled`,
+			`ALTER TABLE containers DROP COLUMN IF EXISTS ssh_enabled`,
+		},
+	},
+}
+
+// MigrationStatus describes one known migration and whether it is applied.
+type MigrationStatus struct {
+	Version   int
+	Name      string
+	AppliedAt time.Time // zero when pending
+}
+
+// withMigrationLock runs fn on a single connection holding the migration
+// advisory lock (advisory locks are per session, so the pool can't be used)
+func (db *DB) withMigrationLock(ctx context.Context, fn func(conn *sql.Conn) error) error {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("get connection: %w", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, migrationLockKey); err != nil {
+		return fmt.Errorf("acquire migration lock: %w", err)
+	}
+	defer conn.ExecContext(context.Background(), `SELECT pg_advisory_unlock($1)`, migrationLockKey)
+
+	if _, err := conn.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		service TEXT NOT NULL,
+		version INTEGER NOT NULL,
+		name TEXT NOT NULL,
+		applied_at BIGINT NOT NULL,
+		PRIMARY KEY (service, version)
+	)`); err != nil {
+		return fmt.Errorf("create schema_migrations: %w", err)
+	}
+	return fn(conn)
+}
+
+func appliedMigrations(ctx context.Context, conn *sql.Conn) (map[int]time.Time, error) {
+	rows, err := conn.QueryContext(ctx,
+		`SELECT version, applied_at FROM schema_migrations WHERE service = $1`, migrationService)
+	if err != nil {
+		return nil, fmt.Errorf("query schema_migrations: %w", err)
+	}
+	defer rows.Close()
+
+	applied := make(map[int]time.Time)
+	for rows.Next() {
+		var version int
+		var appliedAt int64
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, fmt.Errorf("scan schema_migrations: %w", err)
+		}
+		applied[version] = time.Unix(appliedAt, 0)
+	}
+	return applied, rows.Err()
+}
+
+func runMigration(ctx context.Context, conn *sql.Conn, m migration, up bool) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("begin: %w", err)
+	}
+	defer tx.Rollback()
+
+	stmts := m.Down
+	if up {
+		stmts = m.Up
+	}
+	for _, stmt := range stmts {
+		if _, err := tx.ExecContext(ctx, stmt); err != nil {
+			return fmt.Errorf("execute: %w", err)
+		}
+	}
+	if up {
+		_, err = tx.ExecContext(ctx,
+			`INSERT INTO schema_migrations (service, version, name, applied_at) VALUES ($1, $2, $3, $4)`,
+			migrationService, m.Version, m.Name, time.Now().Unix())
+	} else {
+		_, err = tx.ExecContext(ctx,
+			`DELETE FROM schema_migrations WHERE service = $1 AND version = $2`,
+			migrationService, m.Version)
+	}
+	if err != nil {
+		return fmt.Errorf("record version: %w", err)
+	}
+	return tx.Commit()
+}
+
+// Migrate applies every pending migration in version order
+func (db *DB) Migrate(ctx context.Context) error {
+	return db.withMigrationLock(ctx, func(conn *sql.Conn) error {
+		applied, err := appliedMigrations(ctx, conn)
+		if err != nil {
+			return err
+		}
+		for _, m := range migrations {
+			if _, ok := applied[m.Version]; ok {
+				continue
+			}
+			if err := runMigration(ctx, conn, m, true); err != nil {
+				return fmt.Errorf("migration %d (%s): %w", m.Version, m.Name, err)
+			}
+			slog.Info("applied migration", "version", m.Version, "name", m.Name)
+		}
+		return nil
+	})
+}
+
+// MigrateDown reverts applied migrations newer than target, newest first.
+// A negative target reverts only the latest applied migration.
+func (db *DB) MigrateDown(ctx context.Context, target int) error {
+	return db.withMigrationLock(ctx, func(conn *sql.Conn) error {
+		applied, err := appliedMigrations(ctx, conn)
+		if err != nil {
+			return err
+		}
+		reverted := 0
+		for i := len(migrations) - 1; i >= 0; i-- {
+			m := migrations[i]
+			if target >= 0 && m.Version <= target {
+				break
+			}
+			if _, ok := applied[m.Version]; !ok {
+				continue
+			}
+			if err := runMigration(ctx, conn, m, false); err != nil {
+				return fmt.Errorf("revert migration %d (%s): %w", m.Version, m.Name, err)
+			}
+			slog.Info("reverted migration", "version", m.Version, "name", m.Name)
+			reverted++
+			if target < 0 {
+				break
+			}
+		}
+		if reverted == 0 {
+			slog.Info("no migrations to revert")
+		}
+		return nil
+	})
+}
+
+// MigrationStatus lists every known migration with its applied time
+func (db *DB) MigrationStatus(ctx context.Context) ([]MigrationStatus, error) {
+	var status []MigrationStatus
+	err := db.withMigrationLock(ctx, func(conn *sql.Conn) error {
+		applied, err := appliedMigrations(ctx, conn)
+		if err != nil {
+			return err
+		}
+		for _, m := range migrations {
+			status = append(status, MigrationStatus{Version: m.Version, Name: m.Name, AppliedAt: applied[m.Version]})
+		}
+		return nil
+	})
+	return status, err
+}
+
+// legacyUserID is the owner every container and SSH key was recorded under
+// before compute used the session's user ID.
+const legacyUserID = 1
+
+// ReassignLegacyOwner moves containers and SSH keys still recorded under
+// legacyUserID to userID and reports how many of each moved. Kubernetes
+// namespaces keep their original names; compute reads them from the
+// containers table.
+func (db *DB) ReassignLegacyOwner(ctx context.Context, userID int64) (containers, sshKeys int64, err error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, 0, fmt.Errorf("begin: %w", err)
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx, `UPDATE containers SET user_id = $1 WHERE user_id = $2`, userID, legacyUserID)
+	if err != nil {
+		return 0, 0, fmt.Errorf("reassign containers: %w", err)
+	}
+	containers, _ = res.RowsAffected()
+	res, err = tx.ExecContext(ctx, `UPDATE ssh_keys SET user_id = $1 WHERE user_id = $2`, userID, legacyUserID)
+	if err != nil {
+		return 0, 0, fmt.Errorf("reassign ssh keys: %w", err)
+	}
+	sshKeys, _ = res.RowsAffected()
+	if err := tx.Commit(); err != nil {
+		return 0, 0, fmt.Errorf("commit: %w", err)
+	}
+	return containers, sshKeys, nil
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"io"
 	"strings"
 
 	corev1 "k8s.io/api/core/v1"
@@ -381,6 +382,21 @@ func (c *Client) GetPodIP(ctx context.Context, namespace string) (string, error)
 	return pod.Status.PodIP, nil
 }
 
+// StreamPodLogs streams the output of the container pod. A negative
+// tailLines returns the whole log; with follow set the stream stays open for
+// new output until ctx ends.
+func (c *Client) StreamPodLogs(ctx context.Context, namespace string, tailLines int64, follow bool) (io.ReadCloser, error) {
+	opts := &corev1.PodLogOptions{Container: "main", Follow: follow}
+	if tailLines >= 0 {
+		opts.TailLines = &tailLines
+	}
+	stream, err := c.clientset.CoreV1().Pods(namespace).GetLogs("container", opts).Stream(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("stream logs: %w", err)
+	}
+	return stream, nil
+}
+
 // DeletePod deletes the container pod
 func (c *Client) DeletePod(ctx context.Context, namespace string) error {
 	err := c.clientset.CoreV1().Pods(namespace).Delete(ctx, "container", metav1.DeleteOptions{})
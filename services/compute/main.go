@@ -9,29 +9,21 @@ import (
 	"syscall"
 
 	"eddisonso.com/edd-cloud/services/compute/internal/api"
+	"eddisonso.com/edd-cloud/services/compute/internal/auth"
 	"eddisonso.com/edd-cloud/services/compute/internal/db"
 	"eddisonso.com/edd-cloud/services/compute/internal/k8s"
 	"eddisonso.com/go-gfs/pkg/gfslog"
 )
 
-func corsMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		origin := r.Header.Get("Origin")
-		if origin != "" {
-			w.Header().Set("Access-Control-Allow-Origin", origin)
-			w.Header().Set("Access-Control-Allow-Credentials", "true")
-			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
-		}
-		if r.Method == "OPTIONS" {
-			w.WriteHeader(http.StatusOK)
-			return
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := runMigrate(os.Args[2:]); err != nil {
+			slog.Error("migrate failed", "error", err)
+			os.Exit(1)
 		}
-		next.ServeHTTP(w, r)
-	})
-}
+		return
+	}
 
-func main() {
 	addr := flag.String("addr", ":8080", "HTTP listen address")
 	logService := flag.String("log-service", "", "Log service address")
 	flag.Parse()
@@ -65,9 +57,10 @@ func main() {
 		os.Exit(1)
 	}
 
-	// HTTP server with CORS
-	handler := api.NewHandler(database, k8sClient)
-	server := &http.Server{Addr: *addr, Handler: corsMiddleware(handler)}
+	// HTTP server with CORS and CSRF checks for the allowlisted origins
+	origins := auth.LoadOriginPolicy()
+	handler := api.NewHandler(database, k8sClient, origins)
+	server := &http.Server{Addr: *addr, Handler: origins.CORS(origins.CSRF(handler))}
 
 	// Graceful shutdown
 	go func() {
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"eddisonso.com/edd-cloud/services/compute/internal/db"
+)
+
+// runMigrate implements `compute migrate [up | down [-to version] | status |
+// reassign -user id]`. reassign is a one-off step for databases from before
+// compute used real user IDs, when every container and SSH key was stored
+// under user 1.
+func runMigrate(args []string) error {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	to := fs.Int("to", -1, "version to migrate down to (down only; default reverts one migration)")
+	user := fs.Int64("user", 0, "user ID to take over containers and SSH keys stored under user 1 (reassign only)")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: compute migrate [up | down [-to version] | status | reassign -user id]")
+		fs.PrintDefaults()
+	}
+
+	action := "up"
+	if len(args) > 0 && args[0] != "" && args[0][0] != '-' {
+		action, args = args[0], args[1:]
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	dbConnStr := os.Getenv("DATABASE_URL")
+	if dbConnStr == "" {
+		dbConnStr = "postgres://localhost:5432/eddcloud?sslmode=disable"
+	}
+	database, err := db.Connect(dbConnStr)
+	if err != nil {
+		return err
+	}
+	defer database.Close()
+
+	ctx := context.Background()
+	switch action {
+	case "up":
+		return database.Migrate(ctx)
+	case "down":
+		return database.MigrateDown(ctx, *to)
+	case "status":
+		status, err := database.MigrationStatus(ctx)
+		if err != nil {
+			return err
+		}
+		for _, m := range status {
+			state := "pending"
+			if !m.AppliedAt.IsZero() {
+				state = "applied " + m.AppliedAt.UTC().Format(time.RFC3339)
+			}
+			fmt.Printf("%3d  %-40s %s\n", m.Version, m.Name, state)
+		}
+		return nil
+	case "reassign":
+		if *user <= 0 {
+			fs.Usage()
+			return fmt.Errorf("reassign needs -user")
+		}
+		containers, keys, err := database.ReassignLegacyOwner(ctx, *user)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("reassigned %d containers and %d ssh keys to user %d\n", containers, keys, *user)
+		return nil
+	default:
+		fs.Usage()
+		return fmt.Errorf("unknown migrate action %q", action)
+	}
+}
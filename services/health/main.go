@@ -6,10 +6,15 @@ import (
 	"flag"
 	"log/slog"
 	"net/http"
+	"net/url"
 	"os"
+	"strings"
 	"sync"
 	"time"
 
+	"eddisonso.com/edd-cloud/pkg/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 	"eddisonso.com/go-gfs/pkg/gfslog"
 	"github.com/gorilla/websocket"
 	corev1 "k8s.io/api/core/v1"
@@ -56,10 +61,57 @@ type metricsNode struct {
 	} `json:"usage"`
 }
 
+var (
+	httpMetrics        = metrics.NewHTTPMetrics("health")
+	clusterPollLatency = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "health_cluster_poll_duration_seconds",
+		Help:    "Latency of polling node metrics and status from the Kubernetes API.",
+		Buckets: metrics.DefaultBuckets,
+	})
+	clusterPollErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "health_cluster_poll_errors_total",
+		Help: "Failed polls of node metrics and status.",
+	})
+	wsConnections = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "health_websocket_connections",
+		Help: "Open cluster-info WebSocket connections.",
+	})
+)
+
 var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool {
+	CheckOrigin: originAllowed,
+}
+
+// allowedOrigins is the comma-separated ALLOWED_ORIGINS allowlist shared with
+// the other edd-cloud services
+var allowedOrigins = loadAllowedOrigins()
+
+func loadAllowedOrigins() map[string]bool {
+	raw := os.Getenv("ALLOWED_ORIGINS")
+	if strings.TrimSpace(raw) == "" {
+		raw = "https://cloud.eddisonso.com,http://localhost:5173"
+	}
+	allowed := make(map[string]bool)
+	for _, origin := range strings.Split(raw, ",") {
+		if origin = strings.TrimSuffix(strings.TrimSpace(origin), "/"); origin != "" {
+			allowed[strings.ToLower(origin)] = true
+		}
+	}
+	return allowed
+}
+
+// originAllowed accepts WebSocket upgrades from allowlisted origins and the
+// service's own host
+func originAllowed(r *http.Request) bool {
+	origin := strings.ToLower(r.Header.Get("Origin"))
+	if origin == "" {
+		return false
+	}
+	if allowedOrigins[origin] {
 		return true
-	},
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
 }
 
 func main() {
@@ -104,14 +156,24 @@ func main() {
 		w.Write([]byte("ok"))
 	})
 
+	http.Handle("GET /metrics", metrics.Handler())
+
 	slog.Info("Cluster monitor listening", "addr", *addr)
-	if err := http.ListenAndServe(*addr, nil); err != nil {
+	if err := http.ListenAndServe(*addr, httpMetrics.Instrument(http.DefaultServeMux)); err != nil {
 		slog.Error("HTTP server failed", "error", err)
 		os.Exit(1)
 	}
 }
 
-func getClusterInfo(ctx context.Context, clientset *kubernetes.Clientset) (*ClusterInfo, error) {
+func getClusterInfo(ctx context.Context, clientset *kubernetes.Clientset) (info *ClusterInfo, err error) {
+	start := time.Now()
+	defer func() {
+		metrics.Since(clusterPollLatency, start)
+		if err != nil {
+			clusterPollErrors.Inc()
+		}
+	}()
+
 	// Get node metrics from metrics-server
 	metricsData, err := clientset.RESTClient().
 		Get().
@@ -218,6 +280,8 @@ func handleClusterInfoWS(w http.ResponseWriter, r *http.Request, clientset *kube
 		return
 	}
 	defer conn.Close()
+	wsConnections.Inc()
+	defer wsConnections.Dec()
 
 	var mu sync.Mutex
 	done := make(chan struct{})
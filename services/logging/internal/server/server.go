@@ -9,7 +9,30 @@ import (
 	"time"
 
 	gfs "eddisonso.com/go-gfs/pkg/go-gfs-sdk"
+	"eddisonso.com/edd-cloud/pkg/metrics"
 	pb "eddisonso.com/edd-cloud/services/logging/proto/logging"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	entriesIngested = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "logging_entries_ingested_total",
+		Help: "Log entries received by source and level.",
+	}, []string{"source", "level"})
+	entriesDropped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "logging_entries_dropped_total",
+		Help: "Log entries dropped because a queue was full.",
+	}, []string{"queue"})
+	persistErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "logging_persist_errors_total",
+		Help: "Failed GFS appends of persisted log batches.",
+	})
+	persistDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "logging_persist_duration_seconds",
+		Help:    "GFS append latency for persisted log batches.",
+		Buckets: metrics.DefaultBuckets,
+	})
 )
 
 const bufferSize = 1000
@@ -161,6 +184,7 @@ func (s *LogServer) PushLog(ctx context.Context, req *pb.PushLogRequest) (*pb.Pu
 
 	// Track source
 	s.trackSource(entry.Source)
+	entriesIngested.WithLabelValues(entry.Source, entry.Level.String()).Inc()
 
 	// Add to appropriate ring buffer
 	buf := s.getOrCreateBuffer(entry.Source, entry.Level)
@@ -175,6 +199,7 @@ func (s *LogServer) PushLog(ctx context.Context, req *pb.PushLogRequest) (*pb.Pu
 		case s.persistCh <- entry:
 		default:
 			// Channel full, drop (logs are best-effort persisted)
+			entriesDropped.WithLabelValues("persist").Inc()
 		}
 	}
 
@@ -310,6 +335,7 @@ func (s *LogServer) broadcast(entry *pb.LogEntry) {
 		case ch <- entry:
 		default:
 			// Drop if subscriber is slow
+			entriesDropped.WithLabelValues("subscriber").Inc()
 		}
 	}
 }
@@ -375,7 +401,11 @@ func (s *LogServer) persistenceWorker() {
 				data = append(data, '\n')
 			}
 
-			if _, err := s.gfsClient.AppendWithNamespace(ctx, path, namespace, data); err != nil {
+			start := time.Now()
+			_, err := s.gfsClient.AppendWithNamespace(ctx, path, namespace, data)
+			metrics.Since(persistDuration, start)
+			if err != nil {
+				persistErrors.Inc()
 				slog.Warn("failed to persist logs", "path", path, "error", err)
 			}
 		}
@@ -9,23 +9,66 @@ import (
 	"log/slog"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
 
 	gfs "eddisonso.com/go-gfs/pkg/go-gfs-sdk"
+	"eddisonso.com/edd-cloud/pkg/metrics"
 	"eddisonso.com/edd-cloud/services/logging/internal/server"
 	pb "eddisonso.com/edd-cloud/services/logging/proto/logging"
 	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 	"google.golang.org/grpc"
 )
 
+var (
+	httpMetrics   = metrics.NewHTTPMetrics("logging")
+	wsConnections = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "logging_websocket_connections",
+		Help: "Open log stream WebSocket connections.",
+	})
+)
+
 var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool {
+	CheckOrigin: originAllowed,
+}
+
+// allowedOrigins is the comma-separated ALLOWED_ORIGINS allowlist shared with
+// the other edd-cloud services
+var allowedOrigins = loadAllowedOrigins()
+
+func loadAllowedOrigins() map[string]bool {
+	raw := os.Getenv("ALLOWED_ORIGINS")
+	if strings.TrimSpace(raw) == "" {
+		raw = "https://cloud.eddisonso.com,http://localhost:5173"
+	}
+	allowed := make(map[string]bool)
+	for _, origin := range strings.Split(raw, ",") {
+		if origin = strings.TrimSuffix(strings.TrimSpace(origin), "/"); origin != "" {
+			allowed[strings.ToLower(origin)] = true
+		}
+	}
+	return allowed
+}
+
+// originAllowed accepts WebSocket upgrades from allowlisted origins and the
+// service's own host
+func originAllowed(r *http.Request) bool {
+	origin := strings.ToLower(r.Header.Get("Origin"))
+	if origin == "" {
+		return false
+	}
+	if allowedOrigins[origin] {
 		return true
-	},
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
 }
 
 func main() {
@@ -77,7 +120,9 @@ func main() {
 		w.Write([]byte("ok"))
 	})
 
-	httpServer := &http.Server{Addr: *httpAddr}
+	http.Handle("GET /metrics", metrics.Handler())
+
+	httpServer := &http.Server{Addr: *httpAddr, Handler: httpMetrics.Instrument(http.DefaultServeMux)}
 	go func() {
 		slog.Info("HTTP server listening", "addr", *httpAddr)
 		if err := httpServer.ListenAndServe(); err != http.ErrServerClosed {
@@ -107,6 +152,8 @@ func handleWebSocket(w http.ResponseWriter, r *http.Request, logServer *server.L
 		return
 	}
 	defer conn.Close()
+	wsConnections.Inc()
+	defer wsConnections.Dec()
 
 	// Parse query parameters
 	source := r.URL.Query().Get("source")
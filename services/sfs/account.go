@@ -0,0 +1,365 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	minPasswordLength = 8
+	// Session last_seen is only written once per interval to avoid a database
+	// write on every request.
+	sessionTouchInterval = time.Minute
+)
+
+type accountInfo struct {
+	ID               int64    `json:"id"`
+	Username         string   `json:"username"`
+	DisplayName      string   `json:"display_name"`
+	Email            string   `json:"email,omitempty"`
+	HasPassword      bool     `json:"has_password"`
+	TwoFactorEnabled bool     `json:"two_factor_enabled"`
+	IsAdmin          bool     `json:"is_admin"`
+	Roles            []string `json:"roles"`
+}
+
+type accountUpdateRequest struct {
+	DisplayName *string `json:"display_name"`
+}
+
+// handleAccount handles GET and PUT on /api/account for the signed-in user.
+func (s *server) handleAccount(w http.ResponseWriter, r *http.Request) {
+	username, ok := s.requireAuth(w, r)
+	if !ok {
+		return
+	}
+	userID, ok := s.requireUserID(w, r)
+	if !ok {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var payload accountUpdateRequest
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			http.Error(w, "invalid payload", http.StatusBadRequest)
+			return
+		}
+		if payload.DisplayName != nil {
+			displayName := strings.TrimSpace(*payload.DisplayName)
+			if displayName == "" {
+				displayName = username
+			}
+			if len(displayName) > 100 {
+				http.Error(w, "display name too long", http.StatusBadRequest)
+				return
+			}
+			if _, err := s.db.Exec(`UPDATE users SET display_name = $1 WHERE id = $2`, displayName, userID); err != nil {
+				http.Error(w, "failed to update account", http.StatusInternalServerError)
+				return
+			}
+			s.sessions.invalidateUser(userID, "")
+		}
+	default:
+		w.Header().Set("Allow", "GET, PUT")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	roles, err := s.userRoles(userID)
+	if err != nil {
+		http.Error(w, "failed to load account", http.StatusInternalServerError)
+		return
+	}
+	info := accountInfo{ID: userID, Username: username, Roles: roles}
+	for _, role := range roles {
+		info.IsAdmin = info.IsAdmin || role == roleAdmin
+	}
+	var hash string
+	var totpEnabled int
+	if err := s.db.QueryRow(
+		`SELECT COALESCE(display_name, username), email, password_hash, totp_enabled FROM users WHERE id = $1`,
+		userID,
+	).Scan(&info.DisplayName, &info.Email, &hash, &totpEnabled); err != nil {
+		http.Error(w, "failed to load account", http.StatusInternalServerError)
+		return
+	}
+	if info.DisplayName == "" {
+		info.DisplayName = username
+	}
+	info.HasPassword = hash != ""
+	info.TwoFactorEnabled = totpEnabled != 0
+	writeJSON(w, info)
+}
+
+type passwordChangeRequest struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
+}
+
+func validatePassword(password string) string {
+	if len(password) < minPasswordLength {
+		return "password must be at least 8 characters"
+	}
+	return ""
+}
+
+// handleAccountPassword changes the signed-in user's password: POST
+// /api/account/password. Every other session of the user is revoked.
+func (s *server) handleAccountPassword(w http.ResponseWriter, r *http.Request) {
+	username, ok := s.requireAuth(w, r)
+	if !ok {
+		return
+	}
+	userID, ok := s.requireUserID(w, r)
+	if !ok {
+		return
+	}
+
+	var payload passwordChangeRequest
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		http.Error(w, "invalid payload", http.StatusBadRequest)
+		return
+	}
+	var hash string
+	if err := s.db.QueryRow(`SELECT password_hash FROM users WHERE id = $1`, userID).Scan(&hash); err != nil {
+		http.Error(w, "failed to load account", http.StatusInternalServerError)
+		return
+	}
+	if hash == "" {
+		http.Error(w, "this account signs in through single sign-on", http.StatusBadRequest)
+		return
+	}
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(payload.CurrentPassword)) != nil {
+		http.Error(w, "current password is incorrect", http.StatusBadRequest)
+		return
+	}
+	if msg := validatePassword(payload.NewPassword); msg != "" {
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+
+	if err := s.setPassword(userID, payload.NewPassword, s.sessionToken(r)); err != nil {
+		http.Error(w, "failed to change password", http.StatusInternalServerError)
+		return
+	}
+	s.recordAudit("", username, "account.password_change", "other sessions revoked")
+	writeJSON(w, map[string]string{"status": "ok"})
+}
+
+// setPassword stores a new password hash and revokes the user's sessions,
+// except keepToken when it is non-empty.
+func (s *server) setPassword(userID int64, password, keepToken string) error {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`UPDATE users SET password_hash = $1 WHERE id = $2`, string(hash), userID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM sessions WHERE user_id = $1 AND token <> $2`, userID, keepToken); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	s.sessions.invalidateUser(userID, keepToken)
+	return nil
+}
+
+type sessionInfo struct {
+	ID        int64  `json:"id"`
+	IP        string `json:"ip"`
+	UserAgent string `json:"user_agent"`
+	CreatedAt int64  `json:"created_at"`
+	LastSeen  int64  `json:"last_seen"`
+	ExpiresAt int64  `json:"expires_at"`
+	Current   bool   `json:"current"`
+}
+
+// handleAccountSessions lists the signed-in user's active sessions: GET
+// /api/account/sessions.
+func (s *server) handleAccountSessions(w http.ResponseWriter, r *http.Request) {
+	userID, ok := s.requireUserID(w, r)
+	if !ok {
+		return
+	}
+	current := s.sessionToken(r)
+
+	rows, err := s.db.Query(
+		`SELECT id, token, ip, user_agent, created_at, last_seen, expires_at
+		 FROM sessions WHERE user_id = $1 AND expires_at > $2
+		 ORDER BY last_seen DESC`,
+		userID,
+		time.Now().Unix(),
+	)
+	if err != nil {
+		http.Error(w, "failed to load sessions", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	sessions := make([]sessionInfo, 0)
+	for rows.Next() {
+		var info sessionInfo
+		var token string
+		if err := rows.Scan(&info.ID, &token, &info.IP, &info.UserAgent, &info.CreatedAt, &info.LastSeen, &info.ExpiresAt); err != nil {
+			http.Error(w, "failed to load sessions", http.StatusInternalServerError)
+			return
+		}
+		info.Current = token == current
+		sessions = append(sessions, info)
+	}
+	writeJSON(w, sessions)
+}
+
+// handleAccountSessionDelete revokes one of the user's sessions: DELETE
+// /api/account/sessions/{id}.
+func (s *server) handleAccountSessionDelete(w http.ResponseWriter, r *http.Request) {
+	userID, ok := s.requireUserID(w, r)
+	if !ok {
+		return
+	}
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid id", http.StatusBadRequest)
+		return
+	}
+
+	var token string
+	err = s.db.QueryRow(`DELETE FROM sessions WHERE id = $1 AND user_id = $2 RETURNING token`, id, userID).Scan(&token)
+	if err == sql.ErrNoRows {
+		http.Error(w, "session not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "failed to revoke session", http.StatusInternalServerError)
+		return
+	}
+	s.sessions.invalidate(token)
+	writeJSON(w, map[string]string{"status": "ok"})
+}
+
+// touchSession records activity on a session, at most once per
+// sessionTouchInterval.
+func (s *server) touchSession(token string) {
+	now := time.Now()
+	_, _ = s.db.Exec(
+		`UPDATE sessions SET last_seen = $1 WHERE token = $2 AND last_seen < $3`,
+		now.Unix(),
+		token,
+		now.Add(-sessionTouchInterval).Unix(),
+	)
+}
+
+type adminUserUpdateRequest struct {
+	Password    *string `json:"password"`
+	DisplayName *string `json:"display_name"`
+	Disabled    *bool   `json:"disabled"`
+}
+
+// handleAdminUsersUpdate resets a password, renames or disables a user without
+// deleting it: PUT /admin/users?id=. Resetting the password or disabling the
+// account signs the user out everywhere.
+func (s *server) handleAdminUsersUpdate(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid id", http.StatusBadRequest)
+		return
+	}
+	var payload adminUserUpdateRequest
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		http.Error(w, "invalid payload", http.StatusBadRequest)
+		return
+	}
+
+	var target string
+	if err := s.db.QueryRow(`SELECT username FROM users WHERE id = $1`, id).Scan(&target); err != nil {
+		http.Error(w, "user not found", http.StatusNotFound)
+		return
+	}
+	currentUsername, _ := s.currentUser(r)
+
+	if payload.Disabled != nil && *payload.Disabled && target == currentUsername {
+		http.Error(w, "cannot disable yourself", http.StatusBadRequest)
+		return
+	}
+	if payload.Password != nil {
+		if msg := validatePassword(*payload.Password); msg != "" {
+			http.Error(w, msg, http.StatusBadRequest)
+			return
+		}
+	}
+
+	if payload.DisplayName != nil {
+		displayName := strings.TrimSpace(*payload.DisplayName)
+		if displayName == "" {
+			displayName = target
+		}
+		if _, err := s.db.Exec(`UPDATE users SET display_name = $1 WHERE id = $2`, displayName, id); err != nil {
+			http.Error(w, "failed to update user", http.StatusInternalServerError)
+			return
+		}
+		s.sessions.invalidateUser(id, "")
+	}
+	if payload.Password != nil {
+		if err := s.setPassword(id, *payload.Password, ""); err != nil {
+			http.Error(w, "failed to reset password", http.StatusInternalServerError)
+			return
+		}
+		s.recordAudit("", currentUsername, "user.password_reset", target)
+	}
+	if payload.Disabled != nil {
+		disabled := 0
+		if *payload.Disabled {
+			disabled = 1
+		}
+		if _, err := s.db.Exec(`UPDATE users SET disabled = $1 WHERE id = $2`, disabled, id); err != nil {
+			http.Error(w, "failed to update user", http.StatusInternalServerError)
+			return
+		}
+		if *payload.Disabled {
+			_, _ = s.db.Exec(`DELETE FROM sessions WHERE user_id = $1`, id)
+			_, _ = s.db.Exec(`DELETE FROM login_challenges WHERE user_id = $1`, id)
+			s.sessions.invalidateUser(id, "")
+			s.recordAudit("", currentUsername, "user.disable", target)
+		} else {
+			s.recordAudit("", currentUsername, "user.enable", target)
+		}
+	}
+
+	var u adminUser
+	var disabled int
+	if err := s.db.QueryRow(
+		`SELECT id, username, COALESCE(display_name, username), disabled FROM users WHERE id = $1`,
+		id,
+	).Scan(&u.ID, &u.Username, &u.DisplayName, &disabled); err != nil {
+		http.Error(w, "failed to load user", http.StatusInternalServerError)
+		return
+	}
+	u.Disabled = disabled != 0
+	if u.Roles, err = s.userRoles(id); err != nil {
+		http.Error(w, "failed to load user", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, u)
+}
+
+func truncate(value string, limit int) string {
+	if len(value) <= limit {
+		return value
+	}
+	return value[:limit]
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	_ "embed"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"strings"
+
+	"eddisonso.com/edd-cloud/pkg/httpapi"
+)
+
+// The /api/v1 surface serves the same handlers as the legacy routes, with the
+// prefix mapped onto them:
+//
+//	/api/v1/storage/...             -> /storage/...
+//	/api/v1/admin/...               -> /admin/...
+//	/api/v1/drop/...                -> /drop/...
+//	/api/v1/ws                      -> /ws
+//	/api/v1/.well-known/jwks.json   -> /.well-known/jwks.json
+//	/api/v1/metrics                 -> /metrics
+//	/api/v1/...                     -> /api/...
+//
+// Unlike the legacy routes, every error is a JSON envelope:
+//
+//	{"error": {"code": "not_found", "message": "...", "request_id": "...", "details": ...}}
+//
+// Handlers keep calling http.Error; httpapi.ErrorWriter rewrites plain-text
+// error responses into the envelope, so both surfaces stay in sync.
+
+const apiV1Prefix = "/api/v1"
+
+//go:embed openapi.json
+var openAPISpec []byte
+
+type apiV1Key struct{}
+
+// isAPIv1 reports whether r arrived through the v1 API.
+func isAPIv1(r *http.Request) bool {
+	v1, _ := r.Context().Value(apiV1Key{}).(bool)
+	return v1
+}
+
+// legacyPath maps an /api/v1 path onto the route that serves it.
+func legacyPath(path string) string {
+	rest := strings.TrimPrefix(path, apiV1Prefix)
+	switch {
+	case rest == "/ws", rest == "/metrics", rest == "/.well-known/jwks.json",
+		rest == "/storage" || strings.HasPrefix(rest, "/storage/"),
+		rest == "/admin" || strings.HasPrefix(rest, "/admin/"),
+		strings.HasPrefix(rest, "/drop/"):
+		return rest
+	}
+	return "/api" + rest
+}
+
+// apiV1 serves the versioned API: it answers the OpenAPI document, rewrites
+// the path onto the legacy route and turns error responses into envelopes.
+// routes is consulted so unknown v1 paths 404 instead of reaching the static
+// file fallback.
+func (s *server) apiV1(routes *http.ServeMux, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != apiV1Prefix && !strings.HasPrefix(r.URL.Path, apiV1Prefix+"/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if r.URL.Path == apiV1Prefix+"/openapi.json" {
+			if r.Method != http.MethodGet && r.Method != http.MethodHead {
+				w.Header().Set("Allow", "GET, HEAD")
+				httpapi.WriteError(w, r, http.StatusMethodNotAllowed, "method not allowed", nil)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Cache-Control", "public, max-age=300")
+			_, _ = w.Write(openAPISpec)
+			return
+		}
+
+		legacy := r.Clone(context.WithValue(r.Context(), apiV1Key{}, true))
+		legacy.URL.Path = legacyPath(r.URL.Path)
+		legacy.URL.RawPath = ""
+		if _, pattern := routes.Handler(legacy); pattern == "/" {
+			httpapi.WriteError(w, r, http.StatusNotFound, "no such endpoint", map[string]string{"path": r.URL.Path})
+			return
+		}
+
+		ew := httpapi.NewErrorWriter(w, r)
+		defer ew.Finish()
+		next.ServeHTTP(ew, legacy)
+	})
+}
+
+// storageErrorStatus picks the status for a failed storage operation instead
+// of blaming the backend for every error.
+func storageErrorStatus(err error) int {
+	var maxBytes *http.MaxBytesError
+	switch {
+	case errors.Is(err, errFileExists), errors.Is(err, errNamespaceRenaming):
+		return http.StatusConflict
+	case errors.Is(err, errDraining):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, fs.ErrNotExist):
+		return http.StatusNotFound
+	case errors.As(err, &maxBytes):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout
+	case errors.Is(err, context.Canceled), errors.Is(err, io.ErrUnexpectedEOF):
+		// The client went away or sent a truncated body.
+		return http.StatusBadRequest
+	}
+	return http.StatusBadGateway
+}
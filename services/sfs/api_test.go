@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// TestOpenAPIPathsRouted walks every operation in openapi.json and checks the
+// v1 path reaches a registered route rather than the static fallback.
+func TestOpenAPIPathsRouted(t *testing.T) {
+	var spec struct {
+		Paths map[string]map[string]json.RawMessage `json:"paths"`
+	}
+	if err := json.Unmarshal(openAPISpec, &spec); err != nil {
+		t.Fatal(err)
+	}
+	routes := (&server{limits: newTrafficLimits(roleLimits{}, roleLimits{}, roleLimits{}, 0)}).routes()
+	param := regexp.MustCompile(`\{[^}]+\}`)
+
+	for path, ops := range spec.Paths {
+		concrete := param.ReplaceAllString(path, "x")
+		for method := range ops {
+			if method == "parameters" {
+				continue
+			}
+			r := httptest.NewRequest(strings.ToUpper(method), apiV1Prefix+concrete, nil)
+			r.URL.Path = legacyPath(r.URL.Path)
+			if _, pattern := routes.Handler(r); pattern == "" || pattern == "/" {
+				t.Errorf("%s %s: no route for %s", strings.ToUpper(method), path, r.URL.Path)
+			}
+		}
+	}
+}
+
+func TestLegacyPath(t *testing.T) {
+	tests := map[string]string{
+		"/api/v1/login":                 "/api/login",
+		"/api/v1/storage/files":         "/storage/files",
+		"/api/v1/admin/users":           "/admin/users",
+		"/api/v1/drop/abc123":           "/drop/abc123",
+		"/api/v1/ws":                    "/ws",
+		"/api/v1/.well-known/jwks.json": "/.well-known/jwks.json",
+		"/api/v1/metrics":               "/metrics",
+		"/api/v1/storagex":              "/api/storagex",
+	}
+	for in, want := range tests {
+		if got := legacyPath(in); got != want {
+			t.Errorf("legacyPath(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// auditEvent is a single entry in the audit trail. Namespace is empty for
+// events that are not tied to a namespace, such as logins.
+type auditEvent struct {
+	ID        int64  `json:"id"`
+	Namespace string `json:"namespace,omitempty"`
+	Actor     string `json:"actor"`
+	Action    string `json:"action"`
+	Detail    string `json:"detail,omitempty"`
+	CreatedAt int64  `json:"created_at"`
+}
+
+// recordAudit appends an event to the audit trail. Failures are logged rather
+// than returned so auditing never breaks the request that triggered it.
+func (s *server) recordAudit(namespace, actor, action, detail string) {
+	_, err := s.db.Exec(
+		`INSERT INTO audit_events (namespace, actor, action, detail, created_at) VALUES ($1, $2, $3, $4, $5)`,
+		namespace,
+		actor,
+		action,
+		detail,
+		time.Now().Unix(),
+	)
+	if err != nil {
+		log.Printf("audit write failed namespace=%s action=%s err=%v", namespace, action, err)
+	}
+}
+
+// loadAuditEvents returns events newest first. An empty namespace matches
+// every event.
+func (s *server) loadAuditEvents(namespace string, before int64, limit int) ([]auditEvent, error) {
+	query := `SELECT id, namespace, actor, action, detail, created_at FROM audit_events WHERE ($1::text = '' OR namespace = $1)`
+	args := []any{namespace}
+	if before > 0 {
+		query += ` AND id < $2`
+		args = append(args, before)
+	}
+	query += ` ORDER BY id DESC LIMIT ` + strconv.Itoa(limit)
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := make([]auditEvent, 0)
+	for rows.Next() {
+		var ev auditEvent
+		if err := rows.Scan(&ev.ID, &ev.Namespace, &ev.Actor, &ev.Action, &ev.Detail, &ev.CreatedAt); err != nil {
+			return nil, err
+		}
+		events = append(events, ev)
+	}
+	return events, rows.Err()
+}
+
+// auditPage reads the ?before and ?limit paging parameters.
+func auditPage(r *http.Request) (int64, int) {
+	before, _ := strconv.ParseInt(r.URL.Query().Get("before"), 10, 64)
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit <= 0 || limit > 500 {
+		limit = 100
+	}
+	return before, limit
+}
+
+// handleNamespaceAudit handles GET /storage/namespaces/{name}/audit for the
+// namespace owner or an admin.
+func (s *server) handleNamespaceAudit(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.requireAuth(w, r); !ok {
+		return
+	}
+
+	name, err := sanitizeNamespace(r.PathValue("name"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !s.canManageNamespace(r, name) {
+		s.denyAccess(w, r)
+		return
+	}
+
+	before, limit := auditPage(r)
+	events, err := s.loadAuditEvents(name, before, limit)
+	if err != nil {
+		http.Error(w, "failed to load audit events", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, events)
+}
+
+// handleAdminAudit handles GET /admin/audit, optionally filtered by
+// ?namespace.
+func (s *server) handleAdminAudit(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.requireRole(w, r, roleAuditor); !ok {
+		return
+	}
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	before, limit := auditPage(r)
+	events, err := s.loadAuditEvents(r.URL.Query().Get("namespace"), before, limit)
+	if err != nil {
+		http.Error(w, "failed to load audit events", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, events)
+}
@@ -0,0 +1,537 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// POST /storage/batch runs a list of file operations in one request:
+//
+//	{"operations": [
+//	  {"op": "delete", "namespace": "docs", "name": "a.txt"},
+//	  {"op": "move", "namespace": "docs", "name": "b.txt", "to_namespace": "archive"},
+//	  {"op": "copy", "namespace": "docs", "name": "c.txt", "to_name": "c-copy.txt"},
+//	  {"op": "set_tags", "namespace": "docs", "name": "d.txt", "tags": {"project": "x"}}
+//	], "async": false}
+//
+// Operations run with bounded concurrency and each gets its own result; one
+// failing item doesn't stop the rest. Small batches answer 200 with every
+// result. Large ones, or any batch with "async": true, answer 202 with a job
+// that GET /storage/batch/{id} reports on until it is done.
+
+const (
+	maxBatchOperations = 1000
+	// maxSyncBatch is the largest batch run inside the request.
+	maxSyncBatch = 100
+	// batchJobStaleAfter marks a running job as interrupted once its replica
+	// stops reporting progress, e.g. because it was restarted.
+	batchJobStaleAfter = 2 * time.Minute
+	batchJobRetention  = 7 * 24 * time.Hour
+
+	maxFileTags     = 20
+	maxTagKeyLen    = 64
+	maxTagValueLen  = 256
+	batchOpDelete   = "delete"
+	batchOpMove     = "move"
+	batchOpCopy     = "copy"
+	batchOpSetTags  = "set_tags"
+	batchJobRunning = "running"
+	batchJobDone    = "done"
+	batchJobStale   = "interrupted"
+)
+
+type batchOperation struct {
+	Op          string            `json:"op"`
+	Namespace   string            `json:"namespace"`
+	Name        string            `json:"name"`
+	ToNamespace string            `json:"to_namespace,omitempty"`
+	ToName      string            `json:"to_name,omitempty"`
+	Overwrite   bool              `json:"overwrite,omitempty"`
+	Tags        map[string]string `json:"tags,omitempty"`
+}
+
+type batchRequest struct {
+	Operations []batchOperation `json:"operations"`
+	Async      bool             `json:"async"`
+}
+
+// batchResult reports one operation; Status is the HTTP status the equivalent
+// single-file request would have returned.
+type batchResult struct {
+	Index  int    `json:"index"`
+	Op     string `json:"op"`
+	Status int    `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type batchJob struct {
+	// mu guards the counters while the batch runs.
+	mu sync.Mutex
+
+	ID         string        `json:"id,omitempty"`
+	Status     string        `json:"status"`
+	Total      int           `json:"total"`
+	Completed  int           `json:"completed"`
+	Failed     int           `json:"failed"`
+	CreatedAt  int64         `json:"created_at,omitempty"`
+	FinishedAt int64         `json:"finished_at,omitempty"`
+	Results    []batchResult `json:"results,omitempty"`
+}
+
+// batchTask is a validated operation waiting to run.
+type batchTask struct {
+	index int
+	op    batchOperation
+}
+
+func (s *server) handleBatch(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.requireAuth(w, r); !ok {
+		return
+	}
+	session := s.session(r)
+
+	var payload batchRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&payload); err != nil {
+		http.Error(w, "invalid batch payload", http.StatusBadRequest)
+		return
+	}
+	if len(payload.Operations) == 0 {
+		http.Error(w, "operations required", http.StatusBadRequest)
+		return
+	}
+	if len(payload.Operations) > maxBatchOperations {
+		http.Error(w, fmt.Sprintf("too many operations (max %d)", maxBatchOperations), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	// Permissions are checked up front, while the request is at hand; async
+	// jobs outlive it.
+	results := make([]batchResult, len(payload.Operations))
+	var tasks []batchTask
+	for i, op := range payload.Operations {
+		normalized, status, err := s.validateBatchOperation(r, op)
+		results[i] = batchResult{Index: i, Op: op.Op, Status: status}
+		if err != nil {
+			results[i].Error = err.Error()
+			continue
+		}
+		tasks = append(tasks, batchTask{index: i, op: normalized})
+	}
+
+	job := &batchJob{
+		Status:    batchJobRunning,
+		Total:     len(payload.Operations),
+		Completed: len(payload.Operations) - len(tasks),
+		Failed:    len(payload.Operations) - len(tasks),
+		CreatedAt: time.Now().Unix(),
+	}
+
+	if !payload.Async && len(payload.Operations) <= maxSyncBatch {
+		finish, err := s.beginUpload(w)
+		if err != nil {
+			http.Error(w, err.Error(), storageErrorStatus(err))
+			return
+		}
+		defer finish()
+		s.runBatch(r.Context(), tasks, results, job, nil)
+		job.Status = batchJobDone
+		job.FinishedAt = time.Now().Unix()
+		job.Results = results
+		writeJSON(w, job)
+		return
+	}
+
+	jobCtx, finish, err := s.beginJob(w)
+	if err != nil {
+		http.Error(w, err.Error(), storageErrorStatus(err))
+		return
+	}
+	id, err := generateToken(12)
+	if err != nil {
+		finish()
+		http.Error(w, "failed to create batch job", http.StatusInternalServerError)
+		return
+	}
+	job.ID = id
+	if err := s.saveBatchJob(job, session.UserID, results); err != nil {
+		finish()
+		log.Printf("batch job create failed: %v", err)
+		http.Error(w, "failed to create batch job", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Location", "/storage/batch/"+id)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	_ = json.NewEncoder(w).Encode(job)
+	go func() {
+		defer finish()
+		s.runBatchJob(jobCtx, job, tasks, results, session.UserID)
+	}()
+}
+
+// handleBatchStatus reports an async batch job: GET /storage/batch/{id}.
+// Jobs are visible to the user who started them and to storage admins.
+func (s *server) handleBatchStatus(w http.ResponseWriter, r *http.Request) {
+	username, ok := s.requireAuth(w, r)
+	if !ok {
+		return
+	}
+	session := s.session(r)
+
+	var job batchJob
+	var userID int64
+	var rawResults string
+	var updatedAt int64
+	err := s.db.QueryRow(
+		`SELECT id, user_id, status, total, completed, failed, results, created_at, updated_at, finished_at
+		 FROM batch_jobs WHERE id = $1`,
+		r.PathValue("id"),
+	).Scan(&job.ID, &userID, &job.Status, &job.Total, &job.Completed, &job.Failed, &rawResults, &job.CreatedAt, &updatedAt, &job.FinishedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "batch job not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "failed to load batch job", http.StatusInternalServerError)
+		return
+	}
+	if userID != session.UserID && !s.hasRole(username, roleStorageAdmin) {
+		http.Error(w, "batch job not found", http.StatusNotFound)
+		return
+	}
+	if job.Status == batchJobRunning && time.Since(time.Unix(updatedAt, 0)) > batchJobStaleAfter {
+		job.Status = batchJobStale
+	}
+	if job.Status != batchJobRunning && rawResults != "" {
+		if err := json.Unmarshal([]byte(rawResults), &job.Results); err != nil {
+			log.Printf("batch job %s has unreadable results: %v", job.ID, err)
+		}
+	}
+	writeJSON(w, &job)
+}
+
+// validateBatchOperation normalizes an operation and checks the caller may
+// run it, returning the status to report when it may not.
+func (s *server) validateBatchOperation(r *http.Request, op batchOperation) (batchOperation, int, error) {
+	op.Op = strings.TrimSpace(op.Op)
+	switch op.Op {
+	case batchOpDelete, batchOpMove, batchOpCopy, batchOpSetTags:
+	default:
+		return op, http.StatusBadRequest, fmt.Errorf("unknown op %q", op.Op)
+	}
+
+	var err error
+	if op.Namespace, err = batchNamespace(op.Namespace); err != nil {
+		return op, http.StatusBadRequest, err
+	}
+	if op.Name, err = sanitizePath(op.Name); err != nil {
+		return op, http.StatusBadRequest, err
+	}
+	if !s.canAccessNamespace(r, op.Namespace) {
+		return op, http.StatusForbidden, errors.New("forbidden")
+	}
+
+	switch op.Op {
+	case batchOpMove, batchOpCopy:
+		if op.ToNamespace == "" {
+			op.ToNamespace = op.Namespace
+		} else if op.ToNamespace, err = batchNamespace(op.ToNamespace); err != nil {
+			return op, http.StatusBadRequest, err
+		}
+		if op.ToName == "" {
+			op.ToName = op.Name
+		} else if op.ToName, err = sanitizePath(op.ToName); err != nil {
+			return op, http.StatusBadRequest, err
+		}
+		if op.ToNamespace == op.Namespace && op.ToName == op.Name {
+			return op, http.StatusBadRequest, errors.New("source and destination are the same")
+		}
+		if !s.canAccessNamespace(r, op.ToNamespace) {
+			return op, http.StatusForbidden, errors.New("forbidden")
+		}
+		exists, err := s.namespaceExists(op.ToNamespace)
+		if err != nil {
+			return op, http.StatusInternalServerError, errors.New("failed to verify namespace")
+		}
+		if !exists {
+			return op, http.StatusNotFound, errors.New("destination namespace does not exist")
+		}
+	case batchOpSetTags:
+		if err := validateTags(op.Tags); err != nil {
+			return op, http.StatusBadRequest, err
+		}
+	}
+	return op, http.StatusOK, nil
+}
+
+func batchNamespace(raw string) (string, error) {
+	if strings.TrimSpace(raw) == "" {
+		return defaultNamespace, nil
+	}
+	return sanitizeNamespace(raw)
+}
+
+func validateTags(tags map[string]string) error {
+	if len(tags) > maxFileTags {
+		return fmt.Errorf("too many tags (max %d)", maxFileTags)
+	}
+	for key, value := range tags {
+		if strings.TrimSpace(key) == "" || len(key) > maxTagKeyLen {
+			return fmt.Errorf("tag keys must be 1-%d characters", maxTagKeyLen)
+		}
+		if len(value) > maxTagValueLen {
+			return fmt.Errorf("tag %q is longer than %d characters", key, maxTagValueLen)
+		}
+	}
+	return nil
+}
+
+// runBatch executes tasks with at most s.batchConcurrency in flight, filling
+// in results and the job's counters. Each operation gets the upload timeout.
+// progress, if set, is called after each task with job.mu held.
+func (s *server) runBatch(ctx context.Context, tasks []batchTask, results []batchResult, job *batchJob, progress func()) {
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, max(s.batchConcurrency, 1))
+	for _, task := range tasks {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(task batchTask) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			opCtx, cancel := context.WithTimeout(ctx, s.uploadTTL)
+			status, err := s.runBatchOperation(opCtx, task.op)
+			cancel()
+
+			job.mu.Lock()
+			defer job.mu.Unlock()
+			results[task.index].Status = status
+			job.Completed++
+			if err != nil {
+				results[task.index].Error = err.Error()
+				job.Failed++
+			}
+			if progress != nil {
+				progress()
+			}
+		}(task)
+	}
+	wg.Wait()
+}
+
+func (s *server) runBatchOperation(ctx context.Context, op batchOperation) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return storageErrorStatus(err), err
+	}
+	if _, err := s.storage.GetFileWithNamespace(ctx, op.Name, s.gfsNamespace(op.Namespace)); err != nil {
+		return http.StatusNotFound, fmt.Errorf("file not found: %s", op.Name)
+	}
+
+	switch op.Op {
+	case batchOpDelete:
+		if err := s.deleteFile(ctx, op.Namespace, op.Name); err != nil {
+			return storageErrorStatus(err), fmt.Errorf("delete failed: %w", err)
+		}
+		s.recordChange(op.Namespace, changeDeleted, op.Name, "", 0)
+	case batchOpCopy, batchOpMove:
+		existed, size, err := s.copyFile(ctx, op.Namespace, op.Name, op.ToNamespace, op.ToName, op.Overwrite)
+		if err != nil {
+			if errors.Is(err, errFileExists) {
+				return http.StatusConflict, fmt.Errorf("file already exists: %s", op.ToName)
+			}
+			return storageErrorStatus(err), err
+		}
+		if op.Op == batchOpCopy {
+			s.recordChange(op.ToNamespace, writeOp(existed), op.ToName, "", size)
+			break
+		}
+		// The copy is done, so finish the move even if the job is being
+		// cancelled rather than leave the file in both places.
+		removeCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), partialCleanupTimeout)
+		err = s.deleteFile(removeCtx, op.Namespace, op.Name)
+		cancel()
+		if err != nil {
+			s.recordChange(op.ToNamespace, writeOp(existed), op.ToName, "", size)
+			return storageErrorStatus(err), fmt.Errorf("copied, but removing the source failed: %w", err)
+		}
+		// Within a namespace sync clients see a rename; across namespaces
+		// each side sees its half.
+		if op.ToNamespace == op.Namespace {
+			s.recordChange(op.Namespace, changeMoved, op.ToName, op.Name, size)
+		} else {
+			s.recordChange(op.Namespace, changeDeleted, op.Name, "", 0)
+			s.recordChange(op.ToNamespace, writeOp(existed), op.ToName, "", size)
+		}
+	case batchOpSetTags:
+		if err := s.setFileTags(op.Namespace, op.Name, op.Tags); err != nil {
+			return http.StatusInternalServerError, errors.New("failed to save tags")
+		}
+	}
+	return http.StatusOK, nil
+}
+
+// copyFile copies a file's contents and tags. The data goes through
+// readFile/writeFile so it is re-encoded for the destination namespace.
+// Reports whether a destination file was replaced and the bytes copied.
+func (s *server) copyFile(ctx context.Context, srcNamespace, srcName, dstNamespace, dstName string, overwrite bool) (bool, int64, error) {
+	existed, err := s.prepareFile(ctx, dstNamespace, dstName, overwrite)
+	if err != nil {
+		return existed, 0, err
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		_, err := s.readFile(ctx, srcNamespace, srcName, pw)
+		pw.CloseWithError(err)
+	}()
+	counting := &countingReader{reader: pr}
+	_, err = s.writeFile(ctx, dstNamespace, dstName, counting)
+	pr.CloseWithError(err)
+	if err != nil {
+		cleanupCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 10*time.Second)
+		defer cancel()
+		if cleanupErr := s.deleteFile(cleanupCtx, dstNamespace, dstName); cleanupErr != nil {
+			log.Printf("batch copy cleanup failed namespace=%s name=%s err=%v", dstNamespace, dstName, cleanupErr)
+		}
+		return existed, 0, fmt.Errorf("copy failed: %w", err)
+	}
+	if _, err := s.db.Exec(
+		`INSERT INTO file_metadata (namespace, path, tags, updated_at)
+		 SELECT $3, $4, tags, $5 FROM file_metadata WHERE namespace = $1 AND path = $2
+		 ON CONFLICT (namespace, path) DO UPDATE SET tags = excluded.tags, updated_at = excluded.updated_at`,
+		srcNamespace, srcName, dstNamespace, dstName, time.Now().Unix(),
+	); err != nil {
+		log.Printf("batch copy tags failed namespace=%s name=%s err=%v", dstNamespace, dstName, err)
+	}
+	return existed, counting.read, nil
+}
+
+// setFileTags replaces a file's tags; an empty set removes them.
+func (s *server) setFileTags(namespace, name string, tags map[string]string) error {
+	if len(tags) == 0 {
+		_, err := s.db.Exec(`DELETE FROM file_metadata WHERE namespace = $1 AND path = $2`, namespace, name)
+		return err
+	}
+	encoded, err := json.Marshal(tags)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(
+		`INSERT INTO file_metadata (namespace, path, tags, updated_at) VALUES ($1, $2, $3, $4)
+		 ON CONFLICT (namespace, path) DO UPDATE SET tags = excluded.tags, updated_at = excluded.updated_at`,
+		namespace, name, string(encoded), time.Now().Unix(),
+	)
+	return err
+}
+
+// loadFileTags returns the tags of every tagged file in a namespace.
+func (s *server) loadFileTags(namespace string) (map[string]map[string]string, error) {
+	rows, err := s.db.Query(`SELECT path, tags FROM file_metadata WHERE namespace = $1`, namespace)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tags := make(map[string]map[string]string)
+	for rows.Next() {
+		var path, raw string
+		if err := rows.Scan(&path, &raw); err != nil {
+			return nil, err
+		}
+		var fileTags map[string]string
+		if err := json.Unmarshal([]byte(raw), &fileTags); err != nil {
+			continue
+		}
+		tags[path] = fileTags
+	}
+	return tags, rows.Err()
+}
+
+// runBatchJob runs an async batch, saving progress at most once a second and
+// at least every 30 seconds so pollers can tell it is still alive. Once ctx
+// is cancelled the operations still to run fail, and copies in progress
+// remove their partial destination.
+func (s *server) runBatchJob(ctx context.Context, job *batchJob, tasks []batchTask, results []batchResult, userID int64) {
+	lastSave := time.Now()
+	save := func() {
+		if err := s.updateBatchJob(job); err != nil {
+			log.Printf("batch job %s progress update failed: %v", job.ID, err)
+		}
+		lastSave = time.Now()
+	}
+
+	heartbeat := time.NewTicker(30 * time.Second)
+	defer heartbeat.Stop()
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-heartbeat.C:
+				job.mu.Lock()
+				save()
+				job.mu.Unlock()
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	s.runBatch(ctx, tasks, results, job, func() {
+		if time.Since(lastSave) >= time.Second {
+			save()
+		}
+	})
+	close(done)
+
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	job.Status = batchJobDone
+	job.FinishedAt = time.Now().Unix()
+	if err := s.saveBatchJob(job, userID, results); err != nil {
+		log.Printf("batch job %s save failed: %v", job.ID, err)
+	}
+	log.Printf("batch job %s done total=%d failed=%d", job.ID, job.Total, job.Failed)
+}
+
+// saveBatchJob writes the whole job, results included.
+func (s *server) saveBatchJob(job *batchJob, userID int64, results []batchResult) error {
+	var encoded []byte
+	if job.Status != batchJobRunning {
+		var err error
+		if encoded, err = json.Marshal(results); err != nil {
+			return err
+		}
+	}
+	_, err := s.db.Exec(
+		`INSERT INTO batch_jobs (id, user_id, status, total, completed, failed, results, created_at, updated_at, finished_at)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		 ON CONFLICT (id) DO UPDATE SET
+		   status = excluded.status,
+		   completed = excluded.completed,
+		   failed = excluded.failed,
+		   results = excluded.results,
+		   updated_at = excluded.updated_at,
+		   finished_at = excluded.finished_at`,
+		job.ID, userID, job.Status, job.Total, job.Completed, job.Failed, string(encoded),
+		job.CreatedAt, time.Now().Unix(), job.FinishedAt,
+	)
+	return err
+}
+
+// updateBatchJob saves a running job's counters.
+func (s *server) updateBatchJob(job *batchJob) error {
+	_, err := s.db.Exec(
+		`UPDATE batch_jobs SET completed = $2, failed = $3, updated_at = $4 WHERE id = $1`,
+		job.ID, job.Completed, job.Failed, time.Now().Unix(),
+	)
+	return err
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Every namespace has a change journal that sync clients read instead of
+// diffing listings. Entries are numbered by a per-namespace sequence; the
+// sequence row is locked while an entry is inserted, so entries commit in
+// sequence order and a reader never sees a gap that fills in later.
+//
+// GET /storage/changes?namespace=docs&since=41 returns entries after 41 and
+// the cursor to pass next time. Leaving out since returns no entries, only
+// the current cursor, for clients that have just listed the namespace. With
+// wait set, the request long-polls until something changes. Replicas wake
+// each other's long-polls with Postgres NOTIFY.
+//
+// Entries older than the retention are pruned. A cursor from before the
+// pruned range, or from a namespace that has since been deleted, answers 410
+// and the client has to list the namespace again.
+
+const (
+	changeCreated     = "created"
+	changeOverwritten = "overwritten"
+	changeDeleted     = "deleted"
+	changeMoved       = "moved"
+
+	changesChannel      = "sfs_changes"
+	defaultChangesLimit = 500
+	maxChangesLimit     = 1000
+	maxChangesWait      = 60 * time.Second
+	// changesPollInterval rechecks the journal during long-polls in case a
+	// notification was lost while the listener reconnected.
+	changesPollInterval = 5 * time.Second
+)
+
+type fileChange struct {
+	Seq       int64  `json:"seq"`
+	Op        string `json:"op"`
+	Path      string `json:"path"`
+	OldPath   string `json:"old_path,omitempty"`
+	Size      int64  `json:"size,omitempty"`
+	CreatedAt int64  `json:"created_at"`
+}
+
+type changesResponse struct {
+	Namespace string       `json:"namespace"`
+	Cursor    int64        `json:"cursor"`
+	HasMore   bool         `json:"has_more"`
+	Changes   []fileChange `json:"changes"`
+}
+
+// writeOp picks the journal op for a finished write.
+func writeOp(existed bool) string {
+	if existed {
+		return changeOverwritten
+	}
+	return changeCreated
+}
+
+// recordChange appends to a namespace's journal. Like the stats updates,
+// failures are only logged: the storage change has already happened.
+func (s *server) recordChange(namespace, op, path, oldPath string, size int64) {
+	_, err := s.db.Exec(
+		`WITH next AS (
+		   INSERT INTO change_sequences (namespace, seq) VALUES ($1, 1)
+		   ON CONFLICT (namespace) DO UPDATE SET seq = change_sequences.seq + 1
+		   RETURNING seq
+		 )
+		 INSERT INTO file_changes (namespace, seq, op, path, old_path, size, created_at)
+		 SELECT $1, seq, $2, $3, $4, $5, $6 FROM next`,
+		namespace,
+		op,
+		path,
+		oldPath,
+		size,
+		time.Now().Unix(),
+	)
+	if err != nil {
+		log.Printf("change journal append failed namespace=%s op=%s path=%s err=%v", namespace, op, path, err)
+		return
+	}
+	s.notifyChange(namespace)
+}
+
+func (s *server) notifyChange(namespace string) {
+	if _, err := s.db.Exec(`SELECT pg_notify($1, $2)`, changesChannel, namespace); err != nil {
+		log.Printf("change notify failed namespace=%s err=%v", namespace, err)
+	}
+}
+
+// resetChanges drops a namespace's journal when the namespace is deleted.
+// The sequence is kept and marked pruned, so cursors handed out before fail
+// with 410 instead of silently matching a recreated namespace.
+func (s *server) resetChanges(namespace string) error {
+	if _, err := s.db.Exec(`DELETE FROM file_changes WHERE namespace = $1`, namespace); err != nil {
+		return err
+	}
+	if _, err := s.db.Exec(`UPDATE change_sequences SET pruned_through = seq WHERE namespace = $1`, namespace); err != nil {
+		return err
+	}
+	s.notifyChange(namespace)
+	return nil
+}
+
+var errCursorExpired = errors.New("cursor expired, list the namespace and start again")
+
+// loadChanges returns up to limit entries after since, along with the
+// namespace's current sequence. A negative since only fetches the sequence.
+func (s *server) loadChanges(namespace string, since int64, limit int) ([]fileChange, int64, error) {
+	var seq, prunedThrough int64
+	err := s.db.QueryRow(
+		`SELECT seq, pruned_through FROM change_sequences WHERE namespace = $1`,
+		namespace,
+	).Scan(&seq, &prunedThrough)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, 0, err
+	}
+	if since < 0 {
+		return nil, seq, nil
+	}
+	if since < prunedThrough || since > seq {
+		return nil, seq, errCursorExpired
+	}
+	if since == seq {
+		return nil, seq, nil
+	}
+
+	rows, err := s.db.Query(
+		`SELECT seq, op, path, old_path, size, created_at FROM file_changes
+		 WHERE namespace = $1 AND seq > $2
+		 ORDER BY seq
+		 LIMIT $3`,
+		namespace,
+		since,
+		limit,
+	)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	var changes []fileChange
+	for rows.Next() {
+		var change fileChange
+		if err := rows.Scan(&change.Seq, &change.Op, &change.Path, &change.OldPath, &change.Size, &change.CreatedAt); err != nil {
+			return nil, 0, err
+		}
+		changes = append(changes, change)
+	}
+	return changes, seq, rows.Err()
+}
+
+// handleChanges serves GET /storage/changes.
+func (s *server) handleChanges(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	namespace := defaultNamespace
+	if raw := strings.TrimSpace(query.Get("namespace")); raw != "" {
+		var err error
+		if namespace, err = sanitizeNamespace(raw); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if !s.canAccessNamespace(r, namespace) {
+		s.denyAccess(w, r)
+		return
+	}
+
+	since := int64(-1)
+	if raw := query.Get("since"); raw != "" {
+		parsed, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil || parsed < 0 {
+			http.Error(w, "invalid since cursor", http.StatusBadRequest)
+			return
+		}
+		since = parsed
+	}
+	limit := defaultChangesLimit
+	if raw := query.Get("limit"); raw != "" {
+		parsed, err := strconv.Atoi(raw)
+		if err != nil || parsed < 1 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = min(parsed, maxChangesLimit)
+	}
+	var wait time.Duration
+	if raw := query.Get("wait"); raw != "" {
+		seconds, err := strconv.Atoi(raw)
+		if err != nil || seconds < 0 {
+			http.Error(w, "invalid wait", http.StatusBadRequest)
+			return
+		}
+		wait = min(time.Duration(seconds)*time.Second, maxChangesWait)
+	}
+
+	deadline := time.NewTimer(wait)
+	defer deadline.Stop()
+	poll := time.NewTicker(changesPollInterval)
+	defer poll.Stop()
+	for {
+		// Subscribe before querying so a change landing in between still
+		// wakes us.
+		woken := s.changes.wait(namespace)
+		changes, seq, err := s.loadChanges(namespace, since, limit+1)
+		if errors.Is(err, errCursorExpired) {
+			http.Error(w, err.Error(), http.StatusGone)
+			return
+		}
+		if err != nil {
+			http.Error(w, "failed to load changes", http.StatusInternalServerError)
+			return
+		}
+		if len(changes) > 0 || wait == 0 || since < 0 {
+			resp := changesResponse{Namespace: namespace, Cursor: seq, Changes: changes}
+			if len(changes) > limit {
+				resp.Changes = changes[:limit]
+				resp.HasMore = true
+			}
+			if len(resp.Changes) > 0 {
+				resp.Cursor = resp.Changes[len(resp.Changes)-1].Seq
+			} else if since >= 0 {
+				resp.Cursor = since
+			}
+			if resp.Changes == nil {
+				resp.Changes = []fileChange{}
+			}
+			writeJSON(w, resp)
+			return
+		}
+		select {
+		case <-woken:
+		case <-poll.C:
+		case <-deadline.C:
+			wait = 0
+		case <-s.changes.stopped:
+			wait = 0
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// changeHub wakes long-polls on this replica when a namespace changes.
+type changeHub struct {
+	mu      sync.Mutex
+	waiters map[string]chan struct{}
+	stopped chan struct{}
+	stop    sync.Once
+}
+
+func newChangeHub() *changeHub {
+	return &changeHub{
+		waiters: make(map[string]chan struct{}),
+		stopped: make(chan struct{}),
+	}
+}
+
+// wait returns a channel that is closed on the namespace's next change.
+func (h *changeHub) wait(namespace string) <-chan struct{} {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	ch, ok := h.waiters[namespace]
+	if !ok {
+		ch = make(chan struct{})
+		h.waiters[namespace] = ch
+	}
+	return ch
+}
+
+func (h *changeHub) notify(namespace string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if ch, ok := h.waiters[namespace]; ok {
+		close(ch)
+		delete(h.waiters, namespace)
+	}
+}
+
+func (h *changeHub) notifyAll() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for namespace, ch := range h.waiters {
+		close(ch)
+		delete(h.waiters, namespace)
+	}
+}
+
+// close answers every long-poll immediately, so they don't hold up shutdown.
+func (h *changeHub) close() {
+	h.stop.Do(func() { close(h.stopped) })
+}
+
+// listenChanges relays change notifications from every replica to the hub.
+func (s *server) listenChanges(dsn string) {
+	listener := pq.NewListener(dsn, time.Second, time.Minute, func(event pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Printf("change listener: %v", err)
+		}
+	})
+	if err := listener.Listen(changesChannel); err != nil {
+		log.Printf("change listener: listen failed, long-polls fall back to polling: %v", err)
+		return
+	}
+	ticker := time.NewTicker(90 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case n := <-listener.Notify:
+			if n == nil {
+				// Reconnected; anything could have been missed.
+				s.changes.notifyAll()
+				continue
+			}
+			s.changes.notify(n.Extra)
+		case <-ticker.C:
+			go listener.Ping()
+		}
+	}
+}
+
+// pruneChanges drops journal entries older than retention and records how
+// far each namespace was pruned.
+func (s *server) pruneChanges(interval, retention time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		result, err := s.db.Exec(
+			`WITH pruned AS (
+			   DELETE FROM file_changes WHERE created_at < $1 RETURNING namespace, seq
+			 )
+			 UPDATE change_sequences SET pruned_through = GREATEST(change_sequences.pruned_through, p.last)
+			 FROM (SELECT namespace, MAX(seq) AS last FROM pruned GROUP BY namespace) p
+			 WHERE change_sequences.namespace = p.namespace`,
+			time.Now().Add(-retention).Unix(),
+		)
+		if err != nil {
+			log.Printf("change journal prune failed: %v", err)
+			continue
+		}
+		if n, _ := result.RowsAffected(); n > 0 {
+			log.Printf("change journal pruned namespaces=%d", n)
+		}
+	}
+}
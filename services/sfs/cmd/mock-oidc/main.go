@@ -0,0 +1,53 @@
+// Command mock-oidc is a minimal OpenID Connect provider for exercising SFS
+// single sign-on locally. It approves every authorization request for one
+// configurable identity.
+//
+//	go run ./cmd/mock-oidc -groups admins
+//	OIDC_ISSUER=http://localhost:9000 OIDC_CLIENT_ID=sfs \
+//	OIDC_REDIRECT_URL=http://localhost:8080/api/oidc/callback OIDC_ADMIN_GROUP=admins ./sfs ...
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+	"strings"
+
+	"eddisonso.com/edd-cloud/services/sfs/internal/mockoidc"
+)
+
+func main() {
+	addr := flag.String("addr", ":9000", "HTTP listen address")
+	issuer := flag.String("issuer", "http://localhost:9000", "issuer URL advertised in discovery and tokens")
+	clientID := flag.String("client-id", "sfs", "accepted client ID")
+	sub := flag.String("sub", "mock-user-1", "subject of the signed-in identity")
+	email := flag.String("email", "mock@example.com", "email of the signed-in identity")
+	name := flag.String("name", "Mock User", "display name of the signed-in identity")
+	username := flag.String("username", "mock", "preferred_username of the signed-in identity")
+	groups := flag.String("groups", "", "comma-separated groups claim")
+	flag.Parse()
+
+	groupList := []string{}
+	for _, g := range strings.Split(*groups, ",") {
+		if g = strings.TrimSpace(g); g != "" {
+			groupList = append(groupList, g)
+		}
+	}
+
+	p, err := mockoidc.New(*issuer, *clientID, map[string]any{
+		"sub":                *sub,
+		"email":              *email,
+		"email_verified":     true,
+		"name":               *name,
+		"preferred_username": *username,
+		"groups":             groupList,
+	})
+	if err != nil {
+		log.Fatalf("generate key: %v", err)
+	}
+
+	log.Printf("mock oidc provider issuer=%s listening on %s", p.Issuer, *addr)
+	if err := http.ListenAndServe(*addr, p.Handler()); err != nil {
+		log.Fatalf("server stopped: %v", err)
+	}
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"compress/gzip"
+	"database/sql"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Namespaces can compress files as they are written. Compression runs before
+// encryption, since ciphertext doesn't compress. Each compressed file has a
+// file_codecs row with its codec and logical size, so changing the namespace
+// setting only affects new writes and older files stay readable.
+//
+// Downloads are decompressed on the fly, unless the client accepts the
+// file's codec as a Content-Encoding, in which case the stored bytes are
+// passed through.
+
+type compressionCodec struct {
+	newWriter func(io.Writer) (io.WriteCloser, error)
+	newReader func(io.Reader) (io.ReadCloser, error)
+}
+
+var compressionCodecs = map[string]compressionCodec{
+	"gzip": {
+		newWriter: func(w io.Writer) (io.WriteCloser, error) { return gzip.NewWriter(w), nil },
+		newReader: func(r io.Reader) (io.ReadCloser, error) { return gzip.NewReader(r) },
+	},
+	// Each upload and download streams through its own encoder or decoder,
+	// so both run single-threaded rather than a goroutine per core.
+	"zstd": {
+		newWriter: func(w io.Writer) (io.WriteCloser, error) {
+			return zstd.NewWriter(w, zstd.WithEncoderConcurrency(1))
+		},
+		newReader: func(r io.Reader) (io.ReadCloser, error) {
+			zr, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+			if err != nil {
+				return nil, err
+			}
+			return zr.IOReadCloser(), nil
+		},
+	},
+}
+
+// validCompression reports whether codec may be configured on a namespace;
+// empty means no compression.
+func validCompression(codec string) error {
+	if codec == "" {
+		return nil
+	}
+	if _, ok := compressionCodecs[codec]; ok {
+		return nil
+	}
+	supported := make([]string, 0, len(compressionCodecs))
+	for name := range compressionCodecs {
+		supported = append(supported, name)
+	}
+	sort.Strings(supported)
+	return fmt.Errorf("unsupported compression %q (supported: %s)", codec, strings.Join(supported, ", "))
+}
+
+func (s *server) namespaceCompression(namespace string) (string, error) {
+	var codec string
+	err := s.db.QueryRow(`SELECT compression FROM namespaces WHERE name = $1`, namespace).Scan(&codec)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return codec, err
+}
+
+func (s *server) updateNamespaceCompression(name, codec string) error {
+	if err := validCompression(codec); err != nil {
+		return err
+	}
+	result, err := s.db.Exec(`UPDATE namespaces SET compression = $1 WHERE name = $2`, codec, name)
+	if err != nil {
+		return err
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if updated == 0 {
+		return fmt.Errorf("namespace not found")
+	}
+	return nil
+}
+
+type fileCodec struct {
+	Codec       string
+	LogicalSize int64
+}
+
+// loadFileCodec returns how a file is compressed, or nil if it isn't.
+func (s *server) loadFileCodec(namespace, name string) (*fileCodec, error) {
+	fc := &fileCodec{}
+	err := s.db.QueryRow(
+		`SELECT codec, logical_size FROM file_codecs WHERE namespace = $1 AND path = $2`,
+		namespace,
+		name,
+	).Scan(&fc.Codec, &fc.LogicalSize)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return fc, nil
+}
+
+func (s *server) saveFileCodec(namespace, name, codec string, logicalSize int64) error {
+	_, err := s.db.Exec(
+		`INSERT INTO file_codecs (namespace, path, codec, logical_size, created_at)
+		 VALUES ($1, $2, $3, $4, $5)
+		 ON CONFLICT(namespace, path) DO UPDATE SET
+		   codec = excluded.codec,
+		   logical_size = excluded.logical_size,
+		   created_at = excluded.created_at`,
+		namespace,
+		name,
+		codec,
+		logicalSize,
+		time.Now().Unix(),
+	)
+	return err
+}
+
+// fileSizer resolves the logical size of files in one namespace listing.
+type fileSizer struct {
+	segments map[string]int
+	codecs   map[string]fileCodec
+}
+
+func (s *server) loadFileSizer(namespace string) (fileSizer, error) {
+	segments, err := s.loadFileKeySizes(namespace)
+	if err != nil {
+		return fileSizer{}, err
+	}
+	rows, err := s.db.Query(`SELECT path, codec, logical_size FROM file_codecs WHERE namespace = $1`, namespace)
+	if err != nil {
+		return fileSizer{}, err
+	}
+	defer rows.Close()
+
+	codecs := make(map[string]fileCodec)
+	for rows.Next() {
+		var name string
+		var fc fileCodec
+		if err := rows.Scan(&name, &fc.Codec, &fc.LogicalSize); err != nil {
+			return fileSizer{}, err
+		}
+		codecs[name] = fc
+	}
+	return fileSizer{segments: segments, codecs: codecs}, rows.Err()
+}
+
+func (z fileSizer) logical(name string, stored uint64) uint64 {
+	if fc, ok := z.codecs[name]; ok {
+		return uint64(fc.LogicalSize)
+	}
+	if segmentSize, ok := z.segments[name]; ok {
+		return plaintextSize(stored, segmentSize)
+	}
+	return stored
+}
+
+func (z fileSizer) encoding(name string) string {
+	return z.codecs[name].Codec
+}
+
+// compressReader compresses src as it is read. Close it once done reading so
+// the compressing goroutine exits even if the reader gave up early.
+type compressReader struct {
+	*io.PipeReader
+}
+
+func newCompressReader(src io.Reader, codec string) *compressReader {
+	pr, pw := io.Pipe()
+	go func() {
+		zw, err := compressionCodecs[codec].newWriter(pw)
+		if err == nil {
+			_, err = io.Copy(zw, src)
+			if closeErr := zw.Close(); err == nil {
+				err = closeErr
+			}
+		}
+		pw.CloseWithError(err)
+	}()
+	return &compressReader{pr}
+}
+
+// decompressWriter decompresses what is written to it into w. Close waits
+// for the last of the output and reports any decoding error.
+type decompressWriter struct {
+	pw   *io.PipeWriter
+	done chan error
+}
+
+func newDecompressWriter(w io.Writer, codec string) *decompressWriter {
+	pr, pw := io.Pipe()
+	d := &decompressWriter{pw: pw, done: make(chan error, 1)}
+	go func() {
+		zr, err := compressionCodecs[codec].newReader(pr)
+		if err == nil {
+			_, err = io.Copy(w, zr)
+			zr.Close()
+		}
+		pr.CloseWithError(err)
+		d.done <- err
+	}()
+	return d
+}
+
+func (d *decompressWriter) Write(p []byte) (int, error) {
+	return d.pw.Write(p)
+}
+
+func (d *decompressWriter) Close() error {
+	d.pw.Close()
+	return <-d.done
+}
+
+// acceptsEncoding reports whether an Accept-Encoding header allows codec.
+func acceptsEncoding(header, codec string) bool {
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if !strings.EqualFold(strings.TrimSpace(name), codec) {
+			continue
+		}
+		key, value, ok := strings.Cut(strings.TrimSpace(params), "=")
+		if ok && strings.TrimSpace(key) == "q" {
+			q, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+			return err == nil && q > 0
+		}
+		return true
+	}
+	return false
+}
+
+// negotiateEncoding picks how a file is sent. If it is compressed with a
+// codec the client accepts, the Content-Encoding header is set and the codec
+// returned for readFileEncoded; otherwise it returns "" and the file is
+// decompressed on the way out.
+func (s *server) negotiateEncoding(w http.ResponseWriter, r *http.Request, namespace, name string) string {
+	fc, err := s.loadFileCodec(namespace, name)
+	if err != nil || fc == nil {
+		return ""
+	}
+	w.Header().Add("Vary", "Accept-Encoding")
+	if !acceptsEncoding(r.Header.Get("Accept-Encoding"), fc.Codec) {
+		return ""
+	}
+	w.Header().Set("Content-Encoding", fc.Codec)
+	return fc.Codec
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestCompressionRoundTrip(t *testing.T) {
+	data := bytes.Repeat([]byte("timestamp,level,message\n2026-01-01,info,ok\n"), 50000)
+	for codec := range compressionCodecs {
+		t.Run(codec, func(t *testing.T) {
+			zr := newCompressReader(bytes.NewReader(data), codec)
+			stored, err := io.ReadAll(zr)
+			zr.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(stored) >= len(data)/10 {
+				t.Fatalf("compressed %d bytes to %d", len(data), len(stored))
+			}
+
+			var out bytes.Buffer
+			dw := newDecompressWriter(&out, codec)
+			if _, err := io.Copy(dw, bytes.NewReader(stored)); err != nil {
+				t.Fatal(err)
+			}
+			if err := dw.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(out.Bytes(), data) {
+				t.Fatalf("round trip changed the data")
+			}
+
+			dw = newDecompressWriter(io.Discard, codec)
+			dw.Write(stored[:len(stored)/2])
+			if err := dw.Close(); err == nil {
+				t.Fatalf("truncated stream decoded without error")
+			}
+		})
+	}
+}
+
+func TestAcceptsEncoding(t *testing.T) {
+	tests := []struct {
+		header, codec string
+		want          bool
+	}{
+		{"gzip, deflate, br, zstd", "zstd", true},
+		{"gzip;q=1.0, zstd;q=0", "zstd", false},
+		{"ZSTD", "zstd", true},
+		{"gzip", "zstd", false},
+		{"", "gzip", false},
+	}
+	for _, tt := range tests {
+		if got := acceptsEncoding(tt.header, tt.codec); got != tt.want {
+			t.Errorf("acceptsEncoding(%q, %q) = %v, want %v", tt.header, tt.codec, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+const (
+	csrfCookieName = "sfs_csrf"
+	csrfHeaderName = "X-CSRF-Token"
+	// Used when ALLOWED_ORIGINS is unset: the production frontend and the
+	// vite dev server.
+	defaultAllowedOrigins = "https://cloud.eddisonso.com,http://localhost:5173"
+)
+
+// originPolicy decides which browser origins may make credentialed calls.
+// Requests from the API's own origin are always allowed.
+type originPolicy struct {
+	allowed map[string]bool
+}
+
+func loadOriginPolicy() originPolicy {
+	raw := os.Getenv("ALLOWED_ORIGINS")
+	if strings.TrimSpace(raw) == "" {
+		raw = defaultAllowedOrigins
+	}
+	policy := originPolicy{allowed: make(map[string]bool)}
+	for _, origin := range strings.Split(raw, ",") {
+		if origin = strings.TrimSuffix(strings.TrimSpace(origin), "/"); origin != "" {
+			policy.allowed[strings.ToLower(origin)] = true
+		}
+	}
+	return policy
+}
+
+func (p originPolicy) allows(r *http.Request, origin string) bool {
+	origin = strings.ToLower(origin)
+	if p.allowed[origin] {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && u.Host != "" && strings.EqualFold(u.Host, r.Host)
+}
+
+// cors answers preflights and sets CORS headers for allowlisted origins only;
+// other origins get no CORS headers, so browsers refuse to expose responses.
+func (p originPolicy) cors(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		allowed := origin != "" && p.allows(r, origin)
+		if allowed {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-File-Size, "+csrfHeaderName)
+			w.Header().Set("Access-Control-Expose-Headers", "X-Request-ID")
+			w.Header().Add("Vary", "Origin")
+		}
+		// Handle preflight
+		if r.Method == http.MethodOptions {
+			if origin != "" && !allowed {
+				http.Error(w, "origin not allowed", http.StatusForbidden)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// csrfExempt lists unsafe endpoints that run before a CSRF token exists or
+// don't use the session at all.
+func csrfExempt(path string) bool {
+	return path == "/api/login" || path == "/api/login/2fa" || strings.HasPrefix(path, "/drop/")
+}
+
+// csrfProtect requires a double-submit token on unsafe requests that carry
+// auth cookies: the X-CSRF-Token header must match the sfs_csrf cookie, which
+// other sites can neither read nor set. Unsafe requests from a foreign Origin
+// are refused outright.
+func (s *server) csrfProtect(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			next.ServeHTTP(w, r)
+			return
+		}
+		if origin := r.Header.Get("Origin"); origin != "" && !s.origins.allows(r, origin) {
+			http.Error(w, "origin not allowed", http.StatusForbidden)
+			return
+		}
+		if csrfExempt(r.URL.Path) || !hasAuthCookie(r, s.cookieName) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		cookie, err := r.Cookie(csrfCookieName)
+		header := r.Header.Get(csrfHeaderName)
+		if err != nil || cookie.Value == "" || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(header)) != 1 {
+			http.Error(w, "invalid csrf token", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func hasAuthCookie(r *http.Request, sessionCookie string) bool {
+	for _, cookie := range r.Cookies() {
+		if (cookie.Name == sessionCookie || cookie.Name == accessCookieName) && cookie.Value != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// setCSRFCookie issues a new CSRF token readable by the frontend, scoped like
+// the session cookie so compute sees it too.
+func setCSRFCookie(w http.ResponseWriter, r *http.Request, expires time.Time) (string, error) {
+	token, err := generateToken(32)
+	if err != nil {
+		return "", err
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     csrfCookieName,
+		Value:    token,
+		Path:     "/",
+		Domain:   getCookieDomain(r),
+		Expires:  expires,
+		SameSite: http.SameSiteLaxMode,
+		Secure:   isSecureRequest(r),
+	})
+	return token, nil
+}
+
+// csrfToken returns the request's CSRF token, issuing one for sessions that
+// predate CSRF protection.
+func (s *server) csrfToken(w http.ResponseWriter, r *http.Request, session *authSession) string {
+	if cookie, err := r.Cookie(csrfCookieName); err == nil && cookie.Value != "" {
+		return cookie.Value
+	}
+	token, err := setCSRFCookie(w, r, time.Unix(session.ExpiresAt, 0))
+	if err != nil {
+		log.Printf("csrf token generation failed: %v", err)
+		return ""
+	}
+	return token
+}
+
+// wsHandshake rejects WebSocket upgrades from origins outside the allowlist.
+func (s *server) wsHandshake(config *websocket.Config, r *http.Request) error {
+	origin := r.Header.Get("Origin")
+	if origin == "" || !s.origins.allows(r, origin) {
+		return fmt.Errorf("websocket origin %q not allowed", origin)
+	}
+	return nil
+}
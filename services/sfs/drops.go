@@ -0,0 +1,470 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultDropTTL      = 7 * 24 * time.Hour
+	defaultDropMaxFiles = 20
+	dropFolderPrefix    = "drops"
+)
+
+var errDropFileTooLarge = errors.New("file exceeds the drop link size limit")
+
+// dropLink lets people without an account upload into a namespace. Links can
+// only add files; they never list or download.
+type dropLink struct {
+	ID                int      `json:"id"`
+	Token             string   `json:"token,omitempty"`
+	Namespace         string   `json:"namespace"`
+	Label             string   `json:"label"`
+	Folder            string   `json:"folder"`
+	ExpiresAt         int64    `json:"expires_at"`
+	MaxFileBytes      int64    `json:"max_file_bytes"`
+	MaxFiles          int      `json:"max_files"`
+	UploadCount       int      `json:"upload_count"`
+	AllowedExtensions []string `json:"allowed_extensions"`
+	CreatedAt         int64    `json:"created_at"`
+}
+
+type dropLinkRequest struct {
+	Label             string   `json:"label"`
+	ExpiresInHours    int      `json:"expires_in_hours"`
+	MaxFileSizeMB     int64    `json:"max_file_size_mb"`
+	MaxFiles          int      `json:"max_files"`
+	AllowedExtensions []string `json:"allowed_extensions"`
+}
+
+const dropLinkColumns = `id, token, namespace, label, folder, expires_at, max_file_bytes, max_files, upload_count, allowed_extensions, created_at`
+
+func scanDropLink(row interface{ Scan(...any) error }) (dropLink, error) {
+	var link dropLink
+	var extensions string
+	err := row.Scan(
+		&link.ID,
+		&link.Token,
+		&link.Namespace,
+		&link.Label,
+		&link.Folder,
+		&link.ExpiresAt,
+		&link.MaxFileBytes,
+		&link.MaxFiles,
+		&link.UploadCount,
+		&extensions,
+		&link.CreatedAt,
+	)
+	link.AllowedExtensions = splitExtensions(extensions)
+	return link, err
+}
+
+func splitExtensions(raw string) []string {
+	extensions := make([]string, 0)
+	for _, ext := range strings.Split(raw, ",") {
+		ext = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(ext), "."))
+		if ext != "" {
+			extensions = append(extensions, ext)
+		}
+	}
+	return extensions
+}
+
+func (l dropLink) allowsExtension(name string) bool {
+	if len(l.AllowedExtensions) == 0 {
+		return true
+	}
+	ext := strings.ToLower(strings.TrimPrefix(path.Ext(name), "."))
+	for _, allowed := range l.AllowedExtensions {
+		if ext == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// handleNamespaceDrops handles GET (list) and POST (create) on
+// /storage/namespaces/{name}/drops.
+func (s *server) handleNamespaceDrops(w http.ResponseWriter, r *http.Request) {
+	username, ok := s.requireAuth(w, r)
+	if !ok {
+		return
+	}
+
+	name, err := sanitizeNamespace(r.PathValue("name"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if exists, err := s.namespaceExists(name); err != nil {
+		http.Error(w, "failed to check namespace", http.StatusInternalServerError)
+		return
+	} else if !exists {
+		http.Error(w, "namespace not found", http.StatusNotFound)
+		return
+	}
+	if !s.canManageNamespace(r, name) {
+		s.denyAccess(w, r)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		rows, err := s.db.Query(
+			`SELECT `+dropLinkColumns+` FROM drop_links WHERE namespace = $1 ORDER BY created_at DESC`,
+			name,
+		)
+		if err != nil {
+			http.Error(w, "failed to load drop links", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+		links := make([]dropLink, 0)
+		for rows.Next() {
+			link, err := scanDropLink(rows)
+			if err != nil {
+				http.Error(w, "failed to load drop links", http.StatusInternalServerError)
+				return
+			}
+			links = append(links, link)
+		}
+		writeJSON(w, links)
+	case http.MethodPost:
+		var payload dropLinkRequest
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			http.Error(w, "invalid payload", http.StatusBadRequest)
+			return
+		}
+		link, err := s.createDropLink(name, username, payload)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.recordAudit(name, username, "drop.create", fmt.Sprintf("link %d (%s) expires %s", link.ID, link.Label, time.Unix(link.ExpiresAt, 0).UTC().Format(time.RFC3339)))
+		writeJSON(w, link)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *server) createDropLink(namespace, username string, payload dropLinkRequest) (dropLink, error) {
+	if payload.ExpiresInHours < 0 || payload.MaxFileSizeMB < 0 || payload.MaxFiles < 0 {
+		return dropLink{}, fmt.Errorf("limits must not be negative")
+	}
+	ttl := defaultDropTTL
+	if payload.ExpiresInHours > 0 {
+		ttl = time.Duration(payload.ExpiresInHours) * time.Hour
+	}
+	maxFileBytes := s.maxUpload
+	if payload.MaxFileSizeMB > 0 {
+		maxFileBytes = maxUploadBytes(payload.MaxFileSizeMB)
+		if s.maxUpload > 0 && maxFileBytes > s.maxUpload {
+			return dropLink{}, fmt.Errorf("max_file_size_mb exceeds the server upload limit")
+		}
+	}
+	maxFiles := payload.MaxFiles
+	if maxFiles == 0 {
+		maxFiles = defaultDropMaxFiles
+	}
+	for _, ext := range payload.AllowedExtensions {
+		if strings.ContainsAny(ext, ",/\\") {
+			return dropLink{}, fmt.Errorf("invalid extension: %s", ext)
+		}
+	}
+
+	token, err := generateToken(24)
+	if err != nil {
+		return dropLink{}, fmt.Errorf("failed to create token")
+	}
+	var createdBy *int
+	var userID int
+	if err := s.db.QueryRow(`SELECT id FROM users WHERE username = $1`, username).Scan(&userID); err == nil {
+		createdBy = &userID
+	}
+
+	now := time.Now()
+	row := s.db.QueryRow(
+		`INSERT INTO drop_links (token, namespace, label, folder, created_by, expires_at, max_file_bytes, max_files, allowed_extensions, created_at)
+		 VALUES ($1, $2, $3, '', $4, $5, $6, $7, $8, $9)
+		 RETURNING `+dropLinkColumns,
+		token,
+		namespace,
+		strings.TrimSpace(payload.Label),
+		createdBy,
+		now.Add(ttl).Unix(),
+		maxFileBytes,
+		maxFiles,
+		strings.Join(splitExtensions(strings.Join(payload.AllowedExtensions, ",")), ","),
+		now.Unix(),
+	)
+	link, err := scanDropLink(row)
+	if err != nil {
+		return dropLink{}, fmt.Errorf("failed to create drop link")
+	}
+
+	// Each link writes into its own folder so contributions stay separate.
+	link.Folder = fmt.Sprintf("%s/%d", dropFolderPrefix, link.ID)
+	if _, err := s.db.Exec(`UPDATE drop_links SET folder = $1 WHERE id = $2`, link.Folder, link.ID); err != nil {
+		return dropLink{}, fmt.Errorf("failed to create drop link")
+	}
+	return link, nil
+}
+
+// handleNamespaceDropDelete handles DELETE /storage/namespaces/{name}/drops/{id}.
+// Files already uploaded through the link are kept.
+func (s *server) handleNamespaceDropDelete(w http.ResponseWriter, r *http.Request) {
+	username, ok := s.requireAuth(w, r)
+	if !ok {
+		return
+	}
+
+	name, err := sanitizeNamespace(r.PathValue("name"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "invalid id", http.StatusBadRequest)
+		return
+	}
+	if !s.canManageNamespace(r, name) {
+		s.denyAccess(w, r)
+		return
+	}
+
+	result, err := s.db.Exec(`DELETE FROM drop_links WHERE id = $1 AND namespace = $2`, id, name)
+	if err != nil {
+		http.Error(w, "failed to revoke drop link", http.StatusInternalServerError)
+		return
+	}
+	if deleted, _ := result.RowsAffected(); deleted == 0 {
+		http.Error(w, "drop link not found", http.StatusNotFound)
+		return
+	}
+	s.recordAudit(name, username, "drop.revoke", fmt.Sprintf("link %d", id))
+	writeJSON(w, map[string]string{"status": "ok"})
+}
+
+// activeDropLink loads a link by token, treating expired links as missing.
+func (s *server) activeDropLink(token string) (*dropLink, error) {
+	link, err := scanDropLink(s.db.QueryRow(`SELECT `+dropLinkColumns+` FROM drop_links WHERE token = $1`, token))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if time.Now().Unix() > link.ExpiresAt {
+		return nil, nil
+	}
+	return &link, nil
+}
+
+type dropInfo struct {
+	Label             string   `json:"label"`
+	ExpiresAt         int64    `json:"expires_at"`
+	MaxFileBytes      int64    `json:"max_file_bytes"`
+	RemainingFiles    int      `json:"remaining_files"`
+	AllowedExtensions []string `json:"allowed_extensions"`
+}
+
+type dropUploadResult struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+}
+
+// handleDrop serves the public drop endpoint: GET /drop/{token} describes the
+// link's limits and POST /drop/{token} accepts a multipart upload with one or
+// more "file" parts. No session is required.
+func (s *server) handleDrop(w http.ResponseWriter, r *http.Request) {
+	link, err := s.activeDropLink(r.PathValue("token"))
+	if err != nil {
+		http.Error(w, "failed to load drop link", http.StatusInternalServerError)
+		return
+	}
+	if link == nil {
+		http.Error(w, "drop link not found or expired", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, dropInfo{
+			Label:             link.Label,
+			ExpiresAt:         link.ExpiresAt,
+			MaxFileBytes:      link.MaxFileBytes,
+			RemainingFiles:    max(link.MaxFiles-link.UploadCount, 0),
+			AllowedExtensions: link.AllowedExtensions,
+		})
+	case http.MethodPost:
+		s.handleDropUpload(w, r, link)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *server) handleDropUpload(w http.ResponseWriter, r *http.Request, link *dropLink) {
+	finish, err := s.beginUpload(w)
+	if err != nil {
+		http.Error(w, err.Error(), storageErrorStatus(err))
+		return
+	}
+	defer finish()
+
+	if s.maxUpload > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, s.maxUpload)
+	}
+	mr, err := r.MultipartReader()
+	if err != nil {
+		http.Error(w, "invalid multipart upload", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), s.uploadTTL)
+	defer cancel()
+	throttle := s.throttle(ctx, r, link.Namespace, "upload")
+
+	uploaded := make([]dropUploadResult, 0)
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			http.Error(w, "invalid multipart upload", http.StatusBadRequest)
+			return
+		}
+		if part.FormName() != "file" {
+			part.Close()
+			continue
+		}
+
+		result, code, err := s.storeDropFile(ctx, link, part, throttle)
+		part.Close()
+		if err != nil {
+			log.Printf("drop upload failed link=%d namespace=%s err=%v", link.ID, link.Namespace, err)
+			http.Error(w, err.Error(), code)
+			return
+		}
+		uploaded = append(uploaded, result)
+	}
+
+	if len(uploaded) == 0 {
+		http.Error(w, "missing file", http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, map[string]any{"status": "ok", "files": uploaded})
+}
+
+// storeDropFile writes one multipart file into the link's folder, returning
+// the HTTP status to use on failure.
+func (s *server) storeDropFile(ctx context.Context, link *dropLink, part *multipart.Part, throttle *transferThrottle) (dropUploadResult, int, error) {
+	filename, err := sanitizeName(part.FileName())
+	if err != nil {
+		return dropUploadResult{}, http.StatusBadRequest, err
+	}
+	if !link.allowsExtension(filename) {
+		return dropUploadResult{}, http.StatusUnsupportedMediaType, fmt.Errorf("file type not allowed: %s", filename)
+	}
+
+	// Reserve a slot first so concurrent uploads cannot exceed max_files.
+	result, err := s.db.Exec(
+		`UPDATE drop_links SET upload_count = upload_count + 1 WHERE id = $1 AND upload_count < max_files`,
+		link.ID,
+	)
+	if err != nil {
+		return dropUploadResult{}, http.StatusInternalServerError, fmt.Errorf("failed to reserve upload")
+	}
+	if reserved, _ := result.RowsAffected(); reserved == 0 {
+		return dropUploadResult{}, http.StatusForbidden, fmt.Errorf("drop link upload limit reached")
+	}
+	release := func() {
+		_, _ = s.db.Exec(`UPDATE drop_links SET upload_count = upload_count - 1 WHERE id = $1 AND upload_count > 0`, link.ID)
+	}
+
+	name, err := s.prepareDropFile(ctx, link, filename)
+	if err != nil {
+		release()
+		return dropUploadResult{}, storageErrorStatus(err), err
+	}
+
+	counting := &countingReader{reader: part, throttle: throttle}
+	reader := io.Reader(counting)
+	if link.MaxFileBytes > 0 {
+		reader = &limitedReader{reader: reader, remaining: link.MaxFileBytes}
+	}
+	_, err = s.writeFile(ctx, link.Namespace, name, reader)
+	if err != nil {
+		release()
+		if cleanupErr := s.deleteFile(ctx, link.Namespace, name); cleanupErr != nil {
+			log.Printf("drop cleanup failed namespace=%s name=%s err=%v", link.Namespace, name, cleanupErr)
+		}
+		var maxErr *http.MaxBytesError
+		if errors.Is(err, errDropFileTooLarge) || errors.As(err, &maxErr) {
+			return dropUploadResult{}, http.StatusRequestEntityTooLarge, errDropFileTooLarge
+		}
+		return dropUploadResult{}, storageErrorStatus(err), fmt.Errorf("upload failed: %v", err)
+	}
+
+	size := counting.read
+	s.recordChange(link.Namespace, changeCreated, name, "", size)
+	log.Printf("drop upload ok link=%d namespace=%s name=%s size=%d", link.ID, link.Namespace, name, size)
+	s.recordAudit(link.Namespace, fmt.Sprintf("drop:%d", link.ID), "drop.upload", fmt.Sprintf("%s (%d bytes)", name, size))
+	return dropUploadResult{Name: path.Base(name), Size: size}, 0, nil
+}
+
+// prepareDropFile creates the destination file, adding a numeric suffix when
+// a contributor uploads the same name twice. Drop links never overwrite.
+func (s *server) prepareDropFile(ctx context.Context, link *dropLink, filename string) (string, error) {
+	ext := path.Ext(filename)
+	stem := strings.TrimSuffix(filename, ext)
+	for i := 0; i < 100; i++ {
+		candidate := filename
+		if i > 0 {
+			candidate = fmt.Sprintf("%s-%d%s", stem, i, ext)
+		}
+		name := path.Join(link.Folder, candidate)
+		_, err := s.prepareFile(ctx, link.Namespace, name, false)
+		if errors.Is(err, errFileExists) {
+			continue
+		}
+		return name, err
+	}
+	return "", fmt.Errorf("too many files named %s", filename)
+}
+
+// limitedReader fails with errDropFileTooLarge once more than remaining bytes
+// have been read, rather than silently truncating like io.LimitReader.
+type limitedReader struct {
+	reader    io.Reader
+	remaining int64
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.remaining < 0 {
+		return 0, errDropFileTooLarge
+	}
+	if int64(len(p)) > l.remaining+1 {
+		p = p[:l.remaining+1]
+	}
+	n, err := l.reader.Read(p)
+	l.remaining -= int64(n)
+	if l.remaining < 0 {
+		return 0, errDropFileTooLarge
+	}
+	return n, err
+}
@@ -0,0 +1,513 @@
+package main
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Files in encrypted namespaces are stored as a sequence of AES-256-GCM
+// segments. Each file gets its own random data key, which is wrapped by the
+// active master key and kept in the file_keys table so that rotating the
+// master key only rewrites the wrapped keys, never the file data.
+const (
+	defaultSegmentSize = 64 * 1024
+	dataKeySize        = 32
+	gcmTagSize         = 16
+)
+
+type masterKey struct {
+	id   string
+	aead cipher.AEAD
+}
+
+type keyring struct {
+	active *masterKey
+	keys   map[string]*masterKey
+}
+
+// loadKeyring reads master keys from the given file, falling back to the
+// SFS_MASTER_KEY environment variable. Keys are base64 encoded 32 byte values
+// separated by newlines or commas; the first key is used for new files and the
+// rest are kept so files wrapped before a rotation can still be read.
+// Returns nil when no key is configured.
+func loadKeyring(keyFile string) (*keyring, error) {
+	raw := ""
+	if keyFile != "" {
+		data, err := os.ReadFile(keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("read master key file: %w", err)
+		}
+		raw = string(data)
+	} else {
+		raw = os.Getenv("SFS_MASTER_KEY")
+	}
+
+	fields := strings.FieldsFunc(raw, func(r rune) bool {
+		return r == '\n' || r == '\r' || r == ','
+	})
+	ring := &keyring{keys: make(map[string]*masterKey)}
+	for _, field := range fields {
+		field = strings.TrimSpace(field)
+		if field == "" || strings.HasPrefix(field, "#") {
+			continue
+		}
+		key, err := base64.StdEncoding.DecodeString(field)
+		if err != nil {
+			return nil, fmt.Errorf("decode master key: %w", err)
+		}
+		if len(key) != 32 {
+			return nil, fmt.Errorf("master key must be 32 bytes, got %d", len(key))
+		}
+		aead, err := newGCM(key)
+		if err != nil {
+			return nil, err
+		}
+		sum := sha256.Sum256(key)
+		mk := &masterKey{id: hex.EncodeToString(sum[:8]), aead: aead}
+		if _, dup := ring.keys[mk.id]; dup {
+			continue
+		}
+		ring.keys[mk.id] = mk
+		if ring.active == nil {
+			ring.active = mk
+		}
+	}
+	if ring.active == nil {
+		return nil, nil
+	}
+	return ring, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("create cipher: %w", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("create gcm: %w", err)
+	}
+	return aead, nil
+}
+
+// wrap encrypts a data key with the active master key.
+func (k *keyring) wrap(dataKey []byte) (string, string, error) {
+	nonce := make([]byte, k.active.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", "", err
+	}
+	sealed := k.active.aead.Seal(nonce, nonce, dataKey, []byte(k.active.id))
+	return k.active.id, base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// unwrap decrypts a data key with the master key it was wrapped under.
+func (k *keyring) unwrap(keyID, wrapped string) ([]byte, error) {
+	mk, ok := k.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("master key %s not loaded", keyID)
+	}
+	sealed, err := base64.StdEncoding.DecodeString(wrapped)
+	if err != nil {
+		return nil, fmt.Errorf("decode wrapped key: %w", err)
+	}
+	nonceSize := mk.aead.NonceSize()
+	if len(sealed) < nonceSize {
+		return nil, fmt.Errorf("wrapped key too short")
+	}
+	dataKey, err := mk.aead.Open(nil, sealed[:nonceSize], sealed[nonceSize:], []byte(keyID))
+	if err != nil {
+		return nil, fmt.Errorf("unwrap data key: %w", err)
+	}
+	return dataKey, nil
+}
+
+// segmentNonce derives the nonce for a segment from its index. Data keys are
+// never reused across files, so a counter is enough to keep nonces unique. The
+// last byte marks the final segment so truncated files fail to decrypt.
+func segmentNonce(counter uint64, final bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce, counter)
+	if final {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// encryptReader encrypts a plaintext stream into GCM segments as it is read.
+type encryptReader struct {
+	src     *bufio.Reader
+	aead    cipher.AEAD
+	plain   []byte
+	out     []byte
+	counter uint64
+	done    bool
+}
+
+func newEncryptReader(src io.Reader, dataKey []byte, segmentSize int) (*encryptReader, error) {
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return &encryptReader{
+		src:   bufio.NewReaderSize(src, segmentSize),
+		aead:  aead,
+		plain: make([]byte, segmentSize),
+	}, nil
+}
+
+func (e *encryptReader) Read(p []byte) (int, error) {
+	for len(e.out) == 0 {
+		if e.done {
+			return 0, io.EOF
+		}
+		if err := e.seal(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, e.out)
+	e.out = e.out[n:]
+	return n, nil
+}
+
+func (e *encryptReader) seal() error {
+	n, err := io.ReadFull(e.src, e.plain)
+	final := false
+	switch {
+	case err == io.EOF || err == io.ErrUnexpectedEOF:
+		final = true
+	case err != nil:
+		return err
+	default:
+		// A full segment was read; peek to find out if it was the last one.
+		if _, err := e.src.Peek(1); err == io.EOF {
+			final = true
+		} else if err != nil {
+			return err
+		}
+	}
+	e.out = e.aead.Seal(e.out[:0], segmentNonce(e.counter, final), e.plain[:n], nil)
+	e.counter++
+	e.done = final
+	return nil
+}
+
+// decryptWriter decrypts GCM segments written to it and forwards the
+// plaintext. Close must be called to flush the final segment.
+type decryptWriter struct {
+	dst     io.Writer
+	aead    cipher.AEAD
+	segment int
+	buf     []byte
+	plain   []byte
+	counter uint64
+}
+
+func newDecryptWriter(dst io.Writer, dataKey []byte, segmentSize int) (*decryptWriter, error) {
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return &decryptWriter{
+		dst:     dst,
+		aead:    aead,
+		segment: segmentSize + aead.Overhead(),
+	}, nil
+}
+
+func (d *decryptWriter) Write(p []byte) (int, error) {
+	d.buf = append(d.buf, p...)
+	offset := 0
+	// Keep at least one segment buffered; only Close knows which one is final.
+	for len(d.buf)-offset > d.segment {
+		if err := d.open(d.buf[offset:offset+d.segment], false); err != nil {
+			return 0, err
+		}
+		offset += d.segment
+	}
+	d.buf = append(d.buf[:0], d.buf[offset:]...)
+	return len(p), nil
+}
+
+func (d *decryptWriter) Close() error {
+	err := d.open(d.buf, true)
+	d.buf = d.buf[:0]
+	return err
+}
+
+func (d *decryptWriter) open(segment []byte, final bool) error {
+	plain, err := d.aead.Open(d.plain[:0], segmentNonce(d.counter, final), segment, nil)
+	if err != nil {
+		return fmt.Errorf("decrypt segment %d: %w", d.counter, err)
+	}
+	d.plain = plain
+	d.counter++
+	_, err = d.dst.Write(plain)
+	return err
+}
+
+// plaintextSize computes the logical size of an encrypted file from the
+// number of bytes stored.
+func plaintextSize(stored uint64, segmentSize int) uint64 {
+	full := uint64(segmentSize + gcmTagSize)
+	segments := (stored + full - 1) / full
+	if segments == 0 || stored < segments*gcmTagSize {
+		return 0
+	}
+	return stored - segments*gcmTagSize
+}
+
+type fileKey struct {
+	KeyID       string
+	WrappedKey  string
+	SegmentSize int
+}
+
+func (s *server) loadFileKey(namespace, name string) (*fileKey, error) {
+	var fk fileKey
+	err := s.db.QueryRow(
+		`SELECT key_id, wrapped_key, segment_size FROM file_keys WHERE namespace = $1 AND path = $2`,
+		namespace,
+		name,
+	).Scan(&fk.KeyID, &fk.WrappedKey, &fk.SegmentSize)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &fk, nil
+}
+
+// loadFileKeySizes returns the segment size of every encrypted file in a
+// namespace, keyed by path.
+func (s *server) loadFileKeySizes(namespace string) (map[string]int, error) {
+	rows, err := s.db.Query(`SELECT path, segment_size FROM file_keys WHERE namespace = $1`, namespace)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sizes := make(map[string]int)
+	for rows.Next() {
+		var name string
+		var segmentSize int
+		if err := rows.Scan(&name, &segmentSize); err != nil {
+			return nil, err
+		}
+		sizes[name] = segmentSize
+	}
+	return sizes, rows.Err()
+}
+
+func (s *server) namespaceEncrypted(namespace string) (bool, error) {
+	var encrypted int
+	err := s.db.QueryRow(`SELECT encrypted FROM namespaces WHERE name = $1`, namespace).Scan(&encrypted)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return encrypted != 0, nil
+}
+
+func (s *server) updateNamespaceEncrypted(name string, encrypted bool) error {
+	if encrypted && s.keys == nil {
+		return fmt.Errorf("encryption is not configured")
+	}
+	encryptedValue := 0
+	if encrypted {
+		encryptedValue = 1
+	}
+	result, err := s.db.Exec(`UPDATE namespaces SET encrypted = $1 WHERE name = $2`, encryptedValue, name)
+	if err != nil {
+		return err
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if updated == 0 {
+		return fmt.Errorf("namespace not found")
+	}
+	return nil
+}
+
+// encryptFile saves a fresh data key for a file about to be written and
+// returns src wrapped to encrypt with it.
+func (s *server) encryptFile(namespace, name string, src io.Reader) (io.Reader, error) {
+	if s.keys == nil {
+		return nil, fmt.Errorf("namespace %s is encrypted but no master key is loaded", namespace)
+	}
+	dataKey := make([]byte, dataKeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, fmt.Errorf("generate data key: %w", err)
+	}
+	keyID, wrapped, err := s.keys.wrap(dataKey)
+	if err != nil {
+		return nil, fmt.Errorf("wrap data key: %w", err)
+	}
+	if _, err := s.db.Exec(
+		`INSERT INTO file_keys (namespace, path, key_id, wrapped_key, segment_size, created_at)
+		 VALUES ($1, $2, $3, $4, $5, $6)
+		 ON CONFLICT(namespace, path) DO UPDATE SET
+		   key_id = excluded.key_id,
+		   wrapped_key = excluded.wrapped_key,
+		   segment_size = excluded.segment_size,
+		   created_at = excluded.created_at`,
+		namespace,
+		name,
+		keyID,
+		wrapped,
+		defaultSegmentSize,
+		time.Now().Unix(),
+	); err != nil {
+		return nil, fmt.Errorf("save data key: %w", err)
+	}
+	er, err := newEncryptReader(src, dataKey, defaultSegmentSize)
+	if err != nil {
+		return nil, err
+	}
+	return er, nil
+}
+
+// decryptFile returns a writer that decrypts a file stored under fk into w.
+// Close it to check the final segment.
+func (s *server) decryptFile(fk *fileKey, w io.Writer) (*decryptWriter, error) {
+	if s.keys == nil {
+		return nil, fmt.Errorf("file is encrypted but no master key is loaded")
+	}
+	dataKey, err := s.keys.unwrap(fk.KeyID, fk.WrappedKey)
+	if err != nil {
+		return nil, err
+	}
+	return newDecryptWriter(w, dataKey, fk.SegmentSize)
+}
+
+// rotateFileKeys rewraps every data key that is not wrapped by the active
+// master key. File data is untouched.
+func (s *server) rotateFileKeys() (int, error) {
+	rows, err := s.db.Query(`SELECT namespace, path, key_id, wrapped_key FROM file_keys WHERE key_id <> $1`, s.keys.active.id)
+	if err != nil {
+		return 0, err
+	}
+	type staleKey struct {
+		namespace, path, keyID, wrapped string
+	}
+	var stale []staleKey
+	for rows.Next() {
+		var k staleKey
+		if err := rows.Scan(&k.namespace, &k.path, &k.keyID, &k.wrapped); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		stale = append(stale, k)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	rewrapped := 0
+	for _, k := range stale {
+		dataKey, err := s.keys.unwrap(k.keyID, k.wrapped)
+		if err != nil {
+			return rewrapped, fmt.Errorf("%s/%s: %w", k.namespace, k.path, err)
+		}
+		keyID, wrapped, err := s.keys.wrap(dataKey)
+		if err != nil {
+			return rewrapped, err
+		}
+		if _, err := s.db.Exec(
+			`UPDATE file_keys SET key_id = $1, wrapped_key = $2 WHERE namespace = $3 AND path = $4 AND key_id = $5`,
+			keyID,
+			wrapped,
+			k.namespace,
+			k.path,
+			k.keyID,
+		); err != nil {
+			return rewrapped, err
+		}
+		rewrapped++
+	}
+	return rewrapped, nil
+}
+
+type encryptionStatus struct {
+	Configured  bool           `json:"configured"`
+	ActiveKeyID string         `json:"active_key_id,omitempty"`
+	LoadedKeys  []string       `json:"loaded_keys"`
+	FilesByKey  map[string]int `json:"files_by_key"`
+}
+
+// handleAdminEncryption reports key usage (GET) and rewraps data keys under
+// the active master key (POST).
+func (s *server) handleAdminEncryption(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.requireRole(w, r, readableBy(r, roleStorageAdmin)...); !ok {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		status := encryptionStatus{
+			Configured: s.keys != nil,
+			LoadedKeys: []string{},
+			FilesByKey: make(map[string]int),
+		}
+		if s.keys != nil {
+			status.ActiveKeyID = s.keys.active.id
+			for id := range s.keys.keys {
+				status.LoadedKeys = append(status.LoadedKeys, id)
+			}
+		}
+		rows, err := s.db.Query(`SELECT key_id, COUNT(1) FROM file_keys GROUP BY key_id`)
+		if err != nil {
+			http.Error(w, "failed to load key usage", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var id string
+			var count int
+			if err := rows.Scan(&id, &count); err != nil {
+				http.Error(w, "failed to load key usage", http.StatusInternalServerError)
+				return
+			}
+			status.FilesByKey[id] = count
+		}
+		writeJSON(w, status)
+	case http.MethodPost:
+		if s.keys == nil {
+			http.Error(w, "encryption is not configured", http.StatusBadRequest)
+			return
+		}
+		rewrapped, err := s.rotateFileKeys()
+		if err != nil {
+			log.Printf("key rotation failed after %d keys: %v", rewrapped, err)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusInternalServerError)
+			_ = json.NewEncoder(w).Encode(map[string]any{"rewrapped": rewrapped, "error": err.Error()})
+			return
+		}
+		log.Printf("key rotation complete active=%s rewrapped=%d", s.keys.active.id, rewrapped)
+		writeJSON(w, map[string]any{"status": "ok", "active_key_id": s.keys.active.id, "rewrapped": rewrapped})
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"io"
+	"testing"
+)
+
+const testSegmentSize = 64
+
+func encryptTest(t *testing.T, key, data []byte) []byte {
+	t.Helper()
+	er, err := newEncryptReader(bytes.NewReader(data), key, testSegmentSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, err := io.ReadAll(er)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return stored
+}
+
+// decryptTest feeds stored to a decryptWriter in uneven writes.
+func decryptTest(key, stored []byte) ([]byte, error) {
+	var out bytes.Buffer
+	dw, err := newDecryptWriter(&out, key, testSegmentSize)
+	if err != nil {
+		return nil, err
+	}
+	for len(stored) > 0 {
+		n := min(len(stored), 37)
+		if _, err := dw.Write(stored[:n]); err != nil {
+			return nil, err
+		}
+		stored = stored[n:]
+	}
+	if err := dw.Close(); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+func testDataKey(t *testing.T) []byte {
+	t.Helper()
+	key := make([]byte, dataKeySize)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestSegmentRoundTrip(t *testing.T) {
+	key := testDataKey(t)
+	for _, size := range []int{0, 1, testSegmentSize - 1, testSegmentSize, testSegmentSize + 1, 3*testSegmentSize + 7} {
+		data := make([]byte, size)
+		rand.Read(data)
+
+		stored := encryptTest(t, key, data)
+		if got := plaintextSize(uint64(len(stored)), testSegmentSize); got != uint64(size) {
+			t.Errorf("size %d: plaintextSize = %d", size, got)
+		}
+		plain, err := decryptTest(key, stored)
+		if err != nil {
+			t.Fatalf("size %d: %v", size, err)
+		}
+		if !bytes.Equal(plain, data) {
+			t.Fatalf("size %d: round trip changed the data", size)
+		}
+	}
+}
+
+func TestSegmentTamper(t *testing.T) {
+	key := testDataKey(t)
+	data := make([]byte, 3*testSegmentSize+7)
+	rand.Read(data)
+	stored := encryptTest(t, key, data)
+	segment := testSegmentSize + gcmTagSize
+
+	reordered := append([]byte{}, stored...)
+	copy(reordered[:segment], stored[segment:2*segment])
+	copy(reordered[segment:2*segment], stored[:segment])
+
+	flipped := append([]byte{}, stored...)
+	flipped[segment+3] ^= 1
+
+	tests := []struct {
+		name   string
+		key    []byte
+		stored []byte
+	}{
+		{"truncated at a segment boundary", key, stored[:2*segment]},
+		{"truncated mid-segment", key, stored[:2*segment+10]},
+		{"final segment dropped", key, stored[:3*segment]},
+		{"segments reordered", key, reordered},
+		{"bit flipped", key, flipped},
+		{"wrong key", testDataKey(t), stored},
+	}
+	for _, tt := range tests {
+		if _, err := decryptTest(tt.key, tt.stored); err == nil {
+			t.Errorf("%s: decrypted without error", tt.name)
+		}
+	}
+}
+
+func TestKeyringWrap(t *testing.T) {
+	oldKey, newKey := testDataKey(t), testDataKey(t)
+	t.Setenv("SFS_MASTER_KEY", base64.StdEncoding.EncodeToString(oldKey))
+	old, err := loadKeyring("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dataKey := testDataKey(t)
+	keyID, wrapped, err := old.wrap(dataKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// After a rotation the old master key is still listed, after the new one.
+	t.Setenv("SFS_MASTER_KEY", base64.StdEncoding.EncodeToString(newKey)+","+base64.StdEncoding.EncodeToString(oldKey))
+	rotated, err := loadKeyring("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rotated.active.id == keyID {
+		t.Fatalf("rotated keyring still wraps with %s", keyID)
+	}
+	got, err := rotated.unwrap(keyID, wrapped)
+	if err != nil || !bytes.Equal(got, dataKey) {
+		t.Fatalf("unwrap after rotation = %x, %v", got, err)
+	}
+	if _, err := rotated.unwrap(rotated.active.id, wrapped); err == nil {
+		t.Fatalf("unwrapped under the wrong master key")
+	}
+}
@@ -5,14 +5,24 @@ go 1.24.0
 toolchain go1.24.11
 
 require (
+	eddisonso.com/edd-cloud/pkg v0.0.0
 	eddisonso.com/go-gfs v0.0.0
+	github.com/DATA-DOG/go-sqlmock v1.5.2
+	github.com/klauspost/compress v1.18.0
 	github.com/lib/pq v1.10.9
+	github.com/prometheus/client_golang v1.22.0
 	golang.org/x/crypto v0.40.0
 	golang.org/x/net v0.41.0
 )
 
 require (
+	github.com/beorn7/perks v1.0.1 // indirect
+	github.com/cespare/xxhash/v2 v2.3.0 // indirect
 	github.com/golang-jwt/jwt/v5 v5.3.0 // indirect
+	github.com/munnerz/goautoneg v0.0.0-20191010083416-a7dc8b61c822 // indirect
+	github.com/prometheus/client_model v0.6.1 // indirect
+	github.com/prometheus/common v0.62.0 // indirect
+	github.com/prometheus/procfs v0.15.1 // indirect
 	golang.org/x/sys v0.40.0 // indirect
 	golang.org/x/text v0.27.0 // indirect
 	google.golang.org/genproto/googleapis/rpc v0.0.0-20250324211829-b45e905df463 // indirect
@@ -21,3 +31,5 @@ require (
 )
 
 replace eddisonso.com/go-gfs => ../../../go-gfs
+
+replace eddisonso.com/edd-cloud/pkg => ../../pkg
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Failures allowed before backoff kicks in.
+	loginFreeAttempts = 3
+	// Upper bound for the backoff delay between failed attempts.
+	loginMaxBackoff = 5 * time.Minute
+	// Shared addresses (NAT, office networks) get more room than a username.
+	loginIPFailureFactor = 5
+)
+
+// loginLimiter throttles failed logins per username and per client IP. State
+// lives in Postgres so every SFS replica sees the same counters.
+type loginLimiter struct {
+	maxFailures int
+	lockout     time.Duration
+}
+
+func loginUserKey(username string) string {
+	return "user:" + strings.ToLower(username)
+}
+
+func loginIPKey(ip string) string {
+	return "ip:" + ip
+}
+
+// defaultTrustedProxies is the cluster network the ingress controller and
+// the Cloudflare tunnel connect from. Trusting nothing by default would make
+// every client share the ingress address, so a handful of bad passwords
+// would lock everyone out.
+const defaultTrustedProxies = "10.0.0.0/8"
+
+// trustedProxies lists the addresses whose forwarding headers are believed.
+// Anyone else could put whatever they like in CF-Connecting-IP or
+// X-Forwarded-For, so their own address is used instead.
+type trustedProxies []netip.Prefix
+
+// parseTrustedProxies reads a comma-separated list of IPs and CIDRs.
+func parseTrustedProxies(raw string) (trustedProxies, error) {
+	var out trustedProxies
+	for _, entry := range strings.Split(raw, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if strings.Contains(entry, "/") {
+			prefix, err := netip.ParsePrefix(entry)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, prefix.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(entry)
+		if err != nil {
+			return nil, err
+		}
+		addr = addr.Unmap()
+		out = append(out, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return out, nil
+}
+
+func (p trustedProxies) trusts(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range p {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the caller's address. Behind a trusted proxy that is the
+// address the Cloudflare tunnel or ingress reports; X-Forwarded-For is read
+// from the right, skipping our own proxies, since entries further left are
+// whatever the client sent.
+func (p trustedProxies) clientIP(r *http.Request) string {
+	remote, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		remote = r.RemoteAddr
+	}
+	if !p.trusts(remote) {
+		return remote
+	}
+	if ip := headerIP(r.Header.Get("CF-Connecting-IP")); ip != "" {
+		return ip
+	}
+	if forwarded := r.Header.Values("X-Forwarded-For"); len(forwarded) > 0 {
+		hops := strings.Split(strings.Join(forwarded, ","), ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			ip := headerIP(hops[i])
+			if ip == "" {
+				break
+			}
+			if !p.trusts(ip) || i == 0 {
+				return ip
+			}
+		}
+	}
+	if ip := headerIP(r.Header.Get("X-Real-IP")); ip != "" {
+		return ip
+	}
+	return remote
+}
+
+// headerIP returns the address in a forwarding header value, or "" when it
+// is not one.
+func headerIP(value string) string {
+	addr, err := netip.ParseAddr(strings.TrimSpace(value))
+	if err != nil {
+		return ""
+	}
+	return addr.Unmap().String()
+}
+
+// clientIP is the caller's address as seen through the trusted proxies.
+func (s *server) clientIP(r *http.Request) string {
+	return s.proxies.clientIP(r)
+}
+
+// loginBackoff is the delay enforced after the given number of consecutive
+// failures: none for the first few, then doubling from one second.
+func loginBackoff(failures int) time.Duration {
+	if failures < loginFreeAttempts {
+		return 0
+	}
+	shift := failures - loginFreeAttempts
+	if shift > 16 {
+		return loginMaxBackoff
+	}
+	delay := time.Second << shift
+	if delay > loginMaxBackoff {
+		return loginMaxBackoff
+	}
+	return delay
+}
+
+func (l loginLimiter) threshold(key string) int {
+	if strings.HasPrefix(key, "ip:") {
+		return l.maxFailures * loginIPFailureFactor
+	}
+	return l.maxFailures
+}
+
+// loginRetryAfter reports how long the caller must wait before another login
+// attempt is allowed for any of the keys. Zero means the attempt may proceed.
+func (s *server) loginRetryAfter(keys ...string) time.Duration {
+	now := time.Now()
+	var wait time.Duration
+	for _, key := range keys {
+		var failures int
+		var lastFailure, lockedUntil int64
+		err := s.db.QueryRow(
+			`SELECT failures, last_failure, locked_until FROM login_attempts WHERE key = $1`,
+			key,
+		).Scan(&failures, &lastFailure, &lockedUntil)
+		if err != nil {
+			continue
+		}
+		if lockedUntil > now.Unix() {
+			wait = max(wait, time.Unix(lockedUntil, 0).Sub(now))
+			continue
+		}
+		if now.Sub(time.Unix(lastFailure, 0)) > s.logins.lockout {
+			continue
+		}
+		if next := time.Unix(lastFailure, 0).Add(loginBackoff(failures)); next.After(now) {
+			wait = max(wait, next.Sub(now))
+		}
+	}
+	return wait
+}
+
+// recordLoginFailure bumps the failure counters and locks any key that has
+// reached its threshold. Counters older than the lockout window start over.
+func (s *server) recordLoginFailure(username, ip string) {
+	now := time.Now()
+	for _, key := range []string{loginUserKey(username), loginIPKey(ip)} {
+		var failures int
+		err := s.db.QueryRow(
+			`INSERT INTO login_attempts (key, failures, last_failure, locked_until)
+			 VALUES ($1, 1, $2, 0)
+			 ON CONFLICT(key) DO UPDATE SET
+			   failures = CASE WHEN login_attempts.last_failure < $3 THEN 1 ELSE login_attempts.failures + 1 END,
+			   last_failure = excluded.last_failure
+			 RETURNING failures`,
+			key,
+			now.Unix(),
+			now.Add(-s.logins.lockout).Unix(),
+		).Scan(&failures)
+		if err != nil {
+			log.Printf("login attempt update failed key=%s err=%v", key, err)
+			continue
+		}
+		if failures < s.logins.threshold(key) {
+			continue
+		}
+		until := now.Add(s.logins.lockout)
+		if _, err := s.db.Exec(`UPDATE login_attempts SET locked_until = $1 WHERE key = $2`, until.Unix(), key); err != nil {
+			log.Printf("login lockout failed key=%s err=%v", key, err)
+			continue
+		}
+		log.Printf("login locked key=%s failures=%d until=%s", key, failures, until.UTC().Format(time.RFC3339))
+		s.recordAudit("", key, "login.lockout", fmt.Sprintf("%d failed attempts, locked until %s (last attempt for %q from %s)",
+			failures, until.UTC().Format(time.RFC3339), username, ip))
+	}
+}
+
+// clearLoginFailures resets a username's counter after a successful login.
+// The IP counter is left alone so one valid account cannot launder attempts
+// against others.
+func (s *server) clearLoginFailures(username string) {
+	_, _ = s.db.Exec(`DELETE FROM login_attempts WHERE key = $1`, loginUserKey(username))
+}
+
+// pruneLoginAttempts periodically drops counters that no longer affect
+// anything.
+func (s *server) pruneLoginAttempts(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		now := time.Now()
+		_, err := s.db.Exec(
+			`DELETE FROM login_attempts WHERE last_failure < $1 AND locked_until < $2`,
+			now.Add(-s.logins.lockout).Unix(),
+			now.Unix(),
+		)
+		if err != nil {
+			log.Printf("login attempt prune failed: %v", err)
+		}
+	}
+}
+
+type loginLockout struct {
+	Key         string `json:"key"`
+	Failures    int    `json:"failures"`
+	LastFailure int64  `json:"last_failure"`
+	LockedUntil int64  `json:"locked_until"`
+}
+
+// handleAdminLockouts lists throttled login keys (GET) and unlocks one
+// (DELETE ?key=user:alice, or ?username=alice).
+func (s *server) handleAdminLockouts(w http.ResponseWriter, r *http.Request) {
+	username, ok := s.requireRole(w, r, readableBy(r)...)
+	if !ok {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		rows, err := s.db.Query(
+			`SELECT key, failures, last_failure, locked_until FROM login_attempts
+			 WHERE locked_until > $1 OR failures >= $2
+			 ORDER BY last_failure DESC`,
+			time.Now().Unix(),
+			loginFreeAttempts,
+		)
+		if err != nil {
+			http.Error(w, "failed to load lockouts", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+		lockouts := make([]loginLockout, 0)
+		for rows.Next() {
+			var l loginLockout
+			if err := rows.Scan(&l.Key, &l.Failures, &l.LastFailure, &l.LockedUntil); err != nil {
+				http.Error(w, "failed to load lockouts", http.StatusInternalServerError)
+				return
+			}
+			lockouts = append(lockouts, l)
+		}
+		writeJSON(w, lockouts)
+	case http.MethodDelete:
+		key := strings.TrimSpace(r.URL.Query().Get("key"))
+		if target := strings.TrimSpace(r.URL.Query().Get("username")); target != "" {
+			key = loginUserKey(target)
+		}
+		if key == "" {
+			http.Error(w, "key or username required", http.StatusBadRequest)
+			return
+		}
+		result, err := s.db.Exec(`DELETE FROM login_attempts WHERE key = $1`, key)
+		if err != nil {
+			http.Error(w, "failed to unlock", http.StatusInternalServerError)
+			return
+		}
+		if deleted, _ := result.RowsAffected(); deleted == 0 {
+			http.Error(w, "no lockout for key", http.StatusNotFound)
+			return
+		}
+		s.recordAudit("", username, "login.unlock", key)
+		writeJSON(w, map[string]string{"status": "ok"})
+	default:
+		w.Header().Set("Allow", "GET, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func retryAfterSeconds(wait time.Duration) string {
+	seconds := int((wait + time.Second - 1) / time.Second)
+	return strconv.Itoa(max(seconds, 1))
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestClientIP(t *testing.T) {
+	proxies, err := parseTrustedProxies("10.0.0.0/8, 192.0.2.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		remote  string
+		headers map[string]string
+		want    string
+	}{
+		{"direct", "203.0.113.7:5000", nil, "203.0.113.7"},
+		{"untrusted forwarder", "203.0.113.7:5000", map[string]string{"CF-Connecting-IP": "198.51.100.1", "X-Forwarded-For": "198.51.100.2"}, "203.0.113.7"},
+		{"cloudflare", "10.1.2.3:5000", map[string]string{"CF-Connecting-IP": "198.51.100.1"}, "198.51.100.1"},
+		{"forwarded chain", "192.0.2.1:5000", map[string]string{"X-Forwarded-For": "1.1.1.1, 198.51.100.2, 10.0.0.5"}, "198.51.100.2"},
+		{"all proxies", "10.1.2.3:5000", map[string]string{"X-Forwarded-For": "10.0.0.9, 10.0.0.5"}, "10.0.0.9"},
+		{"garbage hop", "10.1.2.3:5000", map[string]string{"X-Forwarded-For": "nonsense", "X-Real-IP": "198.51.100.3"}, "198.51.100.3"},
+		{"no headers", "10.1.2.3:5000", nil, "10.1.2.3"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = tt.remote
+			for k, v := range tt.headers {
+				r.Header.Set(k, v)
+			}
+			if got := proxies.clientIP(r); got != tt.want {
+				t.Fatalf("clientIP = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	var none trustedProxies
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "10.1.2.3:5000"
+	r.Header.Set("X-Forwarded-For", "198.51.100.2")
+	if got := none.clientIP(r); got != "10.1.2.3" {
+		t.Fatalf("with no trusted proxies clientIP = %q", got)
+	}
+	if _, err := parseTrustedProxies("10.0.0.0/33"); err == nil {
+		t.Fatalf("bad CIDR accepted")
+	}
+}
+
+// TestLoginThroughProxy checks that a failed login arriving through the
+// ingress is counted against the client, not the proxy every client shares.
+func TestLoginThroughProxy(t *testing.T) {
+	proxies, err := parseTrustedProxies(defaultTrustedProxies)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	s := &server{
+		db:      db,
+		proxies: proxies,
+		logins:  loginLimiter{maxFailures: 10, lockout: 15 * time.Minute},
+	}
+
+	for _, key := range []string{"user:ada", "ip:198.51.100.1"} {
+		mock.ExpectQuery(sqlText(`SELECT failures, last_failure, locked_until FROM login_attempts`)).
+			WithArgs(key).
+			WillReturnError(sql.ErrNoRows)
+	}
+	mock.ExpectQuery(sqlText(`SELECT id, password_hash`)).
+		WithArgs("ada").
+		WillReturnError(sql.ErrNoRows)
+	for _, key := range []string{"user:ada", "ip:198.51.100.1"} {
+		mock.ExpectQuery(sqlText(`INSERT INTO login_attempts`)).
+			WithArgs(key, sqlmock.AnyArg(), sqlmock.AnyArg()).
+			WillReturnRows(sqlmock.NewRows([]string{"failures"}).AddRow(1))
+	}
+
+	r := httptest.NewRequest("POST", "/api/login", strings.NewReader(`{"username":"ada","password":"wrong"}`))
+	r.RemoteAddr = "10.42.0.17:41234"
+	r.Header.Set("CF-Connecting-IP", "198.51.100.1")
+	w := httptest.NewRecorder()
+	s.handleLogin(w, r)
+
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("status = %d, want 401", w.Code)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
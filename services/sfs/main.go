@@ -6,50 +6,81 @@ import (
 	"database/sql"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"html"
 	"io"
 	"log"
 	"log/slog"
 	"mime"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
 	"path"
 	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
-	gfs "eddisonso.com/go-gfs/pkg/go-gfs-sdk"
+	"eddisonso.com/edd-cloud/pkg/httpapi"
+	"eddisonso.com/edd-cloud/pkg/metrics"
 	"eddisonso.com/go-gfs/pkg/gfslog"
+	_ "github.com/lib/pq"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 	"golang.org/x/crypto/bcrypt"
 	"golang.org/x/net/websocket"
-	_ "github.com/lib/pq"
 )
 
 type fileInfo struct {
-	Name       string `json:"name"`
-	Path       string `json:"path"`
-	Namespace  string `json:"namespace"`
-	Size       uint64 `json:"size"`
-	CreatedAt  int64  `json:"created_at"`
-	ModifiedAt int64  `json:"modified_at"`
+	Name       string            `json:"name"`
+	Path       string            `json:"path"`
+	Namespace  string            `json:"namespace"`
+	Size       uint64            `json:"size"`
+	CreatedAt  int64             `json:"created_at"`
+	ModifiedAt int64             `json:"modified_at"`
+	Tags       map[string]string `json:"tags,omitempty"`
+	// Size is what downloads return; StoredSize is what the file takes up
+	// after compression and encryption.
+	StoredSize uint64 `json:"stored_size"`
+	Encoding   string `json:"encoding,omitempty"`
+	ScanStatus string `json:"scan_status,omitempty"`
 }
 
 type server struct {
-	client     *gfs.Client
-	prefix     string
-	staticDir  string
-	maxUpload  int64
-	listPrefix string
-	uploadTTL  time.Duration
-	db         *sql.DB
-	cookieName string
-	sessionTTL time.Duration
-	wsMu       sync.Mutex
-	wsConns    map[string]*websocket.Conn
+	storage     storageBackend
+	prefix      string
+	staticDir   string
+	maxUpload   int64
+	listPrefix  string
+	uploadTTL   time.Duration
+	db          *sql.DB
+	cookieName  string
+	sessionTTL  time.Duration
+	wsMu        sync.Mutex
+	wsConns     map[string]*websocket.Conn
+	keys        *keyring
+	sitesDomain string
+	logins      loginLimiter
+	oidc        *oidcProvider
+	sessions    *sessionCache
+	tokens      *tokenSigner
+	origins     originPolicy
+	proxies     trustedProxies
+	drain       drainer
+	limits      *trafficLimits
+	changes     *changeHub
+	// batchConcurrency caps storage calls in flight per batch request.
+	batchConcurrency int
+	// scanner checks uploads for malware; nil disables scanning.
+	scanner             fileScanner
+	scanTimeout         time.Duration
+	quarantineNamespace string
 }
 
 const (
@@ -58,23 +89,57 @@ const (
 )
 
 type namespaceInfo struct {
-	Name    string `json:"name"`
-	Count   int    `json:"count"`
-	Hidden  bool   `json:"hidden"`
-	OwnerID *int   `json:"owner_id,omitempty"`
+	Name         string `json:"name"`
+	Count        int    `json:"count"`
+	Bytes        int64  `json:"bytes"`
+	LogicalBytes int64  `json:"logical_bytes"`
+	LastModified int64  `json:"last_modified,omitempty"`
+	Hidden       bool   `json:"hidden"`
+	Encrypted    bool   `json:"encrypted"`
+	Compression  string `json:"compression,omitempty"`
+	OwnerID      *int   `json:"owner_id,omitempty"`
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := runMigrateCommand(os.Args[2:]); err != nil {
+			log.Fatalf("migrate: %v", err)
+		}
+		return
+	}
+
 	addr := flag.String("addr", ":8080", "HTTP listen address")
 	master := flag.String("master", "127.0.0.1:50051", "GFS master gRPC address")
+	backend := flag.String("backend", "gfs", "storage backend: gfs or local")
+	dataDir := flag.String("data-dir", "data", "directory for the local storage backend")
+	sitesDomain := flag.String("sites-domain", "", "parent domain for namespace websites served at {namespace}.<domain> (empty disables)")
 	prefix := flag.String("prefix", "/sfs", "GFS namespace prefix for simple file store")
 	staticDir := flag.String("static", "frontend", "path to frontend assets")
 	maxUploadMB := flag.Int64("max-upload-mb", 0, "max upload size in MB (0 = unlimited)")
 	uploadTTL := flag.Duration("upload-timeout", 10*time.Minute, "max time allowed for a single upload")
+	statsReconcile := flag.Duration("stats-reconcile-interval", time.Hour, "how often namespace file counts and sizes are rechecked against storage")
+	listRateLimit := flag.String("list-rate-limit", "120,storage-admin=600,admin=0", "listing requests per minute per user (per IP when signed out), with role=limit overrides (0 = unlimited)")
+	authRateLimit := flag.String("auth-rate-limit", "20", "login and token requests per minute per user or IP, with role=limit overrides (0 = unlimited)")
+	userBandwidthMB := flag.String("user-bandwidth-mb", "0", "upload and download bandwidth per user in MB/s, with role=limit overrides (0 = unlimited)")
+	namespaceBandwidthMB := flag.Float64("namespace-bandwidth-mb", 0, "upload and download bandwidth per namespace in MB/s (0 = unlimited)")
+	changeRetention := flag.Duration("change-retention", 30*24*time.Hour, "how long change journal entries are kept for sync clients")
+	batchConcurrency := flag.Int("batch-concurrency", 8, "max operations a batch request runs at once")
+	clamdAddr := flag.String("clamd", "", "clamd address for malware scanning of uploads: host:port or unix:///path/to/clamd.sock (empty disables)")
+	scanTimeout := flag.Duration("scan-timeout", 2*time.Minute, "how long to wait for a malware scan verdict once an upload ends")
+	quarantineNamespace := flag.String("quarantine-namespace", "quarantine", "hidden namespace infected uploads are moved to")
+	drainTimeout := flag.Duration("drain-timeout", 2*time.Minute, "how long shutdown waits for active transfers before cancelling them")
 	// authDB flag kept for backwards compatibility but DATABASE_URL takes precedence
 	sessionTTL := flag.Duration("session-ttl", 24*time.Hour, "session lifetime")
 	logServiceAddr := flag.String("log-service", "", "Log service address (e.g., log-service:50051)")
 	logSource := flag.String("log-source", "edd-cloud-interface", "Log source name (e.g., pod name)")
+	loginMaxFailures := flag.Int("login-max-failures", 10, "failed logins per username before a temporary lockout (per IP allows 5x)")
+	loginLockout := flag.Duration("login-lockout", 15*time.Minute, "lockout duration and failure counting window for logins")
+	sessionCacheTTL := flag.Duration("session-cache-ttl", 30*time.Second, "how long resolved sessions are cached in memory (0 disables)")
+	sessionCacheSize := flag.Int("session-cache-size", 10000, "max sessions held in the in-memory cache")
+	accessTokenTTL := flag.Duration("access-token-ttl", 5*time.Minute, "lifetime of signed access tokens")
+	signingKeyRotation := flag.Duration("signing-key-rotation", 7*24*time.Hour, "how often a new access token signing key is generated")
+	trustedProxyList := flag.String("trusted-proxies", defaultTrustedProxies, "comma-separated IPs or CIDRs of proxies whose CF-Connecting-IP and X-Forwarded-For headers are trusted (empty trusts none)")
+	masterKeyFile := flag.String("master-key-file", "", "file with base64 master keys for namespace encryption, active key first (falls back to SFS_MASTER_KEY)")
 	flag.Parse()
 
 	// Initialize logger
@@ -92,13 +157,39 @@ func main() {
 	if cleanPrefix == "/" {
 		log.Fatal("prefix cannot be root")
 	}
+	if *signingKeyRotation < 2*signingKeyReload {
+		log.Fatalf("-signing-key-rotation must be at least %s", 2*signingKeyReload)
+	}
+
+	listLimits, err := parseRoleLimits(*listRateLimit)
+	if err != nil {
+		log.Fatalf("invalid -list-rate-limit: %v", err)
+	}
+	authLimits, err := parseRoleLimits(*authRateLimit)
+	if err != nil {
+		log.Fatalf("invalid -auth-rate-limit: %v", err)
+	}
+	userBandwidth, err := parseRoleLimits(*userBandwidthMB)
+	if err != nil {
+		log.Fatalf("invalid -user-bandwidth-mb: %v", err)
+	}
+	proxies, err := parseTrustedProxies(*trustedProxyList)
+	if err != nil {
+		log.Fatalf("invalid -trusted-proxies: %v", err)
+	}
 
 	ctx := context.Background()
-	client, err := gfs.New(ctx, *master)
+	backendStorage, err := newStorageBackend(ctx, *backend, *master, *dataDir)
+	if err != nil {
+		log.Fatalf("failed to init storage backend: %v", err)
+	}
+	storage := &instrumentedStorage{backend: *backend, next: backendStorage}
+	defer storage.Close()
+
+	keys, err := loadKeyring(*masterKeyFile)
 	if err != nil {
-		log.Fatalf("failed to connect to gfs master: %v", err)
+		log.Fatalf("failed to load master keys: %v", err)
 	}
-	defer client.Close()
 
 	absStatic, err := filepath.Abs(*staticDir)
 	if err != nil {
@@ -128,46 +219,167 @@ func main() {
 	}
 
 	srv := &server{
-		client:     client,
-		prefix:     cleanPrefix,
-		staticDir:  absStatic,
-		maxUpload:  maxUploadBytes(*maxUploadMB),
-		listPrefix: "",
-		uploadTTL:  *uploadTTL,
-		db:         db,
-		cookieName: "sfs_session",
-		sessionTTL: *sessionTTL,
-		wsConns:    make(map[string]*websocket.Conn),
+		storage:     storage,
+		prefix:      cleanPrefix,
+		staticDir:   absStatic,
+		maxUpload:   maxUploadBytes(*maxUploadMB),
+		listPrefix:  "",
+		uploadTTL:   *uploadTTL,
+		db:          db,
+		cookieName:  "sfs_session",
+		sessionTTL:  *sessionTTL,
+		wsConns:     make(map[string]*websocket.Conn),
+		keys:        keys,
+		sitesDomain: strings.ToLower(strings.Trim(strings.TrimSpace(*sitesDomain), ".")),
+		logins:      loginLimiter{maxFailures: *loginMaxFailures, lockout: *loginLockout},
+		sessions:    newSessionCache(*sessionCacheTTL, *sessionCacheSize),
+		tokens:      &tokenSigner{ttl: *accessTokenTTL, rotation: *signingKeyRotation},
+		origins:     loadOriginPolicy(),
+		proxies:     proxies,
+		changes:     newChangeHub(),
+		limits:      newTrafficLimits(listLimits, authLimits, userBandwidth.scaled(1<<20), *namespaceBandwidthMB*(1<<20)),
+
+		batchConcurrency:    *batchConcurrency,
+		scanTimeout:         *scanTimeout,
+		quarantineNamespace: *quarantineNamespace,
+	}
+	if *clamdAddr != "" {
+		scanner, err := newClamdScanner(*clamdAddr, *scanTimeout)
+		if err != nil {
+			log.Fatalf("invalid -clamd: %v", err)
+		}
+		if err := ensureQuarantineNamespace(db, *quarantineNamespace); err != nil {
+			log.Fatalf("failed to set up quarantine namespace: %v", err)
+		}
+		srv.scanner = scanner
+		go srv.retryScansLoop(time.Minute)
+		log.Printf("malware scanning enabled clamd=%s quarantine=%s", scanner, *quarantineNamespace)
+	}
+	if err := srv.loadSigningKeys(); err != nil {
+		log.Fatalf("failed to load token signing keys: %v", err)
+	}
+	go srv.rotateSigningKeys(signingKeyReload)
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "sfs_websocket_connections",
+		Help: "Open transfer progress WebSockets.",
+	}, srv.wsConnCount)
+	go srv.pruneLoginAttempts(time.Hour)
+	go srv.sweepSessions(10 * time.Minute)
+	go srv.reconcileNamespaceStatsLoop(*statsReconcile)
+	go srv.pruneTrafficLimits(time.Minute)
+	go srv.listenChanges(dbConnStr)
+	go srv.pruneChanges(time.Hour, *changeRetention)
+
+	if oidcCfg := loadOIDCConfig(); oidcCfg.enabled() {
+		if oidcCfg.RedirectURL == "" {
+			log.Fatal("OIDC_REDIRECT_URL is required when OIDC_ISSUER is set")
+		}
+		srv.oidc = newOIDCProvider(oidcCfg)
+		log.Printf("single sign-on enabled issuer=%s", oidcCfg.Issuer)
 	}
 
-	mux := http.NewServeMux()
-	// Auth endpoints
-	mux.HandleFunc("/api/login", srv.handleLogin)
-	mux.HandleFunc("/api/logout", srv.handleLogout)
-	mux.HandleFunc("/api/session", srv.handleSession)
-	// Storage endpoints
-	mux.HandleFunc("/storage/namespaces", srv.handleNamespaces)
-	mux.HandleFunc("DELETE /storage/namespaces/{name}", srv.handleNamespaceDeleteByPath)
-	mux.HandleFunc("PUT /storage/namespaces/{name}", srv.handleNamespaceUpdateByPath)
-	mux.HandleFunc("/storage/files", srv.handleList)
-	mux.HandleFunc("/storage/upload", srv.handleUpload)
-	mux.HandleFunc("/storage/download", srv.handleDownload)
-	mux.HandleFunc("/storage/delete", srv.handleDelete)
-	mux.HandleFunc("GET /storage/download/{namespace}/{file...}", srv.handleFileDownload)
-	mux.HandleFunc("GET /storage/{namespace}/{file...}", srv.handleFileGet)
-	// Admin endpoints
-	mux.HandleFunc("/admin/files", srv.handleAdminFiles)
-	mux.HandleFunc("/admin/namespaces", srv.handleAdminNamespaces)
-	mux.HandleFunc("/admin/users", srv.handleAdminUsers)
-	mux.Handle("/ws", websocket.Handler(srv.handleWS))
-	mux.Handle("/", srv.staticHandler())
+	mux := srv.routes()
 
 	log.Printf("listening on %s", *addr)
 	log.Printf("serving frontend from %s", srv.staticDir)
-		log.Printf("sharing files under namespace prefix %s", srv.prefix)
-	if err := http.ListenAndServe(*addr, corsMiddleware(logRequests(mux))); err != nil {
+	if srv.keys != nil {
+		log.Printf("namespace encryption enabled active_key=%s", srv.keys.active.id)
+	}
+	log.Printf("sharing files under namespace prefix %s (backend=%s)", srv.prefix, *backend)
+	if srv.sitesDomain != "" {
+		log.Printf("serving namespace websites on *.%s", srv.sitesDomain)
+	}
+	var handler http.Handler = srv.siteMiddleware(recordRoute(mux))
+	handler = srv.withSession(srv.csrfProtect(handler))
+	handler = instrumentRequests(srv.apiV1(mux, handler))
+	handler = srv.origins.cors(httpapi.WithRequestID(logRequests(handler)))
+
+	// Request contexts derive from baseCtx so a forced shutdown can cancel
+	// uploads that outlive the drain timeout.
+	baseCtx, cancelRequests := context.WithCancel(context.Background())
+	defer cancelRequests()
+	httpServer := &http.Server{
+		Addr:        *addr,
+		Handler:     handler,
+		BaseContext: func(net.Listener) context.Context { return baseCtx },
+	}
+	serveErr := make(chan error, 1)
+	go func() { serveErr <- httpServer.ListenAndServe() }()
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case err := <-serveErr:
 		log.Fatalf("server stopped: %v", err)
+	case sig := <-sigCh:
+		log.Printf("received %s", sig)
 	}
+	srv.shutdown(httpServer, cancelRequests, *drainTimeout)
+}
+
+// routes registers every handler. The v1 API resolves its paths against the
+// same mux.
+func (s *server) routes() *http.ServeMux {
+	mux := http.NewServeMux()
+	// Auth endpoints
+	mux.HandleFunc("/api/login", s.rateLimit(rateClassAuth, s.handleLogin))
+	mux.HandleFunc("/api/login/2fa", s.rateLimit(rateClassAuth, s.handleLoginTOTP))
+	mux.HandleFunc("/api/logout", s.handleLogout)
+	mux.HandleFunc("GET /api/oidc", s.handleOIDCConfig)
+	mux.HandleFunc("GET /api/oidc/login", s.rateLimit(rateClassAuth, s.handleOIDCLogin))
+	mux.HandleFunc("GET /api/oidc/callback", s.rateLimit(rateClassAuth, s.handleOIDCCallback))
+	mux.HandleFunc("/api/account", s.handleAccount)
+	mux.HandleFunc("POST /api/account/password", s.rateLimit(rateClassAuth, s.handleAccountPassword))
+	mux.HandleFunc("GET /api/account/sessions", s.handleAccountSessions)
+	mux.HandleFunc("DELETE /api/account/sessions/{id}", s.handleAccountSessionDelete)
+	mux.HandleFunc("GET /api/account/2fa", s.handleTOTPStatus)
+	mux.HandleFunc("POST /api/account/2fa/setup", s.handleTOTPSetup)
+	mux.HandleFunc("POST /api/account/2fa/enable", s.handleTOTPEnable)
+	mux.HandleFunc("POST /api/account/2fa/disable", s.handleTOTPDisable)
+	mux.HandleFunc("POST /api/account/2fa/recovery-codes", s.handleTOTPRecoveryCodes)
+	mux.HandleFunc("/api/session", s.handleSession)
+	mux.HandleFunc("POST /api/token", s.rateLimit(rateClassAuth, s.handleToken))
+	mux.HandleFunc("GET /.well-known/jwks.json", s.handleJWKS)
+	// Storage endpoints
+	mux.HandleFunc("/storage/namespaces", s.rateLimit(rateClassList, s.handleNamespaces))
+	mux.HandleFunc("DELETE /storage/namespaces/{name}", s.handleNamespaceDeleteByPath)
+	mux.HandleFunc("PUT /storage/namespaces/{name}", s.handleNamespaceUpdateByPath)
+	mux.HandleFunc("POST /storage/namespaces/{name}/rename", s.handleNamespaceRename)
+	mux.HandleFunc("PUT /storage/namespaces/{name}/owner", s.handleNamespaceOwner)
+	mux.HandleFunc("GET /storage/namespaces/{name}/drops", s.handleNamespaceDrops)
+	mux.HandleFunc("POST /storage/namespaces/{name}/drops", s.handleNamespaceDrops)
+	mux.HandleFunc("DELETE /storage/namespaces/{name}/drops/{id}", s.handleNamespaceDropDelete)
+	mux.HandleFunc("GET /storage/namespaces/{name}/audit", s.handleNamespaceAudit)
+	mux.HandleFunc("GET /storage/namespaces/{name}/website", s.handleNamespaceWebsite)
+	mux.HandleFunc("PUT /storage/namespaces/{name}/website", s.handleNamespaceWebsite)
+	mux.HandleFunc("DELETE /storage/namespaces/{name}/website", s.handleNamespaceWebsite)
+	mux.HandleFunc("GET /drop/{token}", s.handleDrop)
+	mux.HandleFunc("POST /drop/{token}", s.handleDrop)
+	mux.HandleFunc("/storage/files", s.rateLimit(rateClassList, s.handleList))
+	mux.HandleFunc("/storage/upload", s.handleUpload)
+	mux.HandleFunc("/storage/download", s.handleDownload)
+	mux.HandleFunc("/storage/delete", s.handleDelete)
+	mux.HandleFunc("GET /storage/changes", s.rateLimit(rateClassList, s.handleChanges))
+	mux.HandleFunc("POST /storage/batch", s.handleBatch)
+	mux.HandleFunc("GET /storage/batch/{id}", s.handleBatchStatus)
+	mux.HandleFunc("GET /storage/download/{namespace}/{file...}", s.handleFileDownload)
+	mux.HandleFunc("GET /storage/{namespace}/{file...}", s.handleFileGet)
+	mux.HandleFunc("PUT /storage/{namespace}/{file...}", s.handleFilePut)
+	// Admin endpoints
+	mux.HandleFunc("/admin/files", s.rateLimit(rateClassList, s.handleAdminFiles))
+	mux.HandleFunc("/admin/namespaces", s.rateLimit(rateClassList, s.handleAdminNamespaces))
+	mux.HandleFunc("/admin/users", s.handleAdminUsers)
+	mux.HandleFunc("/admin/users/2fa", s.handleAdminUserTOTPReset)
+	mux.HandleFunc("/admin/users/roles", s.handleAdminUserRoles)
+	mux.HandleFunc("/admin/roles", s.handleAdminRoles)
+	mux.HandleFunc("/admin/namespaces/orphaned", s.handleAdminOrphanedNamespaces)
+	mux.HandleFunc("/admin/encryption", s.handleAdminEncryption)
+	mux.HandleFunc("/admin/audit", s.handleAdminAudit)
+	mux.HandleFunc("/admin/lockouts", s.handleAdminLockouts)
+	mux.Handle("/ws", websocket.Server{Handler: s.handleWS, Handshake: s.wsHandshake})
+	mux.Handle("GET /metrics", metrics.Handler())
+	mux.Handle("/", s.staticHandler())
+	return mux
 }
 
 func normalizePrefix(prefix string) string {
@@ -181,39 +393,13 @@ func normalizePrefix(prefix string) string {
 	return strings.TrimSuffix(trimmed, "/")
 }
 
+// initAuthDB brings the schema up to date and seeds the default user and
+// built-in namespaces.
 func initAuthDB(db *sql.DB, username string, password string) error {
-	stmts := []string{
-		`CREATE TABLE IF NOT EXISTS users (
-			id SERIAL PRIMARY KEY,
-			username TEXT NOT NULL UNIQUE,
-			password_hash TEXT NOT NULL,
-			display_name TEXT NOT NULL DEFAULT ''
-		)`,
-		`CREATE TABLE IF NOT EXISTS sessions (
-			id SERIAL PRIMARY KEY,
-			user_id INTEGER NOT NULL,
-			token TEXT NOT NULL UNIQUE,
-			expires_at BIGINT NOT NULL,
-			CONSTRAINT fk_user FOREIGN KEY(user_id) REFERENCES users(id)
-		)`,
-		`CREATE TABLE IF NOT EXISTS namespaces (
-			name TEXT PRIMARY KEY,
-			hidden INTEGER NOT NULL DEFAULT 0,
-			owner_id INTEGER REFERENCES users(id)
-		)`,
-	}
-	for _, stmt := range stmts {
-		if _, err := db.Exec(stmt); err != nil {
-			return err
-		}
+	if err := migrateUp(context.Background(), db); err != nil {
+		return err
 	}
 
-	// Migration: add display_name column if it doesn't exist
-	_, _ = db.Exec(`ALTER TABLE users ADD COLUMN IF NOT EXISTS display_name TEXT NOT NULL DEFAULT ''`)
-
-	// Migration: add owner_id column to namespaces if it doesn't exist
-	_, _ = db.Exec(`ALTER TABLE namespaces ADD COLUMN IF NOT EXISTS owner_id INTEGER REFERENCES users(id)`)
-
 	var count int
 	if err := db.QueryRow(`SELECT COUNT(1) FROM users`).Scan(&count); err != nil {
 		return err
@@ -233,6 +419,10 @@ func initAuthDB(db *sql.DB, username string, password string) error {
 		}
 	}
 
+	if err := seedAdminRole(db, os.Getenv("ADMIN_USERNAME")); err != nil {
+		return err
+	}
+
 	if err := ensureNamespaceRow(db, defaultNamespace, false); err != nil {
 		return err
 	}
@@ -270,18 +460,33 @@ func (s *server) handleList(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		if !s.canAccessNamespace(r, namespace) {
-			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			s.denyAccess(w, r)
 			return
 		}
 	} else {
 		namespace = defaultNamespace
 	}
 
-	files, err := s.client.ListFilesWithNamespace(ctx, s.gfsNamespace(namespace), s.listPrefix)
+	files, err := s.storage.ListFilesWithNamespace(ctx, s.gfsNamespace(namespace), s.listPrefix)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("list files failed: %v", err), http.StatusBadGateway)
 		return
 	}
+	sizer, err := s.loadFileSizer(namespace)
+	if err != nil {
+		http.Error(w, "failed to load file keys", http.StatusInternalServerError)
+		return
+	}
+	tags, err := s.loadFileTags(namespace)
+	if err != nil {
+		http.Error(w, "failed to load file tags", http.StatusInternalServerError)
+		return
+	}
+	scans, err := s.loadScanStatuses(namespace)
+	if err != nil {
+		http.Error(w, "failed to load scan status", http.StatusInternalServerError)
+		return
+	}
 
 	resp := make([]fileInfo, 0, len(files))
 	for _, file := range files {
@@ -294,9 +499,13 @@ func (s *server) handleList(w http.ResponseWriter, r *http.Request) {
 			Name:       name,
 			Path:       file.Path,
 			Namespace:  namespace,
-			Size:       file.Size,
+			Size:       sizer.logical(file.Path, file.Size),
 			CreatedAt:  file.CreatedAt,
 			ModifiedAt: file.ModifiedAt,
+			Tags:       tags[name],
+			StoredSize: file.Size,
+			Encoding:   sizer.encoding(file.Path),
+			ScanStatus: scans[name],
 		})
 	}
 
@@ -320,15 +529,17 @@ func (s *server) handleNamespaces(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *server) handleNamespaceList(w http.ResponseWriter, r *http.Request) {
-	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
-	defer cancel()
-
 	currentUserID, _ := s.currentUserID(r)
 	namespaceRows, err := s.loadAllNamespaces()
 	if err != nil {
 		http.Error(w, "failed to load namespaces", http.StatusInternalServerError)
 		return
 	}
+	stats, err := s.loadNamespaceStats()
+	if err != nil {
+		http.Error(w, "failed to load namespace stats", http.StatusInternalServerError)
+		return
+	}
 
 	// Build map for quick lookup
 	nsMap := make(map[string]namespaceInfo)
@@ -339,27 +550,15 @@ func (s *server) handleNamespaceList(w http.ResponseWriter, r *http.Request) {
 				continue
 			}
 		}
-		count, err := s.countNamespaceFiles(ctx, entry.Name)
-		if err != nil {
-			http.Error(w, "failed to list namespace files", http.StatusBadGateway)
-			return
-		}
-		entry.Count = count
+		entry.applyStats(stats[entry.Name])
 		nsMap[entry.Name] = entry
 	}
 
 	// Add default namespace if not present
 	if _, ok := nsMap[defaultNamespace]; !ok {
-		count, err := s.countNamespaceFiles(ctx, defaultNamespace)
-		if err != nil {
-			http.Error(w, "failed to list namespace files", http.StatusBadGateway)
-			return
-		}
-		nsMap[defaultNamespace] = namespaceInfo{
-			Name:   defaultNamespace,
-			Count:  count,
-			Hidden: false,
-		}
+		entry := namespaceInfo{Name: defaultNamespace}
+		entry.applyStats(stats[defaultNamespace])
+		nsMap[defaultNamespace] = entry
 	}
 
 	resp := make([]namespaceInfo, 0, len(nsMap))
@@ -371,8 +570,10 @@ func (s *server) handleNamespaceList(w http.ResponseWriter, r *http.Request) {
 }
 
 type namespaceCreateRequest struct {
-	Name   string `json:"name"`
-	Hidden bool   `json:"hidden"`
+	Name        string `json:"name"`
+	Hidden      bool   `json:"hidden"`
+	Encrypted   bool   `json:"encrypted"`
+	Compression string `json:"compression"`
 }
 
 func (s *server) handleNamespaceCreate(w http.ResponseWriter, r *http.Request) {
@@ -397,6 +598,15 @@ func (s *server) handleNamespaceCreate(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if payload.Encrypted && s.keys == nil {
+		http.Error(w, "encryption is not configured", http.StatusBadRequest)
+		return
+	}
+	if err := validCompression(payload.Compression); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	if exists, err := s.namespaceExists(name); err != nil {
 		http.Error(w, "failed to check namespace", http.StatusInternalServerError)
 		return
@@ -415,12 +625,26 @@ func (s *server) handleNamespaceCreate(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "failed to save namespace", http.StatusInternalServerError)
 		return
 	}
+	if payload.Encrypted {
+		if err := s.updateNamespaceEncrypted(name, true); err != nil {
+			http.Error(w, "failed to save namespace", http.StatusInternalServerError)
+			return
+		}
+	}
+	if payload.Compression != "" {
+		if err := s.updateNamespaceCompression(name, payload.Compression); err != nil {
+			http.Error(w, "failed to save namespace", http.StatusInternalServerError)
+			return
+		}
+	}
 
 	writeJSON(w, namespaceInfo{
-		Name:    name,
-		Count:   0,
-		Hidden:  payload.Hidden,
-		OwnerID: ownerID,
+		Name:        name,
+		Count:       0,
+		Hidden:      payload.Hidden,
+		Encrypted:   payload.Encrypted,
+		Compression: payload.Compression,
+		OwnerID:     ownerID,
 	})
 }
 
@@ -436,21 +660,21 @@ func (s *server) handleNamespaceDelete(w http.ResponseWriter, r *http.Request) {
 
 	// Check ownership for hidden namespaces
 	if !s.canAccessNamespace(r, name) {
-		http.Error(w, "forbidden", http.StatusForbidden)
+		s.denyAccess(w, r)
 		return
 	}
 
 	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
 	defer cancel()
 
-	files, err := s.client.ListFilesWithNamespace(ctx, s.gfsNamespace(name), s.listPrefix)
+	files, err := s.storage.ListFilesWithNamespace(ctx, s.gfsNamespace(name), s.listPrefix)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("list files failed: %v", err), http.StatusBadGateway)
 		return
 	}
 
 	for _, file := range files {
-		if err := s.client.DeleteFileWithNamespace(ctx, file.Path, s.gfsNamespace(name)); err != nil {
+		if err := s.deleteFile(ctx, name, file.Path); err != nil {
 			http.Error(w, fmt.Sprintf("delete failed: %v", err), http.StatusBadGateway)
 			return
 		}
@@ -465,8 +689,10 @@ func (s *server) handleNamespaceDelete(w http.ResponseWriter, r *http.Request) {
 }
 
 type namespaceUpdateRequest struct {
-	Name   string `json:"name"`
-	Hidden bool   `json:"hidden"`
+	Name        string  `json:"name"`
+	Hidden      bool    `json:"hidden"`
+	Encrypted   *bool   `json:"encrypted,omitempty"`
+	Compression *string `json:"compression,omitempty"`
 }
 
 func (s *server) handleNamespaceUpdate(w http.ResponseWriter, r *http.Request) {
@@ -488,7 +714,7 @@ func (s *server) handleNamespaceUpdate(w http.ResponseWriter, r *http.Request) {
 
 	// Check ownership for hidden namespaces
 	if !s.canAccessNamespace(r, name) {
-		http.Error(w, "forbidden", http.StatusForbidden)
+		s.denyAccess(w, r)
 		return
 	}
 
@@ -496,15 +722,37 @@ func (s *server) handleNamespaceUpdate(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "hidden namespace must be marked hidden", http.StatusBadRequest)
 		return
 	}
+	// Encryption and compression change how every stored file is read
+	// back, so only the owner or a storage admin may change them.
+	if (payload.Encrypted != nil || payload.Compression != nil) && !s.canManageNamespace(r, name) {
+		s.denyAccess(w, r)
+		return
+	}
 
 	if err := s.updateNamespaceHidden(name, payload.Hidden); err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	if payload.Encrypted != nil {
+		if err := s.updateNamespaceEncrypted(name, *payload.Encrypted); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if payload.Compression != nil {
+		if err := s.updateNamespaceCompression(name, *payload.Compression); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
 
+	encrypted, _ := s.namespaceEncrypted(name)
+	compression, _ := s.namespaceCompression(name)
 	writeJSON(w, namespaceInfo{
-		Name:   name,
-		Hidden: payload.Hidden,
+		Name:        name,
+		Hidden:      payload.Hidden,
+		Encrypted:   encrypted,
+		Compression: compression,
 	})
 }
 
@@ -522,21 +770,21 @@ func (s *server) handleNamespaceDeleteByPath(w http.ResponseWriter, r *http.Requ
 
 	// Check ownership for hidden namespaces
 	if !s.canAccessNamespace(r, name) {
-		http.Error(w, "forbidden", http.StatusForbidden)
+		s.denyAccess(w, r)
 		return
 	}
 
 	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
 	defer cancel()
 
-	files, err := s.client.ListFilesWithNamespace(ctx, s.gfsNamespace(name), s.listPrefix)
+	files, err := s.storage.ListFilesWithNamespace(ctx, s.gfsNamespace(name), s.listPrefix)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("list files failed: %v", err), http.StatusBadGateway)
 		return
 	}
 
 	for _, file := range files {
-		if err := s.client.DeleteFileWithNamespace(ctx, file.Path, s.gfsNamespace(name)); err != nil {
+		if err := s.deleteFile(ctx, name, file.Path); err != nil {
 			http.Error(w, fmt.Sprintf("delete failed: %v", err), http.StatusBadGateway)
 			return
 		}
@@ -564,12 +812,14 @@ func (s *server) handleNamespaceUpdateByPath(w http.ResponseWriter, r *http.Requ
 
 	// Check ownership for hidden namespaces
 	if !s.canAccessNamespace(r, name) {
-		http.Error(w, "forbidden", http.StatusForbidden)
+		s.denyAccess(w, r)
 		return
 	}
 
 	var payload struct {
-		Hidden bool `json:"hidden"`
+		Hidden      bool    `json:"hidden"`
+		Encrypted   *bool   `json:"encrypted,omitempty"`
+		Compression *string `json:"compression,omitempty"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
 		http.Error(w, "invalid payload", http.StatusBadRequest)
@@ -580,15 +830,37 @@ func (s *server) handleNamespaceUpdateByPath(w http.ResponseWriter, r *http.Requ
 		http.Error(w, "hidden namespace must be marked hidden", http.StatusBadRequest)
 		return
 	}
+	// Encryption and compression change how every stored file is read
+	// back, so only the owner or a storage admin may change them.
+	if (payload.Encrypted != nil || payload.Compression != nil) && !s.canManageNamespace(r, name) {
+		s.denyAccess(w, r)
+		return
+	}
 
 	if err := s.updateNamespaceHidden(name, payload.Hidden); err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	if payload.Encrypted != nil {
+		if err := s.updateNamespaceEncrypted(name, *payload.Encrypted); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if payload.Compression != nil {
+		if err := s.updateNamespaceCompression(name, *payload.Compression); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
 
+	encrypted, _ := s.namespaceEncrypted(name)
+	compression, _ := s.namespaceCompression(name)
 	writeJSON(w, namespaceInfo{
-		Name:   name,
-		Hidden: payload.Hidden,
+		Name:        name,
+		Hidden:      payload.Hidden,
+		Encrypted:   encrypted,
+		Compression: compression,
 	})
 }
 
@@ -699,6 +971,13 @@ func (s *server) handleUpload(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	finish, err := s.beginUpload(w)
+	if err != nil {
+		fail(err.Error(), storageErrorStatus(err))
+		return
+	}
+	defer finish()
+
 	fullPath := name
 	overwrite := r.URL.Query().Get("overwrite") == "true"
 	ctx, cancel := context.WithTimeout(r.Context(), s.uploadTTL)
@@ -715,28 +994,18 @@ func (s *server) handleUpload(w http.ResponseWriter, r *http.Request) {
 		}
 	}()
 
-	// Check if file exists
-	existingFile, err := s.client.GetFileWithNamespace(ctx, fullPath, s.gfsNamespace(namespace))
-	fileExists := err == nil && existingFile != nil
-
-	if fileExists {
-		if !overwrite {
-			fail(fmt.Sprintf("file already exists: %s", fullPath), http.StatusConflict)
-			return
-		}
-		// Delete existing file before overwriting
-		if err := s.client.DeleteFileWithNamespace(ctx, fullPath, s.gfsNamespace(namespace)); err != nil {
-			fail(fmt.Sprintf("failed to delete existing file: %v", err), http.StatusInternalServerError)
-			return
-		}
-		log.Printf("upload overwrite namespace=%s name=%s transfer=%s", namespace, name, transferID)
+	existed, err := s.prepareFile(ctx, namespace, fullPath, overwrite)
+	if errors.Is(err, errFileExists) {
+		fail(fmt.Sprintf("file already exists: %s", fullPath), http.StatusConflict)
+		return
 	}
-
-	// Create new file
-	if _, err := s.client.CreateFileWithNamespace(ctx, fullPath, s.gfsNamespace(namespace)); err != nil {
-		fail(fmt.Sprintf("prepare file failed: %v", err), http.StatusBadGateway)
+	if err != nil {
+		fail(err.Error(), storageErrorStatus(err))
 		return
 	}
+	if existed {
+		log.Printf("upload overwrite namespace=%s name=%s transfer=%s", namespace, name, transferID)
+	}
 
 	total = s.parseSizeHeader(r.Header.Get("X-File-Size"))
 	reporter := s.newReporter(transferID, "upload", total)
@@ -753,10 +1022,14 @@ func (s *server) handleUpload(w http.ResponseWriter, r *http.Request) {
 	reporter.Update(0)
 
 	// Wrap file reader to track progress as HTTP data is received
-	counting := &countingReader{reader: file, reporter: reporter}
+	counting := &countingReader{
+		reader:   file,
+		reporter: reporter,
+		throttle: s.throttle(ctx, r, namespace, "upload"),
+	}
 
 	// Use AppendFrom directly - allocates chunks on-demand for faster start
-	if _, err := s.client.AppendFromWithNamespace(ctx, fullPath, s.gfsNamespace(namespace), counting); err != nil {
+	if _, err := s.writeFile(ctx, namespace, fullPath, counting); err != nil {
 		reporter.Error(err)
 		log.Printf(
 			"upload append failed namespace=%s name=%s size=%d transfer=%s err=%v",
@@ -766,10 +1039,11 @@ func (s *server) handleUpload(w http.ResponseWriter, r *http.Request) {
 			transferID,
 			err,
 		)
-		fail(fmt.Sprintf("upload failed: %v", err), http.StatusBadGateway)
+		fail(fmt.Sprintf("upload failed: %v", err), storageErrorStatus(err))
 		return
 	}
 	reporter.Done()
+	s.recordChange(namespace, writeOp(existed), fullPath, "", counting.read)
 	log.Printf(
 		"upload complete namespace=%s name=%s size=%d transfer=%s",
 		namespace,
@@ -796,32 +1070,44 @@ func (s *server) handleDownload(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		if !s.canAccessNamespace(r, namespace) {
-			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			s.denyAccess(w, r)
 			return
 		}
 	}
 
 	fullPath := name
+	if status, msg := s.downloadBlocked(w, namespace, fullPath); status != 0 {
+		http.Error(w, msg, status)
+		return
+	}
 	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Minute)
 	defer cancel()
 
+	encoding := s.negotiateEncoding(w, r, namespace, fullPath)
 	transferID := s.transferID(r)
 	var total int64
 	if transferID != "" {
-		if info, err := s.client.GetFileWithNamespace(ctx, fullPath, s.gfsNamespace(namespace)); err == nil {
-			total = int64(info.Size)
+		if info, err := s.storage.GetFileWithNamespace(ctx, fullPath, s.gfsNamespace(namespace)); err == nil {
+			total = int64(s.logicalSize(namespace, fullPath, info.Size))
+			if encoding != "" {
+				total = int64(info.Size)
+			}
 		}
 	}
 
 	reporter := s.newReporter(transferID, "download", total)
-	counting := &countingWriter{writer: w, reporter: reporter}
+	counting := &countingWriter{
+		writer:   w,
+		reporter: reporter,
+		throttle: s.throttle(ctx, r, namespace, "download"),
+	}
 
 	w.Header().Set("Content-Type", "application/octet-stream")
 	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
 
-	if _, err := s.client.ReadToWithNamespace(ctx, fullPath, s.gfsNamespace(namespace), counting); err != nil {
+	if _, err := s.readFileEncoded(ctx, namespace, fullPath, counting, encoding); err != nil {
 		reporter.Error(err)
-		http.Error(w, fmt.Sprintf("download failed: %v", err), http.StatusBadGateway)
+		http.Error(w, fmt.Sprintf("download failed: %v", err), storageErrorStatus(err))
 		return
 	}
 	reporter.Done()
@@ -842,21 +1128,24 @@ func (s *server) handleFileGet(w http.ResponseWriter, r *http.Request) {
 	// URL-decode the file path to handle special characters
 	file, err := url.PathUnescape(file)
 	if err != nil {
-		serveErrorPage(w, http.StatusBadRequest, "Bad Request",
+		serveErrorPage(w, r, http.StatusBadRequest, "Bad Request",
 			"The file path contains invalid characters.")
 		return
 	}
 
 	namespace, err = sanitizeNamespace(namespace)
 	if err != nil {
-		serveErrorPage(w, http.StatusBadRequest, "Bad Request",
+		serveErrorPage(w, r, http.StatusBadRequest, "Bad Request",
 			"The namespace name is invalid. Namespaces can only contain letters, numbers, hyphens, underscores, and dots.")
 		return
 	}
 
 	if !s.canAccessNamespace(r, namespace) {
-		serveErrorPage(w, http.StatusUnauthorized, "Unauthorized",
-			"You don't have permission to access this namespace. Please log in if this is a private namespace.")
+		s.serveAccessDenied(w, r)
+		return
+	}
+	if status, msg := s.downloadBlocked(w, namespace, file); status != 0 {
+		serveErrorPage(w, r, status, "File Unavailable", "The "+msg+".")
 		return
 	}
 
@@ -871,8 +1160,10 @@ func (s *server) handleFileGet(w http.ResponseWriter, r *http.Request) {
 	}
 	w.Header().Set("Content-Type", contentType)
 
-	if _, err := s.client.ReadToWithNamespace(ctx, file, s.gfsNamespace(namespace), w); err != nil {
-		serveErrorPage(w, http.StatusNotFound, "File Not Found",
+	encoding := s.negotiateEncoding(w, r, namespace, file)
+	throttled := &countingWriter{writer: w, throttle: s.throttle(ctx, r, namespace, "download")}
+	if _, err := s.readFileEncoded(ctx, namespace, file, throttled, encoding); err != nil {
+		serveErrorPage(w, r, http.StatusNotFound, "File Not Found",
 			fmt.Sprintf("The file \"%s\" was not found in namespace \"%s\".", file, namespace))
 		return
 	}
@@ -884,7 +1175,7 @@ func (s *server) handleFileDownload(w http.ResponseWriter, r *http.Request) {
 	file := r.PathValue("file")
 
 	if namespace == "" || file == "" {
-		serveErrorPage(w, http.StatusBadRequest, "Bad Request",
+		serveErrorPage(w, r, http.StatusBadRequest, "Bad Request",
 			"The requested URL is incomplete. Please provide both a namespace and filename.")
 		return
 	}
@@ -892,21 +1183,24 @@ func (s *server) handleFileDownload(w http.ResponseWriter, r *http.Request) {
 	// URL-decode the file path to handle special characters
 	file, err := url.PathUnescape(file)
 	if err != nil {
-		serveErrorPage(w, http.StatusBadRequest, "Bad Request",
+		serveErrorPage(w, r, http.StatusBadRequest, "Bad Request",
 			"The file path contains invalid characters.")
 		return
 	}
 
 	namespace, err = sanitizeNamespace(namespace)
 	if err != nil {
-		serveErrorPage(w, http.StatusBadRequest, "Bad Request",
+		serveErrorPage(w, r, http.StatusBadRequest, "Bad Request",
 			"The namespace name is invalid. Namespaces can only contain letters, numbers, hyphens, underscores, and dots.")
 		return
 	}
 
 	if !s.canAccessNamespace(r, namespace) {
-		serveErrorPage(w, http.StatusUnauthorized, "Unauthorized",
-			"You don't have permission to access this namespace. Please log in if this is a private namespace.")
+		s.serveAccessDenied(w, r)
+		return
+	}
+	if status, msg := s.downloadBlocked(w, namespace, file); status != 0 {
+		serveErrorPage(w, r, status, "File Unavailable", "The "+msg+".")
 		return
 	}
 
@@ -921,8 +1215,10 @@ func (s *server) handleFileDownload(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", contentType)
 	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filepath.Base(file)))
 
-	if _, err := s.client.ReadToWithNamespace(ctx, file, s.gfsNamespace(namespace), w); err != nil {
-		serveErrorPage(w, http.StatusNotFound, "File Not Found",
+	encoding := s.negotiateEncoding(w, r, namespace, file)
+	throttled := &countingWriter{writer: w, throttle: s.throttle(ctx, r, namespace, "download")}
+	if _, err := s.readFileEncoded(ctx, namespace, file, throttled, encoding); err != nil {
+		serveErrorPage(w, r, http.StatusNotFound, "File Not Found",
 			fmt.Sprintf("The file \"%s\" was not found in namespace \"%s\".", file, namespace))
 		return
 	}
@@ -957,10 +1253,11 @@ func (s *server) handleDelete(w http.ResponseWriter, r *http.Request) {
 	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
 	defer cancel()
 
-	if err := s.client.DeleteFileWithNamespace(ctx, fullPath, s.gfsNamespace(namespace)); err != nil {
-		http.Error(w, fmt.Sprintf("delete failed: %v", err), http.StatusBadGateway)
+	if err := s.deleteFile(ctx, namespace, fullPath); err != nil {
+		http.Error(w, fmt.Sprintf("delete failed: %v", err), storageErrorStatus(err))
 		return
 	}
+	s.recordChange(namespace, changeDeleted, fullPath, "", 0)
 
 	writeJSON(w, map[string]string{"status": "ok", "name": name})
 }
@@ -971,15 +1268,12 @@ type loginRequest struct {
 }
 
 type sessionResponse struct {
-	Username    string `json:"username"`
-	DisplayName string `json:"display_name"`
-	IsAdmin     bool   `json:"is_admin"`
-}
-
-var adminUsername = os.Getenv("ADMIN_USERNAME")
-
-func isAdmin(username string) bool {
-	return adminUsername != "" && username == adminUsername
+	UserID      int64    `json:"user_id"`
+	Username    string   `json:"username"`
+	DisplayName string   `json:"display_name"`
+	IsAdmin     bool     `json:"is_admin"`
+	Roles       []string `json:"roles"`
+	CSRFToken   string   `json:"csrf_token,omitempty"`
 }
 
 func (s *server) handleLogin(w http.ResponseWriter, r *http.Request) {
@@ -1000,40 +1294,80 @@ func (s *server) handleLogin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	ip := s.clientIP(r)
+	if wait := s.loginRetryAfter(loginUserKey(payload.Username), loginIPKey(ip)); wait > 0 {
+		w.Header().Set("Retry-After", retryAfterSeconds(wait))
+		http.Error(w, "too many failed login attempts, try again later", http.StatusTooManyRequests)
+		return
+	}
+
 	var (
 		userID      int64
 		hash        string
 		displayName string
+		totpEnabled int
+		disabled    int
 	)
-	err := s.db.QueryRow(`SELECT id, password_hash, COALESCE(display_name, username) FROM users WHERE username = $1`, payload.Username).
-		Scan(&userID, &hash, &displayName)
+	err := s.db.QueryRow(`SELECT id, password_hash, COALESCE(display_name, username), totp_enabled, disabled FROM users WHERE username = $1`, payload.Username).
+		Scan(&userID, &hash, &displayName, &totpEnabled, &disabled)
 	if err != nil {
+		s.recordLoginFailure(payload.Username, ip)
 		http.Error(w, "invalid credentials", http.StatusUnauthorized)
 		return
 	}
 	if err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(payload.Password)); err != nil {
+		s.recordLoginFailure(payload.Username, ip)
 		http.Error(w, "invalid credentials", http.StatusUnauthorized)
 		return
 	}
+	if disabled != 0 {
+		http.Error(w, "account disabled", http.StatusForbidden)
+		return
+	}
+
+	// With 2FA enabled the password only earns a short-lived challenge; the
+	// session is issued by /api/login/2fa once the code checks out.
+	if totpEnabled != 0 {
+		challenge, err := s.createLoginChallenge(userID)
+		if err != nil {
+			http.Error(w, "failed to start two-factor login", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, challenge)
+		return
+	}
+	s.clearLoginFailures(payload.Username)
+
 	// Fall back to username if display_name is empty
 	if displayName == "" {
 		displayName = payload.Username
 	}
+	if err := s.startSession(w, r, userID); err != nil {
+		http.Error(w, "failed to create session", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, s.sessionFor(userID, payload.Username, displayName))
+}
 
+// startSession creates a session row for the user and sets the session cookie.
+func (s *server) startSession(w http.ResponseWriter, r *http.Request, userID int64) error {
 	token, err := generateToken(32)
 	if err != nil {
-		http.Error(w, "failed to create session", http.StatusInternalServerError)
-		return
+		return err
 	}
-	expires := time.Now().Add(s.sessionTTL)
+	now := time.Now()
+	expires := now.Add(s.sessionTTL)
 	if _, err := s.db.Exec(
-		`INSERT INTO sessions (user_id, token, expires_at) VALUES ($1, $2, $3)`,
+		`INSERT INTO sessions (user_id, token, expires_at, ip, user_agent, created_at, last_seen)
+		 VALUES ($1, $2, $3, $4, $5, $6, $6)`,
 		userID,
 		token,
 		expires.Unix(),
+		s.clientIP(r),
+		truncate(r.UserAgent(), 512),
+		now.Unix(),
 	); err != nil {
-		http.Error(w, "failed to create session", http.StatusInternalServerError)
-		return
+		return err
 	}
 
 	http.SetCookie(w, &http.Cookie{
@@ -1046,33 +1380,44 @@ func (s *server) handleLogin(w http.ResponseWriter, r *http.Request) {
 		SameSite: http.SameSiteLaxMode,
 		Secure:   isSecureRequest(r),
 	})
-	writeJSON(w, sessionResponse{Username: payload.Username, DisplayName: displayName, IsAdmin: isAdmin(payload.Username)})
+	if _, err := setCSRFCookie(w, r, expires); err != nil {
+		return err
+	}
+	_, err = s.issueAccessToken(w, r, userID)
+	return err
 }
 
 func (s *server) handleSession(w http.ResponseWriter, r *http.Request) {
-	username, displayName, ok := s.currentUserWithDisplay(r)
-	if !ok {
+	session := s.session(r)
+	if session == nil {
 		http.Error(w, "unauthorized", http.StatusUnauthorized)
 		return
 	}
-	writeJSON(w, sessionResponse{Username: username, DisplayName: displayName, IsAdmin: isAdmin(username)})
+	resp := s.sessionFor(session.UserID, session.Username, session.DisplayName)
+	resp.CSRFToken = s.csrfToken(w, r, session)
+	writeJSON(w, resp)
 }
 
 func (s *server) handleLogout(w http.ResponseWriter, r *http.Request) {
 	token := s.sessionToken(r)
 	if token != "" {
 		_, _ = s.db.Exec(`DELETE FROM sessions WHERE token = $1`, token)
+		s.sessions.invalidate(token)
+	}
+	// The access token stays valid until it expires; dropping the cookie just
+	// stops this browser from presenting it.
+	for _, name := range []string{s.cookieName, accessCookieName, csrfCookieName} {
+		http.SetCookie(w, &http.Cookie{
+			Name:     name,
+			Value:    "",
+			Path:     "/",
+			Domain:   getCookieDomain(r),
+			MaxAge:   -1,
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+			Secure:   isSecureRequest(r),
+		})
 	}
-	http.SetCookie(w, &http.Cookie{
-		Name:     s.cookieName,
-		Value:    "",
-		Path:     "/",
-		Domain:   getCookieDomain(r),
-		MaxAge:   -1,
-		HttpOnly: true,
-		SameSite: http.SameSiteLaxMode,
-		Secure:   isSecureRequest(r),
-	})
 	writeJSON(w, map[string]string{"status": "ok"})
 }
 
@@ -1117,105 +1462,27 @@ func (s *server) requireAuth(w http.ResponseWriter, r *http.Request) (string, bo
 }
 
 func (s *server) currentUser(r *http.Request) (string, bool) {
-	token := s.sessionToken(r)
-	if token == "" {
+	session := s.session(r)
+	if session == nil {
 		return "", false
 	}
-
-	var (
-		username  string
-		expiresAt int64
-	)
-	err := s.db.QueryRow(
-		`SELECT users.username, sessions.expires_at
-		 FROM sessions
-		 JOIN users ON sessions.user_id = users.id
-		 WHERE sessions.token = $1`,
-		token,
-	).Scan(&username, &expiresAt)
-	if err != nil {
-		return "", false
-	}
-	if time.Now().Unix() > expiresAt {
-		_, _ = s.db.Exec(`DELETE FROM sessions WHERE token = $1`, token)
-		return "", false
-	}
-	return username, true
+	return session.Username, true
 }
 
 func (s *server) currentUserID(r *http.Request) (int, bool) {
-	token := s.sessionToken(r)
-	if token == "" {
-		return 0, false
-	}
-
-	var (
-		userID    int
-		expiresAt int64
-	)
-	err := s.db.QueryRow(
-		`SELECT users.id, sessions.expires_at
-		 FROM sessions
-		 JOIN users ON sessions.user_id = users.id
-		 WHERE sessions.token = $1`,
-		token,
-	).Scan(&userID, &expiresAt)
-	if err != nil {
+	session := s.session(r)
+	if session == nil {
 		return 0, false
 	}
-	if time.Now().Unix() > expiresAt {
-		_, _ = s.db.Exec(`DELETE FROM sessions WHERE token = $1`, token)
-		return 0, false
-	}
-	return userID, true
-}
-
-func (s *server) currentUserWithDisplay(r *http.Request) (string, string, bool) {
-	token := s.sessionToken(r)
-	if token == "" {
-		return "", "", false
-	}
-
-	var (
-		username    string
-		displayName string
-		expiresAt   int64
-	)
-	err := s.db.QueryRow(
-		`SELECT users.username, COALESCE(users.display_name, users.username), sessions.expires_at
-		 FROM sessions
-		 JOIN users ON sessions.user_id = users.id
-		 WHERE sessions.token = $1`,
-		token,
-	).Scan(&username, &displayName, &expiresAt)
-	if err != nil {
-		return "", "", false
-	}
-	if time.Now().Unix() > expiresAt {
-		_, _ = s.db.Exec(`DELETE FROM sessions WHERE token = $1`, token)
-		return "", "", false
-	}
-	// Fall back to username if display_name is empty
-	if displayName == "" {
-		displayName = username
-	}
-	return username, displayName, true
+	return int(session.UserID), true
 }
 
 func (s *server) sessionToken(r *http.Request) string {
-	// Check all cookies with matching name (handles duplicate cookies from different domains)
-	for _, cookie := range r.Cookies() {
-		if cookie.Name == s.cookieName && cookie.Value != "" {
-			// Verify this token exists in database
-			var count int
-			err := s.db.QueryRow(`SELECT COUNT(*) FROM sessions WHERE token = $1 AND expires_at > $2`,
-				cookie.Value, time.Now().Unix()).Scan(&count)
-			if err == nil && count > 0 {
-				return cookie.Value
-			}
-		}
+	session := s.session(r)
+	if session == nil {
+		return ""
 	}
-	return ""
+	return session.Token
 }
 
 func generateToken(length int) (string, error) {
@@ -1228,11 +1495,10 @@ func generateToken(length int) (string, error) {
 
 func (s *server) ensureEmptyFile(ctx context.Context, namespace, fullPath string) error {
 	// Check if file already exists - reject if so
-	if _, err := s.client.GetFileWithNamespace(ctx, fullPath, s.gfsNamespace(namespace)); err == nil {
+	if _, err := s.storage.GetFileWithNamespace(ctx, fullPath, s.gfsNamespace(namespace)); err == nil {
 		return fmt.Errorf("file already exists: %s", fullPath)
 	}
-	_, err := s.client.CreateFileWithNamespace(ctx, fullPath, s.gfsNamespace(namespace))
-	return err
+	return s.storage.CreateFileWithNamespace(ctx, fullPath, s.gfsNamespace(namespace))
 }
 
 func (s *server) loadHiddenNamespaces() (map[string]bool, error) {
@@ -1260,7 +1526,7 @@ func (s *server) loadHiddenNamespaces() (map[string]bool, error) {
 }
 
 func (s *server) loadAllNamespaces() ([]namespaceInfo, error) {
-	rows, err := s.db.Query(`SELECT name, hidden, owner_id FROM namespaces`)
+	rows, err := s.db.Query(`SELECT name, hidden, encrypted, compression, owner_id FROM namespaces`)
 	if err != nil {
 		return nil, err
 	}
@@ -1270,14 +1536,18 @@ func (s *server) loadAllNamespaces() ([]namespaceInfo, error) {
 	for rows.Next() {
 		var name string
 		var hiddenFlag int
+		var encryptedFlag int
+		var compression string
 		var ownerID *int
-		if err := rows.Scan(&name, &hiddenFlag, &ownerID); err != nil {
+		if err := rows.Scan(&name, &hiddenFlag, &encryptedFlag, &compression, &ownerID); err != nil {
 			return nil, err
 		}
 		namespaces = append(namespaces, namespaceInfo{
-			Name:    name,
-			Hidden:  hiddenFlag != 0,
-			OwnerID: ownerID,
+			Name:        name,
+			Hidden:      hiddenFlag != 0,
+			Encrypted:   encryptedFlag != 0,
+			Compression: compression,
+			OwnerID:     ownerID,
 		})
 	}
 	if err := rows.Err(); err != nil {
@@ -1302,6 +1572,18 @@ func (s *server) upsertNamespace(name string, hidden bool, ownerID *int) error {
 }
 
 func (s *server) deleteNamespace(name string) error {
+	if _, err := s.db.Exec(`DELETE FROM namespace_stats WHERE namespace = $1`, name); err != nil {
+		return err
+	}
+	if _, err := s.db.Exec(`DELETE FROM file_metadata WHERE namespace = $1`, name); err != nil {
+		return err
+	}
+	if _, err := s.db.Exec(`DELETE FROM file_scans WHERE namespace = $1`, name); err != nil {
+		return err
+	}
+	if err := s.resetChanges(name); err != nil {
+		return err
+	}
 	_, err := s.db.Exec(`DELETE FROM namespaces WHERE name = $1`, name)
 	return err
 }
@@ -1372,21 +1654,6 @@ func (s *server) canAccessNamespace(r *http.Request, namespace string) bool {
 	return *ownerID == userID
 }
 
-func (s *server) countNamespaceFiles(ctx context.Context, namespace string) (int, error) {
-	files, err := s.client.ListFilesWithNamespace(ctx, s.gfsNamespace(namespace), s.listPrefix)
-	if err != nil {
-		return 0, err
-	}
-	count := 0
-	for _, file := range files {
-		if relativeNameWithPrefix(file.Path, s.listPrefix) == "" {
-			continue
-		}
-		count++
-	}
-	return count, nil
-}
-
 func relativeNameWithPrefix(fullPath, prefix string) string {
 	if prefix == "" {
 		return strings.TrimPrefix(fullPath, "/")
@@ -1421,6 +1688,7 @@ type progressMessage struct {
 	Total     int64  `json:"total"`
 	Done      bool   `json:"done"`
 	Error     string `json:"error,omitempty"`
+	Reconnect bool   `json:"reconnect,omitempty"`
 }
 
 type progressReporter struct {
@@ -1496,6 +1764,7 @@ func (p *progressReporter) Error(err error) {
 type countingReader struct {
 	reader   io.Reader
 	reporter *progressReporter
+	throttle *transferThrottle
 	read     int64
 }
 
@@ -1504,6 +1773,9 @@ func (c *countingReader) Read(p []byte) (int, error) {
 	if n > 0 {
 		c.read += int64(n)
 		c.reporter.Update(c.read)
+		if waitErr := c.throttle.wait(n); waitErr != nil {
+			return n, waitErr
+		}
 	}
 	if err == io.EOF {
 		c.reporter.Update(c.read)
@@ -1514,10 +1786,14 @@ func (c *countingReader) Read(p []byte) (int, error) {
 type countingWriter struct {
 	writer   io.Writer
 	reporter *progressReporter
+	throttle *transferThrottle
 	wrote    int64
 }
 
 func (c *countingWriter) Write(p []byte) (int, error) {
+	if err := c.throttle.wait(len(p)); err != nil {
+		return 0, err
+	}
 	n, err := c.writer.Write(p)
 	if n > 0 {
 		c.wrote += int64(n)
@@ -1553,6 +1829,12 @@ func (s *server) registerWS(id string, conn *websocket.Conn) {
 	s.wsMu.Unlock()
 }
 
+func (s *server) wsConnCount() float64 {
+	s.wsMu.Lock()
+	defer s.wsMu.Unlock()
+	return float64(len(s.wsConns))
+}
+
 func (s *server) unregisterWS(id string, conn *websocket.Conn) {
 	s.wsMu.Lock()
 	if current, ok := s.wsConns[id]; ok && current == conn {
@@ -1650,11 +1932,30 @@ func sanitizeNamespace(raw string) (string, error) {
 	return trimmed, nil
 }
 
-// serveErrorPage renders a styled HTML error page
-func serveErrorPage(w http.ResponseWriter, statusCode int, title, message string) {
+// serveAccessDenied is denyAccess for pages opened in a browser.
+func (s *server) serveAccessDenied(w http.ResponseWriter, r *http.Request) {
+	if s.session(r) == nil {
+		serveErrorPage(w, r, http.StatusUnauthorized, "Unauthorized",
+			"This namespace is private. Please log in to access it.")
+		return
+	}
+	serveErrorPage(w, r, http.StatusForbidden, "Forbidden",
+		"You don't have permission to access this namespace.")
+}
+
+// serveErrorPage renders a styled HTML error page, or a plain error on the
+// v1 API, where it becomes a JSON envelope.
+func serveErrorPage(w http.ResponseWriter, r *http.Request, statusCode int, title, message string) {
+	if isAPIv1(r) {
+		http.Error(w, message, statusCode)
+		return
+	}
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
 	w.WriteHeader(statusCode)
-	html := fmt.Sprintf(`<!DOCTYPE html>
+	// Messages often quote namespace and file names straight from the URL.
+	title = html.EscapeString(title)
+	message = html.EscapeString(message)
+	page := fmt.Sprintf(`<!DOCTYPE html>
 <html lang="en">
 <head>
     <meta charset="UTF-8">
@@ -1718,15 +2019,13 @@ func serveErrorPage(w http.ResponseWriter, statusCode int, title, message string
     </div>
 </body>
 </html>`, statusCode, title, statusCode, title, message)
-	w.Write([]byte(html))
+	w.Write([]byte(page))
 }
 
 // Admin handlers
 
 func (s *server) handleAdminFiles(w http.ResponseWriter, r *http.Request) {
-	username, ok := s.currentUser(r)
-	if !ok || !isAdmin(username) {
-		http.Error(w, "forbidden", http.StatusForbidden)
+	if _, ok := s.requireRole(w, r, readableBy(r, roleStorageAdmin)...); !ok {
 		return
 	}
 
@@ -1742,11 +2041,21 @@ func (s *server) handleAdminFiles(w http.ResponseWriter, r *http.Request) {
 
 	var allFiles []fileInfo
 	for _, ns := range namespaces {
-		files, err := s.client.ListFilesWithNamespace(ctx, s.gfsNamespace(ns.Name), s.listPrefix)
+		files, err := s.storage.ListFilesWithNamespace(ctx, s.gfsNamespace(ns.Name), s.listPrefix)
 		if err != nil {
 			log.Printf("failed to list files for namespace %s: %v", ns.Name, err)
 			continue
 		}
+		sizer, err := s.loadFileSizer(ns.Name)
+		if err != nil {
+			log.Printf("failed to load file keys for namespace %s: %v", ns.Name, err)
+			continue
+		}
+		scans, err := s.loadScanStatuses(ns.Name)
+		if err != nil {
+			log.Printf("failed to load scan status for namespace %s: %v", ns.Name, err)
+			continue
+		}
 		for _, file := range files {
 			relative := relativeNameWithPrefix(file.Path, s.listPrefix)
 			if relative == "" {
@@ -1756,9 +2065,12 @@ func (s *server) handleAdminFiles(w http.ResponseWriter, r *http.Request) {
 				Name:       relative,
 				Path:       file.Path,
 				Namespace:  ns.Name,
-				Size:       file.Size,
+				Size:       sizer.logical(file.Path, file.Size),
 				CreatedAt:  file.CreatedAt,
 				ModifiedAt: file.ModifiedAt,
+				StoredSize: file.Size,
+				Encoding:   sizer.encoding(file.Path),
+				ScanStatus: scans[relative],
 			})
 		}
 	}
@@ -1767,36 +2079,46 @@ func (s *server) handleAdminFiles(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *server) handleAdminNamespaces(w http.ResponseWriter, r *http.Request) {
-	username, ok := s.currentUser(r)
-	if !ok || !isAdmin(username) {
-		http.Error(w, "forbidden", http.StatusForbidden)
+	if _, ok := s.requireRole(w, r, readableBy(r, roleStorageAdmin)...); !ok {
 		return
 	}
 
-	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
-	defer cancel()
-
 	namespaces, err := s.loadAllNamespaces()
 	if err != nil {
 		http.Error(w, "failed to load namespaces", http.StatusInternalServerError)
 		return
 	}
+	stats, err := s.loadNamespaceStats()
+	if err != nil {
+		http.Error(w, "failed to load namespace stats", http.StatusInternalServerError)
+		return
+	}
 
 	type adminNamespace struct {
-		Name    string `json:"name"`
-		Count   int    `json:"count"`
-		Hidden  bool   `json:"hidden"`
-		OwnerID *int   `json:"owner_id"`
+		Name         string `json:"name"`
+		Count        int    `json:"count"`
+		Bytes        int64  `json:"bytes"`
+		LogicalBytes int64  `json:"logical_bytes"`
+		LastModified int64  `json:"last_modified,omitempty"`
+		Hidden       bool   `json:"hidden"`
+		Encrypted    bool   `json:"encrypted"`
+		Compression  string `json:"compression,omitempty"`
+		OwnerID      *int   `json:"owner_id"`
 	}
 
 	result := make([]adminNamespace, 0, len(namespaces))
 	for _, ns := range namespaces {
-		count, _ := s.countNamespaceFiles(ctx, ns.Name)
+		st := stats[ns.Name]
 		result = append(result, adminNamespace{
-			Name:    ns.Name,
-			Count:   count,
-			Hidden:  ns.Hidden,
-			OwnerID: ns.OwnerID,
+			Name:         ns.Name,
+			Count:        st.Files,
+			Bytes:        st.Bytes,
+			LogicalBytes: st.LogicalBytes,
+			LastModified: st.LastModified,
+			Hidden:       ns.Hidden,
+			Encrypted:    ns.Encrypted,
+			Compression:  ns.Compression,
+			OwnerID:      ns.OwnerID,
 		})
 	}
 
@@ -1804,9 +2126,7 @@ func (s *server) handleAdminNamespaces(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *server) handleAdminUsers(w http.ResponseWriter, r *http.Request) {
-	username, ok := s.currentUser(r)
-	if !ok || !isAdmin(username) {
-		http.Error(w, "forbidden", http.StatusForbidden)
+	if _, ok := s.requireRole(w, r, readableBy(r)...); !ok {
 		return
 	}
 
@@ -1815,22 +2135,33 @@ func (s *server) handleAdminUsers(w http.ResponseWriter, r *http.Request) {
 		s.handleAdminUsersList(w, r)
 	case http.MethodPost:
 		s.handleAdminUsersCreate(w, r)
+	case http.MethodPut:
+		s.handleAdminUsersUpdate(w, r)
 	case http.MethodDelete:
 		s.handleAdminUsersDelete(w, r)
 	default:
-		w.Header().Set("Allow", "GET, POST, DELETE")
+		w.Header().Set("Allow", "GET, POST, PUT, DELETE")
 		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 	}
 }
 
 type adminUser struct {
-	ID          int64  `json:"id"`
-	Username    string `json:"username"`
-	DisplayName string `json:"display_name"`
+	ID          int64    `json:"id"`
+	Username    string   `json:"username"`
+	DisplayName string   `json:"display_name"`
+	Disabled    bool     `json:"disabled"`
+	Roles       []string `json:"roles"`
 }
 
 func (s *server) handleAdminUsersList(w http.ResponseWriter, r *http.Request) {
-	rows, err := s.db.Query(`SELECT id, username, COALESCE(display_name, username) FROM users ORDER BY id`)
+	rows, err := s.db.Query(
+		`SELECT users.id, users.username, COALESCE(users.display_name, users.username), users.disabled,
+		   COALESCE(string_agg(user_roles.role, ',' ORDER BY user_roles.role), '')
+		 FROM users
+		 LEFT JOIN user_roles ON user_roles.user_id = users.id
+		 GROUP BY users.id
+		 ORDER BY users.id`,
+	)
 	if err != nil {
 		http.Error(w, "failed to list users", http.StatusInternalServerError)
 		return
@@ -1840,10 +2171,17 @@ func (s *server) handleAdminUsersList(w http.ResponseWriter, r *http.Request) {
 	users := make([]adminUser, 0)
 	for rows.Next() {
 		var u adminUser
-		if err := rows.Scan(&u.ID, &u.Username, &u.DisplayName); err != nil {
+		var disabled int
+		var roles string
+		if err := rows.Scan(&u.ID, &u.Username, &u.DisplayName, &disabled, &roles); err != nil {
 			http.Error(w, "failed to scan user", http.StatusInternalServerError)
 			return
 		}
+		u.Disabled = disabled != 0
+		u.Roles = []string{}
+		if roles != "" {
+			u.Roles = strings.Split(roles, ",")
+		}
 		if u.DisplayName == "" {
 			u.DisplayName = u.Username
 		}
@@ -1899,7 +2237,7 @@ func (s *server) handleAdminUsersCreate(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	writeJSON(w, adminUser{ID: id, Username: payload.Username, DisplayName: payload.DisplayName})
+	writeJSON(w, adminUser{ID: id, Username: payload.Username, DisplayName: payload.DisplayName, Roles: []string{}})
 }
 
 func (s *server) handleAdminUsersDelete(w http.ResponseWriter, r *http.Request) {
@@ -1930,21 +2268,29 @@ func (s *server) handleAdminUsersDelete(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	// Delete user's sessions first
-	_, _ = s.db.Exec(`DELETE FROM sessions WHERE user_id = $1`, id)
-
-	// Clear ownership of user's namespaces (they become inaccessible)
-	_, _ = s.db.Exec(`UPDATE namespaces SET owner_id = NULL WHERE owner_id = $1`, id)
+	// Hand the user's namespaces to ?transfer_to when given; otherwise clear
+	// ownership (they become inaccessible until an admin reassigns them)
+	var newOwner sql.NullInt64
+	if transferTo := r.URL.Query().Get("transfer_to"); transferTo != "" {
+		owner, err := strconv.ParseInt(transferTo, 10, 64)
+		if err != nil || owner == id {
+			http.Error(w, "invalid transfer_to", http.StatusBadRequest)
+			return
+		}
+		var exists int
+		if err := s.db.QueryRow(`SELECT 1 FROM users WHERE id = $1`, owner).Scan(&exists); err != nil {
+			http.Error(w, "transfer_to user not found", http.StatusBadRequest)
+			return
+		}
+		newOwner = sql.NullInt64{Int64: owner, Valid: true}
+	}
 
-	// Delete user
-	result, err := s.db.Exec(`DELETE FROM users WHERE id = $1`, id)
+	deleted, err := s.deleteUser(id, newOwner)
 	if err != nil {
 		http.Error(w, "failed to delete user", http.StatusInternalServerError)
 		return
 	}
-
-	deleted, _ := result.RowsAffected()
-	if deleted == 0 {
+	if !deleted {
 		http.Error(w, "user not found", http.StatusNotFound)
 		return
 	}
@@ -1952,6 +2298,36 @@ func (s *server) handleAdminUsersDelete(w http.ResponseWriter, r *http.Request)
 	writeJSON(w, map[string]string{"status": "ok"})
 }
 
+// deleteUser removes a user and their sessions, handing their namespaces to
+// newOwner (or leaving them unowned) in the same transaction. It reports
+// false if the user no longer exists.
+func (s *server) deleteUser(id int64, newOwner sql.NullInt64) (bool, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`UPDATE namespaces SET owner_id = $1 WHERE owner_id = $2`, newOwner, id); err != nil {
+		return false, err
+	}
+	if _, err := tx.Exec(`DELETE FROM sessions WHERE user_id = $1`, id); err != nil {
+		return false, err
+	}
+	result, err := tx.Exec(`DELETE FROM users WHERE id = $1`, id)
+	if err != nil {
+		return false, err
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil || deleted == 0 {
+		return false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+	s.sessions.invalidateUser(id, "")
+	return true, nil
+}
+
 func writeJSON(w http.ResponseWriter, payload any) {
 	w.Header().Set("Content-Type", "application/json")
 	enc := json.NewEncoder(w)
@@ -1967,25 +2343,6 @@ func logRequests(next http.Handler) http.Handler {
 		start := time.Now()
 		next.ServeHTTP(w, r)
 		duration := time.Since(start)
-		log.Printf("%s %s %s", r.Method, r.URL.Path, duration.Round(time.Millisecond))
-	})
-}
-
-func corsMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		origin := r.Header.Get("Origin")
-		// Allow requests from cloud.eddisonso.com and localhost for dev
-		if origin != "" {
-			w.Header().Set("Access-Control-Allow-Origin", origin)
-			w.Header().Set("Access-Control-Allow-Credentials", "true")
-			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-File-Size")
-		}
-		// Handle preflight
-		if r.Method == "OPTIONS" {
-			w.WriteHeader(http.StatusOK)
-			return
-		}
-		next.ServeHTTP(w, r)
+		log.Printf("%s %s %s request_id=%s", r.Method, r.URL.Path, duration.Round(time.Millisecond), httpapi.RequestID(r))
 	})
 }
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"eddisonso.com/edd-cloud/pkg/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Metrics are exposed at /metrics through the shared metrics package, which
+// serves the Prometheus client's default registry.
+
+// HTTP metrics.
+
+var httpMetrics = metrics.NewHTTPMetrics("sfs")
+
+type routeKey struct{}
+
+// instrumentRequests counts requests and their latency by mux pattern, so the
+// route label stays bounded however many namespaces and files there are.
+func instrumentRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		route := new(string)
+		rec := &metrics.StatusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r.WithContext(context.WithValue(r.Context(), routeKey{}, route)))
+		httpMetrics.Observe(rec, r, *route, start)
+	})
+}
+
+// recordRoute wraps the mux and reports the pattern it matched back to
+// instrumentRequests. ServeMux sets Pattern on the request it dispatches.
+func recordRoute(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mux.ServeHTTP(w, r)
+		if route, ok := r.Context().Value(routeKey{}).(*string); ok {
+			*route = r.Pattern
+		}
+	})
+}
+
+// setRoute labels requests served outside the mux.
+func setRoute(r *http.Request, name string) {
+	if route, ok := r.Context().Value(routeKey{}).(*string); ok {
+		*route = name
+	}
+}
+
+// Storage and transfer metrics.
+
+var (
+	transferBytesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "sfs_transfer_bytes_total",
+		Help: "Stored bytes written by uploads and read by downloads.",
+	}, []string{"direction"})
+	transferDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "sfs_transfer_duration_seconds",
+		Help:    "Upload and download duration by outcome.",
+		Buckets: metrics.DefaultBuckets,
+	}, []string{"direction", "result"})
+	activeTransfers = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "sfs_active_transfers",
+		Help: "Uploads and downloads in progress.",
+	}, []string{"direction"})
+	storageRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "sfs_storage_request_duration_seconds",
+		Help:    "Storage backend call latency by operation.",
+		Buckets: metrics.DefaultBuckets,
+	}, []string{"backend", "op"})
+	storageErrorsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "sfs_storage_errors_total",
+		Help: "Failed storage backend calls by operation.",
+	}, []string{"backend", "op"})
+	scansTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "sfs_malware_scans_total",
+		Help: "Malware scans of uploaded files by verdict (clean, infected or error).",
+	}, []string{"result"})
+)
+
+// Traffic limit metrics.
+
+var (
+	rateLimitedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "sfs_rate_limited_requests_total",
+		Help: "Requests refused with 429 by endpoint class.",
+	}, []string{"class"})
+	throttledSeconds = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "sfs_bandwidth_throttled_seconds_total",
+		Help: "Time transfers spent waiting on bandwidth limits.",
+	}, []string{"direction"})
+)
+
+// startTransfer marks a transfer as active; call the returned func with the
+// outcome when it ends.
+func startTransfer(direction string) func(n int64, err error) {
+	start := time.Now()
+	activeTransfers.WithLabelValues(direction).Inc()
+	return func(n int64, err error) {
+		activeTransfers.WithLabelValues(direction).Dec()
+		transferBytesTotal.WithLabelValues(direction).Add(float64(n))
+		result := "ok"
+		if err != nil {
+			result = "error"
+		}
+		metrics.Since(transferDuration.WithLabelValues(direction, result), start)
+	}
+}
+
+// instrumentedStorage times every backend call and counts failures.
+type instrumentedStorage struct {
+	backend string
+	next    storageBackend
+}
+
+func (s *instrumentedStorage) observe(op string, start time.Time, err error) {
+	metrics.Since(storageRequestDuration.WithLabelValues(s.backend, op), start)
+	// Cancellations come from clients hanging up, not from the backend.
+	if err != nil && !errors.Is(err, context.Canceled) {
+		storageErrorsTotal.WithLabelValues(s.backend, op).Inc()
+	}
+}
+
+func (s *instrumentedStorage) ListFilesWithNamespace(ctx context.Context, namespace, prefix string) (files []storedFile, err error) {
+	defer func(start time.Time) { s.observe("list", start, err) }(time.Now())
+	return s.next.ListFilesWithNamespace(ctx, namespace, prefix)
+}
+
+// GetFileWithNamespace doubles as an existence check, so its errors are
+// mostly misses and aren't counted.
+func (s *instrumentedStorage) GetFileWithNamespace(ctx context.Context, path, namespace string) (*storedFile, error) {
+	defer s.observe("get", time.Now(), nil)
+	return s.next.GetFileWithNamespace(ctx, path, namespace)
+}
+
+func (s *instrumentedStorage) CreateFileWithNamespace(ctx context.Context, path, namespace string) (err error) {
+	defer func(start time.Time) { s.observe("create", start, err) }(time.Now())
+	return s.next.CreateFileWithNamespace(ctx, path, namespace)
+}
+
+func (s *instrumentedStorage) AppendFromWithNamespace(ctx context.Context, path, namespace string, r io.Reader) (n int64, err error) {
+	defer func(start time.Time) { s.observe("append", start, err) }(time.Now())
+	return s.next.AppendFromWithNamespace(ctx, path, namespace, r)
+}
+
+func (s *instrumentedStorage) ReadToWithNamespace(ctx context.Context, path, namespace string, w io.Writer) (n int64, err error) {
+	defer func(start time.Time) { s.observe("read", start, err) }(time.Now())
+	return s.next.ReadToWithNamespace(ctx, path, namespace, w)
+}
+
+func (s *instrumentedStorage) DeleteFileWithNamespace(ctx context.Context, path, namespace string) (err error) {
+	defer func(start time.Time) { s.observe("delete", start, err) }(time.Now())
+	return s.next.DeleteFileWithNamespace(ctx, path, namespace)
+}
+
+func (s *instrumentedStorage) Close() error {
+	return s.next.Close()
+}
@@ -0,0 +1,604 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+// migration is one versioned schema change. Up and Down run in a single
+// transaction together with the schema_migrations bookkeeping, so a failed
+// migration leaves nothing half-applied.
+//
+// The early versions are written idempotently (IF NOT EXISTS) because they
+// replay what initAuthDB used to do on every boot; databases created before
+// versioning adopt them without changes.
+type migration struct {
+	Version int
+	Name    string
+	Up      []string
+	Down    []string
+}
+
+const (
+	// schema_migrations is shared with other services that use the same
+	// database, so rows are keyed by service.
+	migrationService = "sfs"
+	// migrationLockKey is the pg_advisory_lock key that serializes migrations
+	// across replicas starting at the same time ("sfs" in ASCII).
+	migrationLockKey int64 = 0x736673
+)
+
+var migrations = []migration{
+	{
+		Version: 1,
+		Name:    "initial schema",
+		Up: []string{
+			`CREATE TABLE IF NOT EXISTS users (
+				id SERIAL PRIMARY KEY,
+				username TEXT NOT NULL UNIQUE,
+				password_hash TEXT NOT NULL,
+				display_name TEXT NOT NULL DEFAULT ''
+			)`,
+			`CREATE TABLE IF NOT EXISTS sessions (
+				id SERIAL PRIMARY KEY,
+				user_id INTEGER NOT NULL,
+				token TEXT NOT NULL UNIQUE,
+				expires_at BIGINT NOT NULL,
+				CONSTRAINT fk_user FOREIGN KEY(user_id) REFERENCES users(id)
+			)`,
+			`CREATE TABLE IF NOT EXISTS namespaces (
+				name TEXT PRIMARY KEY,
+				hidden INTEGER NOT NULL DEFAULT 0,
+				owner_id INTEGER REFERENCES users(id)
+			)`,
+			`ALTER TABLE users ADD COLUMN IF NOT EXISTS display_name TEXT NOT NULL DEFAULT ''`,
+			`ALTER TABLE namespaces ADD COLUMN IF NOT EXISTS owner_id INTEGER REFERENCES users(id)`,
+		},
+		Down: []string{
+			`DROP TABLE IF EXISTS namespaces`,
+			`DROP TABLE IF EXISTS sessions`,
+			`DROP TABLE IF EXISTS users`,
+		},
+	},
+	{
+		Version: 2,
+		Name:    "namespace encryption",
+		Up: []string{
+			`ALTER TABLE namespaces ADD COLUMN IF NOT EXISTS encrypted INTEGER NOT NULL DEFAULT 0`,
+			`CREATE TABLE IF NOT EXISTS file_keys (
+				namespace TEXT NOT NULL,
+				path TEXT NOT NULL,
+				key_id TEXT NOT NULL,
+				wrapped_key TEXT NOT NULL,
+				segment_size INTEGER NOT NULL,
+				created_at BIGINT NOT NULL,
+				PRIMARY KEY (namespace, path)
+			)`,
+		},
+		Down: []string{
+			`DROP TABLE IF EXISTS file_keys`,
+			`ALTER TABLE namespaces DROP COLUMN IF EXISTS encrypted`,
+		},
+	},
+	{
+		Version: 3,
+		Name:    "namespace websites",
+		Up: []string{
+			`CREATE TABLE IF NOT EXISTS websites (
+				namespace TEXT PRIMARY KEY REFERENCES namespaces(name) ON UPDATE CASCADE ON DELETE CASCADE,
+				index_document TEXT NOT NULL DEFAULT 'index.html',
+				error_document TEXT NOT NULL DEFAULT '',
+				spa_fallback INTEGER NOT NULL DEFAULT 0,
+				cache_seconds INTEGER NOT NULL DEFAULT 300
+			)`,
+		},
+		Down: []string{
+			`DROP TABLE IF EXISTS websites`,
+		},
+	},
+	{
+		Version: 4,
+		Name:    "drop links",
+		Up: []string{
+			`CREATE TABLE IF NOT EXISTS drop_links (
+				id SERIAL PRIMARY KEY,
+				token TEXT NOT NULL UNIQUE,
+				namespace TEXT NOT NULL REFERENCES namespaces(name) ON UPDATE CASCADE ON DELETE CASCADE,
+				label TEXT NOT NULL DEFAULT '',
+				folder TEXT NOT NULL DEFAULT '',
+				created_by INTEGER REFERENCES users(id) ON DELETE SET NULL,
+				expires_at BIGINT NOT NULL,
+				max_file_bytes BIGINT NOT NULL DEFAULT 0,
+				max_files INTEGER NOT NULL,
+				upload_count INTEGER NOT NULL DEFAULT 0,
+				allowed_extensions TEXT NOT NULL DEFAULT '',
+				created_at BIGINT NOT NULL
+			)`,
+		},
+		Down: []string{
+			`DROP TABLE IF EXISTS drop_links`,
+		},
+	},
+	{
+		Version: 5,
+		Name:    "audit events",
+		Up: []string{
+			`CREATE TABLE IF NOT EXISTS audit_events (
+				id BIGSERIAL PRIMARY KEY,
+				namespace TEXT NOT NULL DEFAULT '',
+				actor TEXT NOT NULL,
+				action TEXT NOT NULL,
+				detail TEXT NOT NULL DEFAULT '',
+				created_at BIGINT NOT NULL
+			)`,
+			`CREATE INDEX IF NOT EXISTS audit_events_namespace_idx ON audit_events (namespace, id)`,
+		},
+		Down: []string{
+			`DROP TABLE IF EXISTS audit_events`,
+		},
+	},
+	{
+		Version: 6,
+		Name:    "login attempts",
+		Up: []string{
+			`CREATE TABLE IF NOT EXISTS login_attempts (
+				key TEXT PRIMARY KEY,
+				failures INTEGER NOT NULL DEFAULT 0,
+				last_failure BIGINT NOT NULL DEFAULT 0,
+				locked_until BIGINT NOT NULL DEFAULT 0
+			)`,
+		},
+		Down: []string{
+			`DROP TABLE IF EXISTS login_attempts`,
+		},
+	},
+	{
+		Version: 7,
+		Name:    "two-factor authentication",
+		Up: []string{
+			`ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_secret TEXT NOT NULL DEFAULT ''`,
+			`ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_enabled INTEGER NOT NULL DEFAULT 0`,
+			`ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_last_step BIGINT NOT NULL DEFAULT 0`,
+			`CREATE TABLE IF NOT EXISTS login_challenges (
+				token TEXT PRIMARY KEY,
+				user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+				attempts INTEGER NOT NULL DEFAULT 0,
+				expires_at BIGINT NOT NULL
+			)`,
+			`CREATE TABLE IF NOT EXISTS totp_recovery_codes (
+				id SERIAL PRIMARY KEY,
+				user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+				code_hash TEXT NOT NULL,
+				used_at BIGINT NOT NULL DEFAULT 0
+			)`,
+		},
+		Down: []string{
+			`DROP TABLE IF EXISTS totp_recovery_codes`,
+			`DROP TABLE IF EXISTS login_challenges`,
+			`ALTER TABLE users DROP COLUMN IF EXISTS totp_last_step`,
+			`ALTER TABLE users DROP COLUMN IF EXISTS totp_enabled`,
+			`ALTER TABLE users DROP COLUMN IF EXISTS totp_secret`,
+		},
+	},
+	{
+		Version: 8,
+		Name:    "single sign-on",
+		Up: []string{
+			`ALTER TABLE users ADD COLUMN IF NOT EXISTS email TEXT NOT NULL DEFAULT ''`,
+			`ALTER TABLE users ADD COLUMN IF NOT EXISTS oidc_subject TEXT UNIQUE`,
+			`CREATE TABLE IF NOT EXISTS oidc_states (
+				state TEXT PRIMARY KEY,
+				nonce TEXT NOT NULL,
+				verifier TEXT NOT NULL,
+				redirect TEXT NOT NULL,
+				expires_at BIGINT NOT NULL
+			)`,
+		},
+		Down: []string{
+			`DROP TABLE IF EXISTS oidc_states`,
+			`ALTER TABLE users DROP COLUMN IF EXISTS oidc_subject`,
+			`ALTER TABLE users DROP COLUMN IF EXISTS email`,
+		},
+	},
+	{
+		Version: 9,
+		Name:    "account status and session metadata",
+		Up: []string{
+			`ALTER TABLE users ADD COLUMN IF NOT EXISTS disabled INTEGER NOT NULL DEFAULT 0`,
+			`ALTER TABLE sessions ADD COLUMN IF NOT EXISTS ip TEXT NOT NULL DEFAULT ''`,
+			`ALTER TABLE sessions ADD COLUMN IF NOT EXISTS user_agent TEXT NOT NULL DEFAULT ''`,
+			`ALTER TABLE sessions ADD COLUMN IF NOT EXISTS created_at BIGINT NOT NULL DEFAULT 0`,
+			`ALTER TABLE sessions ADD COLUMN IF NOT EXISTS last_seen BIGINT NOT NULL DEFAULT 0`,
+		},
+		Down: []string{
+			`ALTER TABLE sessions DROP COLUMN IF EXISTS last_seen`,
+			`ALTER TABLE sessions DROP COLUMN IF EXISTS created_at`,
+			`ALTER TABLE sessions DROP COLUMN IF EXISTS user_agent`,
+			`ALTER TABLE sessions DROP COLUMN IF EXISTS ip`,
+			`ALTER TABLE users DROP COLUMN IF EXISTS disabled`,
+		},
+	},
+	{
+		Version: 10,
+		Name:    "user roles",
+		Up: []string{
+			`CREATE TABLE IF NOT EXISTS user_roles (
+				user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+				role TEXT NOT NULL,
+				PRIMARY KEY (user_id, role)
+			)`,
+			// Databases from before roles carry an is_admin flag set by SSO.
+			`DO $$
+			BEGIN
+				IF EXISTS (SELECT 1 FROM information_schema.columns
+				           WHERE table_name = 'users' AND column_name = 'is_admin') THEN
+					INSERT INTO user_roles (user_id, role)
+					SELECT id, 'admin' FROM users WHERE is_admin <> 0
+					ON CONFLICT DO NOTHING;
+					ALTER TABLE users DROP COLUMN is_admin;
+				END IF;
+			END $$`,
+		},
+		Down: []string{
+			`ALTER TABLE users ADD COLUMN IF NOT EXISTS is_admin INTEGER NOT NULL DEFAULT 0`,
+			`UPDATE users SET is_admin = 1 WHERE id IN (SELECT user_id FROM user_roles WHERE role = 'admin')`,
+			`DROP TABLE IF EXISTS user_roles`,
+		},
+	},
+	{
+		Version: 11,
+		Name:    "token signing keys",
+		Up: []string{
+			`CREATE TABLE signing_keys (
+				kid TEXT PRIMARY KEY,
+				private_key TEXT NOT NULL,
+				created_at BIGINT NOT NULL
+			)`,
+		},
+		Down: []string{
+			`DROP TABLE signing_keys`,
+		},
+	},
+	{
+		Version: 12,
+		Name:    "namespace statistics",
+		Up: []string{
+			// Filled in by the stats reconciliation on the first boot.
+			`CREATE TABLE namespace_stats (
+				namespace TEXT PRIMARY KEY,
+				file_count BIGINT NOT NULL DEFAULT 0,
+				total_bytes BIGINT NOT NULL DEFAULT 0,
+				last_modified BIGINT NOT NULL DEFAULT 0,
+				version BIGINT NOT NULL DEFAULT 0,
+				reconciled_at BIGINT NOT NULL DEFAULT 0
+			)`,
+		},
+		Down: []string{
+			`DROP TABLE namespace_stats`,
+		},
+	},
+	{
+		Version: 13,
+		Name:    "batch jobs and file metadata",
+		Up: []string{
+			// tags is a JSON object of string keys and values.
+			`CREATE TABLE file_metadata (
+				namespace TEXT NOT NULL,
+				path TEXT NOT NULL,
+				tags TEXT NOT NULL DEFAULT '{}',
+				updated_at BIGINT NOT NULL,
+				PRIMARY KEY (namespace, path)
+			)`,
+			`CREATE TABLE batch_jobs (
+				id TEXT PRIMARY KEY,
+				user_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+				status TEXT NOT NULL,
+				total INTEGER NOT NULL,
+				completed INTEGER NOT NULL DEFAULT 0,
+				failed INTEGER NOT NULL DEFAULT 0,
+				results TEXT NOT NULL DEFAULT '',
+				created_at BIGINT NOT NULL,
+				updated_at BIGINT NOT NULL,
+				finished_at BIGINT NOT NULL DEFAULT 0
+			)`,
+			`CREATE INDEX batch_jobs_finished_at_idx ON batch_jobs (finished_at)`,
+		},
+		Down: []string{
+			`DROP TABLE batch_jobs`,
+			`DROP TABLE file_metadata`,
+		},
+	},
+	{
+		Version: 14,
+		Name:    "file compression",
+		Up: []string{
+			`ALTER TABLE namespaces ADD COLUMN IF NOT EXISTS compression TEXT NOT NULL DEFAULT ''`,
+			`CREATE TABLE file_codecs (
+				namespace TEXT NOT NULL,
+				path TEXT NOT NULL,
+				codec TEXT NOT NULL,
+				logical_size BIGINT NOT NULL DEFAULT 0,
+				created_at BIGINT NOT NULL,
+				PRIMARY KEY (namespace, path)
+			)`,
+			// Filled in by the next stats reconciliation.
+			`ALTER TABLE namespace_stats ADD COLUMN logical_bytes BIGINT NOT NULL DEFAULT 0`,
+		},
+		Down: []string{
+			`ALTER TABLE namespace_stats DROP COLUMN logical_bytes`,
+			`DROP TABLE file_codecs`,
+			`ALTER TABLE namespaces DROP COLUMN compression`,
+		},
+	},
+	{
+		Version: 15,
+		Name:    "change journal",
+		Up: []string{
+			`CREATE TABLE change_sequences (
+				namespace TEXT PRIMARY KEY,
+				seq BIGINT NOT NULL DEFAULT 0,
+				pruned_through BIGINT NOT NULL DEFAULT 0
+			)`,
+			`CREATE TABLE file_changes (
+				namespace TEXT NOT NULL,
+				seq BIGINT NOT NULL,
+				op TEXT NOT NULL,
+				path TEXT NOT NULL,
+				old_path TEXT NOT NULL DEFAULT '',
+				size BIGINT NOT NULL DEFAULT 0,
+				created_at BIGINT NOT NULL,
+				PRIMARY KEY (namespace, seq)
+			)`,
+			`CREATE INDEX file_changes_created_at_idx ON file_changes (created_at)`,
+		},
+		Down: []string{
+			`DROP TABLE file_changes`,
+			`DROP TABLE change_sequences`,
+		},
+	},
+	{
+		Version: 16,
+		Name:    "malware scans",
+		Up: []string{
+			// status is pending, clean or infected. scan_id ties a verdict
+			// to the write it was made for; retry_at is when the sweeper may
+			// next pick the file up (0 once it needs nothing more).
+			`CREATE TABLE file_scans (
+				namespace TEXT NOT NULL,
+				path TEXT NOT NULL,
+				scan_id TEXT NOT NULL,
+				status TEXT NOT NULL,
+				signature TEXT NOT NULL DEFAULT '',
+				error TEXT NOT NULL DEFAULT '',
+				attempts INTEGER NOT NULL DEFAULT 0,
+				retry_at BIGINT NOT NULL DEFAULT 0,
+				scanned_at BIGINT NOT NULL DEFAULT 0,
+				created_at BIGINT NOT NULL,
+				PRIMARY KEY (namespace, path)
+			)`,
+			`CREATE INDEX file_scans_retry_at_idx ON file_scans (retry_at) WHERE retry_at > 0`,
+		},
+		Down: []string{
+			`DROP TABLE file_scans`,
+		},
+	},
+	{
+		Version: 17,
+		Name:    "role grant source",
+		Up: []string{
+			// source is oidc for roles granted by the SSO group mapping, which
+			// is the only kind SSO logins may revoke.
+			`ALTER TABLE user_roles ADD COLUMN source TEXT NOT NULL DEFAULT 'manual'`,
+		},
+		Down: []string{
+			`ALTER TABLE user_roles DROP COLUMN source`,
+		},
+	},
+	{
+		Version: 18,
+		Name:    "namespace rename lock",
+		Up: []string{
+			// Unix time until which a rename holds the namespace read-only;
+			// a crashed rename releases it once the time passes.
+			`ALTER TABLE namespaces ADD COLUMN renaming_until BIGINT NOT NULL DEFAULT 0`,
+		},
+		Down: []string{
+			`ALTER TABLE namespaces DROP COLUMN renaming_until`,
+		},
+	},
+}
+
+type migrationState struct {
+	Version   int
+	Name      string
+	AppliedAt int64
+}
+
+// withMigrationLock runs fn on a dedicated connection holding the migration
+// advisory lock. Advisory locks belong to a session, so every statement has
+// to go through the same connection rather than the pool.
+func withMigrationLock(ctx context.Context, db *sql.DB, fn func(conn *sql.Conn) error) error {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, migrationLockKey); err != nil {
+		return fmt.Errorf("acquire migration lock: %w", err)
+	}
+	defer conn.ExecContext(context.Background(), `SELECT pg_advisory_unlock($1)`, migrationLockKey)
+
+	if _, err := conn.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		service TEXT NOT NULL,
+		version INTEGER NOT NULL,
+		name TEXT NOT NULL,
+		applied_at BIGINT NOT NULL,
+		PRIMARY KEY (service, version)
+	)`); err != nil {
+		return fmt.Errorf("create schema_migrations: %w", err)
+	}
+	return fn(conn)
+}
+
+func appliedMigrations(ctx context.Context, conn *sql.Conn) (map[int]migrationState, error) {
+	rows, err := conn.QueryContext(ctx,
+		`SELECT version, name, applied_at FROM schema_migrations WHERE service = $1`,
+		migrationService,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := make(map[int]migrationState)
+	for rows.Next() {
+		var state migrationState
+		if err := rows.Scan(&state.Version, &state.Name, &state.AppliedAt); err != nil {
+			return nil, err
+		}
+		applied[state.Version] = state
+	}
+	return applied, rows.Err()
+}
+
+func runMigration(ctx context.Context, conn *sql.Conn, m migration, up bool) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmts := m.Down
+	if up {
+		stmts = m.Up
+	}
+	for _, stmt := range stmts {
+		if _, err := tx.ExecContext(ctx, stmt); err != nil {
+			return err
+		}
+	}
+	if up {
+		_, err = tx.ExecContext(ctx,
+			`INSERT INTO schema_migrations (service, version, name, applied_at) VALUES ($1, $2, $3, $4)`,
+			migrationService, m.Version, m.Name, time.Now().Unix(),
+		)
+	} else {
+		_, err = tx.ExecContext(ctx,
+			`DELETE FROM schema_migrations WHERE service = $1 AND version = $2`,
+			migrationService, m.Version,
+		)
+	}
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// migrateUp applies every pending migration in version order.
+func migrateUp(ctx context.Context, db *sql.DB) error {
+	return withMigrationLock(ctx, db, func(conn *sql.Conn) error {
+		applied, err := appliedMigrations(ctx, conn)
+		if err != nil {
+			return err
+		}
+		for _, m := range migrations {
+			if _, ok := applied[m.Version]; ok {
+				continue
+			}
+			if err := runMigration(ctx, conn, m, true); err != nil {
+				return fmt.Errorf("migration %d (%s): %w", m.Version, m.Name, err)
+			}
+			log.Printf("applied migration %d: %s", m.Version, m.Name)
+		}
+		return nil
+	})
+}
+
+// migrateDown reverts applied migrations newer than target, newest first. A
+// negative target reverts only the latest applied migration.
+func migrateDown(ctx context.Context, db *sql.DB, target int) error {
+	return withMigrationLock(ctx, db, func(conn *sql.Conn) error {
+		applied, err := appliedMigrations(ctx, conn)
+		if err != nil {
+			return err
+		}
+		for i := len(migrations) - 1; i >= 0; i-- {
+			m := migrations[i]
+			if target >= 0 && m.Version <= target {
+				break
+			}
+			if _, ok := applied[m.Version]; !ok {
+				continue
+			}
+			if err := runMigration(ctx, conn, m, false); err != nil {
+				return fmt.Errorf("revert migration %d (%s): %w", m.Version, m.Name, err)
+			}
+			log.Printf("reverted migration %d: %s", m.Version, m.Name)
+			if target < 0 {
+				break
+			}
+		}
+		return nil
+	})
+}
+
+// runMigrateCommand implements `sfs migrate [up|down [-to N]|status]`. down
+// without -to reverts only the latest applied migration.
+func runMigrateCommand(args []string) error {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	to := fs.Int("to", -1, "version to migrate down to (down only; default reverts one migration)")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: sfs migrate [up | down [-to version] | status]")
+		fs.PrintDefaults()
+	}
+
+	action := "up"
+	if len(args) > 0 && args[0] != "" && args[0][0] != '-' {
+		action, args = args[0], args[1:]
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	dbConnStr := os.Getenv("DATABASE_URL")
+	if dbConnStr == "" {
+		dbConnStr = "postgres://localhost:5432/eddcloud?sslmode=disable"
+	}
+	db, err := sql.Open("postgres", dbConnStr)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	ctx := context.Background()
+	switch action {
+	case "up":
+		return migrateUp(ctx, db)
+	case "down":
+		return migrateDown(ctx, db, *to)
+	case "status":
+		return withMigrationLock(ctx, db, func(conn *sql.Conn) error {
+			applied, err := appliedMigrations(ctx, conn)
+			if err != nil {
+				return err
+			}
+			for _, m := range migrations {
+				status := "pending"
+				if state, ok := applied[m.Version]; ok {
+					status = "applied " + time.Unix(state.AppliedAt, 0).UTC().Format(time.RFC3339)
+				}
+				fmt.Printf("%3d  %-40s %s\n", m.Version, m.Name, status)
+			}
+			return nil
+		})
+	default:
+		fs.Usage()
+		return fmt.Errorf("unknown migrate action %q", action)
+	}
+}
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+// namespaceRenameTimeout bounds a rename, and with it how long the namespace
+// stays read-only.
+const namespaceRenameTimeout = 10 * time.Minute
+
+var errNamespaceRenaming = errors.New("namespace is being renamed, retry shortly")
+
+// checkNamespaceWritable fails with errNamespaceRenaming while a rename is
+// copying the namespace, since a write landing then would be missed by the
+// copy and removed with the old files.
+func (s *server) checkNamespaceWritable(namespace string) error {
+	var until int64
+	err := s.db.QueryRow(`SELECT renaming_until FROM namespaces WHERE name = $1`, namespace).Scan(&until)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("check namespace: %w", err)
+	}
+	if until > time.Now().Unix() {
+		return errNamespaceRenaming
+	}
+	return nil
+}
+
+// copyStoredFile copies a file's stored bytes between GFS namespaces without
+// decoding them. Encrypted and compressed files stay valid as long as their
+// file_keys and file_codecs rows follow them.
+func (s *server) copyStoredFile(ctx context.Context, name, srcNamespace, dstNamespace string) error {
+	if err := s.storage.CreateFileWithNamespace(ctx, name, dstNamespace); err != nil {
+		return fmt.Errorf("create %s: %w", name, err)
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		_, err := s.storage.ReadToWithNamespace(ctx, name, srcNamespace, pw)
+		pw.CloseWithError(err)
+	}()
+	_, err := s.storage.AppendFromWithNamespace(ctx, name, dstNamespace, pr)
+	pr.CloseWithError(err)
+	if err != nil {
+		return fmt.Errorf("copy %s: %w", name, err)
+	}
+	return nil
+}
+
+type namespaceRenameRequest struct {
+	Name string `json:"name"`
+}
+
+// handleNamespaceRename handles POST /storage/namespaces/{name}/rename.
+// Files are copied into the new GFS namespace first; the database is only
+// switched over once every copy succeeded, and the old files are removed last.
+// The namespace is read-only throughout.
+func (s *server) handleNamespaceRename(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.requireAuth(w, r); !ok {
+		return
+	}
+
+	oldName, err := sanitizeNamespace(r.PathValue("name"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var payload namespaceRenameRequest
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		http.Error(w, "invalid payload", http.StatusBadRequest)
+		return
+	}
+	newName, err := sanitizeNamespace(payload.Name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if oldName == defaultNamespace || oldName == hiddenNamespace || newName == defaultNamespace || newName == hiddenNamespace {
+		http.Error(w, "built-in namespaces cannot be renamed", http.StatusBadRequest)
+		return
+	}
+	if oldName == newName {
+		http.Error(w, "namespace already has that name", http.StatusBadRequest)
+		return
+	}
+
+	if exists, err := s.namespaceExists(oldName); err != nil {
+		http.Error(w, "failed to check namespace", http.StatusInternalServerError)
+		return
+	} else if !exists {
+		http.Error(w, "namespace not found", http.StatusNotFound)
+		return
+	}
+	if !s.canManageNamespace(r, oldName) {
+		s.denyAccess(w, r)
+		return
+	}
+	if exists, err := s.namespaceExists(newName); err != nil {
+		http.Error(w, "failed to check namespace", http.StatusInternalServerError)
+		return
+	} else if exists {
+		http.Error(w, "namespace already exists", http.StatusConflict)
+		return
+	}
+
+	now := time.Now()
+	res, err := s.db.Exec(
+		`UPDATE namespaces SET renaming_until = $2 WHERE name = $1 AND renaming_until <= $3`,
+		oldName,
+		now.Add(namespaceRenameTimeout).Unix(),
+		now.Unix(),
+	)
+	if err != nil {
+		http.Error(w, "failed to lock namespace", http.StatusInternalServerError)
+		return
+	}
+	if locked, _ := res.RowsAffected(); locked == 0 {
+		http.Error(w, errNamespaceRenaming.Error(), http.StatusConflict)
+		return
+	}
+	// Renaming the rows clears the lock too; this covers the failure paths.
+	defer func() {
+		if _, err := s.db.Exec(`UPDATE namespaces SET renaming_until = 0 WHERE name = $1`, oldName); err != nil {
+			log.Printf("rename unlock failed namespace=%s err=%v", oldName, err)
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(r.Context(), namespaceRenameTimeout)
+	defer cancel()
+
+	files, err := s.storage.ListFilesWithNamespace(ctx, s.gfsNamespace(oldName), s.listPrefix)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("list files failed: %v", err), http.StatusBadGateway)
+		return
+	}
+
+	var copied []string
+	rollback := func() {
+		for _, name := range copied {
+			if err := s.storage.DeleteFileWithNamespace(ctx, name, s.gfsNamespace(newName)); err != nil {
+				log.Printf("rename rollback failed namespace=%s name=%s err=%v", newName, name, err)
+			}
+		}
+	}
+	for _, file := range files {
+		if err := s.copyStoredFile(ctx, file.Path, s.gfsNamespace(oldName), s.gfsNamespace(newName)); err != nil {
+			rollback()
+			http.Error(w, fmt.Sprintf("rename failed: %v", err), http.StatusBadGateway)
+			return
+		}
+		copied = append(copied, file.Path)
+	}
+
+	if err := s.renameNamespaceRows(oldName, newName); err != nil {
+		rollback()
+		http.Error(w, "failed to rename namespace", http.StatusInternalServerError)
+		return
+	}
+
+	for _, file := range files {
+		if err := s.storage.DeleteFileWithNamespace(ctx, file.Path, s.gfsNamespace(oldName)); err != nil {
+			log.Printf("rename cleanup failed namespace=%s name=%s err=%v", oldName, file.Path, err)
+		}
+	}
+	log.Printf("namespace renamed from=%s to=%s files=%d", oldName, newName, len(files))
+
+	info, err := s.loadNamespace(newName)
+	if err != nil {
+		http.Error(w, "failed to load namespace", http.StatusInternalServerError)
+		return
+	}
+	if stats, err := s.loadNamespaceStats(); err == nil {
+		info.applyStats(stats[newName])
+	}
+	writeJSON(w, info)
+}
+
+// renameNamespaceRows moves a namespace and every row keyed by it to a new
+// name in one transaction.
+func (s *server) renameNamespaceRows(oldName, newName string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmts := []string{
+		`UPDATE namespaces SET name = $2, renaming_until = 0 WHERE name = $1`,
+		`UPDATE file_keys SET namespace = $2 WHERE namespace = $1`,
+		`UPDATE audit_events SET namespace = $2 WHERE namespace = $1`,
+		// A leftover row for the new name would block the move; the old
+		// namespace's totals describe the copied files.
+		`DELETE FROM namespace_stats WHERE namespace = $2 AND namespace <> $1`,
+		`UPDATE namespace_stats SET namespace = $2 WHERE namespace = $1`,
+		`UPDATE file_metadata SET namespace = $2 WHERE namespace = $1`,
+		`UPDATE file_codecs SET namespace = $2 WHERE namespace = $1`,
+		`UPDATE file_scans SET namespace = $2 WHERE namespace = $1`,
+		// As with the stats, a sequence left by a deleted namespace of the
+		// new name gives way; its old cursors then fail as out of range.
+		`DELETE FROM change_sequences WHERE namespace = $2 AND namespace <> $1`,
+		`UPDATE change_sequences SET namespace = $2 WHERE namespace = $1`,
+		`UPDATE file_changes SET namespace = $2 WHERE namespace = $1`,
+	}
+	for _, stmt := range stmts {
+		if _, err := tx.Exec(stmt, oldName, newName); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *server) loadNamespace(name string) (namespaceInfo, error) {
+	info := namespaceInfo{Name: name}
+	var hidden, encrypted int
+	err := s.db.QueryRow(
+		`SELECT hidden, encrypted, compression, owner_id FROM namespaces WHERE name = $1`,
+		name,
+	).Scan(&hidden, &encrypted, &info.Compression, &info.OwnerID)
+	if err != nil {
+		return info, err
+	}
+	info.Hidden = hidden != 0
+	info.Encrypted = encrypted != 0
+	return info, nil
+}
+
+type namespaceOwnerRequest struct {
+	OwnerID  *int   `json:"owner_id"`
+	Username string `json:"username"`
+}
+
+// resolveOwner finds the user a namespace should be handed to, by ID or
+// username.
+func (s *server) resolveOwner(payload namespaceOwnerRequest) (int, error) {
+	var id int
+	var err error
+	switch {
+	case payload.OwnerID != nil:
+		err = s.db.QueryRow(`SELECT id FROM users WHERE id = $1`, *payload.OwnerID).Scan(&id)
+	case payload.Username != "":
+		err = s.db.QueryRow(`SELECT id FROM users WHERE username = $1`, payload.Username).Scan(&id)
+	default:
+		return 0, fmt.Errorf("owner_id or username required")
+	}
+	if err == sql.ErrNoRows {
+		return 0, fmt.Errorf("user not found")
+	}
+	return id, err
+}
+
+// handleNamespaceOwner handles PUT /storage/namespaces/{name}/owner. The
+// current owner or an admin may hand the namespace to another user.
+func (s *server) handleNamespaceOwner(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.requireAuth(w, r); !ok {
+		return
+	}
+
+	name, err := sanitizeNamespace(r.PathValue("name"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if exists, err := s.namespaceExists(name); err != nil {
+		http.Error(w, "failed to check namespace", http.StatusInternalServerError)
+		return
+	} else if !exists {
+		http.Error(w, "namespace not found", http.StatusNotFound)
+		return
+	}
+	if !s.canManageNamespace(r, name) {
+		s.denyAccess(w, r)
+		return
+	}
+
+	var payload namespaceOwnerRequest
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		http.Error(w, "invalid payload", http.StatusBadRequest)
+		return
+	}
+	ownerID, err := s.resolveOwner(payload)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if _, err := s.db.Exec(`UPDATE namespaces SET owner_id = $1 WHERE name = $2`, ownerID, name); err != nil {
+		http.Error(w, "failed to transfer namespace", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("namespace owner changed namespace=%s owner=%d", name, ownerID)
+
+	info, err := s.loadNamespace(name)
+	if err != nil {
+		http.Error(w, "failed to load namespace", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, info)
+}
+
+type reassignRequest struct {
+	namespaceOwnerRequest
+	Namespaces []string `json:"namespaces"`
+}
+
+// handleAdminOrphanedNamespaces lists namespaces without an owner (GET) and
+// reassigns them (POST). A POST without namespaces reassigns every orphan.
+func (s *server) handleAdminOrphanedNamespaces(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.requireRole(w, r, readableBy(r, roleStorageAdmin)...); !ok {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		namespaces, err := s.loadAllNamespaces()
+		if err != nil {
+			http.Error(w, "failed to load namespaces", http.StatusInternalServerError)
+			return
+		}
+		orphaned := make([]namespaceInfo, 0)
+		for _, ns := range namespaces {
+			if ns.OwnerID == nil && ns.Name != defaultNamespace && ns.Name != hiddenNamespace {
+				orphaned = append(orphaned, ns)
+			}
+		}
+		writeJSON(w, orphaned)
+	case http.MethodPost:
+		var payload reassignRequest
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			http.Error(w, "invalid payload", http.StatusBadRequest)
+			return
+		}
+		ownerID, err := s.resolveOwner(payload.namespaceOwnerRequest)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		reassigned, err := s.reassignOrphanedNamespaces(ownerID, payload.Namespaces)
+		if err != nil {
+			http.Error(w, "failed to reassign namespaces", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, map[string]any{"status": "ok", "owner_id": ownerID, "reassigned": reassigned})
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *server) reassignOrphanedNamespaces(ownerID int, names []string) ([]string, error) {
+	query := `UPDATE namespaces SET owner_id = $1
+		WHERE owner_id IS NULL AND name <> $2 AND name <> $3
+		RETURNING name`
+	args := []any{ownerID, defaultNamespace, hiddenNamespace}
+	if len(names) > 0 {
+		query = `UPDATE namespaces SET owner_id = $1
+			WHERE owner_id IS NULL AND name <> $2 AND name <> $3 AND name IN (`
+		for i, name := range names {
+			if i > 0 {
+				query += ","
+			}
+			query += fmt.Sprintf("$%d", i+4)
+			args = append(args, name)
+		}
+		query += ") RETURNING name"
+	}
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	reassigned := make([]string, 0)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		reassigned = append(reassigned, name)
+	}
+	return reassigned, rows.Err()
+}
@@ -0,0 +1,668 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	oidcStateTTL     = 10 * time.Minute
+	oidcJWKSRefresh  = time.Hour
+	oidcClockSkew    = 2 * time.Minute
+	oidcDefaultScope = "openid profile email"
+)
+
+// oidcConfig is read from the environment. SSO is enabled when an issuer and
+// client ID are set.
+type oidcConfig struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Scopes       string
+	GroupsClaim  string
+	AdminGroup   string
+	DisplayName  string
+}
+
+func loadOIDCConfig() oidcConfig {
+	cfg := oidcConfig{
+		Issuer:       strings.TrimSuffix(strings.TrimSpace(os.Getenv("OIDC_ISSUER")), "/"),
+		ClientID:     strings.TrimSpace(os.Getenv("OIDC_CLIENT_ID")),
+		ClientSecret: os.Getenv("OIDC_CLIENT_SECRET"),
+		RedirectURL:  strings.TrimSpace(os.Getenv("OIDC_REDIRECT_URL")),
+		Scopes:       strings.TrimSpace(os.Getenv("OIDC_SCOPES")),
+		GroupsClaim:  strings.TrimSpace(os.Getenv("OIDC_GROUPS_CLAIM")),
+		AdminGroup:   strings.TrimSpace(os.Getenv("OIDC_ADMIN_GROUP")),
+		DisplayName:  strings.TrimSpace(os.Getenv("OIDC_DISPLAY_NAME")),
+	}
+	if cfg.Scopes == "" {
+		cfg.Scopes = oidcDefaultScope
+	}
+	if cfg.GroupsClaim == "" {
+		cfg.GroupsClaim = "groups"
+	}
+	if cfg.DisplayName == "" {
+		cfg.DisplayName = "SSO"
+	}
+	return cfg
+}
+
+func (c oidcConfig) enabled() bool {
+	return c.Issuer != "" && c.ClientID != ""
+}
+
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+type jsonWebKey struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Alg string `json:"alg,omitempty"`
+	Use string `json:"use,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+// oidcProvider talks to the identity provider. Discovery and keys are
+// fetched lazily so SFS starts even while the IdP is unreachable.
+type oidcProvider struct {
+	cfg    oidcConfig
+	client *http.Client
+
+	mu        sync.Mutex
+	discovery *oidcDiscovery
+	keys      map[string]crypto.PublicKey
+	keysAt    time.Time
+}
+
+func newOIDCProvider(cfg oidcConfig) *oidcProvider {
+	return &oidcProvider{cfg: cfg, client: &http.Client{Timeout: 15 * time.Second}}
+}
+
+func (p *oidcProvider) getJSON(ctx context.Context, target string, out any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", target, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(out)
+}
+
+func (p *oidcProvider) metadata(ctx context.Context) (*oidcDiscovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+	var doc oidcDiscovery
+	if err := p.getJSON(ctx, p.cfg.Issuer+"/.well-known/openid-configuration", &doc); err != nil {
+		return nil, fmt.Errorf("oidc discovery: %w", err)
+	}
+	if strings.TrimSuffix(doc.Issuer, "/") != p.cfg.Issuer {
+		return nil, fmt.Errorf("oidc discovery: issuer mismatch %q", doc.Issuer)
+	}
+	if doc.AuthorizationEndpoint == "" || doc.TokenEndpoint == "" || doc.JWKSURI == "" {
+		return nil, fmt.Errorf("oidc discovery: incomplete provider metadata")
+	}
+	p.discovery = &doc
+	return p.discovery, nil
+}
+
+// key returns the signing key for kid, refetching the JWKS when the key is
+// unknown (the IdP rotated) or the cache is stale.
+func (p *oidcProvider) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	doc, err := p.metadata(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if key, ok := p.keys[kid]; ok && time.Since(p.keysAt) < oidcJWKSRefresh {
+		return key, nil
+	}
+
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := p.getJSON(ctx, doc.JWKSURI, &set); err != nil {
+		return nil, fmt.Errorf("oidc jwks: %w", err)
+	}
+	keys := make(map[string]crypto.PublicKey, len(set.Keys))
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.publicKey()
+		if err != nil {
+			log.Printf("oidc: skipping jwk kid=%s: %v", jwk.Kid, err)
+			continue
+		}
+		keys[jwk.Kid] = key
+	}
+	p.keys = keys
+	p.keysAt = time.Now()
+
+	key, ok := p.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("oidc: unknown signing key %q", kid)
+	}
+	return key, nil
+}
+
+func (k jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	decode := base64.RawURLEncoding.DecodeString
+	switch k.Kty {
+	case "RSA":
+		n, err := decode(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, fmt.Errorf("unsupported curve %s", k.Crv)
+		}
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %s", k.Kty)
+	}
+}
+
+// oidcClaims holds the ID token claims SFS uses. Groups are kept raw since
+// IdPs send either a list or a single string.
+type oidcClaims struct {
+	Issuer            string          `json:"iss"`
+	Subject           string          `json:"sub"`
+	Audience          json.RawMessage `json:"aud"`
+	Expiry            int64           `json:"exp"`
+	IssuedAt          int64           `json:"iat"`
+	Nonce             string          `json:"nonce"`
+	Email             string          `json:"email"`
+	EmailVerified     bool            `json:"email_verified"`
+	Name              string          `json:"name"`
+	PreferredUsername string          `json:"preferred_username"`
+	raw               map[string]json.RawMessage
+}
+
+func (c oidcClaims) audiences() []string {
+	var single string
+	if json.Unmarshal(c.Audience, &single) == nil {
+		return []string{single}
+	}
+	var list []string
+	_ = json.Unmarshal(c.Audience, &list)
+	return list
+}
+
+func (c oidcClaims) groups(claim string) []string {
+	raw, ok := c.raw[claim]
+	if !ok {
+		return nil
+	}
+	var list []string
+	if json.Unmarshal(raw, &list) == nil {
+		return list
+	}
+	var single string
+	if json.Unmarshal(raw, &single) == nil {
+		return strings.Fields(strings.ReplaceAll(single, ",", " "))
+	}
+	return nil
+}
+
+// verifyIDToken checks the signature (RS256 or ES256), issuer, audience,
+// expiry and nonce of an ID token.
+func (p *oidcProvider) verifyIDToken(ctx context.Context, token, nonce string) (*oidcClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed id token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("id token header: %w", err)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("id token signature: %w", err)
+	}
+	key, err := p.key(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	switch pub := key.(type) {
+	case *rsa.PublicKey:
+		if header.Alg != "RS256" {
+			return nil, fmt.Errorf("unexpected alg %s for RSA key", header.Alg)
+		}
+		if err := rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], signature); err != nil {
+			return nil, errors.New("invalid id token signature")
+		}
+	case *ecdsa.PublicKey:
+		if header.Alg != "ES256" || len(signature) != 64 {
+			return nil, fmt.Errorf("unexpected alg %s for EC key", header.Alg)
+		}
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		if !ecdsa.Verify(pub, digest[:], r, s) {
+			return nil, errors.New("invalid id token signature")
+		}
+	default:
+		return nil, errors.New("unsupported signing key")
+	}
+
+	var claims oidcClaims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("id token claims: %w", err)
+	}
+	if err := decodeSegment(parts[1], &claims.raw); err != nil {
+		return nil, fmt.Errorf("id token claims: %w", err)
+	}
+
+	now := time.Now()
+	if strings.TrimSuffix(claims.Issuer, "/") != p.cfg.Issuer {
+		return nil, fmt.Errorf("unexpected issuer %q", claims.Issuer)
+	}
+	audienceOK := false
+	for _, aud := range claims.audiences() {
+		if aud == p.cfg.ClientID {
+			audienceOK = true
+		}
+	}
+	if !audienceOK {
+		return nil, errors.New("id token not issued for this client")
+	}
+	if claims.Expiry == 0 || now.Add(-oidcClockSkew).Unix() > claims.Expiry {
+		return nil, errors.New("id token expired")
+	}
+	if claims.IssuedAt > now.Add(oidcClockSkew).Unix() {
+		return nil, errors.New("id token issued in the future")
+	}
+	if claims.Nonce != nonce {
+		return nil, errors.New("id token nonce mismatch")
+	}
+	if claims.Subject == "" {
+		return nil, errors.New("id token missing subject")
+	}
+	return &claims, nil
+}
+
+func decodeSegment(segment string, out any) error {
+	raw, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(raw, out)
+}
+
+// exchangeCode redeems an authorization code, proving possession of the PKCE
+// verifier, and returns the raw ID token.
+func (p *oidcProvider) exchangeCode(ctx context.Context, code, verifier string) (string, error) {
+	doc, err := p.metadata(ctx)
+	if err != nil {
+		return "", err
+	}
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.cfg.RedirectURL)
+	form.Set("client_id", p.cfg.ClientID)
+	form.Set("code_verifier", verifier)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, doc.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.cfg.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.cfg.ClientID), url.QueryEscape(p.cfg.ClientSecret))
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("token request: %w", err)
+	}
+	defer resp.Body.Close()
+	var body struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&body); err != nil {
+		return "", fmt.Errorf("token response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK || body.Error != "" {
+		return "", fmt.Errorf("token request failed: %s %s", body.Error, body.ErrorDescription)
+	}
+	if body.IDToken == "" {
+		return "", errors.New("token response missing id_token")
+	}
+	return body.IDToken, nil
+}
+
+// pkceChallenge derives the S256 code challenge for a verifier.
+func pkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// safeRedirect keeps post-login redirects on our own sites: relative paths,
+// the API host itself, or hosts sharing the session cookie domain.
+func safeRedirect(r *http.Request, raw string) string {
+	if raw == "" {
+		return "/"
+	}
+	target, err := url.Parse(raw)
+	if err != nil {
+		return "/"
+	}
+	if target.Host == "" {
+		if !strings.HasPrefix(raw, "/") || strings.HasPrefix(raw, "//") {
+			return "/"
+		}
+		return raw
+	}
+	if target.Scheme != "https" && target.Scheme != "http" {
+		return "/"
+	}
+	host := target.Hostname()
+	if host == r.Host || host == strings.Split(r.Host, ":")[0] {
+		return raw
+	}
+	if domain := getCookieDomain(r); domain != "" && strings.HasSuffix(host, domain) {
+		return raw
+	}
+	return "/"
+}
+
+// handleOIDCConfig tells the login page whether SSO is offered.
+func (s *server) handleOIDCConfig(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, map[string]any{
+		"enabled": s.oidc != nil,
+		"name":    s.oidcName(),
+	})
+}
+
+func (s *server) oidcName() string {
+	if s.oidc == nil {
+		return ""
+	}
+	return s.oidc.cfg.DisplayName
+}
+
+// handleOIDCLogin starts the authorization-code flow: GET /api/oidc/login.
+func (s *server) handleOIDCLogin(w http.ResponseWriter, r *http.Request) {
+	if s.oidc == nil {
+		http.Error(w, "single sign-on is not configured", http.StatusNotFound)
+		return
+	}
+	doc, err := s.oidc.metadata(r.Context())
+	if err != nil {
+		log.Printf("oidc login failed: %v", err)
+		http.Error(w, "identity provider unavailable", http.StatusBadGateway)
+		return
+	}
+
+	state, err := generateToken(24)
+	if err != nil {
+		http.Error(w, "failed to start login", http.StatusInternalServerError)
+		return
+	}
+	nonce, err := generateToken(24)
+	if err != nil {
+		http.Error(w, "failed to start login", http.StatusInternalServerError)
+		return
+	}
+	verifier, err := generateToken(48)
+	if err != nil {
+		http.Error(w, "failed to start login", http.StatusInternalServerError)
+		return
+	}
+
+	now := time.Now()
+	_, _ = s.db.Exec(`DELETE FROM oidc_states WHERE expires_at < $1`, now.Unix())
+	if _, err := s.db.Exec(
+		`INSERT INTO oidc_states (state, nonce, verifier, redirect, expires_at) VALUES ($1, $2, $3, $4, $5)`,
+		state,
+		nonce,
+		verifier,
+		safeRedirect(r, r.URL.Query().Get("redirect")),
+		now.Add(oidcStateTTL).Unix(),
+	); err != nil {
+		http.Error(w, "failed to start login", http.StatusInternalServerError)
+		return
+	}
+
+	query := url.Values{}
+	query.Set("response_type", "code")
+	query.Set("client_id", s.oidc.cfg.ClientID)
+	query.Set("redirect_uri", s.oidc.cfg.RedirectURL)
+	query.Set("scope", s.oidc.cfg.Scopes)
+	query.Set("state", state)
+	query.Set("nonce", nonce)
+	query.Set("code_challenge", pkceChallenge(verifier))
+	query.Set("code_challenge_method", "S256")
+
+	target := doc.AuthorizationEndpoint
+	if strings.Contains(target, "?") {
+		target += "&" + query.Encode()
+	} else {
+		target += "?" + query.Encode()
+	}
+	http.Redirect(w, r, target, http.StatusFound)
+}
+
+// handleOIDCCallback finishes the flow: GET /api/oidc/callback. On success the
+// user gets the regular sfs_session cookie.
+func (s *server) handleOIDCCallback(w http.ResponseWriter, r *http.Request) {
+	if s.oidc == nil {
+		http.Error(w, "single sign-on is not configured", http.StatusNotFound)
+		return
+	}
+	query := r.URL.Query()
+	if errCode := query.Get("error"); errCode != "" {
+		serveErrorPage(w, r, http.StatusUnauthorized, "Sign-in Failed",
+			fmt.Sprintf("The identity provider returned an error: %s", errCode))
+		return
+	}
+
+	var nonce, verifier, redirect string
+	var expiresAt int64
+	err := s.db.QueryRow(
+		`DELETE FROM oidc_states WHERE state = $1 RETURNING nonce, verifier, redirect, expires_at`,
+		query.Get("state"),
+	).Scan(&nonce, &verifier, &redirect, &expiresAt)
+	if err != nil || time.Now().Unix() > expiresAt {
+		serveErrorPage(w, r, http.StatusBadRequest, "Sign-in Expired", "The sign-in request expired or was already used. Please try again.")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+	defer cancel()
+
+	rawToken, err := s.oidc.exchangeCode(ctx, query.Get("code"), verifier)
+	if err != nil {
+		log.Printf("oidc token exchange failed: %v", err)
+		serveErrorPage(w, r, http.StatusBadGateway, "Sign-in Failed", "Could not complete sign-in with the identity provider.")
+		return
+	}
+	claims, err := s.oidc.verifyIDToken(ctx, rawToken, nonce)
+	if err != nil {
+		log.Printf("oidc id token rejected: %v", err)
+		serveErrorPage(w, r, http.StatusUnauthorized, "Sign-in Failed", "The identity provider's response could not be verified.")
+		return
+	}
+
+	userID, username, err := s.provisionOIDCUser(claims)
+	if err != nil {
+		log.Printf("oidc provisioning failed sub=%s: %v", claims.Subject, err)
+		serveErrorPage(w, r, http.StatusForbidden, "Sign-in Failed", "Your account could not be set up.")
+		return
+	}
+	if err := s.startSession(w, r, userID); err != nil {
+		http.Error(w, "failed to create session", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("oidc login ok user=%s sub=%s", username, claims.Subject)
+	http.Redirect(w, r, redirect, http.StatusFound)
+}
+
+// provisionOIDCUser finds the user for an identity by subject, links an
+// existing account by verified email, or creates a new passwordless account.
+// When an admin group is configured, the admin role follows it on every login;
+// an admin role granted by hand is never revoked here.
+func (s *server) provisionOIDCUser(claims *oidcClaims) (int64, string, error) {
+	admin := false
+	if group := s.oidc.cfg.AdminGroup; group != "" {
+		for _, g := range claims.groups(s.oidc.cfg.GroupsClaim) {
+			if g == group {
+				admin = true
+			}
+		}
+	}
+	displayName := strings.TrimSpace(claims.Name)
+
+	var userID int64
+	var username string
+	err := s.db.QueryRow(`SELECT id, username FROM users WHERE oidc_subject = $1`, claims.Subject).Scan(&userID, &username)
+	if err == sql.ErrNoRows && claims.Email != "" && claims.EmailVerified {
+		err = s.db.QueryRow(
+			`UPDATE users SET oidc_subject = $1
+			 WHERE id = (SELECT id FROM users WHERE lower(email) = lower($2) AND oidc_subject IS NULL LIMIT 1)
+			 RETURNING id, username`,
+			claims.Subject,
+			claims.Email,
+		).Scan(&userID, &username)
+		if err == nil {
+			s.recordAudit("", username, "oidc.link", fmt.Sprintf("linked to %s", claims.Subject))
+		}
+	}
+	if err == sql.ErrNoRows {
+		userID, username, err = s.createOIDCUser(claims, displayName)
+	}
+	if err != nil {
+		return 0, "", err
+	}
+	var disabled int
+	if err := s.db.QueryRow(`SELECT disabled FROM users WHERE id = $1`, userID).Scan(&disabled); err != nil {
+		return 0, "", err
+	}
+	if disabled != 0 {
+		return 0, "", fmt.Errorf("account %s is disabled", username)
+	}
+
+	if _, err := s.db.Exec(
+		`UPDATE users SET email = CASE WHEN $1 <> '' THEN $1 ELSE email END,
+		   display_name = CASE WHEN $2 <> '' THEN $2 ELSE display_name END
+		 WHERE id = $3`,
+		claims.Email,
+		displayName,
+		userID,
+	); err != nil {
+		return 0, "", err
+	}
+	if s.oidc.cfg.AdminGroup != "" {
+		query := `DELETE FROM user_roles WHERE user_id = $1 AND role = $2 AND source = 'oidc'`
+		if admin {
+			query = `INSERT INTO user_roles (user_id, role, source) VALUES ($1, $2, 'oidc') ON CONFLICT DO NOTHING`
+		}
+		if _, err := s.db.Exec(query, userID, roleAdmin); err != nil {
+			return 0, "", err
+		}
+	}
+	return userID, username, nil
+}
+
+func (s *server) createOIDCUser(claims *oidcClaims, displayName string) (int64, string, error) {
+	base := claims.PreferredUsername
+	if base == "" {
+		base, _, _ = strings.Cut(claims.Email, "@")
+	}
+	base = strings.ToLower(strings.TrimSpace(base))
+	if base == "" {
+		base = "user"
+	}
+	if displayName == "" {
+		displayName = base
+	}
+
+	// Pick the first free username; an empty password hash never matches, so
+	// these accounts can only sign in through the IdP.
+	for i := 0; i < 100; i++ {
+		candidate := base
+		if i > 0 {
+			candidate = fmt.Sprintf("%s%d", base, i+1)
+		}
+		var id int64
+		err := s.db.QueryRow(
+			`INSERT INTO users (username, password_hash, display_name, email, oidc_subject)
+			 VALUES ($1, '', $2, $3, $4)
+			 ON CONFLICT (username) DO NOTHING
+			 RETURNING id`,
+			candidate,
+			displayName,
+			claims.Email,
+			claims.Subject,
+		).Scan(&id)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			return 0, "", err
+		}
+		s.recordAudit("", candidate, "oidc.provision", fmt.Sprintf("created for %s", claims.Subject))
+		return id, candidate, nil
+	}
+	return 0, "", fmt.Errorf("no free username for %q", base)
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"database/sql/driver"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"eddisonso.com/edd-cloud/services/sfs/internal/mockoidc"
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+const testRedirectURL = "https://cloud.example.com/api/oidc/callback"
+
+// capture is a sqlmock argument matcher that records the value it sees.
+type capture struct{ value *string }
+
+func (c capture) Match(v driver.Value) bool {
+	s, ok := v.(string)
+	*c.value = s
+	return ok
+}
+
+func sqlText(query string) string {
+	return regexp.QuoteMeta(query)
+}
+
+// newOIDCTest starts a mock IdP and a server wired to it, with a mocked
+// database whose expectations must be met in order.
+func newOIDCTest(t *testing.T) (*server, *mockoidc.Provider, sqlmock.Sqlmock) {
+	t.Helper()
+	idp, err := mockoidc.New("", "sfs", map[string]any{
+		"sub":                "idp-user-1",
+		"email":              "ada@example.com",
+		"email_verified":     true,
+		"name":               "Ada Lovelace",
+		"preferred_username": "ada",
+		"groups":             []string{"admins"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	idpServer := httptest.NewServer(idp.Handler())
+	t.Cleanup(idpServer.Close)
+	idp.Issuer = idpServer.URL
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &server{
+		db:         db,
+		cookieName: "sfs_session",
+		sessionTTL: time.Hour,
+		tokens: &tokenSigner{
+			ttl:  time.Minute,
+			keys: []signingKey{{ID: "test", Private: private, CreatedAt: time.Now()}},
+		},
+		oidc: newOIDCProvider(oidcConfig{
+			Issuer:      idpServer.URL,
+			ClientID:    "sfs",
+			RedirectURL: testRedirectURL,
+			Scopes:      oidcDefaultScope,
+			GroupsClaim: "groups",
+			AdminGroup:  "admins",
+		}),
+	}
+	return s, idp, mock
+}
+
+type oidcLogin struct {
+	state, nonce, verifier string
+	callback               *url.URL
+}
+
+// startOIDCLogin runs GET /api/oidc/login and follows the redirect through
+// the IdP's authorization endpoint back to the callback URL.
+func startOIDCLogin(t *testing.T, s *server, mock sqlmock.Sqlmock) oidcLogin {
+	t.Helper()
+	var login oidcLogin
+	var redirect string
+	mock.ExpectExec(sqlText(`DELETE FROM oidc_states WHERE expires_at < $1`)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(sqlText(`INSERT INTO oidc_states`)).
+		WithArgs(capture{&login.state}, capture{&login.nonce}, capture{&login.verifier}, capture{&redirect}, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	rec := httptest.NewRecorder()
+	s.handleOIDCLogin(rec, httptest.NewRequest("GET", "/api/oidc/login?redirect=/files", nil))
+	if rec.Code != http.StatusFound {
+		t.Fatalf("login status %d: %s", rec.Code, rec.Body)
+	}
+	if redirect != "/files" {
+		t.Fatalf("stored redirect %q", redirect)
+	}
+
+	authorize, err := url.Parse(rec.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := authorize.Query()
+	if q.Get("code_challenge_method") != "S256" || q.Get("code_challenge") != pkceChallenge(login.verifier) {
+		t.Fatalf("authorization request does not carry the PKCE challenge: %s", authorize)
+	}
+	if q.Get("state") != login.state || q.Get("nonce") != login.nonce || q.Get("redirect_uri") != testRedirectURL {
+		t.Fatalf("authorization request %s does not match stored state", authorize)
+	}
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := client.Get(authorize.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if login.callback, err = resp.Location(); err != nil {
+		t.Fatalf("IdP did not redirect back: %d %v", resp.StatusCode, err)
+	}
+	if !strings.HasPrefix(login.callback.String(), testRedirectURL) || login.callback.Query().Get("state") != login.state {
+		t.Fatalf("IdP redirected to %s", login.callback)
+	}
+	return login
+}
+
+// expectState makes the callback's state lookup return the given values.
+func expectState(mock sqlmock.Sqlmock, state, nonce, verifier string) {
+	mock.ExpectQuery(sqlText(`DELETE FROM oidc_states WHERE state = $1 RETURNING`)).
+		WithArgs(state).
+		WillReturnRows(sqlmock.NewRows([]string{"nonce", "verifier", "redirect", "expires_at"}).
+			AddRow(nonce, verifier, "/files", time.Now().Add(time.Minute).Unix()))
+}
+
+// expectSession covers startSession and the access token it issues.
+func expectSession(mock sqlmock.Sqlmock, userID int64, username string, roles ...string) {
+	mock.ExpectExec(sqlText(`INSERT INTO sessions`)).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectQuery(sqlText(`SELECT username FROM users WHERE id = $1`)).
+		WithArgs(userID).
+		WillReturnRows(sqlmock.NewRows([]string{"username"}).AddRow(username))
+	rows := sqlmock.NewRows([]string{"role"})
+	for _, role := range roles {
+		rows.AddRow(role)
+	}
+	mock.ExpectQuery(sqlText(`SELECT role FROM user_roles`)).WithArgs(userID).WillReturnRows(rows)
+}
+
+func callback(s *server, login oidcLogin) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	s.handleOIDCCallback(rec, httptest.NewRequest("GET", "/api/oidc/callback?"+login.callback.RawQuery, nil))
+	return rec
+}
+
+func TestOIDCLoginLinksVerifiedEmail(t *testing.T) {
+	s, _, mock := newOIDCTest(t)
+	login := startOIDCLogin(t, s, mock)
+
+	expectState(mock, login.state, login.nonce, login.verifier)
+	mock.ExpectQuery(sqlText(`SELECT id, username FROM users WHERE oidc_subject = $1`)).
+		WithArgs("idp-user-1").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "username"}))
+	mock.ExpectQuery(sqlText(`UPDATE users SET oidc_subject = $1`)).
+		WithArgs("idp-user-1", "ada@example.com").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "username"}).AddRow(7, "ada"))
+	mock.ExpectExec(sqlText(`INSERT INTO audit_events`)).
+		WithArgs("", "ada", "oidc.link", sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectQuery(sqlText(`SELECT disabled FROM users WHERE id = $1`)).
+		WithArgs(7).
+		WillReturnRows(sqlmock.NewRows([]string{"disabled"}).AddRow(0))
+	mock.ExpectExec(sqlText(`UPDATE users SET email`)).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(sqlText(`INSERT INTO user_roles (user_id, role, source) VALUES ($1, $2, 'oidc')`)).
+		WithArgs(7, roleAdmin).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	expectSession(mock, 7, "ada", roleAdmin)
+
+	rec := callback(s, login)
+	if rec.Code != http.StatusFound || rec.Header().Get("Location") != "/files" {
+		t.Fatalf("callback status %d location %q: %s", rec.Code, rec.Header().Get("Location"), rec.Body)
+	}
+	if !strings.Contains(strings.Join(rec.Header().Values("Set-Cookie"), "\n"), "sfs_session=") {
+		t.Fatalf("no session cookie set")
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// An unverified email must not take over the account that owns it, and
+// losing the admin group revokes only the role SSO granted.
+func TestOIDCLoginUnverifiedEmailCreatesUser(t *testing.T) {
+	s, idp, mock := newOIDCTest(t)
+	idp.SetClaim("email_verified", false)
+	idp.SetClaim("groups", []string{})
+	login := startOIDCLogin(t, s, mock)
+
+	expectState(mock, login.state, login.nonce, login.verifier)
+	mock.ExpectQuery(sqlText(`SELECT id, username FROM users WHERE oidc_subject = $1`)).
+		WithArgs("idp-user-1").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "username"}))
+	mock.ExpectQuery(sqlText(`INSERT INTO users (username, password_hash, display_name, email, oidc_subject)`)).
+		WithArgs("ada", "Ada Lovelace", "ada@example.com", "idp-user-1").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}))
+	mock.ExpectQuery(sqlText(`INSERT INTO users (username, password_hash, display_name, email, oidc_subject)`)).
+		WithArgs("ada2", "Ada Lovelace", "ada@example.com", "idp-user-1").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(9))
+	mock.ExpectExec(sqlText(`INSERT INTO audit_events`)).
+		WithArgs("", "ada2", "oidc.provision", sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectQuery(sqlText(`SELECT disabled FROM users WHERE id = $1`)).
+		WithArgs(9).
+		WillReturnRows(sqlmock.NewRows([]string{"disabled"}).AddRow(0))
+	mock.ExpectExec(sqlText(`UPDATE users SET email`)).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(sqlText(`DELETE FROM user_roles WHERE user_id = $1 AND role = $2 AND source = 'oidc'`)).
+		WithArgs(9, roleAdmin).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	expectSession(mock, 9, "ada2")
+
+	if rec := callback(s, login); rec.Code != http.StatusFound {
+		t.Fatalf("callback status %d: %s", rec.Code, rec.Body)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOIDCCallbackRejects(t *testing.T) {
+	tests := []struct {
+		name string
+		// state returns the stored nonce and verifier for the login, or
+		// false when the state is unknown.
+		state func(oidcLogin) (nonce, verifier string, ok bool)
+		want  int
+	}{
+		{"unknown or replayed state", func(l oidcLogin) (string, string, bool) { return "", "", false }, http.StatusBadRequest},
+		{"wrong PKCE verifier", func(l oidcLogin) (string, string, bool) { return l.nonce, l.verifier + "x", true }, http.StatusBadGateway},
+		{"nonce mismatch", func(l oidcLogin) (string, string, bool) { return l.nonce + "x", l.verifier, true }, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, _, mock := newOIDCTest(t)
+			login := startOIDCLogin(t, s, mock)
+			nonce, verifier, ok := tt.state(login)
+			if ok {
+				expectState(mock, login.state, nonce, verifier)
+			} else {
+				mock.ExpectQuery(sqlText(`DELETE FROM oidc_states WHERE state = $1 RETURNING`)).
+					WithArgs(login.state).
+					WillReturnRows(sqlmock.NewRows([]string{"nonce", "verifier", "redirect", "expires_at"}))
+			}
+
+			rec := callback(s, login)
+			if rec.Code != tt.want {
+				t.Fatalf("callback status %d, want %d", rec.Code, tt.want)
+			}
+			if len(rec.Header().Values("Set-Cookie")) != 0 {
+				t.Fatalf("rejected callback set cookies")
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestVerifyIDToken(t *testing.T) {
+	s, idp, _ := newOIDCTest(t)
+	now := time.Now()
+	valid := func() map[string]any {
+		return map[string]any{
+			"iss":   idp.Issuer,
+			"aud":   "sfs",
+			"sub":   "idp-user-1",
+			"iat":   now.Unix(),
+			"exp":   now.Add(time.Minute).Unix(),
+			"nonce": "n-1",
+		}
+	}
+	tests := []struct {
+		name   string
+		change func(map[string]any)
+		ok     bool
+	}{
+		{"valid", func(map[string]any) {}, true},
+		{"audience list", func(c map[string]any) { c["aud"] = []string{"other", "sfs"} }, true},
+		{"wrong audience", func(c map[string]any) { c["aud"] = "other" }, false},
+		{"wrong issuer", func(c map[string]any) { c["iss"] = "https://evil.example.com" }, false},
+		{"expired", func(c map[string]any) { c["exp"] = now.Add(-time.Hour).Unix() }, false},
+		{"issued in the future", func(c map[string]any) { c["iat"] = now.Add(time.Hour).Unix() }, false},
+		{"wrong nonce", func(c map[string]any) { c["nonce"] = "n-2" }, false},
+		{"no subject", func(c map[string]any) { delete(c, "sub") }, false},
+	}
+	for _, tt := range tests {
+		claims := valid()
+		tt.change(claims)
+		token, err := idp.Sign(claims)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = s.oidc.verifyIDToken(t.Context(), token, "n-1")
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: verifyIDToken error = %v", tt.name, err)
+		}
+	}
+
+	token, err := idp.Sign(valid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims := valid()
+	claims["sub"] = "someone-else"
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.Split(token, ".")
+	forged := parts[0] + "." + base64.RawURLEncoding.EncodeToString(payload) + "." + parts[2]
+	if _, err := s.oidc.verifyIDToken(t.Context(), forged, "n-1"); err == nil {
+		t.Errorf("token with altered claims verified")
+	}
+}
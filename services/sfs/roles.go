@@ -0,0 +1,231 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Roles grant access to admin endpoints. admin implies every other role;
+// auditor is read-only.
+const (
+	roleAdmin        = "admin"
+	roleStorageAdmin = "storage-admin"
+	roleComputeAdmin = "compute-admin"
+	roleAuditor      = "auditor"
+)
+
+var knownRoles = []string{roleAdmin, roleStorageAdmin, roleComputeAdmin, roleAuditor}
+
+func validRole(role string) bool {
+	for _, known := range knownRoles {
+		if role == known {
+			return true
+		}
+	}
+	return false
+}
+
+// seedAdminRole grants admin to the ADMIN_USERNAME account, which is only
+// used to bootstrap the first admin; further roles are managed via the API.
+func seedAdminRole(db *sql.DB, username string) error {
+	if username == "" {
+		return nil
+	}
+	_, err := db.Exec(
+		`INSERT INTO user_roles (user_id, role)
+		 SELECT id, $2 FROM users WHERE username = $1
+		 ON CONFLICT DO NOTHING`,
+		username,
+		roleAdmin,
+	)
+	return err
+}
+
+func (s *server) userRoles(userID int64) ([]string, error) {
+	rows, err := s.db.Query(`SELECT role FROM user_roles WHERE user_id = $1 ORDER BY role`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	roles := make([]string, 0)
+	for rows.Next() {
+		var role string
+		if err := rows.Scan(&role); err != nil {
+			return nil, err
+		}
+		roles = append(roles, role)
+	}
+	return roles, rows.Err()
+}
+
+// hasRole reports whether the user holds admin or any of the given roles.
+func (s *server) hasRole(username string, roles ...string) bool {
+	var count int
+	err := s.db.QueryRow(
+		`SELECT COUNT(1) FROM user_roles
+		 JOIN users ON user_roles.user_id = users.id
+		 WHERE users.username = $1 AND (user_roles.role = $2 OR user_roles.role = ANY(string_to_array($3, ',')))`,
+		username,
+		roleAdmin,
+		strings.Join(roles, ","),
+	).Scan(&count)
+	return err == nil && count > 0
+}
+
+// requireRole checks that the caller holds one of the roles (admin always
+// passes) and writes 401 or 403 otherwise.
+func (s *server) requireRole(w http.ResponseWriter, r *http.Request, roles ...string) (string, bool) {
+	username, ok := s.currentUser(r)
+	if !ok || !s.hasRole(username, roles...) {
+		s.denyAccess(w, r)
+		return "", false
+	}
+	return username, true
+}
+
+// denyAccess refuses a request: 401 when the caller is signed out, so
+// clients know to log in, and 403 when they are signed in but not allowed.
+func (s *server) denyAccess(w http.ResponseWriter, r *http.Request) {
+	if s.session(r) == nil {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	http.Error(w, "forbidden", http.StatusForbidden)
+}
+
+// readableBy adds auditor to the roles allowed on read-only requests.
+func readableBy(r *http.Request, roles ...string) []string {
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		return append(roles, roleAuditor)
+	}
+	return roles
+}
+
+// sessionFor builds the session payload shared by login and /api/session.
+func (s *server) sessionFor(userID int64, username, displayName string) sessionResponse {
+	roles, err := s.userRoles(userID)
+	if err != nil {
+		roles = []string{}
+	}
+	isAdmin := false
+	for _, role := range roles {
+		if role == roleAdmin {
+			isAdmin = true
+		}
+	}
+	return sessionResponse{
+		UserID:      userID,
+		Username:    username,
+		DisplayName: displayName,
+		IsAdmin:     isAdmin,
+		Roles:       roles,
+	}
+}
+
+type userRolesRequest struct {
+	Roles []string `json:"roles"`
+}
+
+// handleAdminUserRoles reads (GET) or replaces (PUT) a user's roles:
+// /admin/users/roles?id=. Admins cannot drop their own admin role, so the
+// last admin cannot lock everyone out by accident.
+func (s *server) handleAdminUserRoles(w http.ResponseWriter, r *http.Request) {
+	username, ok := s.requireRole(w, r)
+	if !ok {
+		return
+	}
+
+	id, err := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid id", http.StatusBadRequest)
+		return
+	}
+	var target string
+	if err := s.db.QueryRow(`SELECT username FROM users WHERE id = $1`, id).Scan(&target); err != nil {
+		http.Error(w, "user not found", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var payload userRolesRequest
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			http.Error(w, "invalid payload", http.StatusBadRequest)
+			return
+		}
+		roles := make(map[string]bool)
+		for _, role := range payload.Roles {
+			role = strings.TrimSpace(role)
+			if !validRole(role) {
+				http.Error(w, fmt.Sprintf("unknown role: %s", role), http.StatusBadRequest)
+				return
+			}
+			roles[role] = true
+		}
+		if target == username && !roles[roleAdmin] {
+			http.Error(w, "cannot remove your own admin role", http.StatusBadRequest)
+			return
+		}
+		if err := s.setUserRoles(id, roles); err != nil {
+			http.Error(w, "failed to update roles", http.StatusInternalServerError)
+			return
+		}
+		s.recordAudit("", username, "user.roles", fmt.Sprintf("%s: %s", target, strings.Join(payload.Roles, ",")))
+	default:
+		w.Header().Set("Allow", "GET, PUT")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	roles, err := s.userRoles(id)
+	if err != nil {
+		http.Error(w, "failed to load roles", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, map[string]any{"id": id, "username": target, "roles": roles})
+}
+
+// setUserRoles replaces a user's roles. Roles the user already holds keep
+// their grant source, so ones that came from SSO can still be revoked by it.
+func (s *server) setUserRoles(userID int64, roles map[string]bool) error {
+	names := make([]string, 0, len(roles))
+	for role := range roles {
+		names = append(names, role)
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(
+		`DELETE FROM user_roles WHERE user_id = $1 AND role <> ALL(string_to_array($2, ','))`,
+		userID,
+		strings.Join(names, ","),
+	); err != nil {
+		return err
+	}
+	for _, role := range names {
+		if _, err := tx.Exec(
+			`INSERT INTO user_roles (user_id, role) VALUES ($1, $2) ON CONFLICT DO NOTHING`,
+			userID,
+			role,
+		); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// handleAdminRoles lists the roles that can be assigned: GET /admin/roles.
+func (s *server) handleAdminRoles(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.requireRole(w, r, roleAuditor); !ok {
+		return
+	}
+	writeJSON(w, knownRoles)
+}
@@ -0,0 +1,564 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Uploads can be checked for malware by a scanner that speaks the clamd
+// INSTREAM protocol. writeFile tees the plaintext to the scanner while it is
+// appended to storage, after marking the file pending in file_scans. The
+// verdict arrives once the stream ends and is saved against that write's
+// scan_id only, so an overwrite that raced with the scan keeps its own
+// status. Infected files are moved to the quarantine namespace, which is
+// hidden and has no owner, so only admins can see it.
+//
+// Downloads refuse files that are pending or infected. A scan that fails, or
+// that a restart cut off, leaves the file pending with a retry_at; the
+// sweeper then reads the file back from storage and scans it again. The same
+// sweeper retries quarantine moves that failed.
+
+const (
+	scanPending  = "pending"
+	scanClean    = "clean"
+	scanInfected = "infected"
+
+	// clamdChunkSize is the INSTREAM chunk size; clamd's own default is
+	// 2 KiB, larger chunks just mean fewer length prefixes.
+	clamdChunkSize = 64 << 10
+	// clamdWriteTimeout bounds each write to clamd. Uploads wait on those
+	// writes, so a clamd that stops reading must not hold them up for long.
+	clamdWriteTimeout = 30 * time.Second
+	// maxScanRetryDelay caps the backoff between attempts on a file.
+	maxScanRetryDelay = time.Hour
+)
+
+type scanVerdict struct {
+	Infected  bool
+	Signature string
+}
+
+// fileScanner inspects file contents. Scan reads r until EOF unless it fails
+// first; callers drain whatever is left.
+type fileScanner interface {
+	Scan(ctx context.Context, r io.Reader) (scanVerdict, error)
+}
+
+// clamdScanner streams files to clamd, or anything answering its INSTREAM
+// command.
+type clamdScanner struct {
+	network string
+	addr    string
+	// timeout bounds the wait for a verdict after the stream ends.
+	timeout time.Duration
+	// writeTimeout bounds each write of the stream.
+	writeTimeout time.Duration
+}
+
+// newClamdScanner parses a clamd address: host:port, tcp://host:port or
+// unix:///path/to/clamd.sock.
+func newClamdScanner(raw string, timeout time.Duration) (*clamdScanner, error) {
+	if !strings.Contains(raw, "://") {
+		if _, _, err := net.SplitHostPort(raw); err != nil {
+			return nil, fmt.Errorf("invalid clamd address %q: %w", raw, err)
+		}
+		return &clamdScanner{network: "tcp", addr: raw, timeout: timeout, writeTimeout: clamdWriteTimeout}, nil
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid clamd address %q: %w", raw, err)
+	}
+	switch u.Scheme {
+	case "tcp":
+		if _, _, err := net.SplitHostPort(u.Host); err != nil {
+			return nil, fmt.Errorf("invalid clamd address %q: %w", raw, err)
+		}
+		return &clamdScanner{network: "tcp", addr: u.Host, timeout: timeout, writeTimeout: clamdWriteTimeout}, nil
+	case "unix":
+		if u.Path == "" {
+			return nil, fmt.Errorf("invalid clamd address %q: missing socket path", raw)
+		}
+		return &clamdScanner{network: "unix", addr: u.Path, timeout: timeout, writeTimeout: clamdWriteTimeout}, nil
+	default:
+		return nil, fmt.Errorf("invalid clamd address %q: scheme must be tcp or unix", raw)
+	}
+}
+
+func (c *clamdScanner) String() string {
+	return c.network + "://" + c.addr
+}
+
+func (c *clamdScanner) Scan(ctx context.Context, r io.Reader) (scanVerdict, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, c.network, c.addr)
+	if err != nil {
+		return scanVerdict{}, fmt.Errorf("connect to clamd: %w", err)
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { _ = conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	_ = conn.SetWriteDeadline(time.Now().Add(c.writeTimeout))
+	if _, err := io.WriteString(conn, "zINSTREAM\x00"); err != nil {
+		return scanVerdict{}, fmt.Errorf("send to clamd: %w", err)
+	}
+	buf := make([]byte, 4+clamdChunkSize)
+	for {
+		n, readErr := io.ReadFull(r, buf[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(buf, uint32(n))
+			_ = conn.SetWriteDeadline(time.Now().Add(c.writeTimeout))
+			if _, err := conn.Write(buf[:4+n]); err != nil {
+				// clamd hangs up on streams over its StreamMaxLength, after
+				// saying so. A timeout means it stopped reading instead.
+				var netErr net.Error
+				if errors.As(err, &netErr) && netErr.Timeout() {
+					return scanVerdict{}, fmt.Errorf("send to clamd: %w", err)
+				}
+				_ = conn.SetReadDeadline(time.Now().Add(c.writeTimeout))
+				if reply, replyErr := readClamdReply(conn); replyErr == nil && reply != "" {
+					return parseClamdReply(reply)
+				}
+				return scanVerdict{}, fmt.Errorf("send to clamd: %w", err)
+			}
+		}
+		if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+			break
+		}
+		if readErr != nil {
+			return scanVerdict{}, readErr
+		}
+	}
+	_ = conn.SetWriteDeadline(time.Now().Add(c.writeTimeout))
+	if _, err := conn.Write([]byte{0, 0, 0, 0}); err != nil {
+		return scanVerdict{}, fmt.Errorf("send to clamd: %w", err)
+	}
+	if c.timeout > 0 {
+		_ = conn.SetReadDeadline(time.Now().Add(c.timeout))
+	}
+	reply, err := readClamdReply(conn)
+	if err != nil {
+		return scanVerdict{}, fmt.Errorf("read clamd reply: %w", err)
+	}
+	return parseClamdReply(reply)
+}
+
+// readClamdReply reads one NUL-terminated reply.
+func readClamdReply(conn net.Conn) (string, error) {
+	reply, err := bufio.NewReader(io.LimitReader(conn, 4096)).ReadString(0)
+	if err == io.EOF && reply != "" {
+		err = nil
+	}
+	return strings.TrimRight(reply, "\x00\n"), err
+}
+
+// parseClamdReply turns "stream: OK" or "stream: <signature> FOUND" into a
+// verdict; anything else, such as "INSTREAM size limit exceeded. ERROR", is
+// an error.
+func parseClamdReply(reply string) (scanVerdict, error) {
+	result := strings.TrimPrefix(reply, "stream: ")
+	switch {
+	case result == "OK":
+		return scanVerdict{}, nil
+	case strings.HasSuffix(result, " FOUND"):
+		return scanVerdict{Infected: true, Signature: strings.TrimSuffix(result, " FOUND")}, nil
+	default:
+		return scanVerdict{}, fmt.Errorf("clamd: %s", reply)
+	}
+}
+
+// scanLease is how long a scan may run before the sweeper assumes it was
+// lost: an upload can take uploadTTL, and the verdict scanTimeout after it.
+func (s *server) scanLease() time.Duration {
+	return s.uploadTTL + s.scanTimeout
+}
+
+// pendingScan is a scan running alongside a write. Writes to it go to the
+// scanner; finish ends the stream once the write is done. If the scanner
+// stops taking data, or the write's context ends, the scan is dropped and
+// later writes are discarded, so the upload carries on and the file stays
+// pending for the sweeper.
+type pendingScan struct {
+	s         *server
+	namespace string
+	name      string
+	id        string
+	pw        *io.PipeWriter
+	result    chan scanResult
+	// stop detaches the context watcher that drops the scan.
+	stop    func() bool
+	dropped atomic.Bool
+}
+
+type scanResult struct {
+	verdict scanVerdict
+	err     error
+}
+
+// startScan marks a file pending and starts scanning what is written to the
+// returned pendingScan. It returns nil when scanning is off, and for the
+// quarantine namespace, whose files already have a verdict.
+func (s *server) startScan(ctx context.Context, namespace, name string) (*pendingScan, error) {
+	if s.scanner == nil || namespace == s.quarantineNamespace {
+		return nil, nil
+	}
+	id, err := generateToken(12)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	if _, err := s.db.Exec(
+		`INSERT INTO file_scans (namespace, path, scan_id, status, signature, error, attempts, retry_at, scanned_at, created_at)
+		 VALUES ($1, $2, $3, $4, '', '', 0, $5, 0, $6)
+		 ON CONFLICT (namespace, path) DO UPDATE SET
+		   scan_id = excluded.scan_id,
+		   status = excluded.status,
+		   signature = '',
+		   error = '',
+		   attempts = 0,
+		   retry_at = excluded.retry_at,
+		   scanned_at = 0,
+		   created_at = excluded.created_at`,
+		namespace, name, id, scanPending, now.Add(s.scanLease()).Unix(), now.Unix(),
+	); err != nil {
+		return nil, err
+	}
+	return s.streamScan(ctx, namespace, name, id), nil
+}
+
+// streamScan starts the scanner reading from a new pendingScan.
+func (s *server) streamScan(ctx context.Context, namespace, name, id string) *pendingScan {
+	pr, pw := io.Pipe()
+	p := &pendingScan{s: s, namespace: namespace, name: name, id: id, pw: pw, result: make(chan scanResult, 1)}
+	// A pipe write can't be cancelled, so a write stuck behind a stalled
+	// scanner is released by closing the reader.
+	p.stop = context.AfterFunc(ctx, func() { pr.CloseWithError(ctx.Err()) })
+	// The scan outlives the request: the verdict only comes after the body
+	// has been read. An aborted write ends it through the pipe instead.
+	scanCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), s.scanLease())
+	go func() {
+		defer cancel()
+		verdict, err := s.scanner.Scan(scanCtx, pr)
+		// Don't let a scanner that gave up early hold the upload up.
+		pr.CloseWithError(errScanStopped)
+		p.result <- scanResult{verdict: verdict, err: err}
+	}()
+	return p
+}
+
+var errScanStopped = errors.New("malware scan stopped reading")
+
+// Write passes b to the scanner. It never fails: a scan that can't keep up
+// is dropped rather than failing the upload.
+func (p *pendingScan) Write(b []byte) (int, error) {
+	if p.dropped.Load() {
+		return len(b), nil
+	}
+	if _, err := p.pw.Write(b); err != nil {
+		p.dropped.Store(true)
+		log.Printf("malware scan dropped namespace=%s name=%s err=%v", p.namespace, p.name, err)
+	}
+	return len(b), nil
+}
+
+// finish ends the scan stream. If the write failed the scan is abandoned and
+// the file stays pending; otherwise the verdict is saved when it arrives. A
+// dropped scan reports an error, which leaves the file pending too.
+func (p *pendingScan) finish(writeErr error) {
+	if !p.stop() {
+		// The context ended first and already cut the stream off.
+		p.dropped.Store(true)
+	}
+	if writeErr != nil {
+		p.pw.CloseWithError(writeErr)
+		return
+	}
+	p.pw.Close()
+	go func() {
+		res := <-p.result
+		if p.dropped.Load() && res.err == nil && !res.verdict.Infected {
+			// A clean verdict on part of the file says nothing.
+			res.err = errScanStopped
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), p.s.scanLease())
+		defer cancel()
+		p.s.applyScanResult(ctx, p.namespace, p.name, p.id, res.verdict, res.err)
+	}()
+}
+
+// applyScanResult saves a verdict for one scan of a file, quarantining it if
+// infected. A newer write to the path makes it a no-op.
+func (s *server) applyScanResult(ctx context.Context, namespace, name, id string, verdict scanVerdict, scanErr error) {
+	now := time.Now()
+	if scanErr != nil {
+		scansTotal.WithLabelValues("error").Inc()
+		attempts := s.recordScanFailure(namespace, name, id, scanErr.Error())
+		log.Printf("scan failed namespace=%s name=%s attempt=%d err=%v", namespace, name, attempts, scanErr)
+		return
+	}
+
+	// An infected file keeps a retry_at while it is moved, in case the move
+	// fails or is cut off.
+	status, retryAt := scanClean, int64(0)
+	if verdict.Infected {
+		status, retryAt = scanInfected, now.Add(s.scanLease()).Unix()
+	}
+	result, err := s.db.Exec(
+		`UPDATE file_scans SET status = $4, signature = $5, error = '', scanned_at = $6, retry_at = $7
+		 WHERE namespace = $1 AND path = $2 AND scan_id = $3 AND status = $8`,
+		namespace, name, id, status, verdict.Signature, now.Unix(), retryAt, scanPending,
+	)
+	if err != nil {
+		log.Printf("scan verdict save failed namespace=%s name=%s err=%v", namespace, name, err)
+		return
+	}
+	if updated, _ := result.RowsAffected(); updated == 0 {
+		// Overwritten or deleted while the scan ran.
+		return
+	}
+	scansTotal.WithLabelValues(status).Inc()
+	if !verdict.Infected {
+		return
+	}
+	log.Printf("malware found namespace=%s name=%s signature=%s", namespace, name, verdict.Signature)
+	if err := s.quarantineFile(ctx, namespace, name, id, verdict.Signature); err != nil {
+		s.recordScanFailure(namespace, name, id, "quarantine: "+err.Error())
+		log.Printf("quarantine failed namespace=%s name=%s err=%v", namespace, name, err)
+	}
+}
+
+// recordScanFailure notes a failed scan or quarantine attempt and schedules
+// the next one, backing off from a minute up to maxScanRetryDelay. Returns
+// the number of attempts so far.
+func (s *server) recordScanFailure(namespace, name, id, reason string) int {
+	var attempts int
+	err := s.db.QueryRow(
+		`UPDATE file_scans SET
+		   attempts = attempts + 1,
+		   error = $4,
+		   retry_at = $5 + LEAST(60 * POWER(2, LEAST(attempts, 6)), $6)::bigint
+		 WHERE namespace = $1 AND path = $2 AND scan_id = $3
+		 RETURNING attempts`,
+		namespace, name, id, reason, time.Now().Unix(), int64(maxScanRetryDelay/time.Second),
+	).Scan(&attempts)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		log.Printf("scan state update failed namespace=%s name=%s err=%v", namespace, name, err)
+	}
+	return attempts
+}
+
+// quarantinePath is where a file from namespace ends up in the quarantine
+// namespace.
+func quarantinePath(namespace, name string) string {
+	return path.Join(namespace, name)
+}
+
+// quarantineFile moves an infected file into the quarantine namespace. The
+// copy is stored as infected too, so it is never served.
+func (s *server) quarantineFile(ctx context.Context, namespace, name, id, signature string) error {
+	target := quarantinePath(namespace, name)
+	existed, size, err := s.copyFile(ctx, namespace, name, s.quarantineNamespace, target, true)
+	if err != nil {
+		return err
+	}
+	now := time.Now().Unix()
+	if _, err := s.db.Exec(
+		`INSERT INTO file_scans (namespace, path, scan_id, status, signature, error, attempts, retry_at, scanned_at, created_at)
+		 VALUES ($1, $2, $3, $4, $5, '', 0, 0, $6, $6)
+		 ON CONFLICT (namespace, path) DO UPDATE SET
+		   scan_id = excluded.scan_id,
+		   status = excluded.status,
+		   signature = excluded.signature,
+		   error = '',
+		   scanned_at = excluded.scanned_at`,
+		s.quarantineNamespace, target, id, scanInfected, signature, now,
+	); err != nil {
+		return fmt.Errorf("save quarantine verdict: %w", err)
+	}
+	s.recordChange(s.quarantineNamespace, writeOp(existed), target, "", size)
+
+	// Leave the original alone if a new upload replaced it meanwhile.
+	var current string
+	err = s.db.QueryRow(`SELECT scan_id FROM file_scans WHERE namespace = $1 AND path = $2`, namespace, name).Scan(&current)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && current != id) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := s.deleteFile(ctx, namespace, name); err != nil {
+		return fmt.Errorf("remove infected file: %w", err)
+	}
+	s.recordChange(namespace, changeDeleted, name, "", 0)
+	s.recordAudit(namespace, "scanner", "file.quarantine", fmt.Sprintf("%s (%s) moved to %s:%s", name, signature, s.quarantineNamespace, target))
+	log.Printf("file quarantined namespace=%s name=%s target=%s", namespace, name, target)
+	return nil
+}
+
+// fileScanStatus returns a file's scan status, or "" if it has none.
+func (s *server) fileScanStatus(namespace, name string) (string, error) {
+	var status string
+	err := s.db.QueryRow(`SELECT status FROM file_scans WHERE namespace = $1 AND path = $2`, namespace, name).Scan(&status)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	return status, err
+}
+
+// loadScanStatuses returns the scan status of every scanned file in a
+// namespace.
+func (s *server) loadScanStatuses(namespace string) (map[string]string, error) {
+	rows, err := s.db.Query(`SELECT path, status FROM file_scans WHERE namespace = $1`, namespace)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	statuses := make(map[string]string)
+	for rows.Next() {
+		var name, status string
+		if err := rows.Scan(&name, &status); err != nil {
+			return nil, err
+		}
+		statuses[name] = status
+	}
+	return statuses, rows.Err()
+}
+
+// downloadBlocked explains why a file may not be downloaded yet. It returns
+// status 0 when the download may go ahead. Lookup failures block, since an
+// unscanned file is what this guards against.
+func (s *server) downloadBlocked(w http.ResponseWriter, namespace, name string) (int, string) {
+	status, err := s.fileScanStatus(namespace, name)
+	if err != nil {
+		log.Printf("scan status lookup failed namespace=%s name=%s err=%v", namespace, name, err)
+		return http.StatusInternalServerError, "file scan status could not be checked"
+	}
+	switch status {
+	case scanPending:
+		w.Header().Set("Retry-After", "10")
+		return http.StatusConflict, "file is still being scanned for malware"
+	case scanInfected:
+		return http.StatusForbidden, "file failed malware scanning and has been quarantined"
+	}
+	return 0, ""
+}
+
+// ensureQuarantineNamespace creates the quarantine namespace, refusing one
+// that users could reach.
+func ensureQuarantineNamespace(db *sql.DB, name string) error {
+	if err := ensureNamespaceRow(db, name, true); err != nil {
+		return err
+	}
+	var hidden int
+	var ownerID *int
+	if err := db.QueryRow(`SELECT hidden, owner_id FROM namespaces WHERE name = $1`, name).Scan(&hidden, &ownerID); err != nil {
+		return err
+	}
+	if hidden == 0 || ownerID != nil {
+		return fmt.Errorf("namespace %s already exists and is not hidden and unowned", name)
+	}
+	return nil
+}
+
+// rescanFile scans a stored file again by reading it back.
+func (s *server) rescanFile(ctx context.Context, namespace, name, id string) {
+	pr, pw := io.Pipe()
+	go func() {
+		_, err := s.readFile(ctx, namespace, name, pw)
+		pw.CloseWithError(err)
+	}()
+	verdict, err := s.scanner.Scan(ctx, pr)
+	pr.CloseWithError(errors.New("scan finished"))
+	s.applyScanResult(ctx, namespace, name, id, verdict, err)
+}
+
+// retryScans handles files whose scan or quarantine is due for another try.
+// Each row is claimed by pushing its retry_at out, so replicas don't pick up
+// the same file.
+func (s *server) retryScans(ctx context.Context) (int, error) {
+	now := time.Now().Unix()
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT namespace, path, scan_id, status, signature, retry_at FROM file_scans
+		 WHERE retry_at <= $1 AND retry_at > 0 AND namespace <> $2
+		   AND (status = $3 OR status = $4)
+		 ORDER BY retry_at LIMIT 100`,
+		now, s.quarantineNamespace, scanPending, scanInfected,
+	)
+	if err != nil {
+		return 0, err
+	}
+	type dueScan struct {
+		namespace, name, id, status, signature string
+		retryAt                                int64
+	}
+	var due []dueScan
+	for rows.Next() {
+		var d dueScan
+		if err := rows.Scan(&d.namespace, &d.name, &d.id, &d.status, &d.signature, &d.retryAt); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		due = append(due, d)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	handled := 0
+	for _, d := range due {
+		if err := ctx.Err(); err != nil {
+			return handled, err
+		}
+		result, err := s.db.ExecContext(ctx,
+			`UPDATE file_scans SET retry_at = $5 WHERE namespace = $1 AND path = $2 AND scan_id = $3 AND retry_at = $4`,
+			d.namespace, d.name, d.id, d.retryAt, time.Now().Add(s.scanLease()).Unix(),
+		)
+		if err != nil {
+			return handled, err
+		}
+		if claimed, _ := result.RowsAffected(); claimed == 0 {
+			continue
+		}
+		handled++
+		if d.status == scanPending {
+			s.rescanFile(ctx, d.namespace, d.name, d.id)
+			continue
+		}
+		if err := s.quarantineFile(ctx, d.namespace, d.name, d.id, d.signature); err != nil {
+			s.recordScanFailure(d.namespace, d.name, d.id, "quarantine: "+err.Error())
+			log.Printf("quarantine retry failed namespace=%s name=%s err=%v", d.namespace, d.name, err)
+		}
+	}
+	return handled, nil
+}
+
+// retryScansLoop runs retryScans every interval.
+func (s *server) retryScansLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		ctx, cancel := context.WithTimeout(context.Background(), s.scanLease())
+		handled, err := s.retryScans(ctx)
+		cancel()
+		if err != nil {
+			log.Printf("scan retry failed: %v", err)
+		} else if handled > 0 {
+			log.Printf("scan retry handled=%d", handled)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// fakeClamd answers INSTREAM with reply, or never reads past the command
+// when stall is set.
+func fakeClamd(t *testing.T, reply string, stall bool) *clamdScanner {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				cmd := make([]byte, len("zINSTREAM\x00"))
+				if _, err := io.ReadFull(conn, cmd); err != nil {
+					return
+				}
+				if stall {
+					time.Sleep(5 * time.Second)
+					return
+				}
+				for {
+					var size uint32
+					if err := binary.Read(conn, binary.BigEndian, &size); err != nil {
+						return
+					}
+					if size == 0 {
+						break
+					}
+					if _, err := io.CopyN(io.Discard, conn, int64(size)); err != nil {
+						return
+					}
+				}
+				io.WriteString(conn, reply+"\x00")
+			}()
+		}
+	}()
+	scanner, err := newClamdScanner(ln.Addr().String(), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	scanner.writeTimeout = 100 * time.Millisecond
+	return scanner
+}
+
+func TestClamdScan(t *testing.T) {
+	data := bytes.Repeat([]byte("x"), 3*clamdChunkSize+17)
+
+	verdict, err := fakeClamd(t, "stream: OK", false).Scan(context.Background(), bytes.NewReader(data))
+	if err != nil || verdict.Infected {
+		t.Fatalf("clean scan = %+v, %v", verdict, err)
+	}
+	verdict, err = fakeClamd(t, "stream: Eicar-Signature FOUND", false).Scan(context.Background(), bytes.NewReader(data))
+	if err != nil || !verdict.Infected || verdict.Signature != "Eicar-Signature" {
+		t.Fatalf("infected scan = %+v, %v", verdict, err)
+	}
+	if _, err := fakeClamd(t, "INSTREAM size limit exceeded. ERROR", false).Scan(context.Background(), bytes.NewReader(data)); err == nil {
+		t.Fatalf("size limit error was not reported")
+	}
+}
+
+func TestClamdScanStalled(t *testing.T) {
+	scanner := fakeClamd(t, "", true)
+	start := time.Now()
+	_, err := scanner.Scan(context.Background(), bytes.NewReader(make([]byte, 64<<20)))
+	if err == nil {
+		t.Fatalf("scan against a stalled clamd succeeded")
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Fatalf("stalled scan took %s", elapsed)
+	}
+}
+
+// A stalled scanner must not hold up the upload it is teed from.
+func TestPendingScanDoesNotBlockUpload(t *testing.T) {
+	s := &server{scanner: fakeClamd(t, "", true), uploadTTL: time.Minute, scanTimeout: time.Minute}
+	p := s.streamScan(context.Background(), "default", "big.bin", "scan-1")
+
+	start := time.Now()
+	n, err := io.Copy(io.Discard, io.TeeReader(bytes.NewReader(make([]byte, 64<<20)), p))
+	if err != nil || n != 64<<20 {
+		t.Fatalf("upload copied %d bytes, err %v", n, err)
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Fatalf("upload took %s behind a stalled scanner", elapsed)
+	}
+	if !p.dropped.Load() {
+		t.Fatalf("scan was not dropped")
+	}
+	p.stop()
+	p.pw.Close()
+	if res := <-p.result; res.err == nil {
+		t.Fatalf("stalled scan reported verdict %+v", res.verdict)
+	}
+}
+
+func TestPendingScanDroppedOnCancel(t *testing.T) {
+	s := &server{scanner: fakeClamd(t, "", true), uploadTTL: time.Minute, scanTimeout: time.Minute}
+	s.scanner.(*clamdScanner).writeTimeout = time.Minute
+	ctx, cancel := context.WithCancel(context.Background())
+	p := s.streamScan(ctx, "default", "big.bin", "scan-1")
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(io.Discard, io.TeeReader(bytes.NewReader(make([]byte, 64<<20)), p))
+		done <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("upload failed: %v", err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("cancelling the upload did not release it from the scanner")
+	}
+	if res := <-p.result; res.err == nil {
+		t.Fatalf("cancelled scan result = %+v", res)
+	}
+}
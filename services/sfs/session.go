@@ -0,0 +1,213 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// authSession is the signed-in user behind a session cookie.
+type authSession struct {
+	Token       string
+	UserID      int64
+	Username    string
+	DisplayName string
+	ExpiresAt   int64
+}
+
+type sessionContextKey struct{}
+
+// sessionSlot memoizes the session lookup for one request. Handlers resolve
+// the session several times (requireAuth, currentUserID, canAccessNamespace),
+// but only the first call reaches the cache or database.
+type sessionSlot struct {
+	once    sync.Once
+	session *authSession
+}
+
+// withSession gives every request a sessionSlot. The lookup itself stays
+// lazy, so public endpoints never pay for it.
+func (s *server) withSession(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), sessionContextKey{}, &sessionSlot{})
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// session returns the request's active session, or nil when there is none.
+func (s *server) session(r *http.Request) *authSession {
+	slot, ok := r.Context().Value(sessionContextKey{}).(*sessionSlot)
+	if !ok {
+		return s.resolveSession(r)
+	}
+	slot.once.Do(func() {
+		slot.session = s.resolveSession(r)
+	})
+	return slot.session
+}
+
+// resolveSession checks every cookie with the session name (duplicates come
+// from different cookie domains) and returns the first active session.
+func (s *server) resolveSession(r *http.Request) *authSession {
+	now := time.Now()
+	for _, cookie := range r.Cookies() {
+		if cookie.Name != s.cookieName || cookie.Value == "" {
+			continue
+		}
+		if session, touch := s.sessions.get(cookie.Value, now); session != nil {
+			if touch {
+				s.touchSession(session.Token)
+			}
+			return session
+		}
+
+		session := &authSession{Token: cookie.Value}
+		err := s.db.QueryRow(
+			`SELECT users.id, users.username, COALESCE(users.display_name, users.username), sessions.expires_at
+			 FROM sessions
+			 JOIN users ON sessions.user_id = users.id
+			 WHERE sessions.token = $1 AND sessions.expires_at > $2 AND users.disabled = 0`,
+			cookie.Value,
+			now.Unix(),
+		).Scan(&session.UserID, &session.Username, &session.DisplayName, &session.ExpiresAt)
+		if err != nil {
+			continue
+		}
+		if session.DisplayName == "" {
+			session.DisplayName = session.Username
+		}
+		s.sessions.put(session, now)
+		s.touchSession(session.Token)
+		return session
+	}
+	return nil
+}
+
+// sessionCache is a bounded LRU of resolved sessions. Entries live for at
+// most ttl, which also bounds how stale a revocation made on another replica
+// can be; revocations on this replica invalidate entries immediately.
+type sessionCache struct {
+	ttl     time.Duration
+	maxSize int
+
+	mu      sync.Mutex
+	order   *list.List // front is most recently used
+	entries map[string]*list.Element
+}
+
+type sessionCacheEntry struct {
+	session  *authSession
+	cachedAt time.Time
+	touched  time.Time
+}
+
+func newSessionCache(ttl time.Duration, maxSize int) *sessionCache {
+	return &sessionCache{
+		ttl:     ttl,
+		maxSize: maxSize,
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+// get returns a cached session and whether its last_seen is due for an
+// update.
+func (c *sessionCache) get(token string, now time.Time) (*authSession, bool) {
+	if c == nil || c.ttl <= 0 {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[token]
+	if !ok {
+		return nil, false
+	}
+	entry := elem.Value.(*sessionCacheEntry)
+	if now.Sub(entry.cachedAt) > c.ttl || now.Unix() >= entry.session.ExpiresAt {
+		c.order.Remove(elem)
+		delete(c.entries, token)
+		return nil, false
+	}
+	c.order.MoveToFront(elem)
+	touch := now.Sub(entry.touched) >= sessionTouchInterval
+	if touch {
+		entry.touched = now
+	}
+	return entry.session, touch
+}
+
+func (c *sessionCache) put(session *authSession, now time.Time) {
+	if c == nil || c.ttl <= 0 || c.maxSize <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[session.Token]; ok {
+		c.order.Remove(elem)
+	}
+	c.entries[session.Token] = c.order.PushFront(&sessionCacheEntry{session: session, cachedAt: now, touched: now})
+	for c.order.Len() > c.maxSize {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*sessionCacheEntry).session.Token)
+	}
+}
+
+// invalidate drops the given tokens.
+func (c *sessionCache) invalidate(tokens ...string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, token := range tokens {
+		if elem, ok := c.entries[token]; ok {
+			c.order.Remove(elem)
+			delete(c.entries, token)
+		}
+	}
+}
+
+// invalidateUser drops every cached session of a user except keepToken.
+func (c *sessionCache) invalidateUser(userID int64, keepToken string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for token, elem := range c.entries {
+		if elem.Value.(*sessionCacheEntry).session.UserID == userID && token != keepToken {
+			c.order.Remove(elem)
+			delete(c.entries, token)
+		}
+	}
+}
+
+// sweepSessions periodically deletes expired sessions along with other
+// short-lived login state.
+func (s *server) sweepSessions(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		now := time.Now().Unix()
+		result, err := s.db.Exec(`DELETE FROM sessions WHERE expires_at <= $1`, now)
+		if err != nil {
+			log.Printf("session sweep failed: %v", err)
+			continue
+		}
+		if swept, _ := result.RowsAffected(); swept > 0 {
+			log.Printf("swept %d expired sessions", swept)
+		}
+		_, _ = s.db.Exec(`DELETE FROM login_challenges WHERE expires_at < $1`, now)
+		_, _ = s.db.Exec(`DELETE FROM oidc_states WHERE expires_at < $1`, now)
+		_, _ = s.db.Exec(
+			`DELETE FROM batch_jobs WHERE finished_at > 0 AND finished_at < $1`,
+			now-int64(batchJobRetention/time.Second),
+		)
+	}
+}
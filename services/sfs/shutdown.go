@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// partialCleanupTimeout bounds how long a forced shutdown waits for cancelled
+// uploads to remove their partial files.
+const partialCleanupTimeout = 15 * time.Second
+
+// errDraining refuses new uploads once shutdown has started, so the client
+// retries against another replica instead of being cut off mid-transfer.
+var errDraining = errors.New("server is shutting down, retry shortly")
+
+// drainer tracks in-flight uploads and background batch jobs so shutdown
+// can wait for them.
+type drainer struct {
+	mu       sync.Mutex
+	draining bool
+	forced   atomic.Bool
+	uploads  sync.WaitGroup
+	jobs     sync.WaitGroup
+	// jobCtx is cancelled when shutdown stops waiting for jobs.
+	jobCtx     context.Context
+	cancelJobs context.CancelFunc
+}
+
+func (d *drainer) begin() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.draining {
+		return false
+	}
+	d.uploads.Add(1)
+	return true
+}
+
+// beginJob registers a background job, returning the context it should run
+// under.
+func (d *drainer) beginJob() (context.Context, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.draining {
+		return nil, false
+	}
+	if d.jobCtx == nil {
+		d.jobCtx, d.cancelJobs = context.WithCancel(context.Background())
+	}
+	d.jobs.Add(1)
+	return d.jobCtx, true
+}
+
+// stopJobs cancels every background job.
+func (d *drainer) stopJobs() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.cancelJobs != nil {
+		d.cancelJobs()
+	}
+}
+
+func (d *drainer) start() {
+	d.mu.Lock()
+	d.draining = true
+	d.mu.Unlock()
+}
+
+// wait blocks until everything in wg has returned or timeout passes.
+func wait(wg *sync.WaitGroup, timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// beginUpload registers an upload with the drainer; call the returned func
+// when it finishes. During shutdown it returns errDraining instead and sets
+// Retry-After on the response.
+func (s *server) beginUpload(w http.ResponseWriter) (func(), error) {
+	if !s.drain.begin() {
+		w.Header().Set("Retry-After", "5")
+		return nil, errDraining
+	}
+	return s.drain.uploads.Done, nil
+}
+
+// beginJob registers a background batch job with the drainer, like
+// beginUpload. The job must stop when the returned context is cancelled.
+func (s *server) beginJob(w http.ResponseWriter) (context.Context, func(), error) {
+	ctx, ok := s.drain.beginJob()
+	if !ok {
+		w.Header().Set("Retry-After", "5")
+		return nil, nil, errDraining
+	}
+	return ctx, s.drain.jobs.Done, nil
+}
+
+// discardPartial removes a file whose upload was cut off by a forced
+// shutdown. The request context is already cancelled, so it gets its own.
+func (s *server) discardPartial(namespace, name string) {
+	ctx, cancel := context.WithTimeout(context.Background(), partialCleanupTimeout)
+	defer cancel()
+	if err := s.deleteFile(ctx, namespace, name); err != nil {
+		log.Printf("shutdown: failed to remove partial upload namespace=%s name=%s err=%v", namespace, name, err)
+		return
+	}
+	log.Printf("shutdown: removed partial upload namespace=%s name=%s", namespace, name)
+}
+
+// shutdown drains the server. New uploads and batch jobs are refused, and
+// in-flight requests and jobs get up to timeout to finish while their
+// progress WebSockets keep streaming. Remaining WebSocket clients are then
+// told to reconnect. If the drain times out, whatever is left is cancelled
+// and its partial files removed.
+func (s *server) shutdown(httpServer *http.Server, cancelRequests context.CancelFunc, timeout time.Duration) {
+	s.drain.start()
+	s.changes.close()
+	log.Printf("shutdown: draining active transfers timeout=%s", timeout)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := httpServer.Shutdown(ctx); err != nil {
+		log.Printf("shutdown: drain incomplete, cancelling remaining transfers: %v", err)
+		s.drain.forced.Store(true)
+		cancelRequests()
+		// Closing the connections unblocks uploads stuck reading the body.
+		_ = httpServer.Close()
+		if !wait(&s.drain.uploads, partialCleanupTimeout) {
+			log.Printf("shutdown: gave up waiting for cancelled uploads to clean up")
+		}
+	}
+	// Jobs share what is left of the drain timeout.
+	deadline, _ := ctx.Deadline()
+	if !wait(&s.drain.jobs, time.Until(deadline)) {
+		log.Printf("shutdown: drain incomplete, cancelling remaining batch jobs")
+		s.drain.stopJobs()
+		if !wait(&s.drain.jobs, partialCleanupTimeout) {
+			log.Printf("shutdown: gave up waiting for cancelled batch jobs to clean up")
+		}
+	}
+	s.closeWebSockets()
+	log.Printf("shutdown: complete")
+}
+
+// closeWebSockets asks every progress WebSocket client to reconnect and closes
+// its connection. Hijacked connections are not closed by http.Server.
+func (s *server) closeWebSockets() {
+	s.wsMu.Lock()
+	conns := s.wsConns
+	s.wsConns = make(map[string]*websocket.Conn)
+	s.wsMu.Unlock()
+
+	for id, conn := range conns {
+		_ = websocket.JSON.Send(conn, progressMessage{ID: id, Reconnect: true})
+		_ = conn.Close()
+	}
+}
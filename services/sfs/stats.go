@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"time"
+)
+
+// Namespace statistics live in namespace_stats so listings don't have to walk
+// GFS. Uploads, overwrites and deletes adjust them as they happen; a periodic
+// reconciliation rescans storage and corrects any drift (crashes between the
+// storage call and the update, files changed outside SFS).
+//
+// Every adjustment bumps version. Reconciliation only writes its totals if the
+// version is unchanged since before it listed the namespace, so it never
+// clobbers an update that raced with the scan; that namespace is simply
+// corrected on the next run.
+
+// statsReconcileLockKey keeps replicas from reconciling at the same time
+// ("sfs" + 1 in ASCII, next to migrationLockKey).
+const statsReconcileLockKey int64 = 0x73667301
+
+// Bytes counts what is stored, after compression and encryption;
+// LogicalBytes counts what clients upload and download.
+type namespaceStats struct {
+	Files        int
+	Bytes        int64
+	LogicalBytes int64
+	LastModified int64
+}
+
+// adjustNamespaceStats applies a file count and stored and logical byte
+// deltas. Failures are logged rather than returned: the storage change
+// already happened and the next reconciliation repairs the totals.
+func (s *server) adjustNamespaceStats(namespace string, files int, bytes, logical int64) {
+	_, err := s.db.Exec(
+		`INSERT INTO namespace_stats (namespace, file_count, total_bytes, logical_bytes, last_modified, version)
+		 VALUES ($1, GREATEST($2::bigint, 0), GREATEST($3::bigint, 0), GREATEST($5::bigint, 0), $4, 1)
+		 ON CONFLICT (namespace) DO UPDATE SET
+		   file_count = GREATEST(namespace_stats.file_count + $2::bigint, 0),
+		   total_bytes = GREATEST(namespace_stats.total_bytes + $3::bigint, 0),
+		   logical_bytes = GREATEST(namespace_stats.logical_bytes + $5::bigint, 0),
+		   last_modified = $4,
+		   version = namespace_stats.version + 1`,
+		namespace,
+		files,
+		bytes,
+		time.Now().Unix(),
+		logical,
+	)
+	if err != nil {
+		log.Printf("namespace stats update failed namespace=%s err=%v", namespace, err)
+	}
+}
+
+func (info *namespaceInfo) applyStats(st namespaceStats) {
+	info.Count = st.Files
+	info.Bytes = st.Bytes
+	info.LogicalBytes = st.LogicalBytes
+	info.LastModified = st.LastModified
+}
+
+// loadNamespaceStats returns the stored statistics for every namespace.
+func (s *server) loadNamespaceStats() (map[string]namespaceStats, error) {
+	rows, err := s.db.Query(`SELECT namespace, file_count, total_bytes, logical_bytes, last_modified FROM namespace_stats`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	stats := make(map[string]namespaceStats)
+	for rows.Next() {
+		var name string
+		var st namespaceStats
+		if err := rows.Scan(&name, &st.Files, &st.Bytes, &st.LogicalBytes, &st.LastModified); err != nil {
+			return nil, err
+		}
+		stats[name] = st
+	}
+	return stats, rows.Err()
+}
+
+// scanNamespace computes a namespace's statistics from storage.
+func (s *server) scanNamespace(ctx context.Context, namespace string) (namespaceStats, error) {
+	files, err := s.storage.ListFilesWithNamespace(ctx, s.gfsNamespace(namespace), s.listPrefix)
+	if err != nil {
+		return namespaceStats{}, err
+	}
+	sizer, err := s.loadFileSizer(namespace)
+	if err != nil {
+		return namespaceStats{}, err
+	}
+	var st namespaceStats
+	for _, file := range files {
+		if relativeNameWithPrefix(file.Path, s.listPrefix) == "" {
+			continue
+		}
+		st.Files++
+		st.Bytes += int64(file.Size)
+		st.LogicalBytes += int64(sizer.logical(file.Path, file.Size))
+		st.LastModified = max(st.LastModified, file.ModifiedAt)
+	}
+	return st, nil
+}
+
+// reconcileNamespaceStats rescans every namespace and corrects its totals.
+// Returns how many namespaces were corrected.
+func (s *server) reconcileNamespaceStats(ctx context.Context) (int, error) {
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	var locked bool
+	if err := conn.QueryRowContext(ctx, `SELECT pg_try_advisory_lock($1)`, statsReconcileLockKey).Scan(&locked); err != nil {
+		return 0, err
+	}
+	if !locked {
+		// Another replica is already on it.
+		return 0, nil
+	}
+	defer func() {
+		_, _ = conn.ExecContext(context.Background(), `SELECT pg_advisory_unlock($1)`, statsReconcileLockKey)
+	}()
+
+	namespaces, err := s.loadAllNamespaces()
+	if err != nil {
+		return 0, err
+	}
+	names := []string{defaultNamespace}
+	for _, ns := range namespaces {
+		if ns.Name != defaultNamespace {
+			names = append(names, ns.Name)
+		}
+	}
+
+	corrected := 0
+	for _, name := range names {
+		if err := ctx.Err(); err != nil {
+			return corrected, err
+		}
+		var version int64
+		var before namespaceStats
+		err := conn.QueryRowContext(ctx,
+			`SELECT file_count, total_bytes, logical_bytes, last_modified, version FROM namespace_stats WHERE namespace = $1`,
+			name,
+		).Scan(&before.Files, &before.Bytes, &before.LogicalBytes, &before.LastModified, &version)
+		missing := errors.Is(err, sql.ErrNoRows)
+		if err != nil && !missing {
+			return corrected, err
+		}
+
+		scanned, err := s.scanNamespace(ctx, name)
+		if err != nil {
+			log.Printf("namespace stats reconcile failed namespace=%s err=%v", name, err)
+			continue
+		}
+		if !missing && scanned.Files == before.Files && scanned.Bytes == before.Bytes && scanned.LogicalBytes == before.LogicalBytes {
+			continue
+		}
+
+		result, err := conn.ExecContext(ctx,
+			`INSERT INTO namespace_stats (namespace, file_count, total_bytes, logical_bytes, last_modified, version, reconciled_at)
+			 VALUES ($1, $2, $3, $7, $4, 0, $5)
+			 ON CONFLICT (namespace) DO UPDATE SET
+			   file_count = excluded.file_count,
+			   total_bytes = excluded.total_bytes,
+			   logical_bytes = excluded.logical_bytes,
+			   last_modified = GREATEST(namespace_stats.last_modified, excluded.last_modified),
+			   reconciled_at = excluded.reconciled_at
+			 WHERE namespace_stats.version = $6`,
+			name,
+			scanned.Files,
+			scanned.Bytes,
+			scanned.LastModified,
+			time.Now().Unix(),
+			version,
+			scanned.LogicalBytes,
+		)
+		if err != nil {
+			return corrected, err
+		}
+		if n, _ := result.RowsAffected(); n > 0 {
+			log.Printf(
+				"namespace stats corrected namespace=%s files=%d->%d bytes=%d->%d",
+				name, before.Files, scanned.Files, before.Bytes, scanned.Bytes,
+			)
+			corrected++
+		}
+	}
+	return corrected, nil
+}
+
+// reconcileNamespaceStatsLoop reconciles once at startup, which also seeds
+// the table on first deploy, and then every interval.
+func (s *server) reconcileNamespaceStatsLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		start := time.Now()
+		corrected, err := s.reconcileNamespaceStats(ctx)
+		cancel()
+		if err != nil {
+			log.Printf("namespace stats reconcile failed: %v", err)
+		} else if corrected > 0 {
+			log.Printf("namespace stats reconciled corrected=%d duration=%s", corrected, time.Since(start).Truncate(time.Millisecond))
+		}
+		<-ticker.C
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	gfs "eddisonso.com/go-gfs/pkg/go-gfs-sdk"
+)
+
+// storedFile describes a file held by a storage backend.
+type storedFile struct {
+	Path       string
+	Size       uint64
+	CreatedAt  int64
+	ModifiedAt int64
+}
+
+// storageBackend is the file store behind SFS. Namespaces passed in are
+// already mapped through gfsNamespace. Method names mirror the GFS SDK so the
+// GFS adapter stays a thin wrapper.
+type storageBackend interface {
+	ListFilesWithNamespace(ctx context.Context, namespace, prefix string) ([]storedFile, error)
+	GetFileWithNamespace(ctx context.Context, path, namespace string) (*storedFile, error)
+	CreateFileWithNamespace(ctx context.Context, path, namespace string) error
+	AppendFromWithNamespace(ctx context.Context, path, namespace string, r io.Reader) (int64, error)
+	ReadToWithNamespace(ctx context.Context, path, namespace string, w io.Writer) (int64, error)
+	DeleteFileWithNamespace(ctx context.Context, path, namespace string) error
+	Close() error
+}
+
+// newStorageBackend builds the backend selected by the -backend flag.
+func newStorageBackend(ctx context.Context, kind, master, dataDir string) (storageBackend, error) {
+	switch kind {
+	case "gfs":
+		client, err := gfs.New(ctx, master)
+		if err != nil {
+			return nil, fmt.Errorf("connect to gfs master: %w", err)
+		}
+		return &gfsBackend{client: client}, nil
+	case "local":
+		return newLocalBackend(dataDir)
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q (want gfs or local)", kind)
+	}
+}
+
+// gfsBackend stores files in GFS.
+type gfsBackend struct {
+	client *gfs.Client
+}
+
+func (b *gfsBackend) ListFilesWithNamespace(ctx context.Context, namespace, prefix string) ([]storedFile, error) {
+	files, err := b.client.ListFilesWithNamespace(ctx, namespace, prefix)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]storedFile, 0, len(files))
+	for _, file := range files {
+		result = append(result, storedFile{
+			Path:       file.Path,
+			Size:       file.Size,
+			CreatedAt:  file.CreatedAt,
+			ModifiedAt: file.ModifiedAt,
+		})
+	}
+	return result, nil
+}
+
+func (b *gfsBackend) GetFileWithNamespace(ctx context.Context, path, namespace string) (*storedFile, error) {
+	info, err := b.client.GetFileWithNamespace(ctx, path, namespace)
+	if err != nil {
+		return nil, err
+	}
+	if info == nil {
+		return nil, fmt.Errorf("file not found: %s", path)
+	}
+	return &storedFile{
+		Path:       path,
+		Size:       info.Size,
+		CreatedAt:  info.CreatedAt,
+		ModifiedAt: info.ModifiedAt,
+	}, nil
+}
+
+func (b *gfsBackend) CreateFileWithNamespace(ctx context.Context, path, namespace string) error {
+	_, err := b.client.CreateFileWithNamespace(ctx, path, namespace)
+	return err
+}
+
+func (b *gfsBackend) AppendFromWithNamespace(ctx context.Context, path, namespace string, r io.Reader) (int64, error) {
+	n, err := b.client.AppendFromWithNamespace(ctx, path, namespace, r)
+	return int64(n), err
+}
+
+func (b *gfsBackend) ReadToWithNamespace(ctx context.Context, path, namespace string, w io.Writer) (int64, error) {
+	n, err := b.client.ReadToWithNamespace(ctx, path, namespace, w)
+	return int64(n), err
+}
+
+func (b *gfsBackend) DeleteFileWithNamespace(ctx context.Context, path, namespace string) error {
+	return b.client.DeleteFileWithNamespace(ctx, path, namespace)
+}
+
+func (b *gfsBackend) Close() error {
+	b.client.Close()
+	return nil
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+)
+
+// Every file goes through the same pipeline between the HTTP handlers and the
+// storage backend. Writes are scanned, compressed and then encrypted as they
+// stream in; reads undo the encryption and compression on the way out. Each
+// step is optional and keyed by per-file rows (file_codecs, file_keys), so
+// files written under older namespace settings stay readable.
+
+// writeFile streams src into a file that has already been created, compressing
+// and then encrypting it when the namespace has those enabled, and scanning it
+// for malware when a scanner is configured. n counts the stored bytes.
+func (s *server) writeFile(ctx context.Context, namespace, name string, src io.Reader) (n int64, err error) {
+	done := startTransfer("upload")
+	defer func() { done(n, err) }()
+
+	if err := s.checkNamespaceWritable(namespace); err != nil {
+		return 0, err
+	}
+	encrypted, err := s.namespaceEncrypted(namespace)
+	if err != nil {
+		return 0, fmt.Errorf("check namespace encryption: %w", err)
+	}
+	codec, err := s.namespaceCompression(namespace)
+	if err != nil {
+		return 0, fmt.Errorf("check namespace compression: %w", err)
+	}
+
+	logical := &countingReader{reader: src}
+	src = logical
+	scan, err := s.startScan(ctx, namespace, name)
+	if err != nil {
+		return 0, fmt.Errorf("start malware scan: %w", err)
+	}
+	if scan != nil {
+		// The scanner sees the plaintext as it streams to storage.
+		src = io.TeeReader(src, scan)
+		defer func() { scan.finish(err) }()
+	}
+	if codec != "" {
+		// Saved up front so a partial file is still read as compressed; the
+		// logical size is filled in once the write completes.
+		if err := s.saveFileCodec(namespace, name, codec, 0); err != nil {
+			return 0, fmt.Errorf("save file codec: %w", err)
+		}
+		compressed := newCompressReader(src, codec)
+		defer compressed.Close()
+		src = compressed
+	} else if _, err := s.db.Exec(`DELETE FROM file_codecs WHERE namespace = $1 AND path = $2`, namespace, name); err != nil {
+		return 0, fmt.Errorf("clear file codec: %w", err)
+	}
+
+	if encrypted {
+		if src, err = s.encryptFile(namespace, name, src); err != nil {
+			return 0, err
+		}
+	} else {
+		// A previous encrypted file at this path may have left a key behind.
+		if _, err := s.db.Exec(`DELETE FROM file_keys WHERE namespace = $1 AND path = $2`, namespace, name); err != nil {
+			return 0, fmt.Errorf("clear data key: %w", err)
+		}
+	}
+	n, err = s.storage.AppendFromWithNamespace(ctx, name, s.gfsNamespace(namespace), src)
+	if n > 0 {
+		s.adjustNamespaceStats(namespace, 0, n, logical.read)
+	}
+	if err == nil && codec != "" {
+		if err := s.saveFileCodec(namespace, name, codec, logical.read); err != nil {
+			return n, fmt.Errorf("save file codec: %w", err)
+		}
+	}
+	if err == nil {
+		// A rename that started mid-write may have copied only part of
+		// this file; fail so the client writes it again.
+		err = s.checkNamespaceWritable(namespace)
+	}
+	if err != nil && s.drain.forced.Load() {
+		s.discardPartial(namespace, name)
+	}
+	return n, err
+}
+
+// readFile streams a file to w, decrypting and decompressing it as needed.
+func (s *server) readFile(ctx context.Context, namespace, name string, w io.Writer) (int64, error) {
+	return s.readFileEncoded(ctx, namespace, name, w, "")
+}
+
+// readFileEncoded is readFile, except that a file compressed with codec is
+// written still compressed. n counts the stored bytes.
+func (s *server) readFileEncoded(ctx context.Context, namespace, name string, w io.Writer, codec string) (n int64, err error) {
+	done := startTransfer("download")
+	defer func() { done(n, err) }()
+
+	fc, err := s.loadFileCodec(namespace, name)
+	if err != nil {
+		return 0, fmt.Errorf("load file codec: %w", err)
+	}
+	if fc != nil && fc.Codec != codec {
+		dw := newDecompressWriter(w, fc.Codec)
+		defer func() {
+			if closeErr := dw.Close(); err == nil {
+				err = closeErr
+			}
+		}()
+		w = dw
+	}
+
+	fk, err := s.loadFileKey(namespace, name)
+	if err != nil {
+		return 0, fmt.Errorf("load data key: %w", err)
+	}
+	if fk == nil {
+		return s.storage.ReadToWithNamespace(ctx, name, s.gfsNamespace(namespace), w)
+	}
+	dw, err := s.decryptFile(fk, w)
+	if err != nil {
+		return 0, err
+	}
+	n, err = s.storage.ReadToWithNamespace(ctx, name, s.gfsNamespace(namespace), dw)
+	if err != nil {
+		return n, err
+	}
+	return n, dw.Close()
+}
+
+// deleteFile removes a file along with its data key, codec, tags and scan
+// status, if any.
+func (s *server) deleteFile(ctx context.Context, namespace, name string) error {
+	var size, logical int64
+	if stored, err := s.storage.GetFileWithNamespace(ctx, name, s.gfsNamespace(namespace)); err == nil && stored != nil {
+		size = int64(stored.Size)
+		logical = int64(s.logicalSize(namespace, name, stored.Size))
+	}
+	if err := s.storage.DeleteFileWithNamespace(ctx, name, s.gfsNamespace(namespace)); err != nil {
+		return err
+	}
+	s.adjustNamespaceStats(namespace, -1, -size, -logical)
+	if _, err := s.db.Exec(`DELETE FROM file_metadata WHERE namespace = $1 AND path = $2`, namespace, name); err != nil {
+		return err
+	}
+	if _, err := s.db.Exec(`DELETE FROM file_codecs WHERE namespace = $1 AND path = $2`, namespace, name); err != nil {
+		return err
+	}
+	if _, err := s.db.Exec(`DELETE FROM file_scans WHERE namespace = $1 AND path = $2`, namespace, name); err != nil {
+		return err
+	}
+	_, err := s.db.Exec(`DELETE FROM file_keys WHERE namespace = $1 AND path = $2`, namespace, name)
+	return err
+}
+
+// logicalSize returns the uncompressed plaintext size of a stored file.
+func (s *server) logicalSize(namespace, name string, stored uint64) uint64 {
+	if fc, err := s.loadFileCodec(namespace, name); err == nil && fc != nil {
+		return uint64(fc.LogicalSize)
+	}
+	fk, err := s.loadFileKey(namespace, name)
+	if err != nil || fk == nil {
+		return stored
+	}
+	return plaintextSize(stored, fk.SegmentSize)
+}
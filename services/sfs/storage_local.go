@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// localBackend stores files in a directory tree, one directory per namespace.
+// File names are path-escaped so names containing slashes map to a single
+// file on disk. Intended for local development and tests.
+type localBackend struct {
+	root string
+	mu   sync.Mutex
+}
+
+func newLocalBackend(root string) (*localBackend, error) {
+	if strings.TrimSpace(root) == "" {
+		return nil, fmt.Errorf("data directory required for local backend")
+	}
+	abs, err := filepath.Abs(root)
+	if err != nil {
+		return nil, fmt.Errorf("resolve data directory: %w", err)
+	}
+	if err := os.MkdirAll(abs, 0o755); err != nil {
+		return nil, fmt.Errorf("create data directory: %w", err)
+	}
+	return &localBackend{root: abs}, nil
+}
+
+func (b *localBackend) namespaceDir(namespace string) (string, error) {
+	dir := filepath.Join(b.root, filepath.FromSlash(namespace))
+	if dir != b.root && !strings.HasPrefix(dir, b.root+string(filepath.Separator)) {
+		return "", fmt.Errorf("invalid namespace: %s", namespace)
+	}
+	return dir, nil
+}
+
+func (b *localBackend) filePath(path, namespace string) (string, error) {
+	if path == "" || path == "." || path == ".." {
+		return "", fmt.Errorf("invalid filename: %q", path)
+	}
+	dir, err := b.namespaceDir(namespace)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, url.PathEscape(path)), nil
+}
+
+func (b *localBackend) ListFilesWithNamespace(ctx context.Context, namespace, prefix string) ([]storedFile, error) {
+	dir, err := b.namespaceDir(namespace)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	files := make([]storedFile, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		name, err := url.PathUnescape(entry.Name())
+		if err != nil || !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		files = append(files, storedFile{
+			Path:       name,
+			Size:       uint64(info.Size()),
+			CreatedAt:  info.ModTime().Unix(),
+			ModifiedAt: info.ModTime().Unix(),
+		})
+	}
+	return files, nil
+}
+
+func (b *localBackend) GetFileWithNamespace(ctx context.Context, path, namespace string) (*storedFile, error) {
+	full, err := b.filePath(path, namespace)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(full)
+	if err != nil {
+		return nil, err
+	}
+	return &storedFile{
+		Path:       path,
+		Size:       uint64(info.Size()),
+		CreatedAt:  info.ModTime().Unix(),
+		ModifiedAt: info.ModTime().Unix(),
+	}, nil
+}
+
+func (b *localBackend) CreateFileWithNamespace(ctx context.Context, path, namespace string) error {
+	full, err := b.filePath(path, namespace)
+	if err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := os.MkdirAll(filepath.Dir(full), 0o755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(full, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+	if err != nil {
+		if errors.Is(err, os.ErrExist) {
+			return fmt.Errorf("file already exists: %s", path)
+		}
+		return err
+	}
+	return f.Close()
+}
+
+func (b *localBackend) AppendFromWithNamespace(ctx context.Context, path, namespace string, r io.Reader) (int64, error) {
+	full, err := b.filePath(path, namespace)
+	if err != nil {
+		return 0, err
+	}
+	f, err := os.OpenFile(full, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(f, &contextReader{ctx: ctx, reader: r})
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return n, err
+}
+
+func (b *localBackend) ReadToWithNamespace(ctx context.Context, path, namespace string, w io.Writer) (int64, error) {
+	full, err := b.filePath(path, namespace)
+	if err != nil {
+		return 0, err
+	}
+	f, err := os.Open(full)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return io.Copy(w, &contextReader{ctx: ctx, reader: f})
+}
+
+func (b *localBackend) DeleteFileWithNamespace(ctx context.Context, path, namespace string) error {
+	full, err := b.filePath(path, namespace)
+	if err != nil {
+		return err
+	}
+	return os.Remove(full)
+}
+
+func (b *localBackend) Close() error {
+	return nil
+}
+
+// contextReader stops a copy once its context is done, matching the
+// cancellation behaviour of the GFS client.
+type contextReader struct {
+	ctx    context.Context
+	reader io.Reader
+}
+
+func (c *contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.reader.Read(p)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newTestLocalBackend(t *testing.T) *localBackend {
+	t.Helper()
+	b, err := newLocalBackend(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestLocalBackendPaths(t *testing.T) {
+	b := newTestLocalBackend(t)
+
+	full, err := b.filePath("reports/2026/q1.csv", "default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(b.root, "default", "reports%2F2026%2Fq1.csv"); full != want {
+		t.Fatalf("filePath = %q, want %q", full, want)
+	}
+	full, err = b.filePath("../../etc/passwd", "default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filepath.Dir(full) != filepath.Join(b.root, "default") {
+		t.Fatalf("traversing name escaped the namespace: %q", full)
+	}
+
+	for _, name := range []string{"", ".", ".."} {
+		if _, err := b.filePath(name, "default"); err == nil {
+			t.Errorf("filePath(%q) accepted", name)
+		}
+	}
+	for _, ns := range []string{"..", "../other", "a/../../other"} {
+		if _, err := b.filePath("x", ns); err == nil {
+			t.Errorf("namespace %q accepted", ns)
+		}
+		if _, err := b.ListFilesWithNamespace(context.Background(), ns, ""); err == nil {
+			t.Errorf("listing namespace %q accepted", ns)
+		}
+	}
+}
+
+func TestLocalBackendRoundTrip(t *testing.T) {
+	b := newTestLocalBackend(t)
+	ctx := context.Background()
+	const ns, name = "default", "logs/app.log"
+
+	if err := b.CreateFileWithNamespace(ctx, name, ns); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.CreateFileWithNamespace(ctx, name, ns); err == nil || !strings.Contains(err.Error(), "already exists") {
+		t.Fatalf("second create = %v", err)
+	}
+	for _, chunk := range []string{"first line\n", "second line\n"} {
+		if n, err := b.AppendFromWithNamespace(ctx, name, ns, strings.NewReader(chunk)); err != nil || n != int64(len(chunk)) {
+			t.Fatalf("append = %d, %v", n, err)
+		}
+	}
+
+	var out bytes.Buffer
+	if _, err := b.ReadToWithNamespace(ctx, name, ns, &out); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "first line\nsecond line\n" {
+		t.Fatalf("read %q", out.String())
+	}
+	info, err := b.GetFileWithNamespace(ctx, name, ns)
+	if err != nil || info.Size != uint64(out.Len()) || info.ModifiedAt == 0 {
+		t.Fatalf("get = %+v, %v", info, err)
+	}
+
+	if err := b.CreateFileWithNamespace(ctx, "other.txt", ns); err != nil {
+		t.Fatal(err)
+	}
+	files, err := b.ListFilesWithNamespace(ctx, ns, "logs/")
+	if err != nil || len(files) != 1 || files[0].Path != name {
+		t.Fatalf("list = %+v, %v", files, err)
+	}
+	if files, err := b.ListFilesWithNamespace(ctx, "empty", ""); err != nil || len(files) != 0 {
+		t.Fatalf("list of missing namespace = %+v, %v", files, err)
+	}
+
+	if err := b.DeleteFileWithNamespace(ctx, name, ns); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.GetFileWithNamespace(ctx, name, ns); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("get after delete = %v", err)
+	}
+	if _, err := b.AppendFromWithNamespace(ctx, name, ns, strings.NewReader("x")); err == nil {
+		t.Fatalf("append to a deleted file succeeded")
+	}
+}
+
+func TestLocalBackendCancel(t *testing.T) {
+	b := newTestLocalBackend(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := b.CreateFileWithNamespace(ctx, "f", "default"); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	if _, err := b.AppendFromWithNamespace(ctx, "f", "default", strings.NewReader("data")); !errors.Is(err, context.Canceled) {
+		t.Fatalf("append after cancel = %v", err)
+	}
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Traffic limits are token buckets held in memory, so each replica enforces
+// them on its own share of the traffic. Signed-in callers are keyed by user,
+// everyone else by client IP.
+//
+// Request rates are counted per endpoint class (listing, auth). Transfer
+// bandwidth is limited per user and per namespace; a transfer waits for
+// whichever bucket is further behind.
+
+const (
+	rateClassList = "list"
+	rateClassAuth = "auth"
+
+	// rateLimitRoleTTL is how long a user's roles are cached for picking
+	// their limits.
+	rateLimitRoleTTL = time.Minute
+)
+
+// roleLimits is a default limit with per-role overrides, parsed from specs
+// like "120,storage-admin=600,admin=0". Zero means unlimited. A user holding
+// overridden roles gets the most generous of them instead of the default.
+type roleLimits struct {
+	def   float64
+	roles map[string]float64
+}
+
+func parseRoleLimits(spec string) (roleLimits, error) {
+	limits := roleLimits{roles: make(map[string]float64)}
+	for i, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		role, raw, override := strings.Cut(part, "=")
+		if !override {
+			raw = role
+		}
+		value, err := strconv.ParseFloat(strings.TrimSpace(raw), 64)
+		if err != nil || value < 0 {
+			return limits, fmt.Errorf("invalid limit %q", part)
+		}
+		switch {
+		case !override && i == 0:
+			limits.def = value
+		case !override:
+			return limits, fmt.Errorf("only the first limit may omit a role: %q", part)
+		case !validRole(strings.TrimSpace(role)):
+			return limits, fmt.Errorf("unknown role %q", role)
+		default:
+			limits.roles[strings.TrimSpace(role)] = value
+		}
+	}
+	return limits, nil
+}
+
+// scaled returns the limits multiplied by factor, e.g. MB/s to bytes/s.
+func (l roleLimits) scaled(factor float64) roleLimits {
+	out := roleLimits{def: l.def * factor, roles: make(map[string]float64, len(l.roles))}
+	for role, value := range l.roles {
+		out.roles[role] = value * factor
+	}
+	return out
+}
+
+func (l roleLimits) forRoles(roles []string) float64 {
+	limit, overridden := l.def, false
+	for _, role := range roles {
+		value, ok := l.roles[role]
+		if !ok {
+			continue
+		}
+		if value == 0 {
+			return 0
+		}
+		if !overridden || value > limit {
+			limit, overridden = value, true
+		}
+	}
+	return limit
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// bucketSet holds token buckets by key. A bucket that has refilled
+// completely is indistinguishable from a new one, so prune drops those.
+type bucketSet struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+	// fullAt is when each bucket will be full again.
+	fullAt map[string]time.Time
+}
+
+func newBucketSet() *bucketSet {
+	return &bucketSet{
+		buckets: make(map[string]*tokenBucket),
+		fullAt:  make(map[string]time.Time),
+	}
+}
+
+// take removes n tokens from the bucket, refilling at rate per second up to
+// burst. If allowDebt is set the bucket may go negative and the caller waits
+// out the returned delay; otherwise nothing is taken when tokens are short
+// and the delay says when they will be available.
+func (s *bucketSet) take(key string, rate, burst, n float64, allowDebt bool, now time.Time) time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: burst, last: now}
+		s.buckets[key] = b
+	}
+	b.tokens = min(burst, b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+
+	if b.tokens < n && !allowDebt {
+		s.fullAt[key] = now.Add(time.Duration((burst - b.tokens) / rate * float64(time.Second)))
+		return time.Duration((n - b.tokens) / rate * float64(time.Second))
+	}
+	b.tokens -= n
+	s.fullAt[key] = now.Add(time.Duration((burst - b.tokens) / rate * float64(time.Second)))
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / rate * float64(time.Second))
+}
+
+func (s *bucketSet) prune(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key, full := range s.fullAt {
+		if !full.After(now) {
+			delete(s.buckets, key)
+			delete(s.fullAt, key)
+		}
+	}
+}
+
+type cachedRoles struct {
+	roles   []string
+	expires time.Time
+}
+
+type trafficLimits struct {
+	list, auth roleLimits
+	// Bytes per second.
+	userBandwidth      roleLimits
+	namespaceBandwidth float64
+
+	requests  *bucketSet
+	transfers *bucketSet
+
+	rolesMu sync.Mutex
+	roles   map[int64]cachedRoles
+}
+
+func newTrafficLimits(list, auth, userBandwidth roleLimits, namespaceBandwidth float64) *trafficLimits {
+	return &trafficLimits{
+		list:               list,
+		auth:               auth,
+		userBandwidth:      userBandwidth,
+		namespaceBandwidth: namespaceBandwidth,
+		requests:           newBucketSet(),
+		transfers:          newBucketSet(),
+		roles:              make(map[int64]cachedRoles),
+	}
+}
+
+// caller identifies who a request is limited as, with their roles.
+func (s *server) caller(r *http.Request) (string, []string) {
+	session := s.session(r)
+	if session == nil {
+		return "ip:" + s.clientIP(r), nil
+	}
+	key := "user:" + strconv.FormatInt(session.UserID, 10)
+
+	l := s.limits
+	now := time.Now()
+	l.rolesMu.Lock()
+	cached, ok := l.roles[session.UserID]
+	l.rolesMu.Unlock()
+	if ok && now.Before(cached.expires) {
+		return key, cached.roles
+	}
+	roles, err := s.userRoles(session.UserID)
+	if err != nil {
+		// Fall back to the defaults rather than failing the request.
+		return key, nil
+	}
+	l.rolesMu.Lock()
+	l.roles[session.UserID] = cachedRoles{roles: roles, expires: now.Add(rateLimitRoleTTL)}
+	l.rolesMu.Unlock()
+	return key, roles
+}
+
+// rateLimit wraps a handler with the request limit for its class and answers
+// 429 with Retry-After once the caller is over it.
+func (s *server) rateLimit(class string, next http.HandlerFunc) http.HandlerFunc {
+	limits := s.limits.list
+	if class == rateClassAuth {
+		limits = s.limits.auth
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		key, roles := s.caller(r)
+		if perMinute := limits.forRoles(roles); perMinute > 0 {
+			// Bursts of up to a quarter of the per-minute limit.
+			burst := max(perMinute/4, 1)
+			if wait := s.limits.requests.take(class+":"+key, perMinute/60, burst, 1, false, time.Now()); wait > 0 {
+				rateLimitedTotal.WithLabelValues(class).Inc()
+				w.Header().Set("Retry-After", retryAfterSeconds(wait))
+				http.Error(w, "too many requests, try again later", http.StatusTooManyRequests)
+				return
+			}
+		}
+		next(w, r)
+	}
+}
+
+// transferThrottle paces one upload or download against the caller's and the
+// namespace's bandwidth limits. A nil throttle doesn't limit anything.
+type transferThrottle struct {
+	ctx       context.Context
+	buckets   *bucketSet
+	direction string
+	keys      []string
+	rates     []float64
+}
+
+// throttle returns the throttle for a transfer, or nil when neither limit
+// applies to it.
+func (s *server) throttle(ctx context.Context, r *http.Request, namespace, direction string) *transferThrottle {
+	key, roles := s.caller(r)
+	t := &transferThrottle{ctx: ctx, buckets: s.limits.transfers, direction: direction}
+	if rate := s.limits.userBandwidth.forRoles(roles); rate > 0 {
+		t.keys = append(t.keys, key)
+		t.rates = append(t.rates, rate)
+	}
+	if rate := s.limits.namespaceBandwidth; rate > 0 {
+		t.keys = append(t.keys, "ns:"+namespace)
+		t.rates = append(t.rates, rate)
+	}
+	if len(t.keys) == 0 {
+		return nil
+	}
+	return t
+}
+
+// wait accounts for n transferred bytes and sleeps until every bucket is
+// back in credit. Buckets hold one second of bandwidth.
+func (t *transferThrottle) wait(n int) error {
+	if t == nil || n <= 0 {
+		return nil
+	}
+	now := time.Now()
+	var delay time.Duration
+	for i, key := range t.keys {
+		delay = max(delay, t.buckets.take(key, t.rates[i], t.rates[i], float64(n), true, now))
+	}
+	if delay <= 0 {
+		return nil
+	}
+	throttledSeconds.WithLabelValues(t.direction).Add(delay.Seconds())
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-t.ctx.Done():
+		return t.ctx.Err()
+	}
+}
+
+// pruneTrafficLimits drops idle buckets and expired role lookups.
+func (s *server) pruneTrafficLimits(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		now := time.Now()
+		s.limits.requests.prune(now)
+		s.limits.transfers.prune(now)
+		s.limits.rolesMu.Lock()
+		for userID, cached := range s.limits.roles {
+			if now.After(cached.expires) {
+				delete(s.limits.roles, userID)
+			}
+		}
+		s.limits.rolesMu.Unlock()
+	}
+}
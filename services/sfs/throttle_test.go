@@ -0,0 +1,91 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseRoleLimits(t *testing.T) {
+	tests := []struct {
+		spec    string
+		roles   []string
+		want    float64
+		wantErr bool
+	}{
+		{spec: "120", want: 120},
+		{spec: "120", roles: []string{roleAuditor}, want: 120},
+		{spec: "120,storage-admin=600", roles: []string{roleStorageAdmin}, want: 600},
+		{spec: "120,auditor=30", roles: []string{roleAuditor}, want: 30},
+		{spec: "120,auditor=30,storage-admin=600", roles: []string{roleAuditor, roleStorageAdmin}, want: 600},
+		{spec: "120,auditor=30,storage-admin=600", roles: []string{roleStorageAdmin, roleAuditor}, want: 600},
+		{spec: "120,admin=0,storage-admin=600", roles: []string{roleStorageAdmin, roleAdmin}, want: 0},
+		{spec: "0,auditor=30", want: 0},
+		{spec: " 120 , storage-admin = 600 ", roles: []string{roleStorageAdmin}, want: 600},
+		{spec: "storage-admin=600", roles: []string{roleAuditor}, want: 0},
+		{spec: "120,60", wantErr: true},
+		{spec: "120,nobody=5", wantErr: true},
+		{spec: "-1", wantErr: true},
+		{spec: "fast", wantErr: true},
+	}
+	for _, tt := range tests {
+		limits, err := parseRoleLimits(tt.spec)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseRoleLimits(%q) accepted", tt.spec)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseRoleLimits(%q): %v", tt.spec, err)
+			continue
+		}
+		if got := limits.forRoles(tt.roles); got != tt.want {
+			t.Errorf("parseRoleLimits(%q).forRoles(%v) = %v, want %v", tt.spec, tt.roles, got, tt.want)
+		}
+	}
+}
+
+func TestBucketTake(t *testing.T) {
+	start := time.Unix(1_700_000_000, 0)
+	tests := []struct {
+		name      string
+		allowDebt bool
+		at        time.Duration // since start
+		n         float64
+		want      time.Duration
+	}{
+		// rate 2/s, burst 4
+		{"within burst", false, 0, 3, 0},
+		{"short, refused", false, 0, 3, time.Second},
+		{"refilled", false, time.Second, 3, 0},
+		{"debt allowed", true, time.Second, 4, 2 * time.Second},
+		{"still in debt", false, 2 * time.Second, 1, 1500 * time.Millisecond},
+		{"debt repaid", false, 4 * time.Second, 1, 0},
+	}
+	buckets := newBucketSet()
+	for _, tt := range tests {
+		if got := buckets.take("k", 2, 4, tt.n, tt.allowDebt, start.Add(tt.at)); got != tt.want {
+			t.Errorf("%s: take = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestBucketPrune(t *testing.T) {
+	start := time.Unix(1_700_000_000, 0)
+	buckets := newBucketSet()
+	buckets.take("drained", 1, 10, 10, false, start)
+	buckets.take("touched", 1, 10, 1, false, start)
+	buckets.take("refused", 1, 10, 20, false, start)
+
+	buckets.prune(start.Add(time.Second))
+	for key, want := range map[string]bool{"drained": true, "touched": false, "refused": false} {
+		if _, ok := buckets.buckets[key]; ok != want {
+			t.Errorf("after 1s, %s kept = %v, want %v", key, ok, want)
+		}
+	}
+
+	buckets.prune(start.Add(10 * time.Second))
+	if len(buckets.buckets) != 0 || len(buckets.fullAt) != 0 {
+		t.Errorf("after 10s, %d buckets left", len(buckets.buckets))
+	}
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Access tokens are short-lived EdDSA JWTs that other services (compute)
+// verify locally against /.well-known/jwks.json instead of calling
+// /api/session. The session cookie stays the long-lived credential: clients
+// trade it for a fresh access token at POST /api/token before expiry.
+//
+// Signing keys live in the signing_keys table so every replica signs with
+// the same key and publishes the same set. A new key is generated one reload
+// interval before the newest one is due for rotation, and nothing signs with
+// it until it is that old: by then every replica and every verifier caching
+// the JWKS has seen it. Older keys stay published for another period so
+// tokens signed just before a rotation keep verifying.
+
+const (
+	accessTokenIssuer   = "edd-cloud-sfs"
+	accessTokenAudience = "edd-cloud"
+	accessCookieName    = "sfs_access"
+	// Keys are deleted once they are this many rotation periods old.
+	signingKeyRetention = 3
+	// signingKeyReload is how often replicas reload keys, and how long a new
+	// key is published before it signs anything. It covers compute's JWKS
+	// refresh interval and the JWKS Cache-Control max-age.
+	signingKeyReload = 10 * time.Minute
+)
+
+type signingKey struct {
+	ID        string
+	Private   ed25519.PrivateKey
+	CreatedAt time.Time
+}
+
+type tokenSigner struct {
+	ttl      time.Duration
+	rotation time.Duration
+
+	mu   sync.RWMutex
+	keys []signingKey // newest first
+}
+
+type accessClaims struct {
+	Issuer    string   `json:"iss"`
+	Audience  string   `json:"aud"`
+	Subject   string   `json:"sub"`
+	Username  string   `json:"preferred_username"`
+	Roles     []string `json:"roles"`
+	IssuedAt  int64    `json:"iat"`
+	ExpiresAt int64    `json:"exp"`
+}
+
+type accessTokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresAt   int64  `json:"expires_at"`
+}
+
+// loadSigningKeys reads the published keys, generating a new one first when
+// the newest is within a reload interval of rotation.
+func (s *server) loadSigningKeys() error {
+	now := time.Now()
+	keys, err := s.querySigningKeys(now)
+	if err != nil {
+		return err
+	}
+	if len(keys) == 0 || now.Sub(keys[0].CreatedAt) >= s.tokens.rotation-signingKeyReload {
+		if err := s.createSigningKey(now); err != nil {
+			return err
+		}
+		if keys, err = s.querySigningKeys(now); err != nil {
+			return err
+		}
+		if _, err := s.db.Exec(
+			`DELETE FROM signing_keys WHERE created_at < $1`,
+			now.Add(-signingKeyRetention*s.tokens.rotation).Unix(),
+		); err != nil {
+			log.Printf("failed to delete expired signing keys: %v", err)
+		}
+	}
+
+	s.tokens.mu.Lock()
+	s.tokens.keys = keys
+	s.tokens.mu.Unlock()
+	return nil
+}
+
+func (s *server) querySigningKeys(now time.Time) ([]signingKey, error) {
+	rows, err := s.db.Query(
+		`SELECT kid, private_key, created_at FROM signing_keys
+		 WHERE created_at > $1 ORDER BY created_at DESC`,
+		now.Add(-2*s.tokens.rotation).Unix(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := make([]signingKey, 0, 2)
+	for rows.Next() {
+		var (
+			key       signingKey
+			encoded   string
+			createdAt int64
+		)
+		if err := rows.Scan(&key.ID, &encoded, &createdAt); err != nil {
+			return nil, err
+		}
+		seed, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(seed) != ed25519.SeedSize {
+			return nil, fmt.Errorf("signing key %s is malformed", key.ID)
+		}
+		key.Private = ed25519.NewKeyFromSeed(seed)
+		key.CreatedAt = time.Unix(createdAt, 0)
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+func (s *server) createSigningKey(now time.Time) error {
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	kid, err := generateToken(12)
+	if err != nil {
+		return err
+	}
+	if _, err := s.db.Exec(
+		`INSERT INTO signing_keys (kid, private_key, created_at) VALUES ($1, $2, $3)`,
+		kid,
+		base64.StdEncoding.EncodeToString(private.Seed()),
+		now.Unix(),
+	); err != nil {
+		return err
+	}
+	log.Printf("generated token signing key kid=%s", kid)
+	return nil
+}
+
+// rotateSigningKeys reloads keys periodically, picking up keys created by
+// other replicas and rotating when due.
+func (s *server) rotateSigningKeys(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := s.loadSigningKeys(); err != nil {
+			log.Printf("signing key reload failed: %v", err)
+		}
+	}
+}
+
+// activeKey picks the newest key that has been published for a full reload
+// interval. On first start there is only a brand new key, and nothing can
+// verify tokens yet anyway, so the oldest key loaded stands in.
+func activeKey(keys []signingKey, now time.Time) signingKey {
+	for _, key := range keys {
+		if now.Sub(key.CreatedAt) >= signingKeyReload {
+			return key
+		}
+	}
+	return keys[len(keys)-1]
+}
+
+func (t *tokenSigner) sign(claims accessClaims) (string, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if len(t.keys) == 0 {
+		return "", errors.New("no signing key loaded")
+	}
+	key := activeKey(t.keys, time.Now())
+
+	header, err := json.Marshal(map[string]string{"alg": "EdDSA", "typ": "JWT", "kid": key.ID})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	signature := ed25519.Sign(key.Private, []byte(signingInput))
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// issueAccessToken signs a token for the user and sets it as the access
+// cookie, which browsers send along to compute (including WebSockets).
+func (s *server) issueAccessToken(w http.ResponseWriter, r *http.Request, userID int64) (accessTokenResponse, error) {
+	var username string
+	if err := s.db.QueryRow(`SELECT username FROM users WHERE id = $1`, userID).Scan(&username); err != nil {
+		return accessTokenResponse{}, err
+	}
+	roles, err := s.userRoles(userID)
+	if err != nil {
+		return accessTokenResponse{}, err
+	}
+
+	now := time.Now()
+	expires := now.Add(s.tokens.ttl)
+	token, err := s.tokens.sign(accessClaims{
+		Issuer:    accessTokenIssuer,
+		Audience:  accessTokenAudience,
+		Subject:   strconv.FormatInt(userID, 10),
+		Username:  username,
+		Roles:     roles,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: expires.Unix(),
+	})
+	if err != nil {
+		return accessTokenResponse{}, err
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     accessCookieName,
+		Value:    token,
+		Path:     "/",
+		Domain:   getCookieDomain(r),
+		Expires:  expires,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+		Secure:   isSecureRequest(r),
+	})
+	return accessTokenResponse{AccessToken: token, TokenType: "Bearer", ExpiresAt: expires.Unix()}, nil
+}
+
+// handleToken exchanges the session cookie for a fresh access token: POST
+// /api/token.
+func (s *server) handleToken(w http.ResponseWriter, r *http.Request) {
+	session := s.session(r)
+	if session == nil {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	resp, err := s.issueAccessToken(w, r, session.UserID)
+	if err != nil {
+		http.Error(w, "failed to issue token", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, resp)
+}
+
+// handleJWKS publishes the token verification keys: GET
+// /.well-known/jwks.json.
+func (s *server) handleJWKS(w http.ResponseWriter, r *http.Request) {
+	s.tokens.mu.RLock()
+	keys := make([]jsonWebKey, 0, len(s.tokens.keys))
+	for _, key := range s.tokens.keys {
+		keys = append(keys, jsonWebKey{
+			Kid: key.ID,
+			Kty: "OKP",
+			Alg: "EdDSA",
+			Use: "sig",
+			Crv: "Ed25519",
+			X:   base64.RawURLEncoding.EncodeToString(key.Private.Public().(ed25519.PublicKey)),
+		})
+	}
+	s.tokens.mu.RUnlock()
+
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	writeJSON(w, map[string]any{"keys": keys})
+}
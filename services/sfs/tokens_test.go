@@ -0,0 +1,29 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestActiveKey(t *testing.T) {
+	now := time.Now()
+	fresh := signingKey{ID: "fresh", CreatedAt: now.Add(-time.Minute)}
+	current := signingKey{ID: "current", CreatedAt: now.Add(-24 * time.Hour)}
+	previous := signingKey{ID: "previous", CreatedAt: now.Add(-8 * 24 * time.Hour)}
+
+	tests := []struct {
+		name string
+		keys []signingKey
+		want string
+	}{
+		{"new key not yet published long enough", []signingKey{fresh, current, previous}, "current"},
+		{"new key published for a reload interval", []signingKey{{ID: "next", CreatedAt: now.Add(-signingKeyReload)}, current}, "next"},
+		{"first start", []signingKey{fresh}, "fresh"},
+		{"only fresh keys", []signingKey{fresh, {ID: "older", CreatedAt: now.Add(-2 * time.Minute)}}, "older"},
+	}
+	for _, tt := range tests {
+		if got := activeKey(tt.keys, now); got.ID != tt.want {
+			t.Errorf("%s: signed with %s, want %s", tt.name, got.ID, tt.want)
+		}
+	}
+}
@@ -0,0 +1,553 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// TOTP parameters follow RFC 6238 defaults, which every authenticator app
+// understands.
+const (
+	totpIssuer        = "Edd Cloud"
+	totpPeriod        = 30
+	totpDigits        = 6
+	totpModulo        = 1_000_000 // 10^totpDigits
+	totpSkew          = 1
+	recoveryCodeCount = 10
+
+	loginChallengeTTL         = 5 * time.Minute
+	loginChallengeMaxAttempts = 5
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+func generateTOTPSecret() (string, error) {
+	buf := make([]byte, 20)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(buf), nil
+}
+
+// totpCode computes the code for one time step (RFC 4226 dynamic truncation).
+func totpCode(secret []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%totpModulo)
+}
+
+func totpURI(username, secret string) string {
+	label := url.PathEscape(totpIssuer + ":" + username)
+	query := url.Values{}
+	query.Set("secret", secret)
+	query.Set("issuer", totpIssuer)
+	query.Set("algorithm", "SHA1")
+	query.Set("digits", strconv.Itoa(totpDigits))
+	query.Set("period", strconv.Itoa(totpPeriod))
+	return "otpauth://totp/" + label + "?" + query.Encode()
+}
+
+func normalizeCode(code string) string {
+	return strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), " ", ""))
+}
+
+// verifyTOTP checks a code against the user's secret, allowing one step of
+// clock skew. A step can only be used once, so an observed code cannot be
+// replayed.
+func (s *server) verifyTOTP(userID int64, code string) (bool, error) {
+	code = normalizeCode(code)
+	if len(code) != totpDigits {
+		return false, nil
+	}
+	var encoded string
+	var lastStep int64
+	if err := s.db.QueryRow(`SELECT totp_secret, totp_last_step FROM users WHERE id = $1`, userID).Scan(&encoded, &lastStep); err != nil {
+		return false, err
+	}
+	if encoded == "" {
+		return false, nil
+	}
+	secret, err := totpEncoding.DecodeString(encoded)
+	if err != nil {
+		return false, fmt.Errorf("invalid totp secret: %w", err)
+	}
+
+	now := time.Now().Unix() / totpPeriod
+	for step := now - totpSkew; step <= now+totpSkew; step++ {
+		if step <= lastStep || !hmac.Equal([]byte(totpCode(secret, step)), []byte(code)) {
+			continue
+		}
+		result, err := s.db.Exec(
+			`UPDATE users SET totp_last_step = $1 WHERE id = $2 AND totp_last_step < $1`,
+			step,
+			userID,
+		)
+		if err != nil {
+			return false, err
+		}
+		used, _ := result.RowsAffected()
+		return used == 1, nil
+	}
+	return false, nil
+}
+
+func hashRecoveryCode(code string) string {
+	sum := sha256.Sum256([]byte(strings.ReplaceAll(normalizeCode(code), "-", "")))
+	return hex.EncodeToString(sum[:])
+}
+
+// replaceRecoveryCodes discards the user's recovery codes and returns a fresh
+// set. Only hashes are stored; the plain codes are shown once.
+func (s *server) replaceRecoveryCodes(userID int64) ([]string, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM totp_recovery_codes WHERE user_id = $1`, userID); err != nil {
+		return nil, err
+	}
+	codes := make([]string, 0, recoveryCodeCount)
+	for i := 0; i < recoveryCodeCount; i++ {
+		buf := make([]byte, 7)
+		if _, err := rand.Read(buf); err != nil {
+			return nil, err
+		}
+		raw := strings.ToLower(totpEncoding.EncodeToString(buf))[:10]
+		code := raw[:5] + "-" + raw[5:]
+		if _, err := tx.Exec(
+			`INSERT INTO totp_recovery_codes (user_id, code_hash) VALUES ($1, $2)`,
+			userID,
+			hashRecoveryCode(code),
+		); err != nil {
+			return nil, err
+		}
+		codes = append(codes, code)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+func (s *server) useRecoveryCode(userID int64, code string) (bool, error) {
+	if strings.TrimSpace(code) == "" {
+		return false, nil
+	}
+	result, err := s.db.Exec(
+		`UPDATE totp_recovery_codes SET used_at = $1
+		 WHERE id = (
+		   SELECT id FROM totp_recovery_codes
+		   WHERE user_id = $2 AND code_hash = $3 AND used_at = 0
+		   LIMIT 1
+		 )`,
+		time.Now().Unix(),
+		userID,
+		hashRecoveryCode(code),
+	)
+	if err != nil {
+		return false, err
+	}
+	used, _ := result.RowsAffected()
+	return used == 1, nil
+}
+
+// verifySecondFactor accepts either a TOTP code or an unused recovery code.
+func (s *server) verifySecondFactor(userID int64, code, recoveryCode string) (ok bool, usedRecovery bool, err error) {
+	if code != "" {
+		ok, err = s.verifyTOTP(userID, code)
+		return ok, false, err
+	}
+	ok, err = s.useRecoveryCode(userID, recoveryCode)
+	return ok, ok, err
+}
+
+func (s *server) resetTOTP(userID int64) error {
+	if _, err := s.db.Exec(
+		`UPDATE users SET totp_secret = '', totp_enabled = 0, totp_last_step = 0 WHERE id = $1`,
+		userID,
+	); err != nil {
+		return err
+	}
+	_, err := s.db.Exec(`DELETE FROM totp_recovery_codes WHERE user_id = $1`, userID)
+	return err
+}
+
+type loginChallenge struct {
+	TwoFactorRequired bool   `json:"two_factor_required"`
+	Challenge         string `json:"challenge"`
+	ExpiresAt         int64  `json:"expires_at"`
+}
+
+func (s *server) createLoginChallenge(userID int64) (loginChallenge, error) {
+	token, err := generateToken(32)
+	if err != nil {
+		return loginChallenge{}, err
+	}
+	now := time.Now()
+	_, _ = s.db.Exec(`DELETE FROM login_challenges WHERE expires_at < $1`, now.Unix())
+	expires := now.Add(loginChallengeTTL).Unix()
+	if _, err := s.db.Exec(
+		`INSERT INTO login_challenges (token, user_id, expires_at) VALUES ($1, $2, $3)`,
+		token,
+		userID,
+		expires,
+	); err != nil {
+		return loginChallenge{}, err
+	}
+	return loginChallenge{TwoFactorRequired: true, Challenge: token, ExpiresAt: expires}, nil
+}
+
+type loginTOTPRequest struct {
+	Challenge    string `json:"challenge"`
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recovery_code"`
+}
+
+// handleLoginTOTP completes a two-factor login: POST /api/login/2fa with the
+// challenge from /api/login and a TOTP or recovery code.
+func (s *server) handleLoginTOTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var payload loginTOTPRequest
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		http.Error(w, "invalid payload", http.StatusBadRequest)
+		return
+	}
+	if payload.Challenge == "" || (payload.Code == "" && payload.RecoveryCode == "") {
+		http.Error(w, "challenge and code required", http.StatusBadRequest)
+		return
+	}
+
+	var (
+		userID      int64
+		expiresAt   int64
+		username    string
+		displayName string
+		disabled    int
+	)
+	err := s.db.QueryRow(
+		`SELECT login_challenges.user_id, login_challenges.expires_at, users.username, COALESCE(users.display_name, users.username), users.disabled
+		 FROM login_challenges
+		 JOIN users ON login_challenges.user_id = users.id
+		 WHERE login_challenges.token = $1`,
+		payload.Challenge,
+	).Scan(&userID, &expiresAt, &username, &displayName, &disabled)
+	if err != nil || time.Now().Unix() > expiresAt {
+		_, _ = s.db.Exec(`DELETE FROM login_challenges WHERE token = $1`, payload.Challenge)
+		http.Error(w, "login challenge expired, sign in again", http.StatusUnauthorized)
+		return
+	}
+	// The account may have been disabled after the password step.
+	if disabled != 0 {
+		_, _ = s.db.Exec(`DELETE FROM login_challenges WHERE token = $1`, payload.Challenge)
+		http.Error(w, "account disabled", http.StatusForbidden)
+		return
+	}
+
+	ip := s.clientIP(r)
+	if wait := s.loginRetryAfter(loginUserKey(username), loginIPKey(ip)); wait > 0 {
+		w.Header().Set("Retry-After", retryAfterSeconds(wait))
+		http.Error(w, "too many failed login attempts, try again later", http.StatusTooManyRequests)
+		return
+	}
+
+	ok, usedRecovery, err := s.verifySecondFactor(userID, payload.Code, payload.RecoveryCode)
+	if err != nil {
+		http.Error(w, "failed to verify code", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		s.recordLoginFailure(username, ip)
+		var attempts int
+		if err := s.db.QueryRow(
+			`UPDATE login_challenges SET attempts = attempts + 1 WHERE token = $1 RETURNING attempts`,
+			payload.Challenge,
+		).Scan(&attempts); err == nil && attempts >= loginChallengeMaxAttempts {
+			_, _ = s.db.Exec(`DELETE FROM login_challenges WHERE token = $1`, payload.Challenge)
+		}
+		http.Error(w, "invalid code", http.StatusUnauthorized)
+		return
+	}
+
+	_, _ = s.db.Exec(`DELETE FROM login_challenges WHERE token = $1`, payload.Challenge)
+	s.clearLoginFailures(username)
+	if usedRecovery {
+		s.recordAudit("", username, "2fa.recovery_code_used", "signed in with a recovery code")
+	}
+	if displayName == "" {
+		displayName = username
+	}
+	if err := s.startSession(w, r, userID); err != nil {
+		http.Error(w, "failed to create session", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, s.sessionFor(userID, username, displayName))
+}
+
+type totpStatus struct {
+	Enabled                bool `json:"enabled"`
+	Pending                bool `json:"pending"`
+	RecoveryCodesRemaining int  `json:"recovery_codes_remaining"`
+}
+
+// handleTOTPStatus handles GET /api/account/2fa.
+func (s *server) handleTOTPStatus(w http.ResponseWriter, r *http.Request) {
+	userID, ok := s.requireUserID(w, r)
+	if !ok {
+		return
+	}
+	var secret string
+	var enabled int
+	var status totpStatus
+	if err := s.db.QueryRow(`SELECT totp_secret, totp_enabled FROM users WHERE id = $1`, userID).Scan(&secret, &enabled); err != nil {
+		http.Error(w, "failed to load account", http.StatusInternalServerError)
+		return
+	}
+	status.Enabled = enabled != 0
+	status.Pending = !status.Enabled && secret != ""
+	_ = s.db.QueryRow(
+		`SELECT COUNT(1) FROM totp_recovery_codes WHERE user_id = $1 AND used_at = 0`,
+		userID,
+	).Scan(&status.RecoveryCodesRemaining)
+	writeJSON(w, status)
+}
+
+type totpSetupResponse struct {
+	Secret     string `json:"secret"`
+	OTPAuthURI string `json:"otpauth_uri"`
+}
+
+// handleTOTPSetup generates a new secret for enrollment. 2FA stays off until
+// the user proves their authenticator works via /api/account/2fa/enable.
+func (s *server) handleTOTPSetup(w http.ResponseWriter, r *http.Request) {
+	username, ok := s.requireAuth(w, r)
+	if !ok {
+		return
+	}
+	userID, ok := s.requireUserID(w, r)
+	if !ok {
+		return
+	}
+
+	var enabled int
+	if err := s.db.QueryRow(`SELECT totp_enabled FROM users WHERE id = $1`, userID).Scan(&enabled); err != nil {
+		http.Error(w, "failed to load account", http.StatusInternalServerError)
+		return
+	}
+	if enabled != 0 {
+		http.Error(w, "two-factor authentication is already enabled", http.StatusConflict)
+		return
+	}
+
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		http.Error(w, "failed to generate secret", http.StatusInternalServerError)
+		return
+	}
+	if _, err := s.db.Exec(
+		`UPDATE users SET totp_secret = $1, totp_last_step = 0 WHERE id = $2`,
+		secret,
+		userID,
+	); err != nil {
+		http.Error(w, "failed to save secret", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, totpSetupResponse{Secret: secret, OTPAuthURI: totpURI(username, secret)})
+}
+
+type totpCodeRequest struct {
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recovery_code"`
+	Password     string `json:"password"`
+}
+
+// handleTOTPEnable confirms enrollment with a first code and returns the
+// recovery codes.
+func (s *server) handleTOTPEnable(w http.ResponseWriter, r *http.Request) {
+	username, ok := s.requireAuth(w, r)
+	if !ok {
+		return
+	}
+	userID, ok := s.requireUserID(w, r)
+	if !ok {
+		return
+	}
+
+	var payload totpCodeRequest
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		http.Error(w, "invalid payload", http.StatusBadRequest)
+		return
+	}
+	valid, err := s.verifyTOTP(userID, payload.Code)
+	if err != nil {
+		http.Error(w, "failed to verify code", http.StatusInternalServerError)
+		return
+	}
+	if !valid {
+		http.Error(w, "invalid code", http.StatusBadRequest)
+		return
+	}
+
+	if _, err := s.db.Exec(`UPDATE users SET totp_enabled = 1 WHERE id = $1`, userID); err != nil {
+		http.Error(w, "failed to enable two-factor authentication", http.StatusInternalServerError)
+		return
+	}
+	codes, err := s.replaceRecoveryCodes(userID)
+	if err != nil {
+		http.Error(w, "failed to create recovery codes", http.StatusInternalServerError)
+		return
+	}
+	s.recordAudit("", username, "2fa.enable", "")
+	writeJSON(w, map[string]any{"enabled": true, "recovery_codes": codes})
+}
+
+// handleTOTPDisable turns 2FA off. It needs the password and a current code
+// so a hijacked session alone cannot remove the second factor.
+func (s *server) handleTOTPDisable(w http.ResponseWriter, r *http.Request) {
+	username, ok := s.requireAuth(w, r)
+	if !ok {
+		return
+	}
+	userID, ok := s.requireUserID(w, r)
+	if !ok {
+		return
+	}
+
+	var payload totpCodeRequest
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		http.Error(w, "invalid payload", http.StatusBadRequest)
+		return
+	}
+	var hash string
+	if err := s.db.QueryRow(`SELECT password_hash FROM users WHERE id = $1`, userID).Scan(&hash); err != nil {
+		http.Error(w, "failed to load account", http.StatusInternalServerError)
+		return
+	}
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(payload.Password)) != nil {
+		http.Error(w, "invalid password", http.StatusBadRequest)
+		return
+	}
+	valid, _, err := s.verifySecondFactor(userID, payload.Code, payload.RecoveryCode)
+	if err != nil {
+		http.Error(w, "failed to verify code", http.StatusInternalServerError)
+		return
+	}
+	if !valid {
+		http.Error(w, "invalid code", http.StatusBadRequest)
+		return
+	}
+
+	if err := s.resetTOTP(userID); err != nil {
+		http.Error(w, "failed to disable two-factor authentication", http.StatusInternalServerError)
+		return
+	}
+	s.recordAudit("", username, "2fa.disable", "")
+	writeJSON(w, map[string]string{"status": "ok"})
+}
+
+// handleTOTPRecoveryCodes replaces the recovery codes after checking a
+// current TOTP code.
+func (s *server) handleTOTPRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	username, ok := s.requireAuth(w, r)
+	if !ok {
+		return
+	}
+	userID, ok := s.requireUserID(w, r)
+	if !ok {
+		return
+	}
+
+	var payload totpCodeRequest
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		http.Error(w, "invalid payload", http.StatusBadRequest)
+		return
+	}
+	var enabled int
+	if err := s.db.QueryRow(`SELECT totp_enabled FROM users WHERE id = $1`, userID).Scan(&enabled); err != nil || enabled == 0 {
+		http.Error(w, "two-factor authentication is not enabled", http.StatusBadRequest)
+		return
+	}
+	valid, err := s.verifyTOTP(userID, payload.Code)
+	if err != nil {
+		http.Error(w, "failed to verify code", http.StatusInternalServerError)
+		return
+	}
+	if !valid {
+		http.Error(w, "invalid code", http.StatusBadRequest)
+		return
+	}
+
+	codes, err := s.replaceRecoveryCodes(userID)
+	if err != nil {
+		http.Error(w, "failed to create recovery codes", http.StatusInternalServerError)
+		return
+	}
+	s.recordAudit("", username, "2fa.recovery_codes", "regenerated")
+	writeJSON(w, map[string]any{"recovery_codes": codes})
+}
+
+// handleAdminUserTOTPReset clears a user's 2FA enrollment, for users who lost
+// both their authenticator and recovery codes: DELETE /admin/users/2fa?id=.
+func (s *server) handleAdminUserTOTPReset(w http.ResponseWriter, r *http.Request) {
+	username, ok := s.requireRole(w, r)
+	if !ok {
+		return
+	}
+	if r.Method != http.MethodDelete {
+		w.Header().Set("Allow", http.MethodDelete)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id, err := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid id", http.StatusBadRequest)
+		return
+	}
+	var target string
+	if err := s.db.QueryRow(`SELECT username FROM users WHERE id = $1`, id).Scan(&target); err != nil {
+		http.Error(w, "user not found", http.StatusNotFound)
+		return
+	}
+	if err := s.resetTOTP(id); err != nil {
+		http.Error(w, "failed to reset two-factor authentication", http.StatusInternalServerError)
+		return
+	}
+	s.recordAudit("", username, "2fa.reset", fmt.Sprintf("reset for %s", target))
+	writeJSON(w, map[string]string{"status": "ok"})
+}
+
+// requireUserID is requireAuth for handlers that need the numeric user ID.
+func (s *server) requireUserID(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	userID, ok := s.currentUserID(r)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return 0, false
+	}
+	return int64(userID), true
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// RFC 6238 appendix B, SHA-1, truncated to our six digits.
+func TestTOTPCode(t *testing.T) {
+	secret := []byte("12345678901234567890")
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, tt := range tests {
+		if got := totpCode(secret, tt.unix/totpPeriod); got != tt.want {
+			t.Errorf("totpCode at %d = %s, want %s", tt.unix, got, tt.want)
+		}
+	}
+}
+
+func TestVerifyTOTPRejectsReplay(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	s := &server{db: db}
+
+	secret := []byte("12345678901234567890")
+	encoded := totpEncoding.EncodeToString(secret)
+	step := time.Now().Unix() / totpPeriod
+	code := totpCode(secret, step)
+
+	// First use records the step.
+	mock.ExpectQuery(sqlText(`SELECT totp_secret, totp_last_step FROM users`)).
+		WithArgs(int64(7)).
+		WillReturnRows(sqlmock.NewRows([]string{"totp_secret", "totp_last_step"}).AddRow(encoded, 0))
+	mock.ExpectExec(sqlText(`UPDATE users SET totp_last_step = $1`)).
+		WithArgs(sqlmock.AnyArg(), int64(7)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	if ok, err := s.verifyTOTP(7, code); err != nil || !ok {
+		t.Fatalf("first use = %v, %v; want accepted", ok, err)
+	}
+
+	// The same code again is refused without touching the row.
+	mock.ExpectQuery(sqlText(`SELECT totp_secret, totp_last_step FROM users`)).
+		WithArgs(int64(7)).
+		WillReturnRows(sqlmock.NewRows([]string{"totp_secret", "totp_last_step"}).AddRow(encoded, step))
+	if ok, err := s.verifyTOTP(7, code); err != nil || ok {
+		t.Fatalf("replay = %v, %v; want refused", ok, err)
+	}
+
+	// A concurrent request that used the step first wins the update.
+	mock.ExpectQuery(sqlText(`SELECT totp_secret, totp_last_step FROM users`)).
+		WithArgs(int64(7)).
+		WillReturnRows(sqlmock.NewRows([]string{"totp_secret", "totp_last_step"}).AddRow(encoded, step-2))
+	mock.ExpectExec(sqlText(`UPDATE users SET totp_last_step = $1`)).
+		WithArgs(sqlmock.AnyArg(), int64(7)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	if ok, err := s.verifyTOTP(7, code); err != nil || ok {
+		t.Fatalf("raced use = %v, %v; want refused", ok, err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+var errFileExists = errors.New("file already exists")
+
+// prepareFile readies a path for a fresh write. An existing file is removed
+// when overwrite is set, otherwise errFileExists is returned. Reports whether
+// a file was replaced.
+func (s *server) prepareFile(ctx context.Context, namespace, name string, overwrite bool) (bool, error) {
+	if err := s.checkNamespaceWritable(namespace); err != nil {
+		return false, err
+	}
+	existing, err := s.storage.GetFileWithNamespace(ctx, name, s.gfsNamespace(namespace))
+	exists := err == nil && existing != nil
+	if exists {
+		if !overwrite {
+			return true, errFileExists
+		}
+		if err := s.deleteFile(ctx, namespace, name); err != nil {
+			return true, fmt.Errorf("failed to delete existing file: %w", err)
+		}
+	}
+	if err := s.storage.CreateFileWithNamespace(ctx, name, s.gfsNamespace(namespace)); err != nil {
+		return exists, fmt.Errorf("prepare file failed: %w", err)
+	}
+	s.adjustNamespaceStats(namespace, 1, 0, 0)
+	return exists, nil
+}
+
+// sanitizePath validates a file path that may contain directories, as used by
+// the path-based storage routes.
+func sanitizePath(raw string) (string, error) {
+	trimmed := strings.Trim(strings.TrimSpace(raw), "/")
+	if trimmed == "" {
+		return "", fmt.Errorf("filename required")
+	}
+	if strings.Contains(trimmed, "\\") {
+		return "", fmt.Errorf("invalid filename")
+	}
+	for _, segment := range strings.Split(trimmed, "/") {
+		if segment == "" || segment == "." || segment == ".." {
+			return "", fmt.Errorf("invalid filename")
+		}
+	}
+	return trimmed, nil
+}
+
+// handleFilePut stores the raw request body: PUT /storage/{namespace}/{file...}
+// Sending "If-None-Match: *" makes the request create-only; otherwise an
+// existing file is only replaced when ?overwrite=true is given.
+func (s *server) handleFilePut(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.requireAuth(w, r); !ok {
+		return
+	}
+
+	namespace, err := sanitizeNamespace(r.PathValue("namespace"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	rawName, err := url.PathUnescape(r.PathValue("file"))
+	if err != nil {
+		http.Error(w, "invalid filename", http.StatusBadRequest)
+		return
+	}
+	name, err := sanitizePath(rawName)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	exists, err := s.namespaceExists(namespace)
+	if err != nil {
+		http.Error(w, "failed to verify namespace", http.StatusInternalServerError)
+		return
+	}
+	if !exists {
+		http.Error(w, "namespace does not exist", http.StatusNotFound)
+		return
+	}
+	if !s.canAccessNamespace(r, namespace) {
+		s.denyAccess(w, r)
+		return
+	}
+
+	if s.maxUpload > 0 {
+		if r.ContentLength > s.maxUpload {
+			http.Error(w, "file too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, s.maxUpload)
+	}
+
+	finish, err := s.beginUpload(w)
+	if err != nil {
+		http.Error(w, err.Error(), storageErrorStatus(err))
+		return
+	}
+	defer finish()
+
+	createOnly := strings.TrimSpace(r.Header.Get("If-None-Match")) == "*"
+	overwrite := r.URL.Query().Get("overwrite") == "true" && !createOnly
+	transferID := s.transferID(r)
+
+	ctx, cancel := context.WithTimeout(r.Context(), s.uploadTTL)
+	defer cancel()
+
+	start := time.Now()
+	existed, err := s.prepareFile(ctx, namespace, name, overwrite)
+	if errors.Is(err, errFileExists) {
+		if createOnly {
+			http.Error(w, fmt.Sprintf("file already exists: %s", name), http.StatusPreconditionFailed)
+			return
+		}
+		http.Error(w, fmt.Sprintf("file already exists: %s", name), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), storageErrorStatus(err))
+		return
+	}
+
+	total := r.ContentLength
+	if total < 0 {
+		total = s.parseSizeHeader(r.Header.Get("X-File-Size"))
+	}
+	reporter := s.newReporter(transferID, "upload", total)
+	reporter.Update(0)
+	counting := &countingReader{
+		reader:   r.Body,
+		reporter: reporter,
+		throttle: s.throttle(ctx, r, namespace, "upload"),
+	}
+
+	if _, err := s.writeFile(ctx, namespace, name, counting); err != nil {
+		reporter.Error(err)
+		log.Printf("upload failed namespace=%s name=%s transfer=%s err=%v", namespace, name, transferID, err)
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			http.Error(w, "file too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, fmt.Sprintf("upload failed: %v", err), storageErrorStatus(err))
+		return
+	}
+	reporter.Done()
+	s.recordChange(namespace, writeOp(existed), name, "", counting.read)
+	log.Printf(
+		"upload ok namespace=%s name=%s size=%d transfer=%s duration=%s raw=true",
+		namespace,
+		name,
+		counting.read,
+		transferID,
+		time.Since(start).Truncate(time.Millisecond),
+	)
+
+	info := fileInfo{
+		Name:      name,
+		Path:      name,
+		Namespace: namespace,
+		Size:      uint64(counting.read),
+	}
+	if stored, err := s.storage.GetFileWithNamespace(ctx, name, s.gfsNamespace(namespace)); err == nil {
+		info.CreatedAt = stored.CreatedAt
+		info.ModifiedAt = stored.ModifiedAt
+		info.StoredSize = stored.Size
+	}
+	if status, err := s.fileScanStatus(namespace, name); err == nil {
+		info.ScanStatus = status
+	}
+	if !existed {
+		w.Header().Set("Location", r.URL.Path)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+	}
+	writeJSON(w, info)
+}
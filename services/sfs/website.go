@@ -0,0 +1,358 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const defaultWebsiteCacheSeconds = 300
+
+// websiteConfig controls how a namespace is served as a static site on
+// {namespace}.<sites-domain>.
+type websiteConfig struct {
+	Namespace     string `json:"namespace"`
+	IndexDocument string `json:"index_document"`
+	ErrorDocument string `json:"error_document,omitempty"`
+	SPAFallback   bool   `json:"spa_fallback"`
+	CacheSeconds  int    `json:"cache_seconds"`
+}
+
+func (s *server) loadWebsite(namespace string) (*websiteConfig, error) {
+	cfg := websiteConfig{Namespace: namespace}
+	var spa int
+	err := s.db.QueryRow(
+		`SELECT index_document, error_document, spa_fallback, cache_seconds FROM websites WHERE namespace = $1`,
+		namespace,
+	).Scan(&cfg.IndexDocument, &cfg.ErrorDocument, &spa, &cfg.CacheSeconds)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	cfg.SPAFallback = spa != 0
+	return &cfg, nil
+}
+
+func (s *server) saveWebsite(cfg websiteConfig) error {
+	spa := 0
+	if cfg.SPAFallback {
+		spa = 1
+	}
+	_, err := s.db.Exec(
+		`INSERT INTO websites (namespace, index_document, error_document, spa_fallback, cache_seconds)
+		 VALUES ($1, $2, $3, $4, $5)
+		 ON CONFLICT(namespace) DO UPDATE SET
+		   index_document = excluded.index_document,
+		   error_document = excluded.error_document,
+		   spa_fallback = excluded.spa_fallback,
+		   cache_seconds = excluded.cache_seconds`,
+		cfg.Namespace,
+		cfg.IndexDocument,
+		cfg.ErrorDocument,
+		spa,
+		cfg.CacheSeconds,
+	)
+	return err
+}
+
+// canManageNamespace reports whether the current user may change a
+// namespace's settings: its owner, an admin or a storage admin.
+func (s *server) canManageNamespace(r *http.Request, namespace string) bool {
+	username, ok := s.currentUser(r)
+	if !ok {
+		return false
+	}
+	if s.hasRole(username, roleStorageAdmin) {
+		return true
+	}
+	userID, ok := s.currentUserID(r)
+	if !ok {
+		return false
+	}
+	var ownerID *int
+	if err := s.db.QueryRow(`SELECT owner_id FROM namespaces WHERE name = $1`, namespace).Scan(&ownerID); err != nil {
+		return false
+	}
+	return ownerID != nil && *ownerID == userID
+}
+
+// handleNamespaceWebsite handles GET, PUT and DELETE on
+// /storage/namespaces/{name}/website.
+func (s *server) handleNamespaceWebsite(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.requireAuth(w, r); !ok {
+		return
+	}
+
+	name, err := sanitizeNamespace(r.PathValue("name"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if exists, err := s.namespaceExists(name); err != nil {
+		http.Error(w, "failed to check namespace", http.StatusInternalServerError)
+		return
+	} else if !exists {
+		http.Error(w, "namespace not found", http.StatusNotFound)
+		return
+	}
+	if !s.canManageNamespace(r, name) {
+		s.denyAccess(w, r)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		cfg, err := s.loadWebsite(name)
+		if err != nil {
+			http.Error(w, "failed to load website", http.StatusInternalServerError)
+			return
+		}
+		if cfg == nil {
+			http.Error(w, "website not enabled", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, cfg)
+	case http.MethodPut:
+		var payload websiteConfig
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			http.Error(w, "invalid payload", http.StatusBadRequest)
+			return
+		}
+		hidden, err := s.loadHiddenNamespaces()
+		if err != nil {
+			http.Error(w, "failed to load namespace", http.StatusInternalServerError)
+			return
+		}
+		if hidden[name] {
+			http.Error(w, "hidden namespaces cannot be published", http.StatusBadRequest)
+			return
+		}
+		cfg := websiteConfig{
+			Namespace:     name,
+			IndexDocument: strings.Trim(strings.TrimSpace(payload.IndexDocument), "/"),
+			ErrorDocument: strings.TrimPrefix(strings.TrimSpace(payload.ErrorDocument), "/"),
+			SPAFallback:   payload.SPAFallback,
+			CacheSeconds:  payload.CacheSeconds,
+		}
+		if cfg.IndexDocument == "" {
+			cfg.IndexDocument = "index.html"
+		}
+		if strings.Contains(cfg.IndexDocument, "/") {
+			http.Error(w, "index document must be a file name", http.StatusBadRequest)
+			return
+		}
+		if cfg.CacheSeconds < 0 {
+			http.Error(w, "cache_seconds must not be negative", http.StatusBadRequest)
+			return
+		}
+		if cfg.CacheSeconds == 0 {
+			cfg.CacheSeconds = defaultWebsiteCacheSeconds
+		}
+		if err := s.saveWebsite(cfg); err != nil {
+			http.Error(w, "failed to save website", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, cfg)
+	case http.MethodDelete:
+		if _, err := s.db.Exec(`DELETE FROM websites WHERE namespace = $1`, name); err != nil {
+			http.Error(w, "failed to disable website", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, map[string]string{"status": "ok"})
+	default:
+		w.Header().Set("Allow", "GET, PUT, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// siteNamespace extracts the namespace from a {namespace}.<sites-domain> host.
+func (s *server) siteNamespace(host string) (string, bool) {
+	if s.sitesDomain == "" {
+		return "", false
+	}
+	if idx := strings.LastIndex(host, ":"); idx != -1 {
+		host = host[:idx]
+	}
+	host = strings.ToLower(host)
+	label, ok := strings.CutSuffix(host, "."+s.sitesDomain)
+	if !ok || label == "" || strings.Contains(label, ".") {
+		return "", false
+	}
+	namespace, err := sanitizeNamespace(label)
+	if err != nil {
+		return "", false
+	}
+	return namespace, true
+}
+
+// siteMiddleware routes requests for {namespace}.<sites-domain> to the static
+// site handler and passes everything else through.
+func (s *server) siteMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		namespace, ok := s.siteNamespace(r.Host)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		setRoute(r, "site")
+		s.serveSite(w, r, namespace)
+	})
+}
+
+func (s *server) serveSite(w http.ResponseWriter, r *http.Request, namespace string) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	cfg, err := s.loadWebsite(namespace)
+	if err != nil {
+		serveErrorPage(w, r, http.StatusInternalServerError, "Internal Server Error", "The site could not be loaded.")
+		return
+	}
+	hidden, err := s.loadHiddenNamespaces()
+	if err != nil {
+		serveErrorPage(w, r, http.StatusInternalServerError, "Internal Server Error", "The site could not be loaded.")
+		return
+	}
+	if cfg == nil || hidden[namespace] {
+		serveErrorPage(w, r, http.StatusNotFound, "Site Not Found",
+			fmt.Sprintf("No website is published for \"%s\".", namespace))
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Minute)
+	defer cancel()
+
+	name := strings.TrimPrefix(path.Clean("/"+r.URL.Path), "/")
+	if name == "" || strings.HasSuffix(r.URL.Path, "/") {
+		name = path.Join(name, cfg.IndexDocument)
+	}
+
+	if info, err := s.storage.GetFileWithNamespace(ctx, name, s.gfsNamespace(namespace)); err == nil {
+		s.serveSiteFile(ctx, w, r, cfg, namespace, name, info, http.StatusOK)
+		return
+	}
+
+	// A directory requested without its trailing slash: redirect so relative
+	// links inside its index document resolve correctly.
+	if !strings.HasSuffix(r.URL.Path, "/") {
+		indexName := path.Join(name, cfg.IndexDocument)
+		if _, err := s.storage.GetFileWithNamespace(ctx, indexName, s.gfsNamespace(namespace)); err == nil {
+			target := r.URL.Path + "/"
+			if r.URL.RawQuery != "" {
+				target += "?" + r.URL.RawQuery
+			}
+			http.Redirect(w, r, target, http.StatusMovedPermanently)
+			return
+		}
+	}
+
+	// Single-page apps route on the client, so unknown paths without a file
+	// extension get the root index document.
+	if cfg.SPAFallback && filepath.Ext(name) == "" {
+		if info, err := s.storage.GetFileWithNamespace(ctx, cfg.IndexDocument, s.gfsNamespace(namespace)); err == nil {
+			s.serveSiteFile(ctx, w, r, cfg, namespace, cfg.IndexDocument, info, http.StatusOK)
+			return
+		}
+	}
+
+	if cfg.ErrorDocument != "" {
+		if info, err := s.storage.GetFileWithNamespace(ctx, cfg.ErrorDocument, s.gfsNamespace(namespace)); err == nil {
+			s.serveSiteFile(ctx, w, r, cfg, namespace, cfg.ErrorDocument, info, http.StatusNotFound)
+			return
+		}
+	}
+
+	serveErrorPage(w, r, http.StatusNotFound, "Page Not Found",
+		fmt.Sprintf("The page \"/%s\" does not exist.", name))
+}
+
+func (s *server) serveSiteFile(ctx context.Context, w http.ResponseWriter, r *http.Request, cfg *websiteConfig, namespace, name string, info *storedFile, status int) {
+	if blocked, msg := s.downloadBlocked(w, namespace, name); blocked != 0 {
+		serveErrorPage(w, r, blocked, "Page Unavailable", "The "+msg+".")
+		return
+	}
+	contentType := mime.TypeByExtension(filepath.Ext(name))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
+	encoding := s.negotiateEncoding(w, r, namespace, name)
+
+	// HTML documents must revalidate so new deployments show up immediately;
+	// other assets may be cached for the configured period.
+	if strings.HasPrefix(contentType, "text/html") {
+		w.Header().Set("Cache-Control", "public, max-age=0, must-revalidate")
+	} else {
+		w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", cfg.CacheSeconds))
+	}
+
+	// Validators need a modification time; without one every version of a
+	// file of the same size would share an ETag.
+	if status == http.StatusOK && info.ModifiedAt > 0 {
+		etag := siteETag(info, encoding)
+		modified := time.Unix(info.ModifiedAt, 0)
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+		if notModified(r, etag, modified) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+
+	w.WriteHeader(status)
+	if r.Method == http.MethodHead {
+		return
+	}
+	throttled := &countingWriter{writer: w, throttle: s.throttle(ctx, r, namespace, "download")}
+	if _, err := s.readFileEncoded(ctx, namespace, name, throttled, encoding); err != nil {
+		// Headers are already sent; all we can do is log and stop.
+		log.Printf("site read failed namespace=%s name=%s err=%v", namespace, name, err)
+	}
+}
+
+// siteETag identifies a version of a site file. Compressed files passed
+// through with a Content-Encoding are a different representation from the
+// decoded bytes, so the codec is part of the tag.
+func siteETag(info *storedFile, encoding string) string {
+	if encoding != "" {
+		return fmt.Sprintf(`W/"%x-%x-%s"`, info.Size, info.ModifiedAt, encoding)
+	}
+	return fmt.Sprintf(`W/"%x-%x"`, info.Size, info.ModifiedAt)
+}
+
+// notModified evaluates If-None-Match, falling back to If-Modified-Since
+// only when the client sent no entity tags.
+func notModified(r *http.Request, etag string, modified time.Time) bool {
+	if match := r.Header.Get("If-None-Match"); match != "" {
+		return etagMatches(match, etag)
+	}
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	return err == nil && !modified.After(since)
+}
+
+// etagMatches reports whether an If-None-Match list names etag, using weak
+// comparison. "*" matches any existing file.
+func etagMatches(header, etag string) bool {
+	if strings.TrimSpace(header) == "*" {
+		return true
+	}
+	for _, candidate := range strings.Split(header, ",") {
+		if strings.TrimPrefix(strings.TrimSpace(candidate), "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
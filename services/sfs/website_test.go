@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNotModified(t *testing.T) {
+	info := &storedFile{Size: 1234, ModifiedAt: 1760000000}
+	etag := siteETag(info, "")
+	modified := time.Unix(info.ModifiedAt, 0)
+
+	tests := []struct {
+		name    string
+		headers map[string]string
+		want    bool
+	}{
+		{"no validators", nil, false},
+		{"exact match", map[string]string{"If-None-Match": etag}, true},
+		{"strong form of a weak tag", map[string]string{"If-None-Match": `"4d2-68e77800"`}, true},
+		{"list", map[string]string{"If-None-Match": `"abc", ` + etag + `, "def"`}, true},
+		{"list without a match", map[string]string{"If-None-Match": `"abc", W/"4d2-0"`}, false},
+		{"wildcard", map[string]string{"If-None-Match": "*"}, true},
+		{"encoded representation", map[string]string{"If-None-Match": siteETag(info, "zstd")}, false},
+		{"modified since", map[string]string{"If-Modified-Since": modified.Add(-time.Hour).UTC().Format(http.TimeFormat)}, false},
+		{"not modified since", map[string]string{"If-Modified-Since": modified.UTC().Format(http.TimeFormat)}, true},
+		{"entity tags take precedence", map[string]string{
+			"If-None-Match":     `"other"`,
+			"If-Modified-Since": modified.UTC().Format(http.TimeFormat),
+		}, false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		for k, v := range tt.headers {
+			r.Header.Set(k, v)
+		}
+		if got := notModified(r, etag, modified); got != tt.want {
+			t.Errorf("%s: notModified = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestServeErrorPageEscapes(t *testing.T) {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/", nil)
+	serveErrorPage(w, r, http.StatusNotFound, "Page <Not> Found", `The page "/<script>alert(1)</script>" does not exist.`)
+
+	body := w.Body.String()
+	if strings.Contains(body, "<script>") || strings.Contains(body, "<Not>") {
+		t.Fatalf("error page reflects unescaped markup:\n%s", body)
+	}
+	if !strings.Contains(body, "&lt;script&gt;alert(1)&lt;/script&gt;") {
+		t.Errorf("error page is missing the escaped message")
+	}
+}